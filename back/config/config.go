@@ -11,7 +11,19 @@ type Config struct {
 	DBName     string
 	Port       string
 
-	EmailFetchInterval int
+	EmailFetchInterval int  // minutes
+	IMAPIdle           bool // watch mailboxes with IMAP IDLE instead of the polling scheduler
+	MaxAttachmentMB    int  // larger attachments are recorded as rejected, 0 disables the limit
+	MaxMessageMB       int  // larger messages are not downloaded but queued for triage, 0 disables the limit
+	ArchiveMaxEntries  int  // files unpacked from one zip/rar/7z attachment
+	ArchiveMaxTotalMB  int  // bytes unpacked from one archive
+
+	// Outbound mail queue
+	OutboxPollInterval int // seconds
+	OutboxMaxAttempts  int
+
+	// Queue a reminder after the return date stated in an out-of-office reply
+	AutoReplyFollowUp bool
 }
 
 func LoadConfig() *Config {
@@ -21,5 +33,17 @@ func LoadConfig() *Config {
 		DBHost:     utils.GetEnv("DB_HOST", "localhost"),
 		DBName:     utils.GetEnv("DB_NAME", "db_intro"),
 		Port:       utils.GetEnv("PORT", "8080"),
+
+		EmailFetchInterval: utils.GetEnvInt("EMAIL_FETCH_INTERVAL", 10),
+		IMAPIdle:           utils.GetEnv("IMAP_IDLE", "false") == "true",
+		MaxAttachmentMB:    utils.GetEnvInt("MAX_ATTACHMENT_SIZE_MB", 25),
+		MaxMessageMB:       utils.GetEnvInt("MAX_MESSAGE_SIZE_MB", 100),
+		ArchiveMaxEntries:  utils.GetEnvInt("ARCHIVE_MAX_ENTRIES", 100),
+		ArchiveMaxTotalMB:  utils.GetEnvInt("ARCHIVE_MAX_TOTAL_MB", 200),
+
+		OutboxPollInterval: utils.GetEnvInt("OUTBOX_POLL_INTERVAL", 10),
+		OutboxMaxAttempts:  utils.GetEnvInt("OUTBOX_MAX_ATTEMPTS", 5),
+
+		AutoReplyFollowUp: utils.GetEnv("AUTO_REPLY_FOLLOWUP", "true") == "true",
 	}
 }
@@ -2,12 +2,13 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"db_intro_backend/config"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 var DB *sql.DB
@@ -44,3 +45,9 @@ func InitDB(cfg *config.Config) {
 		time.Sleep(waitTime)
 	}
 }
+
+// IsDuplicateKey reports whether err is MySQL's duplicate entry error
+func IsDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
@@ -0,0 +1,69 @@
+package dbtest_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"db_intro_backend/db"
+	"db_intro_backend/mailtest"
+)
+
+// TestArchiveTotalLimit unpacks a zip whose second entry alone exceeds the
+// archive's total limit, with no per-file limit: extraction stops at the
+// limit and the archive records why
+func TestArchiveTotalLimit(t *testing.T) {
+	env := newTestEnv(t)
+	env.config.MaxAttachmentMB = 0
+	env.config.ArchiveMaxTotalMB = 1
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(env.userID, projectID, teachers)
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"a.xlsx", workbook(t, []interface{}{"张三", "数据库导论", 32})},
+		{"zero.bin", make([]byte, 3<<20)},
+	} {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(entry.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := mailtest.BuildReply(env.mailer.Sent()[0].Data, "zhang@school.test", "见附件",
+		mailtest.Attachment{Filename: "工作量.zip", Data: archive.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.mailbox.Deliver(officeAddress, reply)
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+
+	var reason string
+	if err := db.DB.QueryRow("SELECT COALESCE(extract_error, '') FROM attachments WHERE project_id = ? AND parent_attachment_id IS NULL",
+		projectID).Scan(&reason); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reason, "more than 1 MB unpacked") {
+		t.Fatalf("extract_error = %q, want the total limit", reason)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM attachments WHERE project_id = ? AND parent_attachment_id IS NOT NULL", projectID); n != 1 {
+		t.Fatalf("%d files unpacked, want only a.xlsx", n)
+	}
+	if n := env.queryInt("SELECT MAX(file_size) FROM attachments WHERE project_id = ?", projectID); n > 1<<20 {
+		t.Fatalf("stored a %d byte file", n)
+	}
+	if spooled, _ := os.ReadDir("uploads/tmp"); len(spooled) != 0 {
+		t.Fatalf("%d spooled files left behind", len(spooled))
+	}
+}
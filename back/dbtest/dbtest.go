@@ -0,0 +1,123 @@
+// Package dbtest runs database/db_schema.sql on an in-process,
+// MySQL-compatible server (go-mysql-server) so that code using db.DB can be
+// tested without a MySQL installation. The server only listens on
+// 127.0.0.1 and keeps its tables in memory.
+//
+// dbtest is a module of its own, so go-mysql-server and the driver version
+// it needs stay out of the backend's go.mod; the tests that need a database
+// live here as well.
+//
+// go-mysql-server does not cover all of MySQL: statements it rejects (for
+// example UPDATE ... WHERE [NOT] EXISTS (subquery)) fail as they would on a
+// database error. The services are written for MySQL; tests of behaviour
+// that depends on such statements belong with a real MySQL server, not here.
+package dbtest
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	gmssql "github.com/dolthub/go-mysql-server/sql"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+const databaseName = "db_intro"
+
+// Server is a database with the application schema loaded
+type Server struct {
+	DB *sql.DB
+
+	server *server.Server
+}
+
+// NewServer starts a server and creates the schema; call Close when done.
+// Assign DB to db.DB to run the services against it.
+func NewServer() (*Server, error) {
+	schema, err := os.ReadFile(schemaPath())
+	if err != nil {
+		return nil, fmt.Errorf("dbtest: failed to read schema: %w", err)
+	}
+
+	// Keep the server's connection logging out of test output
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	database := memory.NewDatabase(databaseName)
+	// Foreign key checks look parents up by primary key
+	database.EnablePrimaryKeyIndexes()
+	provider := memory.NewDBProvider(database)
+	engine := sqle.NewDefault(provider)
+	config := server.Config{Protocol: "tcp", Address: "127.0.0.1:0"}
+	srv, err := server.NewServer(config, engine, gmssql.NewContext, memory.NewSessionBuilder(provider), nil)
+	if err != nil {
+		return nil, fmt.Errorf("dbtest: failed to start server: %w", err)
+	}
+	go srv.Start()
+
+	// Same options as db.InitDB
+	dsn := fmt.Sprintf("root@tcp(%s)/%s?parseTime=true&charset=utf8mb4", srv.Listener.Addr(), databaseName)
+	conn, err := sql.Open("mysql", dsn)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	s := &Server{DB: conn, server: srv}
+
+	for _, stmt := range statements(string(schema)) {
+		if _, err := conn.Exec(stmt); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("dbtest: failed to load schema: %w\n%s", err, stmt)
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) Close() error {
+	s.DB.Close()
+	return s.server.Close()
+}
+
+// schemaPath locates database/db_schema.sql relative to this file, so tests
+// find it from any package directory
+func schemaPath() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "database", "db_schema.sql")
+}
+
+// statements splits a SQL script at semicolons, dropping "--" comments
+func statements(script string) []string {
+	var out []string
+	var b strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		inQuote := false
+		for i := 0; i < len(line); i++ {
+			ch := line[i]
+			if ch == '\'' {
+				inQuote = !inQuote
+			}
+			if !inQuote && strings.HasPrefix(line[i:], "--") {
+				break
+			}
+			if !inQuote && ch == ';' {
+				if stmt := strings.TrimSpace(b.String()); stmt != "" {
+					out = append(out, stmt)
+				}
+				b.Reset()
+				continue
+			}
+			b.WriteByte(ch)
+		}
+		b.WriteByte('\n')
+	}
+	if stmt := strings.TrimSpace(b.String()); stmt != "" {
+		out = append(out, stmt)
+	}
+	return out
+}
@@ -0,0 +1,305 @@
+package dbtest_test
+
+import (
+	"database/sql"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"db_intro_backend/config"
+	"db_intro_backend/db"
+	"db_intro_backend/dbtest"
+	"db_intro_backend/mailtest"
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const officeAddress = "office@school.test"
+
+// testEnv is the database, mail stand-ins and services of one test
+type testEnv struct {
+	t       *testing.T
+	config  *config.Config
+	mailbox *mailtest.MemoryMailbox
+	mailer  *mailtest.MemoryMailer
+	emails  *services.EmailService
+	outbox  *services.OutboxService
+	userID  int
+}
+
+// newTestEnv loads the schema into a fresh database, points db.DB at it and
+// runs the test in an empty directory, where the services keep their uploads
+func newTestEnv(t *testing.T) *testEnv {
+	srv, err := dbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	previous := db.DB
+	db.DB = srv.DB
+	t.Cleanup(func() { db.DB = previous })
+	t.Chdir(t.TempDir())
+
+	env := &testEnv{
+		t: t,
+		config: &config.Config{
+			MaxAttachmentMB:    25,
+			ArchiveMaxEntries:  100,
+			ArchiveMaxTotalMB:  200,
+			OutboxPollInterval: 3600, // the tests wake the worker themselves
+			OutboxMaxAttempts:  3,
+		},
+		mailbox: mailtest.NewMemoryMailbox(),
+	}
+	env.mailer = &mailtest.MemoryMailer{Mailbox: env.mailbox}
+	env.emails = services.NewEmailService(env.config)
+	env.emails.Mailer = env.mailer
+	env.emails.MailboxReader = env.mailbox
+	env.outbox = services.NewOutboxService(env.config, env.emails)
+	// Stop the worker before db.DB is restored
+	t.Cleanup(env.outbox.Stop)
+
+	env.userID = env.addUser(models.User{
+		SMTPHost: "smtp.school.test", SMTPPort: "465",
+		IMAPHost: "imap.school.test", IMAPPort: "993", IMAPUsername: officeAddress, IMAPPassword: "secret",
+		EmailAddress: officeAddress,
+	})
+	return env
+}
+
+// addUser stores an account with the mail settings of u
+func (e *testEnv) addUser(u models.User) int {
+	e.t.Helper()
+	return e.insert(`
+		INSERT INTO users (username, password, smtp_host, smtp_port, smtp_username, smtp_password, smtp_security,
+			mail_protocol, imap_host, imap_port, imap_username, imap_password, email_address)
+		VALUES (?, 'x', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.EmailAddress, u.SMTPHost, u.SMTPPort, u.SMTPUsername, u.SMTPPassword, u.SMTPSecurity,
+		services.ResolveMailProtocol(u.MailProtocol), u.IMAPHost, u.IMAPPort, u.IMAPUsername, u.IMAPPassword, u.EmailAddress)
+}
+
+// addProject creates a project of userID whose members are the teachers,
+// given as address -> name, and returns it with the teachers' ids
+func (e *testEnv) addProject(userID int, code string, teachers map[string]string) (int, map[string]int) {
+	e.t.Helper()
+	department := e.insert("INSERT INTO departments (name) VALUES (?)", code+"系")
+	projectID := e.insert(`
+		INSERT INTO projects (code, name, email_subject_template, email_body_template, created_by)
+		VALUES (?, '2025年度工作量汇总', '{{project_name}}', '{{teacher_name}}老师您好', ?)`, code, userID)
+	ids := make(map[string]int)
+	for address, name := range teachers {
+		id := e.insert("INSERT INTO teachers (name, email, department_id) VALUES (?, ?, ?)", name, address, department)
+		e.insert("INSERT INTO project_members (project_id, teacher_id) VALUES (?, ?)", projectID, id)
+		ids[address] = id
+	}
+	return projectID, ids
+}
+
+// dispatch queues the project's request to its teachers and waits until the
+// outbox has sent it
+func (e *testEnv) dispatch(userID, projectID int, teachers map[string]int) {
+	e.t.Helper()
+	var messages []models.OutboundEmail
+	for address, id := range teachers {
+		messages = append(messages, models.OutboundEmail{
+			ProjectID: projectID, TeacherID: id, UserID: userID,
+			ToEmail: address, Subject: "2025年度工作量汇总", Body: "请填写附件",
+		})
+	}
+	if _, err := e.outbox.Enqueue(projectID, userID, services.OutboundKindDispatch, messages); err != nil {
+		e.t.Fatal(err)
+	}
+	e.outbox.Start()
+	e.waitFor("the dispatch", func() bool {
+		return e.queryInt("SELECT COUNT(*) FROM outbound_emails WHERE project_id = ? AND status = ?",
+			projectID, services.OutboundStatusSent) == len(teachers)
+	})
+}
+
+func (e *testEnv) insert(query string, args ...interface{}) int {
+	e.t.Helper()
+	res, err := db.DB.Exec(query, args...)
+	if err != nil {
+		e.t.Fatalf("%v\n%s", err, query)
+	}
+	id, _ := res.LastInsertId()
+	return int(id)
+}
+
+func (e *testEnv) queryInt(query string, args ...interface{}) int {
+	e.t.Helper()
+	var n sql.NullInt64
+	if err := db.DB.QueryRow(query, args...).Scan(&n); err != nil {
+		e.t.Fatalf("%v\n%s", err, query)
+	}
+	return int(n.Int64)
+}
+
+// waitFor polls cond until it holds
+func (e *testEnv) waitFor(what string, cond func() bool) {
+	e.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			e.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// workbook returns an .xlsx file with a header row and rows
+func workbook(t *testing.T, rows ...[]interface{}) []byte {
+	t.Helper()
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	f.SetSheetRow(sheet, "A1", &[]interface{}{"姓名", "课程", "工作量"})
+	for i := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		f.SetSheetRow(sheet, cell, &rows[i])
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestDispatchReplyAggregate sends a project's request to its teachers,
+// answers it with spreadsheets and aggregates them, all in process
+func TestDispatchReplyAggregate(t *testing.T) {
+	env := newTestEnv(t)
+	names := map[string]string{"zhang@school.test": "张三", "li@school.test": "李四"}
+	projectID, teachers := env.addProject(env.userID, "WL2025", names)
+	env.dispatch(env.userID, projectID, teachers)
+
+	sent := env.mailer.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(sent))
+	}
+	hours := map[string]int{"zhang@school.test": 32, "li@school.test": 48}
+	for _, msg := range sent {
+		teacher := msg.To[0]
+		name := names[teacher]
+		reply, err := mailtest.BuildReply(msg.Data, teacher, "已填写，见附件",
+			mailtest.Attachment{Filename: "工作量.xlsx", Data: workbook(t, []interface{}{name, "数据库导论", hours[teacher]})})
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.mailbox.Deliver(officeAddress, reply)
+	}
+
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM project_members WHERE project_id = ? AND current_status = 'replied'", projectID); n != 2 {
+		t.Fatalf("%d teachers marked replied, want 2", n)
+	}
+	// A second run finds nothing new
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM replies WHERE project_id = ?", projectID); n != 2 {
+		t.Fatalf("%d replies stored, want 2", n)
+	}
+
+	result, err := services.NewExcelService().AggregateProjectExcel(projectID)
+	if err != nil {
+		t.Fatalf("AggregateProjectExcel: %v", err)
+	}
+	if result.Attachments != 2 || result.Rows != 2 {
+		t.Fatalf("aggregated %d attachments with %d rows, want 2 and 2", result.Attachments, result.Rows)
+	}
+	f, err := excelize.OpenFile(result.OutputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := f.GetRows("Aggregated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, row := range rows[1:] {
+		for i, h := range rows[0] {
+			if h == "工作量" && i < len(row) {
+				n, _ := strconv.Atoi(row[i])
+				total += n
+			}
+		}
+	}
+	if len(rows) != 3 || total != 80 {
+		t.Fatalf("aggregated rows = %q, want both teachers' hours", rows)
+	}
+}
+
+// TestRepliesOverMailServer runs the flow through the production SMTPMailer,
+// IMAPReader and POP3Reader against the loopback mail server
+func TestRepliesOverMailServer(t *testing.T) {
+	for _, protocol := range []string{services.MailProtocolIMAP, services.MailProtocolPOP3} {
+		t.Run(protocol, func(t *testing.T) {
+			env := newTestEnv(t)
+			srv, err := mailtest.NewServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			const office, teacher = "staff@mail.test", "wang@mail.test"
+			for _, address := range []string{office, teacher} {
+				if err := srv.AddAccount(address, "secret"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			user := srv.User(office, "secret")
+			if protocol == services.MailProtocolPOP3 {
+				user = srv.POP3User(office, "secret")
+			}
+			userID := env.addUser(user)
+			env.emails.Mailer = &services.SMTPMailer{}
+			env.emails.MailboxReader = srv.IMAPReader()
+			env.emails.POP3Reader = srv.POP3Reader()
+
+			projectID, teachers := env.addProject(userID, "WL-"+protocol, map[string]string{teacher: "王五"})
+			env.dispatch(userID, projectID, teachers)
+
+			// The teacher finds the request in their inbox and answers it
+			var request []byte
+			_, err = srv.IMAPReader().Fetch(srv.User(teacher, "secret"), models.MailboxSyncState{Mailbox: "INBOX"},
+				func(raw services.RawMessage) error {
+					data, err := io.ReadAll(raw.Body)
+					request = data
+					return err
+				})
+			if err != nil || request == nil {
+				t.Fatalf("request not delivered: %v", err)
+			}
+			reply, err := mailtest.BuildReply(request, teacher, "见附件",
+				mailtest.Attachment{Filename: "工作量.xlsx", Data: workbook(t, []interface{}{"王五", "操作系统", 16})})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := srv.Deliver(office, reply); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := env.emails.ProcessUserEmails(userID); err != nil {
+					t.Fatalf("ProcessUserEmails: %v", err)
+				}
+			}
+			if n := env.queryInt("SELECT COUNT(*) FROM replies WHERE project_id = ?", projectID); n != 1 {
+				t.Fatalf("%d replies stored, want 1", n)
+			}
+			if n := env.queryInt("SELECT COUNT(*) FROM attachments WHERE project_id = ? AND status = ?",
+				projectID, services.AttachmentStatusStored); n != 1 {
+				t.Fatalf("%d attachments stored, want 1", n)
+			}
+			if n := env.queryInt("SELECT COUNT(*) FROM project_members WHERE project_id = ? AND current_status = 'replied'", projectID); n != 1 {
+				t.Fatal("teacher not marked replied")
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package dbtest_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"db_intro_backend/handlers"
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestAggregateDataResponse aggregates a project through its handler: the
+// response lists the summary sheets written and why the others were left out
+func TestAggregateDataResponse(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	err := services.SaveAggregationSettings(projectID, models.AggregationSettings{Summaries: []models.SummarySpec{
+		{Name: "按教师", GroupBy: []string{"姓名"}, Measures: []models.SummaryMeasure{{Func: "sum", Column: "工作量"}}},
+		{Name: "按职称", GroupBy: []string{"职称"}, Measures: []models.SummaryMeasure{{Func: "count"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.dispatch(env.userID, projectID, teachers)
+	env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", 32))
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	handler := handlers.NewProjectHandler(env.emails, services.NewExcelService(), env.outbox)
+	router := gin.New()
+	router.POST("/projects/:id/aggregate", func(c *gin.Context) {
+		c.Set("userID", env.userID)
+		handler.AggregateData(c)
+	})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/projects/%d/aggregate", projectID), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var response struct {
+		Rows          int      `json:"rows"`
+		Summaries     []string `json:"summaries"`
+		SummaryErrors []string `json:"summary_errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Rows != 1 {
+		t.Errorf("rows = %d, want 1", response.Rows)
+	}
+	if want := []string{"按教师"}; !reflect.DeepEqual(response.Summaries, want) {
+		t.Errorf("summaries = %q, want %q", response.Summaries, want)
+	}
+	if want := []string{"按职称: unknown columns 职称"}; !reflect.DeepEqual(response.SummaryErrors, want) {
+		t.Errorf("summary_errors = %q, want %q", response.SummaryErrors, want)
+	}
+}
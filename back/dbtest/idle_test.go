@@ -0,0 +1,62 @@
+package dbtest_test
+
+import (
+	"testing"
+
+	"db_intro_backend/mailtest"
+	"db_intro_backend/services"
+)
+
+// TestIdleWatcher catches up on mail that arrived before the session, then
+// stores replies as the loopback server announces them, and drops the
+// pending fetch when stopped during the debounce
+func TestIdleWatcher(t *testing.T) {
+	env := newTestEnv(t)
+	srv, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	const office = "staff@mail.test"
+	if err := srv.AddAccount(office, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the account on the loopback server is watched
+	env.insert("UPDATE users SET imap_host = '' WHERE id = ?", env.userID)
+	userID := env.addUser(srv.User(office, "secret"))
+	env.emails.MailboxReader = srv.IMAPReader()
+
+	teachers := map[string]string{"zhang@school.test": "张三", "li@school.test": "李四", "wang@school.test": "王五"}
+	projectID, ids := env.addProject(userID, "WL2025", teachers)
+	env.dispatch(userID, projectID, ids)
+	replies := func() int {
+		return env.queryInt("SELECT COUNT(*) FROM replies WHERE project_id = ?", projectID)
+	}
+
+	if err := srv.Deliver(office, env.reply("zhang@school.test", "张三", 32)); err != nil {
+		t.Fatal(err)
+	}
+	watcher := services.NewIdleWatcher(env.config, env.emails)
+	watcher.Start()
+	stopped := false
+	defer func() {
+		if !stopped {
+			watcher.Stop()
+		}
+	}()
+	env.waitFor("the waiting reply", func() bool { return replies() == 1 })
+
+	if err := srv.Deliver(office, env.reply("li@school.test", "李四", 16)); err != nil {
+		t.Fatal(err)
+	}
+	env.waitFor("the announced reply", func() bool { return replies() == 2 })
+
+	if err := srv.Deliver(office, env.reply("wang@school.test", "王五", 8)); err != nil {
+		t.Fatal(err)
+	}
+	watcher.Stop()
+	stopped = true
+	if n := replies(); n != 2 {
+		t.Fatalf("%d replies stored after Stop, want 2", n)
+	}
+}
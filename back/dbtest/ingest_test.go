@@ -0,0 +1,328 @@
+package dbtest_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"db_intro_backend/db"
+	"db_intro_backend/mailtest"
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+)
+
+// reply answers the project's request sent to teacher with a spreadsheet
+func (e *testEnv) reply(teacher, name string, hours int) []byte {
+	e.t.Helper()
+	for _, msg := range e.mailer.Sent() {
+		if msg.To[0] != teacher {
+			continue
+		}
+		data, err := mailtest.BuildReply(msg.Data, teacher, "见附件",
+			mailtest.Attachment{Filename: "工作量.xlsx", Data: workbook(e.t, []interface{}{name, "数据库导论", hours})})
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		return data
+	}
+	e.t.Fatalf("nothing was sent to %s", teacher)
+	return nil
+}
+
+func (e *testEnv) syncState() models.MailboxSyncState {
+	e.t.Helper()
+	var state models.MailboxSyncState
+	db.DB.QueryRow("SELECT uid_validity, last_uid FROM mailbox_sync_state WHERE user_id = ?", e.userID).
+		Scan(&state.UIDValidity, &state.LastUID)
+	return state
+}
+
+// TestIngestFailureKeepsMessage stores a reply while the replies table is
+// unavailable: the mailbox must not move past it, and it is stored once the
+// database is back
+func TestIngestFailureKeepsMessage(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(env.userID, projectID, teachers)
+	env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", 32))
+
+	env.insert("RENAME TABLE replies TO replies_offline")
+	if err := env.emails.ProcessUserEmails(env.userID); err == nil {
+		t.Fatal("ProcessUserEmails succeeded without a replies table")
+	}
+	if state := env.syncState(); state.LastUID != 0 {
+		t.Fatalf("last UID advanced to %d past a message that was not stored", state.LastUID)
+	}
+
+	env.insert("RENAME TABLE replies_offline TO replies")
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM replies WHERE project_id = ?", projectID); n != 1 {
+		t.Fatalf("%d replies stored, want 1", n)
+	}
+	if state := env.syncState(); state.LastUID != 1 {
+		t.Fatalf("last UID = %d, want 1", state.LastUID)
+	}
+}
+
+// TestUnparseableMessageIsQueued moves past a message that cannot be parsed
+// after recording it for triage
+func TestUnparseableMessageIsQueued(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(env.userID, projectID, teachers)
+
+	broken := "From: Zhang <zhang@school.test>\r\nSubject: =?utf-8?B?5bel5L2c6YeP?=\r\nMessage-ID: <broken@school.test>\r\n" +
+		"this line is not a header\r\n\r\nbody\r\n"
+	env.mailbox.Deliver(officeAddress, []byte(broken))
+	env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", 32))
+
+	for i := 0; i < 2; i++ {
+		if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+			t.Fatalf("ProcessUserEmails: %v", err)
+		}
+	}
+	emails, err := env.emails.ListUnmatchedEmails(env.userID, services.UnmatchedStatusPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].IngestError == "" || emails[0].Subject != "工作量" ||
+		emails[0].FromEmail != "zhang@school.test" {
+		t.Fatalf("unmatched emails = %+v, want the broken message with its reason", emails)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM replies WHERE project_id = ?", projectID); n != 1 {
+		t.Fatalf("%d replies stored, want the one after the broken message", n)
+	}
+}
+
+// TestPOP3IngestFailureKeepsMessage is TestIngestFailureKeepsMessage over
+// POP3, where seen messages are remembered by UIDL
+func TestPOP3IngestFailureKeepsMessage(t *testing.T) {
+	env := newTestEnv(t)
+	srv, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	const office = "staff@mail.test"
+	if err := srv.AddAccount(office, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	userID := env.addUser(srv.POP3User(office, "secret"))
+	env.emails.POP3Reader = srv.POP3Reader()
+
+	projectID, teachers := env.addProject(userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(userID, projectID, teachers)
+	if err := srv.Deliver(office, env.reply("zhang@school.test", "张三", 32)); err != nil {
+		t.Fatal(err)
+	}
+
+	env.insert("RENAME TABLE replies TO replies_offline")
+	if err := env.emails.ProcessUserEmails(userID); err == nil {
+		t.Fatal("ProcessUserEmails succeeded without a replies table")
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM pop3_seen_uids WHERE user_id = ?", userID); n != 0 {
+		t.Fatalf("%d messages marked seen, want none", n)
+	}
+
+	env.insert("RENAME TABLE replies_offline TO replies")
+	if err := env.emails.ProcessUserEmails(userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM replies WHERE project_id = ?", projectID); n != 1 {
+		t.Fatalf("%d replies stored, want 1", n)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM pop3_seen_uids WHERE user_id = ?", userID); n != 1 {
+		t.Fatalf("%d messages marked seen, want 1", n)
+	}
+}
+
+// TestOversizeMessageIsQueued receives a message above MAX_MESSAGE_SIZE_MB:
+// it is recorded for triage from its header alone and the mailbox moves on
+func TestOversizeMessageIsQueued(t *testing.T) {
+	for _, protocol := range []string{services.MailProtocolIMAP, services.MailProtocolPOP3} {
+		t.Run(protocol, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.config.MaxMessageMB = 1
+			srv, err := mailtest.NewServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			const office = "staff@mail.test"
+			if err := srv.AddAccount(office, "secret"); err != nil {
+				t.Fatal(err)
+			}
+			user := srv.User(office, "secret")
+			if protocol == services.MailProtocolPOP3 {
+				user = srv.POP3User(office, "secret")
+			}
+			userID := env.addUser(user)
+			imapReader, pop3Reader := srv.IMAPReader(), srv.POP3Reader()
+			imapReader.MaxMessageSize, pop3Reader.MaxMessageSize = 1<<20, 1<<20
+			env.emails.MailboxReader, env.emails.POP3Reader = imapReader, pop3Reader
+
+			projectID, teachers := env.addProject(userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+			env.dispatch(userID, projectID, teachers)
+			large, err := mailtest.BuildReply(env.mailer.Sent()[0].Data, "zhang@school.test", "见附件",
+				mailtest.Attachment{Filename: "扫描件.pdf", Data: make([]byte, 2<<20)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range [][]byte{large, env.reply("zhang@school.test", "张三", 32)} {
+				if err := srv.Deliver(office, msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := env.emails.ProcessUserEmails(userID); err != nil {
+				t.Fatalf("ProcessUserEmails: %v", err)
+			}
+			emails, err := env.emails.ListUnmatchedEmails(userID, services.UnmatchedStatusPending)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(emails) != 1 || emails[0].FromEmail != "zhang@school.test" ||
+				!strings.Contains(emails[0].IngestError, "exceeding the 1 MB limit") {
+				t.Fatalf("unmatched emails = %+v, want the large message with its reason", emails)
+			}
+			if strings.Contains(emails[0].Body, "扫描件") || len(emails[0].Body) > 4096 {
+				t.Fatalf("stored %d bytes of the large message, want its header only", len(emails[0].Body))
+			}
+			if n := env.queryInt("SELECT COUNT(*) FROM replies WHERE project_id = ?", projectID); n != 1 {
+				t.Fatalf("%d replies stored, want the one after the large message", n)
+			}
+		})
+	}
+}
+
+// TestAutoReplyNotAggregated receives an automatic reply carrying a
+// spreadsheet: the teacher has not replied and the file stays out of the
+// aggregation
+func TestAutoReplyNotAggregated(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{
+		"zhang@school.test": "张三", "li@school.test": "李四"})
+	env.dispatch(env.userID, projectID, teachers)
+	env.mailbox.Deliver(officeAddress, append([]byte("Auto-Submitted: auto-replied\r\n"),
+		env.reply("zhang@school.test", "张三", 32)...))
+	env.mailbox.Deliver(officeAddress, env.reply("li@school.test", "李四", 48))
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+
+	if n := env.queryInt("SELECT COUNT(*) FROM project_members WHERE teacher_id = ? AND current_status = ?",
+		teachers["zhang@school.test"], services.MemberStatusAutoReplied); n != 1 {
+		t.Fatal("automatic reply not recorded as such")
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM attachments WHERE project_id = ? AND parsed = TRUE", projectID); n != 1 {
+		t.Fatalf("%d attachments parsed, want only the real reply's", n)
+	}
+	result, err := services.NewExcelService().AggregateProjectExcel(projectID)
+	if err != nil {
+		t.Fatalf("AggregateProjectExcel: %v", err)
+	}
+	if result.Attachments != 1 || result.Report[0].TeacherName != "李四" {
+		t.Fatalf("aggregated %+v, want only 李四's attachment", result.Report)
+	}
+}
+
+// TestBounceFailureKeepsMessage records a bounce while the bounces table is
+// unavailable: the mailbox must not move past it, and the member is marked
+// bounced once the database is back
+func TestBounceFailureKeepsMessage(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(env.userID, projectID, teachers)
+	var sentID string
+	if err := db.DB.QueryRow("SELECT message_id FROM sent_emails WHERE teacher_id = ?", teachers["zhang@school.test"]).Scan(&sentID); err != nil {
+		t.Fatal(err)
+	}
+	env.mailbox.Deliver(officeAddress, []byte("From: MAILER-DAEMON@school.test\r\nTo: "+officeAddress+"\r\n"+
+		"Subject: Undelivered Mail Returned to Sender\r\nMessage-ID: <bounce@school.test>\r\n"+
+		"Content-Type: text/plain\r\n\r\n"+
+		"<zhang@school.test>: host mx.school.test said: 550 5.1.1 User unknown\r\n\r\n"+
+		"------ This is a copy of the message, including all the headers. ------\r\n\r\n"+
+		"Message-ID: "+sentID+"\r\n"))
+
+	env.insert("RENAME TABLE email_bounces TO email_bounces_offline")
+	if err := env.emails.ProcessUserEmails(env.userID); err == nil {
+		t.Fatal("ProcessUserEmails succeeded without an email_bounces table")
+	}
+	if state := env.syncState(); state.LastUID != 0 {
+		t.Fatalf("last UID advanced to %d past a bounce that was not recorded", state.LastUID)
+	}
+
+	env.insert("RENAME TABLE email_bounces_offline TO email_bounces")
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM project_members WHERE project_id = ? AND current_status = ?",
+		projectID, services.MemberStatusBounced); n != 1 {
+		t.Fatal("member not marked bounced")
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM teachers WHERE id = ? AND email_status = ?",
+		teachers["zhang@school.test"], services.EmailStatusBounced); n != 1 {
+		t.Fatal("teacher address not flagged")
+	}
+	if state := env.syncState(); state.LastUID != 1 {
+		t.Fatalf("last UID = %d, want 1", state.LastUID)
+	}
+}
+
+// TestLargeMessageIsStreamed ingests a reply whose attachment is far larger
+// than the parser's buffers and the excerpt kept of unreadable mail: the
+// attachment is spooled from the IMAP literal and stored intact
+func TestLargeMessageIsStreamed(t *testing.T) {
+	env := newTestEnv(t)
+	srv, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	const office = "staff@mail.test"
+	if err := srv.AddAccount(office, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	userID := env.addUser(srv.User(office, "secret"))
+	env.emails.MailboxReader = srv.IMAPReader()
+
+	projectID, teachers := env.addProject(userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(userID, projectID, teachers)
+	scan := make([]byte, 3<<20)
+	for i := range scan {
+		scan[i] = byte(i * 7 % 251)
+	}
+	large, err := mailtest.BuildReply(env.mailer.Sent()[0].Data, "zhang@school.test", "见附件",
+		mailtest.Attachment{Filename: "工作量.xlsx", Data: workbook(t, []interface{}{"张三", "数据库导论", 32})},
+		mailtest.Attachment{Filename: "扫描件.pdf", Data: scan})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Deliver(office, large); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.emails.ProcessUserEmails(userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	var path string
+	var size int64
+	if err := db.DB.QueryRow("SELECT stored_path, file_size FROM attachments WHERE project_id = ? AND original_filename = ? AND status = ?",
+		projectID, "扫描件.pdf", services.AttachmentStatusStored).Scan(&path, &size); err != nil {
+		t.Fatalf("large attachment not stored: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(scan)) || !bytes.Equal(data, scan) {
+		t.Fatalf("stored %d bytes (recorded %d), want the %d bytes sent", len(data), size, len(scan))
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM attachments WHERE project_id = ? AND status = ?",
+		projectID, services.AttachmentStatusStored); n != 2 {
+		t.Fatalf("%d attachments stored, want 2", n)
+	}
+}
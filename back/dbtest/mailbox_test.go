@@ -0,0 +1,83 @@
+package dbtest_test
+
+import (
+	"bytes"
+	"net/mail"
+	"slices"
+	"testing"
+
+	"db_intro_backend/mailtest"
+	"db_intro_backend/services"
+
+	"github.com/emersion/go-imap"
+)
+
+// TestMailboxActions marks matched replies read and files them according to
+// the user's mailbox action, while mail queued for triage stays unread
+func TestMailboxActions(t *testing.T) {
+	tests := []struct {
+		action          string
+		replyFolder     string
+		unmatchedFolder string
+		replyFlagged    bool
+	}{
+		{services.MailboxActionNone, "INBOX", "INBOX", false},
+		{services.MailboxActionFlag, "INBOX", "INBOX", true},
+		{services.MailboxActionMove, "DB_Intro/WL2025", "DB_Intro/Unmatched", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			env := newTestEnv(t)
+			srv, err := mailtest.NewServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			const office = "staff@mail.test"
+			if err := srv.AddAccount(office, "secret"); err != nil {
+				t.Fatal(err)
+			}
+			userID := env.addUser(srv.User(office, "secret"))
+			env.insert("UPDATE users SET mailbox_action = ? WHERE id = ?", tt.action, userID)
+			env.emails.MailboxReader = srv.IMAPReader()
+
+			projectID, teachers := env.addProject(userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+			env.dispatch(userID, projectID, teachers)
+			reply := env.reply("zhang@school.test", "张三", 32)
+			msg, err := mail.ReadMessage(bytes.NewReader(reply))
+			if err != nil {
+				t.Fatal(err)
+			}
+			replyID := msg.Header.Get("Message-Id")
+			const unmatchedID = "<newsletter@mail.test>"
+			for _, data := range [][]byte{reply, []byte("From: newsletter@mail.test\r\nSubject: 本周新闻\r\n" +
+				"Message-ID: " + unmatchedID + "\r\nContent-Type: text/plain\r\n\r\n新闻\r\n")} {
+				if err := srv.Deliver(office, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := env.emails.ProcessUserEmails(userID); err != nil {
+				t.Fatalf("ProcessUserEmails: %v", err)
+			}
+
+			flagsIn := func(folder, messageID string) []string {
+				flags, err := srv.Flags(office, folder)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f, ok := flags[messageID]
+				if !ok {
+					t.Fatalf("%s not in %s", messageID, folder)
+				}
+				return f
+			}
+			if f := flagsIn(tt.replyFolder, replyID); !slices.Contains(f, imap.SeenFlag) || slices.Contains(f, imap.FlaggedFlag) != tt.replyFlagged {
+				t.Errorf("reply flags = %v", f)
+			}
+			if f := flagsIn(tt.unmatchedFolder, unmatchedID); len(f) != 0 {
+				t.Errorf("unmatched mail flags = %v, want it unread", f)
+			}
+		})
+	}
+}
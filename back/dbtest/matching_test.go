@@ -0,0 +1,88 @@
+package dbtest_test
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"testing"
+
+	"db_intro_backend/db"
+)
+
+// TestReplyMatching attributes replies to one of two projects by their
+// In-Reply-To and References headers, a plus-addressed recipient, the
+// project code in the subject and finally the sender. 张三 is a member of
+// both projects, 李四 only of KY2025.
+func TestReplyMatching(t *testing.T) {
+	env := newTestEnv(t)
+	wl, wlTeachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	ky, kyTeachers := env.addProject(env.userID, "KY2025", map[string]string{"li@school.test": "李四"})
+	env.insert("INSERT INTO project_members (project_id, teacher_id) VALUES (?, ?)", ky, wlTeachers["zhang@school.test"])
+	kyTeachers["zhang@school.test"] = wlTeachers["zhang@school.test"]
+	env.dispatch(env.userID, wl, wlTeachers)
+	env.dispatch(env.userID, ky, kyTeachers)
+
+	sentID := func(projectID int, teacher string) string {
+		var id string
+		if err := db.DB.QueryRow("SELECT message_id FROM sent_emails WHERE project_id = ? AND teacher_id = ?",
+			projectID, kyTeachers[teacher]).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	wlToZhang, kyToZhang := sentID(wl, "zhang@school.test"), sentID(ky, "zhang@school.test")
+
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		subject string
+		headers string
+		want    int // project; 0 for the triage queue
+	}{
+		{"In-Reply-To", "zhang@school.test", officeAddress, "Re: 工作量", "In-Reply-To: " + kyToZhang + "\r\n", ky},
+		{"In-Reply-To wins over the subject", "zhang@school.test", officeAddress, "Re: [KY2025]", "In-Reply-To: " + wlToZhang + "\r\n", wl},
+		{"References", "zhang@school.test", officeAddress, "Re: 工作量", "References: <unknown@school.test> " + wlToZhang + "\r\n", wl},
+		{"newest reference", "zhang@school.test", officeAddress, "Re: 工作量", "References: " + wlToZhang + " " + kyToZhang + "\r\n", ky},
+		{"plus address", "zhang@school.test", "office+ky2025@school.test", "Re: 工作量", "", ky},
+		{"unknown plus address", "zhang@school.test", "office+xx2025@school.test", "Re: 工作量", "", 0},
+		{"subject code", "zhang@school.test", officeAddress, "Re: [WL2025] 工作量", "", wl},
+		{"code inside a word", "zhang@school.test", officeAddress, "Re: WL2025a 工作量", "", 0},
+		{"sender with one project", "li@school.test", officeAddress, "工作量", "", ky},
+		{"sender with two projects", "zhang@school.test", officeAddress, "工作量", "", 0},
+		{"unknown sender", "wang@school.test", officeAddress, "工作量", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageID := "<" + strings.ReplaceAll(tt.name, " ", "-") + "@school.test>"
+			env.mailbox.Deliver(officeAddress, []byte(fmt.Sprintf(
+				"From: %s\r\nTo: %s\r\nSubject: %s\r\nMessage-ID: %s\r\n%sContent-Type: text/plain; charset=utf-8\r\n\r\n见附件\r\n",
+				tt.from, tt.to, mime.BEncoding.Encode("utf-8", tt.subject), messageID, tt.headers)))
+			if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+				t.Fatalf("ProcessUserEmails: %v", err)
+			}
+
+			got := env.queryInt("SELECT COALESCE(MAX(project_id), 0) FROM replies WHERE message_id = ?", messageID)
+			queued := env.queryInt("SELECT COUNT(*) FROM unmatched_emails WHERE message_id = ?", messageID)
+			if got != tt.want || (tt.want == 0) != (queued == 1) {
+				t.Fatalf("stored under project %d (queued: %d), want %d", got, queued, tt.want)
+			}
+		})
+	}
+
+	// The ambiguous sender is queued with both projects as candidates
+	emails, err := env.emails.ListUnmatchedEmails(env.userID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range emails {
+		if e.MessageID != "<sender-with-two-projects@school.test>" {
+			continue
+		}
+		if len(e.CandidateProjects) != 2 {
+			t.Fatalf("candidates = %+v, want projects %d and %d", e.CandidateProjects, wl, ky)
+		}
+		return
+	}
+	t.Fatal("ambiguous reply not queued")
+}
@@ -0,0 +1,190 @@
+package dbtest_test
+
+import (
+	"testing"
+	"time"
+
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+)
+
+// TestInterruptedSendNotRepeated restarts the outbox with a message left in
+// "sending": it may have been delivered, so it waits for a manual retry
+// instead of going out again
+func TestInterruptedSendNotRepeated(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{
+		"zhang@school.test": "张三", "li@school.test": "李四"})
+	interrupted := env.insert(`
+		INSERT INTO outbound_emails (project_id, teacher_id, user_id, kind, to_email, subject, body, status)
+		VALUES (?, ?, ?, ?, 'zhang@school.test', '2025年度工作量汇总', '请填写附件', ?)`,
+		projectID, teachers["zhang@school.test"], env.userID, services.OutboundKindDispatch, services.OutboundStatusSending)
+
+	env.outbox.Start()
+	if n := env.queryInt("SELECT COUNT(*) FROM outbound_emails WHERE id = ? AND status = ?",
+		interrupted, services.OutboundStatusUnknown); n != 1 {
+		t.Fatal("interrupted message not marked unknown")
+	}
+	// A message queued after the restart goes out; the interrupted one does not
+	if _, err := env.outbox.Enqueue(projectID, env.userID, services.OutboundKindDispatch, []models.OutboundEmail{{
+		ProjectID: projectID, TeacherID: teachers["li@school.test"], UserID: env.userID,
+		ToEmail: "li@school.test", Subject: "2025年度工作量汇总", Body: "请填写附件",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	env.waitFor("the new message", func() bool {
+		return env.queryInt("SELECT COUNT(*) FROM outbound_emails WHERE to_email = 'li@school.test' AND status = ?",
+			services.OutboundStatusSent) == 1
+	})
+	if sent := env.mailer.Sent(); len(sent) != 1 || sent[0].To[0] != "li@school.test" {
+		t.Fatalf("sent %d messages, want only the one to li@school.test", len(sent))
+	}
+
+	n, err := env.outbox.RetryFailed(projectID)
+	if err != nil || n != 1 {
+		t.Fatalf("RetryFailed = %d, %v; want the interrupted message", n, err)
+	}
+	env.waitFor("the retried message", func() bool {
+		return env.queryInt("SELECT COUNT(*) FROM outbound_emails WHERE id = ? AND status = ?",
+			interrupted, services.OutboundStatusSent) == 1
+	})
+}
+
+// TestScheduledReminderQueuedOnce sends a due follow-up reminder and marks
+// its plan queued, so later rounds of the worker do not send it again
+func TestScheduledReminderQueuedOnce(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	reminder := env.insert("INSERT INTO scheduled_reminders (project_id, teacher_id, due_at) VALUES (?, ?, ?)",
+		projectID, teachers["zhang@school.test"], time.Now().Add(-time.Hour))
+
+	env.outbox.Start()
+	env.waitFor("the reminder", func() bool {
+		return env.queryInt("SELECT COUNT(*) FROM outbound_emails WHERE kind = ? AND status = ?",
+			services.OutboundKindReminder, services.OutboundStatusSent) == 1
+	})
+	if n := env.queryInt("SELECT COUNT(*) FROM scheduled_reminders WHERE id = ? AND status = ? AND job_id IS NOT NULL",
+		reminder, services.ScheduledReminderQueued); n != 1 {
+		t.Fatal("reminder plan not marked queued with its job")
+	}
+
+	// Two more rounds of the worker
+	for i := 0; i < 2; i++ {
+		env.outbox.Notify()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if sent := env.mailer.Sent(); len(sent) != 1 {
+		t.Fatalf("sent %d messages, want the reminder once", len(sent))
+	}
+}
+
+// TestScheduledReminderStatuses reminds teachers who have not answered,
+// only answered automatically or need to revise their submission, and
+// cancels the plan of a teacher who has replied
+func TestScheduledReminderStatuses(t *testing.T) {
+	env := newTestEnv(t)
+	statuses := map[string]string{
+		"zhang@school.test": services.MemberStatusPending,
+		"li@school.test":    services.MemberStatusAutoReplied,
+		"wang@school.test":  services.MemberStatusNeedsRevision,
+		"zhao@school.test":  "replied",
+	}
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{
+		"zhang@school.test": "张三", "li@school.test": "李四", "wang@school.test": "王五", "zhao@school.test": "赵六"})
+	for address, status := range statuses {
+		env.insert("UPDATE project_members SET current_status = ? WHERE project_id = ? AND teacher_id = ?",
+			status, projectID, teachers[address])
+		env.insert("INSERT INTO scheduled_reminders (project_id, teacher_id, due_at) VALUES (?, ?, ?)",
+			projectID, teachers[address], time.Now().Add(-time.Hour))
+	}
+
+	env.outbox.Start()
+	env.waitFor("the reminders", func() bool {
+		return env.queryInt("SELECT COUNT(*) FROM scheduled_reminders WHERE status != ?", services.ScheduledReminderPending) == 4
+	})
+	for address, status := range statuses {
+		want := services.ScheduledReminderQueued
+		if status == "replied" {
+			want = services.ScheduledReminderCancelled
+		}
+		if n := env.queryInt("SELECT COUNT(*) FROM scheduled_reminders WHERE teacher_id = ? AND status = ?",
+			teachers[address], want); n != 1 {
+			t.Errorf("plan for a %s teacher not %s", status, want)
+		}
+	}
+}
+
+// TestSentEmailRecordedLater sends a dispatch while its Message-ID cannot be
+// recorded: the message is still marked sent, and the Message-ID is added
+// on a later round, so that the teacher's reply is matched
+func TestSentEmailRecordedLater(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.insert("RENAME TABLE sent_emails TO sent_emails_offline")
+	env.dispatch(env.userID, projectID, teachers)
+	if n := env.queryInt("SELECT COUNT(*) FROM sent_emails_offline"); n != 0 {
+		t.Fatalf("%d Message-IDs recorded without a sent_emails table", n)
+	}
+
+	env.insert("RENAME TABLE sent_emails_offline TO sent_emails")
+	env.outbox.Notify()
+	env.waitFor("the Message-ID", func() bool {
+		return env.queryInt(`SELECT COUNT(*) FROM sent_emails se
+			JOIN outbound_emails o ON o.message_id = se.message_id
+			WHERE se.project_id = ? AND se.teacher_id = ?`, projectID, teachers["zhang@school.test"]) == 1
+	})
+
+	env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", 32))
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM replies WHERE project_id = ?", projectID); n != 1 {
+		t.Fatal("reply not matched to the project")
+	}
+}
+
+// TestJobCompletion closes a job once its message has been sent, and a job
+// whose message failed is reopened when the message is retried
+func TestJobCompletion(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{
+		"zhang@school.test": "张三", "li@school.test": "李四"})
+	job := func(id int) models.EmailJob {
+		t.Helper()
+		job, err := env.outbox.GetJob(id, env.userID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	// A job left by an earlier run, closed with its message failed
+	failedJob := env.insert("INSERT INTO email_jobs (project_id, kind, status, total_count, finished_at) VALUES (?, ?, ?, 1, NOW())",
+		projectID, services.OutboundKindDispatch, services.JobStatusCompleted)
+	env.insert(`
+		INSERT INTO outbound_emails (project_id, teacher_id, user_id, job_id, kind, to_email, subject, body, status, attempts)
+		VALUES (?, ?, ?, ?, ?, 'li@school.test', '2025年度工作量汇总', '请填写附件', ?, 3)`,
+		projectID, teachers["li@school.test"], env.userID, failedJob, services.OutboundKindDispatch, services.OutboundStatusFailed)
+
+	n, err := env.outbox.RetryFailed(projectID)
+	if err != nil || n != 1 {
+		t.Fatalf("RetryFailed = %d, %v; want the failed message", n, err)
+	}
+	if j := job(failedJob); j.Status != services.JobStatusRunning || j.FinishedAt != nil || j.PendingCount != 1 {
+		t.Fatalf("retried job = %+v, want it running again", j)
+	}
+
+	if _, err := env.outbox.Enqueue(projectID, env.userID, services.OutboundKindDispatch, []models.OutboundEmail{{
+		ProjectID: projectID, TeacherID: teachers["zhang@school.test"], UserID: env.userID,
+		ToEmail: "zhang@school.test", Subject: "2025年度工作量汇总", Body: "请填写附件",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	env.outbox.Start()
+	env.waitFor("both jobs to close", func() bool {
+		return env.queryInt("SELECT COUNT(*) FROM email_jobs WHERE status = ? AND finished_at IS NOT NULL",
+			services.JobStatusCompleted) == 2
+	})
+	if j := job(failedJob); j.SentCount != 1 || j.FailedCount != 0 {
+		t.Errorf("retried job = %+v, want its message sent", j)
+	}
+}
@@ -0,0 +1,299 @@
+package dbtest_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"db_intro_backend/db"
+	"db_intro_backend/mailtest"
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+)
+
+// TestValidationUsesParsedRows checks a reply against the project's rules,
+// which are applied to the rows parsed at ingestion
+func TestValidationUsesParsedRows(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	err := services.SaveValidationRules(projectID, models.ValidationRules{Columns: []models.ColumnRule{
+		{Header: "工作量", Required: true, Type: services.ColumnTypeNumber, Max: "100"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.dispatch(env.userID, projectID, teachers)
+	reply, err := mailtest.BuildReply(env.mailer.Sent()[0].Data, "zhang@school.test", "见附件",
+		mailtest.Attachment{Filename: "工作量.xlsx", Data: workbook(t,
+			[]interface{}{"张三", "数据库导论", 32},
+			[]interface{}{"张三", "操作系统", "很多"},
+			[]interface{}{"张三", "编译原理", 120})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.mailbox.Deliver(officeAddress, reply)
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+
+	var status, issuesJSON string
+	if err := db.DB.QueryRow("SELECT validation_status, validation_errors FROM attachments WHERE project_id = ?", projectID).
+		Scan(&status, &issuesJSON); err != nil {
+		t.Fatal(err)
+	}
+	var issues []models.ValidationIssue
+	json.Unmarshal([]byte(issuesJSON), &issues)
+	if status != services.ValidationStatusInvalid || len(issues) != 2 ||
+		issues[0].Cell != "C3" || issues[0].Value != "很多" || issues[1].Cell != "C4" {
+		t.Fatalf("validation = %s %+v, want C3 and C4 to fail", status, issues)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM project_members WHERE project_id = ? AND current_status = ?",
+		projectID, services.MemberStatusNeedsRevision); n != 1 {
+		t.Fatal("teacher not asked for a revision")
+	}
+}
+
+// TestSettingsKeepParsedRows saves aggregation settings: only a change of
+// column aliases makes the attachments parse again
+func TestSettingsKeepParsedRows(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(env.userID, projectID, teachers)
+	env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", 32))
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	parsed := func() int {
+		return env.queryInt("SELECT COUNT(*) FROM attachments WHERE project_id = ? AND parsed = TRUE", projectID)
+	}
+	if parsed() != 1 {
+		t.Fatal("attachment not parsed at ingestion")
+	}
+
+	settings := models.AggregationSettings{
+		ColumnAliases:     map[string][]string{},
+		ProvenanceColumns: []string{"teacher_name"},
+		OrderBy:           services.AggregationOrderDepartment,
+	}
+	if err := services.SaveAggregationSettings(projectID, settings); err != nil {
+		t.Fatal(err)
+	}
+	if parsed() != 1 {
+		t.Fatal("changing the provenance columns and order invalidated the parsed rows")
+	}
+
+	settings.ColumnAliases = map[string][]string{"工作量": {"学时"}}
+	if err := services.SaveAggregationSettings(projectID, settings); err != nil {
+		t.Fatal(err)
+	}
+	if parsed() != 0 {
+		t.Fatal("changing the column aliases kept the parsed rows")
+	}
+}
+
+// TestProjectDataDoesNotParse reads the data of a project whose attachment
+// waits to be parsed again: it is reported as pending and left unparsed
+func TestProjectDataDoesNotParse(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(env.userID, projectID, teachers)
+	env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", 32))
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	excel := services.NewExcelService()
+	page, err := excel.QueryProjectData(projectID, services.DataQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || len(page.Pending) != 0 {
+		t.Fatalf("page = %+v, want the parsed row", page)
+	}
+
+	settings := models.AggregationSettings{ColumnAliases: map[string][]string{"工作量": {"学时"}}}
+	if err := services.SaveAggregationSettings(projectID, settings); err != nil {
+		t.Fatal(err)
+	}
+	page, err = excel.QueryProjectData(projectID, services.DataQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 0 || len(page.Pending) != 1 || page.Pending[0].Filename != "工作量.xlsx" {
+		t.Fatalf("page = %+v, want the attachment pending", page)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM attachments WHERE project_id = ? AND parsed = TRUE", projectID); n != 0 {
+		t.Fatal("reading the data parsed the attachment")
+	}
+
+	if err := excel.ParsePending(projectID); err != nil {
+		t.Fatal(err)
+	}
+	page, err = excel.QueryProjectData(projectID, services.DataQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || len(page.Pending) != 0 || page.Rows[0].Values["工作量"] != "32" {
+		t.Fatalf("page = %+v, want the row parsed again", page)
+	}
+}
+
+// TestPinSubmission numbers a teacher's replies as versions, selects the
+// latest one and lets a pin override it; a teacher has at most one pin.
+// Unpinning is left out: the test server cannot run its nested UPDATE.
+func TestPinSubmission(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(env.userID, projectID, teachers)
+	for _, hours := range []int{32, 40} {
+		env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", hours))
+		if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+			t.Fatalf("ProcessUserEmails: %v", err)
+		}
+	}
+
+	// versions lists the submissions newest first as version:selected:pinned
+	versions := func() []string {
+		t.Helper()
+		subs, err := services.ListSubmissions(projectID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, sub := range subs {
+			got = append(got, fmt.Sprintf("%d:%v:%v", sub.Version, sub.Selected, sub.Pinned))
+			if len(sub.Attachments) != 1 || sub.Attachments[0] != "工作量.xlsx" {
+				t.Errorf("version %d attachments = %v", sub.Version, sub.Attachments)
+			}
+		}
+		return got
+	}
+	if got := versions(); !slices.Equal(got, []string{"2:true:false", "1:false:false"}) {
+		t.Fatalf("submissions = %v, want the latest of two selected", got)
+	}
+	ids := map[int]int{}
+	for _, version := range []int{1, 2} {
+		ids[version] = env.queryInt("SELECT id FROM submissions WHERE project_id = ? AND version = ?", projectID, version)
+	}
+
+	if err := services.PinSubmission(projectID, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(); !slices.Equal(got, []string{"2:false:false", "1:true:true"}) {
+		t.Errorf("after pinning version 1: %v", got)
+	}
+	if err := services.PinSubmission(projectID, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(); !slices.Equal(got, []string{"2:true:true", "1:false:false"}) {
+		t.Errorf("after pinning version 2: %v", got)
+	}
+
+	otherID, _ := env.addProject(env.userID, "WL2026", map[string]string{"li@school.test": "李四"})
+	for _, tt := range []struct{ projectID, submissionID int }{{otherID, ids[1]}, {projectID, ids[2] + 100}} {
+		if err := services.PinSubmission(tt.projectID, tt.submissionID); !errors.Is(err, services.ErrSubmissionNotFound) {
+			t.Errorf("PinSubmission(%d, %d) = %v, want ErrSubmissionNotFound", tt.projectID, tt.submissionID, err)
+		}
+	}
+}
+
+// TestSubmissionVersionTaken checks that a version taken twice is reported as
+// the duplicate key that recordSubmission retries on
+func TestSubmissionVersionTaken(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.dispatch(env.userID, projectID, teachers)
+	env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", 32))
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+
+	_, err := db.DB.Exec(`INSERT INTO submissions (project_id, teacher_id, reply_id, version)
+		SELECT project_id, teacher_id, reply_id, version FROM submissions WHERE project_id = ?`, projectID)
+	if !db.IsDuplicateKey(err) {
+		t.Fatalf("inserting a taken version: %v, want a duplicate key error", err)
+	}
+	if db.IsDuplicateKey(nil) {
+		t.Error("nil reported as a duplicate key")
+	}
+}
+
+// TestProjectDataFollowsPins changes which submissions are pinned between
+// two reads of the data; the cached rows must not survive a set of pins
+// whose IDs add up to the same sum
+func TestProjectDataFollowsPins(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三", "li@school.test": "李四"})
+	env.dispatch(env.userID, projectID, teachers)
+	// Submissions 1 and 3 are 张三's, 2 and 4 李四's
+	for _, hours := range []int{10, 20, 30, 40} {
+		teacher, name := "zhang@school.test", "张三"
+		if hours%20 == 0 {
+			teacher, name = "li@school.test", "李四"
+		}
+		env.mailbox.Deliver(officeAddress, env.reply(teacher, name, hours))
+		if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+			t.Fatalf("ProcessUserEmails: %v", err)
+		}
+	}
+
+	excel := services.NewExcelService()
+	hours := func() []string {
+		t.Helper()
+		page, err := excel.QueryProjectData(projectID, services.DataQuery{SortBy: "工作量"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, row := range page.Rows {
+			got = append(got, row.Values["工作量"])
+		}
+		return got
+	}
+	pin := func(ids ...int) {
+		t.Helper()
+		for _, id := range ids {
+			if err := services.PinSubmission(projectID, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pin(1, 4)
+	if got := hours(); !slices.Equal(got, []string{"10", "40"}) {
+		t.Fatalf("hours with submissions 1 and 4 pinned = %v", got)
+	}
+	pin(3, 2)
+	if got := hours(); !slices.Equal(got, []string{"20", "30"}) {
+		t.Fatalf("hours with submissions 2 and 3 pinned = %v", got)
+	}
+}
+
+// TestMissingTemplateFile parses a reply to a project whose template file is
+// gone from disk: the headers of the submission are used instead
+func TestMissingTemplateFile(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.insert("UPDATE projects SET excel_template_filename = 'template_deleted.xlsx' WHERE id = ?", projectID)
+	env.dispatch(env.userID, projectID, teachers)
+	env.mailbox.Deliver(officeAddress, env.reply("zhang@school.test", "张三", 32))
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM attachments WHERE project_id = ? AND parsed = TRUE", projectID); n != 1 {
+		t.Fatal("attachment not parsed without the template file")
+	}
+
+	excel := services.NewExcelService()
+	if err := excel.ParsePending(projectID); err != nil {
+		t.Fatalf("ParsePending: %v", err)
+	}
+	page, err := excel.QueryProjectData(projectID, services.DataQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(page.Headers, []string{"姓名", "课程", "工作量"}) || page.Total != 1 || page.Rows[0].Values["工作量"] != "32" {
+		t.Fatalf("page = %+v, want the submitted row under its own headers", page)
+	}
+}
@@ -0,0 +1,153 @@
+package dbtest_test
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+
+	"db_intro_backend/mailtest"
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+)
+
+// queueUnmatched delivers a spreadsheet from an address that is no teacher's
+// and returns the triage entry it ends up in
+func (e *testEnv) queueUnmatched(from string) models.UnmatchedEmail {
+	e.t.Helper()
+	original := []byte("From: " + officeAddress + "\r\nSubject: 工作量\r\nMessage-ID: <unknown@school.test>\r\n\r\n")
+	msg, err := mailtest.BuildReply(original, from, "见附件",
+		mailtest.Attachment{Filename: "工作量.xlsx", Data: workbook(e.t, []interface{}{"张三", "数据库导论", 32})})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	e.mailbox.Deliver(officeAddress, msg)
+	if err := e.emails.ProcessUserEmails(e.userID); err != nil {
+		e.t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	emails, err := e.emails.ListUnmatchedEmails(e.userID, services.UnmatchedStatusPending)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	for _, email := range emails {
+		if email.FromEmail == from {
+			return email
+		}
+	}
+	e.t.Fatalf("email from %s not queued", from)
+	return models.UnmatchedEmail{}
+}
+
+// TestAssignUnmatchedEmail files a queued email under a project: it becomes
+// a reply of the chosen teacher and takes its attachment along
+func TestAssignUnmatchedEmail(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, teachers := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	email := env.queueUnmatched("zhang.private@mail.test")
+	if len(email.Attachments) != 1 {
+		t.Fatalf("queued %d attachments, want 1", len(email.Attachments))
+	}
+	triageCopy := email.Attachments[0].StoredPath
+
+	teacher := sql.NullInt64{Int64: int64(teachers["zhang@school.test"]), Valid: true}
+	replyID, err := env.emails.AssignUnmatchedEmail(env.userID, email.ID, projectID, teacher)
+	if err != nil {
+		t.Fatalf("AssignUnmatchedEmail: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM replies WHERE id = ? AND project_id = ? AND teacher_id = ?",
+		replyID, projectID, teacher.Int64); n != 1 {
+		t.Fatal("reply not stored under the project and teacher")
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM attachments WHERE reply_id = ? AND status = ?",
+		replyID, services.AttachmentStatusStored); n != 1 {
+		t.Fatal("attachment not moved to the reply")
+	}
+	if _, err := os.Stat(triageCopy); !os.IsNotExist(err) {
+		t.Fatalf("triage copy %s left behind", triageCopy)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM unmatched_emails WHERE id = ? AND status = ? AND reply_id = ?",
+		email.ID, services.UnmatchedStatusAssigned, replyID); n != 1 {
+		t.Fatal("email not marked assigned")
+	}
+	// Assigned emails are resolved
+	if _, err := env.emails.AssignUnmatchedEmail(env.userID, email.ID, projectID, teacher); !errors.Is(err, services.ErrUnmatchedEmailNotFound) {
+		t.Fatalf("second assignment = %v, want ErrUnmatchedEmailNotFound", err)
+	}
+}
+
+// TestAssignUnmatchedEmailFailure returns the email to the queue, with its
+// attachment, when the reply cannot be stored
+func TestAssignUnmatchedEmailFailure(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, _ := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	email := env.queueUnmatched("zhang.private@mail.test")
+
+	env.insert("RENAME TABLE replies TO replies_offline")
+	if _, err := env.emails.AssignUnmatchedEmail(env.userID, email.ID, projectID, sql.NullInt64{}); err == nil {
+		t.Fatal("AssignUnmatchedEmail succeeded without a replies table")
+	}
+	env.insert("RENAME TABLE replies_offline TO replies")
+
+	if n := env.queryInt("SELECT COUNT(*) FROM unmatched_emails WHERE id = ? AND status = ? AND project_id IS NULL",
+		email.ID, services.UnmatchedStatusPending); n != 1 {
+		t.Fatal("email not returned to the queue")
+	}
+	if _, err := os.Stat(email.Attachments[0].StoredPath); err != nil {
+		t.Fatalf("attachment lost: %v", err)
+	}
+	if _, err := env.emails.AssignUnmatchedEmail(env.userID, email.ID, projectID, sql.NullInt64{}); err != nil {
+		t.Fatalf("AssignUnmatchedEmail after the failure: %v", err)
+	}
+}
+
+// TestAssignUnreadableEmail refuses to file a message that could not be
+// read: only an excerpt of it was kept
+func TestAssignUnreadableEmail(t *testing.T) {
+	env := newTestEnv(t)
+	projectID, _ := env.addProject(env.userID, "WL2025", map[string]string{"zhang@school.test": "张三"})
+	env.mailbox.Deliver(officeAddress, []byte("From: zhang@school.test\r\nMessage-ID: <broken@school.test>\r\n"+
+		"this line is not a header\r\n\r\nbody\r\n"))
+	if err := env.emails.ProcessUserEmails(env.userID); err != nil {
+		t.Fatalf("ProcessUserEmails: %v", err)
+	}
+	emails, err := env.emails.ListUnmatchedEmails(env.userID, services.UnmatchedStatusPending)
+	if err != nil || len(emails) != 1 || emails[0].IngestError == "" {
+		t.Fatalf("unmatched emails = %+v, %v; want the unreadable message", emails, err)
+	}
+
+	if _, err := env.emails.AssignUnmatchedEmail(env.userID, emails[0].ID, projectID, sql.NullInt64{}); !errors.Is(err, services.ErrUnmatchedEmailUnreadable) {
+		t.Fatalf("AssignUnmatchedEmail = %v, want ErrUnmatchedEmailUnreadable", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM replies"); n != 0 {
+		t.Fatalf("%d replies stored from the excerpt", n)
+	}
+	// It can still be dismissed
+	if err := env.emails.DismissUnmatchedEmail(env.userID, emails[0].ID); err != nil {
+		t.Fatalf("DismissUnmatchedEmail: %v", err)
+	}
+}
+
+// TestDismissUnmatchedEmail resolves a queued email without a reply and
+// deletes its attachment
+func TestDismissUnmatchedEmail(t *testing.T) {
+	env := newTestEnv(t)
+	email := env.queueUnmatched("newsletter@mail.test")
+	otherUser := env.addUser(models.User{EmailAddress: "other@school.test"})
+
+	if err := env.emails.DismissUnmatchedEmail(otherUser, email.ID); !errors.Is(err, services.ErrUnmatchedEmailNotFound) {
+		t.Fatalf("dismissal by another user = %v, want ErrUnmatchedEmailNotFound", err)
+	}
+	if err := env.emails.DismissUnmatchedEmail(env.userID, email.ID); err != nil {
+		t.Fatalf("DismissUnmatchedEmail: %v", err)
+	}
+	if n := env.queryInt("SELECT COUNT(*) FROM unmatched_emails WHERE id = ? AND status = ? AND resolved_at IS NOT NULL",
+		email.ID, services.UnmatchedStatusDismissed); n != 1 {
+		t.Fatal("email not marked dismissed")
+	}
+	if _, err := os.Stat(email.Attachments[0].StoredPath); !os.IsNotExist(err) {
+		t.Fatal("attachment of the dismissed email kept")
+	}
+	if err := env.emails.DismissUnmatchedEmail(env.userID, email.ID); !errors.Is(err, services.ErrUnmatchedEmailNotFound) {
+		t.Fatalf("second dismissal = %v, want ErrUnmatchedEmailNotFound", err)
+	}
+}
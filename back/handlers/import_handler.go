@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ImportHandler struct {
+	EmailService *services.EmailService
+}
+
+func NewImportHandler(emailService *services.EmailService) *ImportHandler {
+	return &ImportHandler{EmailService: emailService}
+}
+
+// ImportEmails ingests uploaded .eml files and mbox archives (multipart field
+// "files") like fetched mail. With dry_run=true nothing is stored and the
+// report shows what would be matched.
+func (h *ImportHandler) ImportEmails(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["files"]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files uploaded"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true" || c.PostForm("dry_run") == "true"
+
+	user, err := services.LoadUserEmailConfig(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := services.NewImportReport(dryRun)
+	for _, fh := range form.File["files"] {
+		f, err := fh.Open()
+		if err == nil {
+			err = h.EmailService.ImportMessages(user, f, fh.Filename, dryRun, report)
+			f.Close()
+		}
+		if err != nil {
+			report.Counts[services.IngestFailed]++
+			report.Messages = append(report.Messages, models.ImportedMessage{
+				Source:            fh.Filename,
+				Outcome:           services.IngestFailed,
+				CandidateProjects: []models.ProjectRef{},
+				Error:             err.Error(),
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": report})
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"db_intro_backend/db"
+	"db_intro_backend/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	jobEventInterval  = time.Second
+	jobEventKeepAlive = 15 // intervals without changes before a keep-alive comment
+)
+
+type JobHandler struct {
+	OutboxService *services.OutboxService
+}
+
+func NewJobHandler(outboxService *services.OutboxService) *JobHandler {
+	return &JobHandler{OutboxService: outboxService}
+}
+
+// GetProjectJobs lists the dispatch and reminder jobs of a project
+func (h *JobHandler) GetProjectJobs(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	jobs, err := h.OutboxService.ListProjectJobs(pid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": jobs})
+}
+
+// GetJob returns a job with its per-teacher delivery results
+func (h *JobHandler) GetJob(c *gin.Context) {
+	userID := c.GetInt("userID")
+	jobID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	job, err := h.OutboxService.GetJob(jobID, userID, true)
+	if err != nil {
+		if errors.Is(err, services.ErrJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": job})
+}
+
+// StreamJob pushes the job's progress as Server-Sent Events ("progress" on
+// every change, "done" once it has finished) until the job completes or the
+// client disconnects.
+func (h *JobHandler) StreamJob(c *gin.Context) {
+	userID := c.GetInt("userID")
+	jobID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	if _, err := h.OutboxService.GetJob(jobID, userID, false); err != nil {
+		if errors.Is(err, services.ErrJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	ticker := time.NewTicker(jobEventInterval)
+	defer ticker.Stop()
+
+	var last string
+	idle := 0
+	first := true
+	c.Stream(func(w io.Writer) bool {
+		if !first {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case <-ticker.C:
+			}
+		}
+		first = false
+
+		job, err := h.OutboxService.GetJob(jobID, userID, false)
+		if err != nil {
+			log.Printf("Failed to load job %d for event stream: %v", jobID, err)
+			c.SSEvent("error", gin.H{"error": "Failed to load job"})
+			return false
+		}
+
+		if job.FinishedAt != nil {
+			full, err := h.OutboxService.GetJob(jobID, userID, true)
+			if err == nil {
+				job = full
+			}
+			c.SSEvent("done", job)
+			return false
+		}
+
+		snapshot := job.Status + "/" + strconv.Itoa(job.SentCount) + "/" + strconv.Itoa(job.FailedCount) + "/" + strconv.Itoa(job.PendingCount)
+		if snapshot != last {
+			c.SSEvent("progress", job)
+			last = snapshot
+			idle = 0
+		} else if idle++; idle >= jobEventKeepAlive {
+			// Keeps proxies from closing a quiet stream
+			io.WriteString(w, ": keep-alive\n\n")
+			idle = 0
+		}
+		return true
+	})
+}
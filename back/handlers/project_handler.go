@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -20,14 +21,16 @@ import (
 )
 
 type ProjectHandler struct {
-	EmailService *services.EmailService
-	ExcelService *services.ExcelService
+	EmailService  *services.EmailService
+	ExcelService  *services.ExcelService
+	OutboxService *services.OutboxService
 }
 
-func NewProjectHandler(emailService *services.EmailService, excelService *services.ExcelService) *ProjectHandler {
+func NewProjectHandler(emailService *services.EmailService, excelService *services.ExcelService, outboxService *services.OutboxService) *ProjectHandler {
 	return &ProjectHandler{
-		EmailService: emailService,
-		ExcelService: excelService,
+		EmailService:  emailService,
+		ExcelService:  excelService,
+		OutboxService: outboxService,
 	}
 }
 
@@ -106,7 +109,7 @@ func (h *ProjectHandler) CreateProject(c *gin.Context) {
 	var filename string
 	if err == nil {
 		// Create uploads directory if not exists
-		uploadDir := "./uploads/templates"
+		uploadDir := services.TemplateDir
 		os.MkdirAll(uploadDir, 0755)
 
 		filename = fmt.Sprintf("%d_%s", time.Now().Unix(), file.Filename)
@@ -145,24 +148,35 @@ func (h *ProjectHandler) DispatchProject(c *gin.Context) {
 		return
 	}
 
-	// Query project members who haven't been sent an email yet
-	rows, err := db.DB.Query("SELECT teacher_id FROM project_members WHERE project_id = ? AND sent_at IS NULL", projectID)
+	// Query project members who haven't been sent an email yet and have none waiting in the outbox.
+	// An interrupted message may have arrived; it is only resent through the outbox retry.
+	rows, err := db.DB.Query(`
+		SELECT t.id, t.name, t.email
+		FROM project_members pm
+		JOIN teachers t ON pm.teacher_id = t.id
+		WHERE pm.project_id = ? AND pm.sent_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM outbound_emails o
+				WHERE o.project_id = pm.project_id AND o.teacher_id = pm.teacher_id
+					AND o.kind = ? AND o.status IN (?, ?, ?)
+			)`, projectID, services.OutboundKindDispatch, services.OutboundStatusQueued, services.OutboundStatusSending,
+		services.OutboundStatusUnknown)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var teacherIDs []int
+	var targets []emailTarget
 	for rows.Next() {
-		var id int
-		if err := rows.Scan(&id); err != nil {
+		var t emailTarget
+		if err := rows.Scan(&t.ID, &t.Name, &t.Email); err != nil {
 			continue
 		}
-		teacherIDs = append(teacherIDs, id)
+		targets = append(targets, t)
 	}
 
-	if len(teacherIDs) == 0 {
+	if len(targets) == 0 {
 		c.JSON(http.StatusOK, gin.H{"code": 200, "message": "No pending emails to send", "target_count": 0})
 		return
 	}
@@ -183,16 +197,22 @@ func (h *ProjectHandler) DispatchProject(c *gin.Context) {
 	// Prepare attachment path
 	var attachmentPath string
 	if project.ExcelTemplateFilename != "" {
-		attachmentPath = filepath.Join("./uploads/templates", project.ExcelTemplateFilename)
+		attachmentPath = filepath.Join(services.TemplateDir, project.ExcelTemplateFilename)
 	}
 
 	targetType := "pending_members"
-	h.dispatchProjectEmailsAsync(project, teacherIDs, attachmentPath, targetType)
+	jobID, err := h.enqueueProjectEmails(project, userID, targets, attachmentPath, targetType)
+	if err != nil {
+		log.Printf("Failed to enqueue dispatch for project %d: %v", project.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue emails"})
+		return
+	}
 
 	c.JSON(http.StatusAccepted, gin.H{
 		"code":         202,
 		"message":      "Email dispatch started",
-		"target_count": len(teacherIDs),
+		"target_count": len(targets),
+		"job_id":       jobID,
 	})
 }
 
@@ -256,6 +276,101 @@ func (h *ProjectHandler) GetProjectTracking(c *gin.Context) {
 	})
 }
 
+// GetProjectReplies returns the replies of a project with their plain-text
+// bodies and attachments. ?teacher_id= limits them to one teacher and
+// ?include_headers=true adds the raw mail headers.
+func (h *ProjectHandler) GetProjectReplies(c *gin.Context) {
+	userID := c.GetInt("userID")
+	projectID := c.Param("id")
+
+	// Verify ownership
+	var count int
+	err := db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", projectID, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	includeHeaders := c.Query("include_headers") == "true"
+	query := `
+		SELECT r.id, r.teacher_id, COALESCE(t.name, ''), r.from_email, COALESCE(r.subject, ''),
+			COALESCE(r.message_id, ''), COALESCE(r.in_reply_to, ''), r.received_at,
+			COALESCE(r.body_text, ''), COALESCE(r.is_auto_reply, FALSE), r.raw_headers
+		FROM replies r
+		LEFT JOIN teachers t ON r.teacher_id = t.id
+		WHERE r.project_id = ?`
+	args := []interface{}{projectID}
+	if teacherID := c.Query("teacher_id"); teacherID != "" {
+		query += " AND r.teacher_id = ?"
+		args = append(args, teacherID)
+	}
+	query += " ORDER BY r.received_at DESC, r.id DESC"
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	replies := []models.Reply{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var r models.Reply
+		var teacherID sql.NullInt64
+		var headers sql.NullString
+		if err := rows.Scan(&r.ID, &teacherID, &r.TeacherName, &r.FromEmail, &r.Subject,
+			&r.MessageID, &r.InReplyTo, &r.ReceivedAt, &r.BodyText, &r.IsAutoReply, &headers); err != nil {
+			continue
+		}
+		if teacherID.Valid {
+			tid := int(teacherID.Int64)
+			r.TeacherID = &tid
+		}
+		if includeHeaders && headers.Valid {
+			r.RawHeaders = json.RawMessage(headers.String)
+		}
+		r.Attachments = []models.ReplyAttachment{}
+		index[r.ID] = len(replies)
+		replies = append(replies, r)
+	}
+
+	attRows, err := db.DB.Query(`
+		SELECT id, reply_id, parent_attachment_id, COALESCE(original_filename, ''), COALESCE(content_type, ''), COALESCE(file_size, 0),
+			status, COALESCE(reject_reason, ''), COALESCE(extract_error, ''), COALESCE(validation_status, ''), validation_errors,
+			COALESCE(parse_status, ''), COALESCE(parse_error, '')
+		FROM attachments
+		WHERE project_id = ? AND reply_id IS NOT NULL
+		ORDER BY id ASC`, projectID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer attRows.Close()
+	for attRows.Next() {
+		var a models.ReplyAttachment
+		var replyID int
+		var parentID sql.NullInt64
+		var issues sql.NullString
+		if err := attRows.Scan(&a.ID, &replyID, &parentID, &a.OriginalFilename, &a.ContentType, &a.FileSize, &a.Status, &a.RejectReason,
+			&a.ExtractError, &a.ValidationStatus, &issues, &a.ParseStatus, &a.ParseError); err != nil {
+			continue
+		}
+		if issues.Valid {
+			json.Unmarshal([]byte(issues.String), &a.ValidationIssues)
+		}
+		if parentID.Valid {
+			pid := int(parentID.Int64)
+			a.ParentID = &pid
+		}
+		if i, ok := index[replyID]; ok {
+			replies[i].Attachments = append(replies[i].Attachments, a)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": replies})
+}
+
 func (h *ProjectHandler) RemindTeachers(c *gin.Context) {
 	userID := c.GetInt("userID")
 	projectID := c.Param("id")
@@ -273,7 +388,7 @@ func (h *ProjectHandler) RemindTeachers(c *gin.Context) {
 	}
 	c.ShouldBindJSON(&req)
 
-	query := "SELECT t.id, t.name, t.email FROM project_members pm JOIN teachers t ON pm.teacher_id = t.id WHERE pm.project_id = ? AND pm.current_status = 'pending'"
+	query := "SELECT t.id, t.name, t.email FROM project_members pm JOIN teachers t ON pm.teacher_id = t.id WHERE pm.project_id = ? AND pm.current_status IN (?, ?, ?)"
 
 	if len(req.TargetIDs) > 0 {
 		query += " AND t.id IN ("
@@ -288,6 +403,9 @@ func (h *ProjectHandler) RemindTeachers(c *gin.Context) {
 
 	var args []interface{}
 	args = append(args, projectID)
+	for _, status := range services.RemindableStatuses {
+		args = append(args, status)
+	}
 	for _, id := range req.TargetIDs {
 		args = append(args, id)
 	}
@@ -299,9 +417,9 @@ func (h *ProjectHandler) RemindTeachers(c *gin.Context) {
 	}
 	defer rows.Close()
 
-	var targets []reminderTarget
+	var targets []emailTarget
 	for rows.Next() {
-		var t reminderTarget
+		var t emailTarget
 		if err := rows.Scan(&t.ID, &t.Name, &t.Email); err != nil {
 			log.Printf("Failed to scan reminder target: %v", err)
 			continue
@@ -327,145 +445,125 @@ func (h *ProjectHandler) RemindTeachers(c *gin.Context) {
 		return
 	}
 
-	h.sendRemindersAsync(project, targets)
+	jobID, err := h.enqueueReminders(project, userID, targets)
+	if err != nil {
+		log.Printf("Failed to enqueue reminders for project %d: %v", project.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue reminder emails"})
+		return
+	}
 
 	c.JSON(http.StatusAccepted, gin.H{
 		"code":         202,
 		"message":      "Reminder emails queued",
 		"target_count": len(targets),
+		"job_id":       jobID,
 	})
 }
 
-func (h *ProjectHandler) dispatchProjectEmailsAsync(project models.Project, teacherIDs []int, attachmentPath, targetType string) {
-	ids := append([]int(nil), teacherIDs...)
-	go func(p models.Project, ids []int, attach, tType string) {
-		// Fetch user config
-		var user models.User
-		var smtpHost, smtpPort, smtpUser, smtpPass, imapHost, imapPort, imapUser, imapPass, emailAddr sql.NullString
-		err := db.DB.QueryRow("SELECT id, smtp_host, smtp_port, smtp_username, smtp_password, imap_host, imap_port, imap_username, imap_password, email_address FROM users WHERE id = ?", p.CreatedBy).Scan(
-			&user.ID, &smtpHost, &smtpPort, &smtpUser, &smtpPass, &imapHost, &imapPort, &imapUser, &imapPass, &emailAddr,
-		)
-		if err != nil {
-			log.Printf("Failed to fetch user config for project %d: %v", p.ID, err)
-			return
-		}
-		user.SMTPHost = smtpHost.String
-		user.SMTPPort = smtpPort.String
-		user.SMTPUsername = smtpUser.String
-		user.SMTPPassword = smtpPass.String
-		user.IMAPHost = imapHost.String
-		user.IMAPPort = imapPort.String
-		user.IMAPUsername = imapUser.String
-		user.IMAPPassword = imapPass.String
-		user.EmailAddress = emailAddr.String
-
-		if user.SMTPHost == "" || user.EmailAddress == "" {
-			log.Printf("User %d has no email config, aborting dispatch", p.CreatedBy)
-			return
-		}
-
-		log.Printf("Starting background dispatch for project %d (%d teachers)...", p.ID, len(ids))
-		successCount := 0
-		for _, tid := range ids {
-			var teacherEmail, teacherName string
-			if err := db.DB.QueryRow("SELECT name, email FROM teachers WHERE id=?", tid).Scan(&teacherName, &teacherEmail); err != nil {
-				log.Printf("Failed to get teacher %d: %v", tid, err)
-				continue
-			}
-
-			subject := h.replaceTemplateVars(p.EmailSubjectTemplate, teacherName, p.Name)
-			body := h.replaceTemplateVars(p.EmailBodyTemplate, teacherName, p.Name)
-
-			msgID, err := h.EmailService.SendEmail(user, teacherEmail, subject, body, attach)
-			if err != nil {
-				log.Printf("Failed to send email to %s: %v", teacherEmail, err)
-				continue
-			}
-
-			if _, err := db.DB.Exec("INSERT INTO sent_emails (project_id, teacher_id, message_id) VALUES (?, ?, ?)", p.ID, tid, msgID); err != nil {
-				log.Printf("Failed to record sent email for teacher %d: %v", tid, err)
-			}
+type emailTarget struct {
+	ID    int
+	Name  string
+	Email string
+}
 
-			if _, err := db.DB.Exec(
-				"INSERT INTO project_members (project_id, teacher_id, sent_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE sent_at=?",
-				p.ID, tid, time.Now(), time.Now(),
-			); err != nil {
-				log.Printf("Failed to upsert project member %d: %v", tid, err)
-				continue
-			}
+// enqueueProjectEmails records a dispatch and queues one templated email per
+// target as a new job; the outbox worker delivers them and bumps the
+// dispatch's sent_count.
+func (h *ProjectHandler) enqueueProjectEmails(p models.Project, userID int, targets []emailTarget, attachmentPath, targetType string) (int, error) {
+	res, err := db.DB.Exec(
+		"INSERT INTO dispatches (project_id, dispatched_by, target_type, sent_count) VALUES (?, ?, ?, 0)",
+		p.ID, userID, targetType,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record dispatch: %w", err)
+	}
+	lastID, _ := res.LastInsertId()
+	dispatchID := int(lastID)
+
+	messages := make([]models.OutboundEmail, 0, len(targets))
+	for _, t := range targets {
+		messages = append(messages, models.OutboundEmail{
+			ProjectID:      p.ID,
+			TeacherID:      t.ID,
+			UserID:         p.CreatedBy,
+			DispatchID:     &dispatchID,
+			ToEmail:        t.Email,
+			Subject:        services.ReplaceTemplateVars(p.EmailSubjectTemplate, t.Name, p.Name),
+			Body:           services.ReplaceTemplateVars(p.EmailBodyTemplate, t.Name, p.Name),
+			AttachmentPath: attachmentPath,
+		})
+	}
 
-			successCount++
-		}
+	jobID, err := h.OutboxService.Enqueue(p.ID, userID, services.OutboundKindDispatch, messages)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Queued dispatch %d for project %d as job %d (%d teachers)", dispatchID, p.ID, jobID, len(messages))
+	return jobID, nil
+}
 
-		if _, err := db.DB.Exec(
-			"INSERT INTO dispatches (project_id, target_type, sent_count) VALUES (?, ?, ?)",
-			p.ID, tType, successCount,
-		); err != nil {
-			log.Printf("Failed to record dispatch for project %d: %v", p.ID, err)
-		}
+func (h *ProjectHandler) enqueueReminders(p models.Project, userID int, targets []emailTarget) (int, error) {
+	messages := make([]models.OutboundEmail, 0, len(targets))
+	for _, t := range targets {
+		messages = append(messages, services.BuildReminder(p, t.ID, t.Name, t.Email))
+	}
 
-		log.Printf("Background dispatch for project %d finished: %d/%d succeeded", p.ID, successCount, len(ids))
-	}(project, ids, attachmentPath, targetType)
+	jobID, err := h.OutboxService.Enqueue(p.ID, userID, services.OutboundKindReminder, messages)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Queued %d reminders for project %d as job %d", len(messages), p.ID, jobID)
+	return jobID, nil
 }
 
-type reminderTarget struct {
-	ID    int
-	Name  string
-	Email string
-}
+// GetProjectOutbox lists the per-recipient delivery status of a project's emails
+func (h *ProjectHandler) GetProjectOutbox(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
 
-func (h *ProjectHandler) sendRemindersAsync(project models.Project, targets []reminderTarget) {
-	targetCopies := append([]reminderTarget(nil), targets...)
-	go func(p models.Project, items []reminderTarget) {
-		// Fetch user config
-		var user models.User
-		var smtpHost, smtpPort, smtpUser, smtpPass, imapHost, imapPort, imapUser, imapPass, emailAddr sql.NullString
-		err := db.DB.QueryRow("SELECT id, smtp_host, smtp_port, smtp_username, smtp_password, imap_host, imap_port, imap_username, imap_password, email_address FROM users WHERE id = ?", p.CreatedBy).Scan(
-			&user.ID, &smtpHost, &smtpPort, &smtpUser, &smtpPass, &imapHost, &imapPort, &imapUser, &imapPass, &emailAddr,
-		)
-		if err != nil {
-			log.Printf("Failed to fetch user config for project %d: %v", p.ID, err)
-			return
-		}
-		user.SMTPHost = smtpHost.String
-		user.SMTPPort = smtpPort.String
-		user.SMTPUsername = smtpUser.String
-		user.SMTPPassword = smtpPass.String
-		user.IMAPHost = imapHost.String
-		user.IMAPPort = imapPort.String
-		user.IMAPUsername = imapUser.String
-		user.IMAPPassword = imapPass.String
-		user.EmailAddress = emailAddr.String
-
-		if user.SMTPHost == "" || user.EmailAddress == "" {
-			log.Printf("User %d has no email config, aborting reminders", p.CreatedBy)
-			return
-		}
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
 
-		log.Printf("Starting reminder run for project %d (%d targets)...", p.ID, len(items))
-		successCount := 0
-		for _, t := range items {
-			subject := "催促提醒: " + p.EmailSubjectTemplate
-			body := fmt.Sprintf("尊敬的%s老师：\n\n这是一封催促提醒邮件。\n\n%s\n\n请尽快完成并回复，谢谢！\n\n原邮件内容：\n%s",
-				t.Name, p.Name, p.EmailBodyTemplate)
-
-			msgID, err := h.EmailService.SendEmail(user, t.Email, subject, body, "")
-			if err != nil {
-				log.Printf("Failed to send reminder to %s (%s): %v", t.Name, t.Email, err)
-				continue
-			}
+	messages, err := h.OutboxService.ListProjectOutbox(pid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": messages})
+}
 
-			if _, err := db.DB.Exec("INSERT INTO sent_emails (project_id, teacher_id, message_id) VALUES (?, ?, ?)", p.ID, t.ID, msgID); err != nil {
-				log.Printf("Failed to record reminder for teacher %d: %v", t.ID, err)
-				continue
-			}
+// RetryProjectOutbox requeues the project's emails that exhausted their retries
+func (h *ProjectHandler) RetryProjectOutbox(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
 
-			log.Printf("Reminder sent to %s (%s)", t.Name, t.Email)
-			successCount++
-		}
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
 
-		log.Printf("Reminder run for project %d finished: %d/%d succeeded", p.ID, successCount, len(items))
-	}(project, targetCopies)
+	requeued, err := h.OutboxService.RetryFailed(pid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "message": "Failed and interrupted emails requeued", "count": requeued})
 }
 
 func (h *ProjectHandler) FetchProjectEmails(c *gin.Context) {
@@ -531,7 +629,7 @@ func (h *ProjectHandler) AggregateData(c *gin.Context) {
 		return
 	}
 
-	outputPath, attachmentCount, rowCount, err := h.ExcelService.AggregateProjectExcel(pid)
+	result, err := h.ExcelService.AggregateProjectExcel(pid)
 	if err != nil {
 		status := http.StatusInternalServerError
 		if errors.Is(err, services.ErrNoExcelAttachments) {
@@ -541,16 +639,294 @@ func (h *ProjectHandler) AggregateData(c *gin.Context) {
 		return
 	}
 
-	log.Printf("Aggregated %d rows from %d attachments for project %d", rowCount, attachmentCount, pid)
+	log.Printf("Aggregated %d rows from %d attachments for project %d", result.Rows, result.Attachments, pid)
 	c.JSON(http.StatusOK, gin.H{
-		"code":        200,
-		"message":     "Aggregation completed",
-		"attachments": attachmentCount,
-		"rows":        rowCount,
-		"file_path":   outputPath,
+		"code":           200,
+		"message":        "Aggregation completed",
+		"attachments":    result.Attachments,
+		"rows":           result.Rows,
+		"file_path":      result.OutputPath,
+		"headers":        result.Headers,
+		"template":       result.Template,
+		"report":         result.Report,
+		"summaries":      result.Summaries,
+		"summary_errors": result.SummaryErrors,
 	})
 }
 
+func (h *ProjectHandler) GetAggregationSettings(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	settings, err := services.LoadAggregationSettings(pid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if settings.ColumnAliases == nil {
+		settings.ColumnAliases = map[string][]string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": settings})
+}
+
+func (h *ProjectHandler) UpdateAggregationSettings(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	var settings models.AggregationSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.ValidateAggregationSettings(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.SaveAggregationSettings(pid, settings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save aggregation settings"})
+		return
+	}
+	// New column aliases leave the attachments to be parsed again; do it now
+	// rather than on the next aggregation, so the data view fills up again
+	go func() {
+		if err := h.ExcelService.ParsePending(pid); err != nil {
+			log.Printf("Failed to parse attachments of project %d: %v", pid, err)
+		}
+	}()
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": settings})
+}
+
+func (h *ProjectHandler) GetValidationRules(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	rules, err := services.LoadValidationRules(pid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rules.Columns == nil {
+		rules.Columns = []models.ColumnRule{}
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": rules})
+}
+
+// UpdateValidationRules replaces the rules; they apply to attachments
+// received from now on
+func (h *ProjectHandler) UpdateValidationRules(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	var rules models.ValidationRules
+	if err := c.ShouldBindJSON(&rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.ValidateValidationRules(&rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := services.SaveValidationRules(pid, rules); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save validation rules"})
+		return
+	}
+	if rules.Columns == nil {
+		rules.Columns = []models.ColumnRule{}
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": rules})
+}
+
+// GetProjectData returns the aggregated rows of a project as JSON. Query
+// parameters: page, page_size, columns (comma separated headers), filter[列]
+// (text the column must contain), q (search over all cells), sort and order
+// (asc | desc), group_by (department | teacher).
+func (h *ProjectHandler) GetProjectData(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	query := services.DataQuery{
+		Filters: c.QueryMap("filter"),
+		Search:  c.Query("q"),
+		SortBy:  c.Query("sort"),
+		GroupBy: c.Query("group_by"),
+	}
+	for name, value := range map[string]*int{"page": &query.Page, "page_size": &query.PageSize} {
+		if raw := c.Query(name); raw != "" {
+			if *value, err = strconv.Atoi(raw); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+				return
+			}
+		}
+	}
+	if columns := c.Query("columns"); columns != "" {
+		for _, column := range strings.Split(columns, ",") {
+			if column = strings.TrimSpace(column); column != "" {
+				query.Columns = append(query.Columns, column)
+			}
+		}
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+
+	page, err := h.ExcelService.QueryProjectData(pid, query)
+	if errors.Is(err, services.ErrInvalidDataQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": page})
+}
+
+// GetProjectSubmissions returns the submission history of a project, newest
+// version first per teacher, with the version aggregation uses marked as
+// selected. ?teacher_id= limits it to one teacher.
+func (h *ProjectHandler) GetProjectSubmissions(c *gin.Context) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+	teacherID := 0
+	if raw := c.Query("teacher_id"); raw != "" {
+		if teacherID, err = strconv.Atoi(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid teacher ID"})
+			return
+		}
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	submissions, err := services.ListSubmissions(pid, teacherID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load submissions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": submissions})
+}
+
+// PinSubmission makes aggregation use the given version of a teacher's data
+func (h *ProjectHandler) PinSubmission(c *gin.Context) {
+	h.setSubmissionPin(c, true)
+}
+
+// UnpinSubmission returns the teacher to the latest valid version
+func (h *ProjectHandler) UnpinSubmission(c *gin.Context) {
+	h.setSubmissionPin(c, false)
+}
+
+func (h *ProjectHandler) setSubmissionPin(c *gin.Context, pin bool) {
+	userID := c.GetInt("userID")
+	pid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+	sid, err := strconv.Atoi(c.Param("submissionId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid submission ID"})
+		return
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", pid, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	if pin {
+		err = services.PinSubmission(pid, sid)
+	} else {
+		err = services.UnpinSubmission(pid, sid)
+	}
+	if errors.Is(err, services.ErrSubmissionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Submission not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update submission"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "message": "Submission updated"})
+}
+
 func (h *ProjectHandler) DownloadAggregated(c *gin.Context) {
 	userID := c.GetInt("userID")
 	projectID := c.Param("id")
@@ -573,16 +949,6 @@ func (h *ProjectHandler) DownloadAggregated(c *gin.Context) {
 	c.FileAttachment(filePath, fmt.Sprintf("project_%s_aggregated.xlsx", projectID))
 }
 
-// replaceTemplateVars replaces template variables in email content
-func (h *ProjectHandler) replaceTemplateVars(text, teacherName, projectName string) string {
-	// Support common template variables
-	text = strings.ReplaceAll(text, "{{teacher_name}}", teacherName)
-	text = strings.ReplaceAll(text, "{{project_name}}", projectName)
-	text = strings.ReplaceAll(text, "{{Teacher_Name}}", teacherName)
-	text = strings.ReplaceAll(text, "{{Project_Name}}", projectName)
-	return text
-}
-
 func (h *ProjectHandler) AddProjectMembers(c *gin.Context) {
 	userID := c.GetInt("userID")
 	projectID := c.Param("id")
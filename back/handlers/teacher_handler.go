@@ -12,7 +12,8 @@ import (
 
 func GetTeachers(c *gin.Context) {
 	query := `
-		SELECT t.id, t.name, t.email, t.department_id, d.name as department_name, t.phone, t.created_at 
+		SELECT t.id, t.name, t.email, t.department_id, d.name as department_name, t.phone,
+			COALESCE(t.email_status, 'ok'), COALESCE(t.email_bounce_reason, ''), t.email_bounced_at, t.created_at 
 		FROM teachers t
 		LEFT JOIN departments d ON t.department_id = d.id
 	`
@@ -38,9 +39,14 @@ func GetTeachers(c *gin.Context) {
 	for rows.Next() {
 		var t models.Teacher
 		var deptName sql.NullString
-		if err := rows.Scan(&t.ID, &t.Name, &t.Email, &t.DepartmentID, &deptName, &t.Phone, &t.CreatedAt); err != nil {
+		var bouncedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &t.Email, &t.DepartmentID, &deptName, &t.Phone,
+			&t.EmailStatus, &t.EmailBounceReason, &bouncedAt, &t.CreatedAt); err != nil {
 			continue
 		}
+		if bouncedAt.Valid {
+			t.EmailBouncedAt = &bouncedAt.Time
+		}
 		if deptName.Valid {
 			t.DepartmentName = deptName.String
 		}
@@ -77,9 +83,16 @@ func UpdateTeacher(c *gin.Context) {
 		return
 	}
 
-	_, err := db.DB.Exec(
-		"UPDATE teachers SET name=?, email=?, department_id=?, phone=? WHERE id=?",
-		t.Name, t.Email, t.DepartmentID, t.Phone, id,
+	// A corrected address clears the bounce flag; the flag columns are set
+	// first because MySQL applies assignments left to right
+	_, err := db.DB.Exec(`
+		UPDATE teachers SET
+			email_status = IF(email = ?, email_status, 'ok'),
+			email_bounce_reason = IF(email = ?, email_bounce_reason, NULL),
+			email_bounced_at = IF(email = ?, email_bounced_at, NULL),
+			name=?, email=?, department_id=?, phone=?
+		WHERE id=?`,
+		t.Email, t.Email, t.Email, t.Name, t.Email, t.DepartmentID, t.Phone, id,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"db_intro_backend/db"
+	"db_intro_backend/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type UnmatchedHandler struct {
+	EmailService *services.EmailService
+}
+
+func NewUnmatchedHandler(emailService *services.EmailService) *UnmatchedHandler {
+	return &UnmatchedHandler{EmailService: emailService}
+}
+
+// GetUnmatchedEmails lists incoming emails that could not be attributed to a
+// project. ?status= filters by pending (default), assigned, dismissed or all.
+func (h *UnmatchedHandler) GetUnmatchedEmails(c *gin.Context) {
+	userID := c.GetInt("userID")
+
+	status := c.DefaultQuery("status", services.UnmatchedStatusPending)
+	switch status {
+	case "all":
+		status = ""
+	case services.UnmatchedStatusPending, services.UnmatchedStatusAssigned, services.UnmatchedStatusDismissed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be one of pending, assigned, dismissed, all"})
+		return
+	}
+
+	emails, err := h.EmailService.ListUnmatchedEmails(userID, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "data": emails})
+}
+
+// AssignUnmatchedEmail files an unmatched email as a reply to one of the
+// user's projects, optionally for an explicitly chosen teacher
+func (h *UnmatchedHandler) AssignUnmatchedEmail(c *gin.Context) {
+	userID := c.GetInt("userID")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	var req struct {
+		ProjectID int  `json:"project_id" binding:"required"`
+		TeacherID *int `json:"teacher_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Verify ownership
+	var count int
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ? AND created_by = ?", req.ProjectID, userID).Scan(&count)
+	if err != nil || count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Project not found or access denied"})
+		return
+	}
+
+	var teacherID sql.NullInt64
+	if req.TeacherID != nil {
+		err = db.DB.QueryRow("SELECT COUNT(*) FROM teachers WHERE id = ?", *req.TeacherID).Scan(&count)
+		if err != nil || count == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Teacher not found"})
+			return
+		}
+		teacherID = sql.NullInt64{Int64: int64(*req.TeacherID), Valid: true}
+	}
+
+	replyID, err := h.EmailService.AssignUnmatchedEmail(userID, id, req.ProjectID, teacherID)
+	if err != nil {
+		if errors.Is(err, services.ErrUnmatchedEmailNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrUnmatchedEmailUnreadable) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign email: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 200, "message": "Email assigned", "data": gin.H{"reply_id": replyID}})
+}
+
+// DismissUnmatchedEmail removes an unmatched email from the triage queue
+func (h *UnmatchedHandler) DismissUnmatchedEmail(c *gin.Context) {
+	userID := c.GetInt("userID")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID"})
+		return
+	}
+
+	if err := h.EmailService.DismissUnmatchedEmail(userID, id); err != nil {
+		if errors.Is(err, services.ErrUnmatchedEmailNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 200, "message": "Email dismissed"})
+}
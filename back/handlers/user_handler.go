@@ -3,7 +3,9 @@ package handlers
 import (
 	"database/sql"
 	"db_intro_backend/db"
+	"db_intro_backend/services"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,11 +22,19 @@ func UpdateEmailConfig(c *gin.Context) {
 		SMTPPort     string `json:"smtp_port"`
 		SMTPUsername string `json:"smtp_username"`
 		SMTPPassword string `json:"smtp_password"`
+		SMTPSecurity string `json:"smtp_security"`
+		SMTPInsecure bool   `json:"smtp_skip_verify"`
+		MailProtocol string `json:"mail_protocol"` // imap | pop3, both use the imap_* settings
 		IMAPHost     string `json:"imap_host"`
 		IMAPPort     string `json:"imap_port"`
 		IMAPUsername string `json:"imap_username"`
 		IMAPPassword string `json:"imap_password"`
 		EmailAddress string `json:"email_address"`
+		PlusAddress  bool   `json:"plus_addressing"`
+		// What to do with processed messages on the IMAP server
+		MailboxAction   string `json:"mailbox_action"`
+		ProcessedFolder string `json:"processed_folder"`
+		UnmatchedFolder string `json:"unmatched_folder"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -32,13 +42,30 @@ func UpdateEmailConfig(c *gin.Context) {
 		return
 	}
 
+	if !services.ValidSMTPSecurity(input.SMTPSecurity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "smtp_security must be one of tls, starttls, none"})
+		return
+	}
+	if !services.ValidMailProtocol(input.MailProtocol) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mail_protocol must be one of imap, pop3"})
+		return
+	}
+	if !services.ValidMailboxAction(input.MailboxAction) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mailbox_action must be one of none, move, flag"})
+		return
+	}
+
 	_, err := db.DB.Exec(`
 		UPDATE users 
-		SET smtp_host=?, smtp_port=?, smtp_username=?, smtp_password=?, 
-			imap_host=?, imap_port=?, imap_username=?, imap_password=?, email_address=?
+		SET smtp_host=?, smtp_port=?, smtp_username=?, smtp_password=?, smtp_security=?, smtp_skip_verify=?,
+			imap_host=?, imap_port=?, imap_username=?, imap_password=?, email_address=?, plus_addressing=?,
+			mailbox_action=?, processed_folder=?, unmatched_folder=?, mail_protocol=?
 		WHERE id=?`,
 		input.SMTPHost, input.SMTPPort, input.SMTPUsername, input.SMTPPassword,
-		input.IMAPHost, input.IMAPPort, input.IMAPUsername, input.IMAPPassword, input.EmailAddress,
+		input.SMTPSecurity, input.SMTPInsecure,
+		input.IMAPHost, input.IMAPPort, input.IMAPUsername, input.IMAPPassword, input.EmailAddress, input.PlusAddress,
+		services.ResolveMailboxAction(input.MailboxAction), strings.TrimSpace(input.ProcessedFolder), strings.TrimSpace(input.UnmatchedFolder),
+		services.ResolveMailProtocol(input.MailProtocol),
 		userID,
 	)
 
@@ -58,13 +85,20 @@ func GetEmailConfig(c *gin.Context) {
 	}
 
 	var (
-		smtpHost     string
-		smtpPort     string
-		smtpUsername string
-		imapHost     string
-		imapPort     string
-		imapUsername string
-		emailAddress string
+		smtpHost        string
+		smtpPort        string
+		smtpUsername    string
+		smtpSecurity    string
+		smtpInsecure    bool
+		imapHost        string
+		imapPort        string
+		imapUsername    string
+		emailAddress    string
+		plusAddress     bool
+		mailboxAction   string
+		processedFolder string
+		unmatchedFolder string
+		mailProtocol    string
 	)
 
 	// Use COALESCE to handle NULLs
@@ -73,13 +107,21 @@ func GetEmailConfig(c *gin.Context) {
 			COALESCE(smtp_host, ''), 
 			COALESCE(smtp_port, ''), 
 			COALESCE(smtp_username, ''), 
+			COALESCE(smtp_security, ''), 
+			COALESCE(smtp_skip_verify, FALSE), 
 			COALESCE(imap_host, ''), 
 			COALESCE(imap_port, ''), 
 			COALESCE(imap_username, ''), 
-			COALESCE(email_address, '') 
+			COALESCE(email_address, ''),
+			COALESCE(plus_addressing, FALSE),
+			COALESCE(mailbox_action, ''),
+			COALESCE(processed_folder, ''),
+			COALESCE(unmatched_folder, ''),
+			COALESCE(mail_protocol, '')
 		FROM users WHERE id = ?`, userID).Scan(
-		&smtpHost, &smtpPort, &smtpUsername,
-		&imapHost, &imapPort, &imapUsername, &emailAddress,
+		&smtpHost, &smtpPort, &smtpUsername, &smtpSecurity, &smtpInsecure,
+		&imapHost, &imapPort, &imapUsername, &emailAddress, &plusAddress,
+		&mailboxAction, &processedFolder, &unmatchedFolder, &mailProtocol,
 	)
 
 	if err != nil {
@@ -90,14 +132,21 @@ func GetEmailConfig(c *gin.Context) {
 	hasConfig := smtpHost != "" && emailAddress != ""
 
 	c.JSON(http.StatusOK, gin.H{
-		"smtp_host":     smtpHost,
-		"smtp_port":     smtpPort,
-		"smtp_username": smtpUsername,
-		"imap_host":     imapHost,
-		"imap_port":     imapPort,
-		"imap_username": imapUsername,
-		"email_address": emailAddress,
-		"has_config":    hasConfig,
+		"smtp_host":        smtpHost,
+		"smtp_port":        smtpPort,
+		"smtp_username":    smtpUsername,
+		"smtp_security":    smtpSecurity, // empty: derived from the port when sending
+		"smtp_skip_verify": smtpInsecure,
+		"mail_protocol":    services.ResolveMailProtocol(mailProtocol),
+		"imap_host":        imapHost,
+		"imap_port":        imapPort,
+		"imap_username":    imapUsername,
+		"email_address":    emailAddress,
+		"plus_addressing":  plusAddress,
+		"mailbox_action":   services.ResolveMailboxAction(mailboxAction),
+		"processed_folder": processedFolder,
+		"unmatched_folder": unmatchedFolder,
+		"has_config":       hasConfig,
 	})
 }
 
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"db_intro_backend/db"
+	"db_intro_backend/services"
+)
+
+// runImportCommand ingests .eml files and mbox archives for a user from the
+// command line and prints the report:
+//
+//	./main import-emails -user admin -dry-run replies.mbox forwarded.eml
+func runImportCommand(emailService *services.EmailService, args []string) error {
+	fs := flag.NewFlagSet("import-emails", flag.ExitOnError)
+	username := fs.String("user", "", "user whose projects the messages are matched against")
+	dryRun := fs.Bool("dry-run", false, "only report what would be matched, store nothing")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main import-emails -user <username> [-dry-run] <file.eml|file.mbox>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *username == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("a user and at least one file are required")
+	}
+
+	var userID int
+	if err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", *username).Scan(&userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %q not found", *username)
+		}
+		return err
+	}
+	user, err := services.LoadUserEmailConfig(userID)
+	if err != nil {
+		return err
+	}
+
+	report := services.NewImportReport(*dryRun)
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = emailService.ImportMessages(user, f, filepath.Base(path), *dryRun, report)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", path, err)
+		}
+	}
+
+	for _, m := range report.Messages {
+		target := "-"
+		if m.Project != nil {
+			target = fmt.Sprintf("%s (%s)", m.Project.Name, m.Project.Code)
+			if m.TeacherName != "" {
+				target += " / " + m.TeacherName
+			}
+			target += " via " + m.MatchMethod
+		} else if len(m.CandidateProjects) > 0 {
+			target = fmt.Sprintf("%d candidate projects", len(m.CandidateProjects))
+		}
+		fmt.Printf("%-10s %-24s %-30s %q -> %s", m.Outcome, m.Source, m.From, m.Subject, target)
+		if m.Error != "" {
+			fmt.Printf(" [%s]", m.Error)
+		}
+		fmt.Println()
+	}
+
+	outcomes := make([]string, 0, len(report.Counts))
+	for outcome := range report.Counts {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+	if *dryRun {
+		fmt.Print("Dry run, nothing stored. ")
+	}
+	fmt.Printf("%d messages:", len(report.Messages))
+	for _, outcome := range outcomes {
+		fmt.Printf(" %s=%d", outcome, report.Counts[outcome])
+	}
+	fmt.Println()
+	return nil
+}
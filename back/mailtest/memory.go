@@ -0,0 +1,131 @@
+// Package mailtest provides in-process stand-ins for the mail servers used by
+// services.EmailService: an in-memory Mailer and MailboxReader, and a
+// loopback SMTP/IMAP server for exercising the real SMTPMailer and
+// IMAPReader. None of them touch the network beyond 127.0.0.1.
+package mailtest
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+)
+
+// SentMessage is a message handed to a MemoryMailer
+type SentMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// MemoryMailer records messages instead of sending them. When Mailbox is
+// set every message is also delivered to its recipients' mailboxes there.
+type MemoryMailer struct {
+	Mailbox *MemoryMailbox
+	// Err, when set, is returned by Send to simulate a failing server
+	Err error
+
+	mu   sync.Mutex
+	sent []SentMessage
+}
+
+func (m *MemoryMailer) Send(user models.User, from string, to []string, msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+
+	data := append([]byte(nil), msg...)
+	m.sent = append(m.sent, SentMessage{From: from, To: append([]string(nil), to...), Data: data})
+	if m.Mailbox != nil {
+		for _, rcpt := range to {
+			m.Mailbox.Deliver(rcpt, data)
+		}
+	}
+	return nil
+}
+
+// Sent returns a copy of the messages sent so far
+func (m *MemoryMailer) Sent() []SentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentMessage(nil), m.sent...)
+}
+
+// MemoryMailbox holds one INBOX per address and serves it to a user by
+// their EmailAddress, assigning UIDs like an IMAP server would.
+type MemoryMailbox struct {
+	mu          sync.Mutex
+	uidValidity uint32
+	boxes       map[string]*memoryBox
+}
+
+type memoryBox struct {
+	nextUID  uint32
+	messages []memoryMessage
+}
+
+type memoryMessage struct {
+	uid  uint32
+	data []byte
+}
+
+func NewMemoryMailbox() *MemoryMailbox {
+	return &MemoryMailbox{uidValidity: 1, boxes: make(map[string]*memoryBox)}
+}
+
+// Deliver appends a message to the address's INBOX and returns its UID
+func (m *MemoryMailbox) Deliver(to string, msg []byte) uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := strings.ToLower(to)
+	box, ok := m.boxes[key]
+	if !ok {
+		box = &memoryBox{nextUID: 1}
+		m.boxes[key] = box
+	}
+	uid := box.nextUID
+	box.nextUID++
+	box.messages = append(box.messages, memoryMessage{uid: uid, data: append([]byte(nil), msg...)})
+	return uid
+}
+
+// SetUIDValidity changes the UIDVALIDITY reported to readers, as a server
+// does after rebuilding a mailbox.
+func (m *MemoryMailbox) SetUIDValidity(v uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uidValidity = v
+}
+
+func (m *MemoryMailbox) Fetch(user models.User, state models.MailboxSyncState, handle func(services.RawMessage) error) (models.MailboxSyncState, error) {
+	m.mu.Lock()
+	next := state
+	if next.UIDValidity != m.uidValidity {
+		next.UIDValidity = m.uidValidity
+		next.LastUID = 0
+	}
+
+	var raws []services.RawMessage
+	if box, ok := m.boxes[strings.ToLower(user.EmailAddress)]; ok {
+		for _, msg := range box.messages {
+			if msg.uid > next.LastUID {
+				raws = append(raws, services.RawMessage{UID: msg.uid, Body: bytes.NewReader(msg.data)})
+			}
+		}
+	}
+	// handle may take a while, so the mailbox is not kept locked
+	m.mu.Unlock()
+
+	for _, raw := range raws {
+		if err := handle(raw); err != nil {
+			return next, err
+		}
+		next.LastUID = raw.UID
+	}
+	return next, nil
+}
@@ -0,0 +1,85 @@
+package mailtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Attachment is a file attached to a message built by BuildReply
+type Attachment struct {
+	Filename string
+	Data     []byte
+}
+
+// BuildReply composes the message a teacher would send in reply to original:
+// addressed to its sender, with In-Reply-To and References pointing at it.
+func BuildReply(original []byte, from, body string, attachments ...Attachment) ([]byte, error) {
+	orig, err := mail.ReadMessage(bytes.NewReader(original))
+	if err != nil {
+		return nil, fmt.Errorf("mailtest: failed to parse original message: %w", err)
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(orig.Header.Get("Subject"))
+	if err != nil {
+		subject = orig.Header.Get("Subject")
+	}
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	origID := orig.Header.Get("Message-ID")
+	references := strings.TrimSpace(orig.Header.Get("References") + " " + origID)
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", orig.Header.Get("From"))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.BEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%d.reply@mailtest>\r\n", time.Now().UnixNano())
+	fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", origID)
+	fmt.Fprintf(&buf, "References: %s\r\n", references)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n", writer.Boundary())
+	fmt.Fprintf(&buf, "\r\n")
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte(body))
+
+	for _, att := range attachments {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/octet-stream"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(att.Data)
+		for i := 0; i < len(encoded); i += 76 {
+			end := i + 76
+			if end > len(encoded) {
+				end = len(encoded)
+			}
+			part.Write([]byte(encoded[i:end] + "\r\n"))
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
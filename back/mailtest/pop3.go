@@ -0,0 +1,152 @@
+package mailtest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// pop3Message is a message as listed to a POP3 client
+type pop3Message struct {
+	uidl string
+	body []byte
+}
+
+// pop3Server is a minimal POP3 server (USER/PASS, STAT, LIST, UIDL, RETR, TOP)
+// over the INBOX of the IMAP accounts. Each session sees the INBOX as it was
+// at login, like a maildrop lock on a real server. Messages cannot be
+// deleted over POP3.
+type pop3Server struct {
+	ln       net.Listener
+	checkPwd func(username, password string) bool
+	messages func(address string) []pop3Message
+}
+
+func (s *pop3Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *pop3Server) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("+OK mailtest POP3 ready")
+
+	var username string
+	var messages []pop3Message
+	loggedIn := false
+
+	// message resolves a 1-based message number argument
+	message := func(arg string) (int, bool) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(messages) {
+			tp.PrintfLine("-ERR no such message")
+			return 0, false
+		}
+		return n, true
+	}
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+
+		if !loggedIn {
+			switch verb {
+			case "CAPA":
+				tp.PrintfLine("+OK capability list follows")
+				tp.PrintfLine("USER")
+				tp.PrintfLine("UIDL")
+				tp.PrintfLine("TOP")
+				tp.PrintfLine(".")
+			case "USER":
+				username = arg
+				tp.PrintfLine("+OK")
+			case "PASS":
+				if username == "" || !s.checkPwd(username, arg) {
+					tp.PrintfLine("-ERR bad username or password")
+					continue
+				}
+				loggedIn = true
+				messages = s.messages(username)
+				tp.PrintfLine("+OK %d messages", len(messages))
+			case "QUIT":
+				tp.PrintfLine("+OK bye")
+				return
+			default:
+				tp.PrintfLine("-ERR not logged in")
+			}
+			continue
+		}
+
+		switch verb {
+		case "STAT":
+			size := 0
+			for _, m := range messages {
+				size += len(m.body)
+			}
+			tp.PrintfLine("+OK %d %d", len(messages), size)
+		case "LIST", "UIDL":
+			if arg != "" {
+				if n, ok := message(arg); ok {
+					tp.PrintfLine("+OK %d %s", n, pop3Column(verb, messages[n-1]))
+				}
+				continue
+			}
+			tp.PrintfLine("+OK")
+			for i, m := range messages {
+				tp.PrintfLine("%d %s", i+1, pop3Column(verb, m))
+			}
+			tp.PrintfLine(".")
+		case "RETR":
+			n, ok := message(arg)
+			if !ok {
+				continue
+			}
+			tp.PrintfLine("+OK %d octets", len(messages[n-1].body))
+			w := tp.DotWriter()
+			w.Write(messages[n-1].body)
+			w.Close()
+		case "TOP":
+			// Only the header: the line count argument is ignored
+			num, _, _ := strings.Cut(arg, " ")
+			n, ok := message(num)
+			if !ok {
+				continue
+			}
+			body := messages[n-1].body
+			if end := bytes.Index(body, []byte("\r\n\r\n")); end >= 0 {
+				body = body[:end+4]
+			}
+			tp.PrintfLine("+OK")
+			w := tp.DotWriter()
+			w.Write(body)
+			w.Close()
+		case "NOOP", "RSET":
+			tp.PrintfLine("+OK")
+		case "QUIT":
+			tp.PrintfLine("+OK bye")
+			return
+		default:
+			tp.PrintfLine("-ERR unsupported command")
+		}
+	}
+}
+
+func pop3Column(verb string, m pop3Message) string {
+	if verb == "LIST" {
+		return fmt.Sprint(len(m.body))
+	}
+	return m.uidl
+}
@@ -0,0 +1,392 @@
+package mailtest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+
+	"github.com/emersion/go-imap"
+	imapid "github.com/emersion/go-imap-id"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// Server runs SMTP servers and implicit-TLS IMAP and POP3 servers on
+// loopback ports. SMTPAddr is plaintext only, SMTPStartTLSAddr requires
+// STARTTLS before AUTH and SMTPTLSAddr uses implicit TLS. Mail accepted over
+// SMTP lands in the INBOX of each recipient account, so a message sent by
+// one account can be fetched by another through the production SMTPMailer,
+// IMAPReader and POP3Reader.
+type Server struct {
+	SMTPAddr         string
+	SMTPStartTLSAddr string
+	SMTPTLSAddr      string
+	IMAPAddr         string
+	POP3Addr         string
+
+	smtpLn  []net.Listener
+	imapLn  net.Listener
+	pop3Ln  net.Listener
+	imap    *imapserver.Server
+	backend *imapBackend
+	roots   *x509.CertPool
+}
+
+// NewServer starts all servers; call Close when done
+func NewServer() (*Server, error) {
+	cert, roots, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+
+	be := &imapBackend{accounts: make(map[string]*imapAccount), updates: make(chan backend.Update, 16)}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	imapLn, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	pop3Ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		imapLn.Close()
+		return nil, err
+	}
+	var smtpLn []net.Listener
+	for _, secure := range []bool{false, false, true} {
+		var ln net.Listener
+		if secure {
+			ln, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		} else {
+			ln, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+		if err != nil {
+			imapLn.Close()
+			pop3Ln.Close()
+			for _, l := range smtpLn {
+				l.Close()
+			}
+			return nil, err
+		}
+		smtpLn = append(smtpLn, ln)
+	}
+
+	srv := &Server{
+		SMTPAddr:         smtpLn[0].Addr().String(),
+		SMTPStartTLSAddr: smtpLn[1].Addr().String(),
+		SMTPTLSAddr:      smtpLn[2].Addr().String(),
+		IMAPAddr:         imapLn.Addr().String(),
+		POP3Addr:         pop3Ln.Addr().String(),
+		smtpLn:           smtpLn,
+		imapLn:           imapLn,
+		pop3Ln:           pop3Ln,
+		backend:          be,
+		roots:            roots,
+	}
+
+	srv.imap = imapserver.New(be)
+	srv.imap.Enable(imapid.NewExtension(imapid.ID{imapid.FieldName: "mailtest"}))
+	go srv.imap.Serve(imapLn)
+
+	deliver := func(from string, to []string, data []byte) {
+		for _, rcpt := range to {
+			be.deliver(rcpt, data)
+		}
+	}
+	for i, ln := range smtpLn {
+		smtp := &smtpServer{ln: ln, accept: be.hasAccount, checkPwd: be.checkPassword, deliver: deliver}
+		if i == 1 {
+			smtp.startTLS = tlsConfig
+		}
+		go smtp.serve()
+	}
+
+	pop3 := &pop3Server{ln: pop3Ln, checkPwd: be.checkPassword, messages: be.inboxMessages}
+	go pop3.serve()
+
+	return srv, nil
+}
+
+// AddAccount creates a mailbox that can log in over IMAP and SMTP with the
+// address as username
+func (s *Server) AddAccount(address, password string) error {
+	return s.backend.addAccount(address, password)
+}
+
+// Deliver drops a message straight into an account's INBOX
+func (s *Server) Deliver(to string, msg []byte) error {
+	if !s.backend.deliver(to, msg) {
+		return errors.New("mailtest: no such account: " + to)
+	}
+	return nil
+}
+
+// User returns an email configuration pointing at this server for an
+// account created with AddAccount
+func (s *Server) User(address, password string) models.User {
+	smtpHost, smtpPort, _ := net.SplitHostPort(s.SMTPAddr)
+	imapHost, imapPort, _ := net.SplitHostPort(s.IMAPAddr)
+	return models.User{
+		SMTPHost:     smtpHost,
+		SMTPPort:     smtpPort,
+		SMTPUsername: address,
+		SMTPPassword: password,
+		SMTPSecurity: services.SMTPSecurityNone,
+		IMAPHost:     imapHost,
+		IMAPPort:     imapPort,
+		IMAPUsername: address,
+		IMAPPassword: password,
+		EmailAddress: address,
+	}
+}
+
+// POP3User is like User but reads the mailbox over POP3
+func (s *Server) POP3User(address, password string) models.User {
+	user := s.User(address, password)
+	user.MailProtocol = services.MailProtocolPOP3
+	user.IMAPHost, user.IMAPPort, _ = net.SplitHostPort(s.POP3Addr)
+	return user
+}
+
+// SMTPMailer returns a mailer that trusts this server's certificate
+func (s *Server) SMTPMailer() *services.SMTPMailer {
+	return &services.SMTPMailer{TLSConfig: &tls.Config{RootCAs: s.roots}}
+}
+
+// IMAPReader returns a reader that trusts this server's certificate
+func (s *Server) IMAPReader() *services.IMAPReader {
+	return &services.IMAPReader{TLSConfig: &tls.Config{RootCAs: s.roots}}
+}
+
+// POP3Reader returns a reader that trusts this server's certificate
+func (s *Server) POP3Reader() *services.POP3Reader {
+	return &services.POP3Reader{TLSConfig: &tls.Config{RootCAs: s.roots}}
+}
+
+// Flags returns the flags of the messages in an account's mailbox, by
+// Message-ID
+func (s *Server) Flags(address, mailbox string) (map[string][]string, error) {
+	return s.backend.flags(address, mailbox)
+}
+
+func (s *Server) Close() error {
+	for _, ln := range s.smtpLn {
+		ln.Close()
+	}
+	s.pop3Ln.Close()
+	return s.imap.Close()
+}
+
+type imapBackend struct {
+	mu       sync.Mutex
+	accounts map[string]*imapAccount
+	updates  chan backend.Update
+}
+
+// Updates lets the server push new-mail notifications to IDLE clients
+func (b *imapBackend) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+type imapAccount struct {
+	password string
+	user     backend.User
+	inbox    *memory.Mailbox
+	nextUID  uint32
+}
+
+func (b *imapBackend) addAccount(address, password string) error {
+	// Each account is a go-imap memory backend user with its sample message removed
+	mem := memory.New()
+	user, err := mem.Login(nil, "username", "password")
+	if err != nil {
+		return err
+	}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		return err
+	}
+	inbox := mbox.(*memory.Mailbox)
+	inbox.Messages = nil
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.accounts[strings.ToLower(address)] = &imapAccount{password: password, user: moveUser{user}, inbox: inbox, nextUID: 1}
+	return nil
+}
+
+// moveUser hands out mailboxes that implement MOVE, which the server
+// advertises but the memory backend lacks, and that mark messages read when
+// their body is fetched without PEEK, as real servers do
+type moveUser struct {
+	backend.User
+}
+
+func (u moveUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return moveMailbox{mbox}, nil
+}
+
+type moveMailbox struct {
+	backend.Mailbox
+}
+
+func (m moveMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	for _, item := range items {
+		if section, err := imap.ParseBodySectionName(item); err == nil && !section.Peek {
+			if err := m.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.SeenFlag}); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return m.Mailbox.ListMessages(uid, seqset, items, ch)
+}
+
+func (m moveMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := m.CopyMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+	if err := m.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	return m.Expunge()
+}
+
+func (b *imapBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	acct, ok := b.accounts[strings.ToLower(username)]
+	if !ok || acct.password != password {
+		return nil, errors.New("bad username or password")
+	}
+	return acct.user, nil
+}
+
+func (b *imapBackend) hasAccount(address string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.accounts[strings.ToLower(address)]
+	return ok
+}
+
+func (b *imapBackend) checkPassword(username, password string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	acct, ok := b.accounts[strings.ToLower(username)]
+	return ok && acct.password == password
+}
+
+// deliver appends to the INBOX with a strictly increasing UID, unlike the
+// memory backend which reuses the UID of an expunged last message
+func (b *imapBackend) deliver(to string, data []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	acct, ok := b.accounts[strings.ToLower(to)]
+	if !ok {
+		return false
+	}
+	acct.inbox.Messages = append(acct.inbox.Messages, &memory.Message{
+		Uid:  acct.nextUID,
+		Date: time.Now(),
+		Size: uint32(len(data)),
+		Body: append([]byte(nil), data...),
+	})
+	acct.nextUID++
+
+	status := imap.NewMailboxStatus("INBOX", []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(acct.inbox.Messages))
+	select {
+	case b.updates <- &backend.MailboxUpdate{Update: backend.NewUpdate(acct.user.Username(), "INBOX"), MailboxStatus: status}:
+	default:
+	}
+	return true
+}
+
+// flags returns the flags of the messages in an account's mailbox by
+// Message-ID
+func (b *imapBackend) flags(address, mailbox string) (map[string][]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	acct, ok := b.accounts[strings.ToLower(address)]
+	if !ok {
+		return nil, errors.New("mailtest: no such account: " + address)
+	}
+	mbox, err := acct.user.(moveUser).User.GetMailbox(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[string][]string)
+	for _, m := range mbox.(*memory.Mailbox).Messages {
+		msg, err := mail.ReadMessage(bytes.NewReader(m.Body))
+		if err != nil {
+			return nil, err
+		}
+		flags[msg.Header.Get("Message-Id")] = m.Flags
+	}
+	return flags, nil
+}
+
+// inboxMessages snapshots an account's INBOX for a POP3 session; the IMAP
+// UID doubles as the UIDL
+func (b *imapBackend) inboxMessages(address string) []pop3Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	acct, ok := b.accounts[strings.ToLower(address)]
+	if !ok {
+		return nil
+	}
+	messages := make([]pop3Message, 0, len(acct.inbox.Messages))
+	for _, m := range acct.inbox.Messages {
+		messages = append(messages, pop3Message{uidl: fmt.Sprintf("mailtest-%d", m.Uid), body: m.Body})
+	}
+	return messages
+}
+
+func selfSignedCert() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mailtest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots, nil
+}
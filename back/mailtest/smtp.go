@@ -0,0 +1,144 @@
+package mailtest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// smtpServer is a minimal SMTP server that accepts AUTH PLAIN and hands
+// every accepted message to deliver. Recipients rejected by deliver get a
+// 550, like an unknown mailbox on a real server. With startTLS set it offers
+// STARTTLS and refuses AUTH until the connection is upgraded.
+type smtpServer struct {
+	ln       net.Listener
+	startTLS *tls.Config
+	accept   func(rcpt string) bool
+	deliver  func(from string, to []string, data []byte)
+	checkPwd func(username, password string) bool
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 mailtest ESMTP ready")
+	_, secure := conn.(*tls.Conn)
+
+	var from string
+	var to []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			tp.PrintfLine("250-mailtest")
+			tp.PrintfLine("250-8BITMIME")
+			if s.startTLS != nil && !secure {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "HELO":
+			tp.PrintfLine("250 mailtest")
+		case "STARTTLS":
+			if s.startTLS == nil || secure {
+				tp.PrintfLine("502 command not implemented")
+				continue
+			}
+			tp.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.startTLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			// The client starts over with EHLO on the encrypted connection
+			conn, tp, secure = tlsConn, textproto.NewConn(tlsConn), true
+			from, to = "", nil
+		case "AUTH":
+			if s.startTLS != nil && !secure {
+				tp.PrintfLine("530 must issue STARTTLS first")
+				continue
+			}
+			mech, initial, _ := strings.Cut(arg, " ")
+			if !strings.EqualFold(mech, "PLAIN") {
+				tp.PrintfLine("504 unsupported mechanism")
+				continue
+			}
+			if initial == "" {
+				tp.PrintfLine("334 ")
+				if initial, err = tp.ReadLine(); err != nil {
+					return
+				}
+			}
+			creds, err := base64.StdEncoding.DecodeString(initial)
+			parts := bytes.Split(creds, []byte{0})
+			if err != nil || len(parts) != 3 || !s.checkPwd(string(parts[1]), string(parts[2])) {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			from = extractPath(arg)
+			to = nil
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			rcpt := extractPath(arg)
+			if !s.accept(rcpt) {
+				tp.PrintfLine("550 no such user: %s", rcpt)
+				continue
+			}
+			to = append(to, rcpt)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			if len(to) == 0 {
+				tp.PrintfLine("554 no valid recipients")
+				continue
+			}
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			// ReadDotBytes normalises line endings to \n; restore CRLF
+			data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+			s.deliver(from, to, data)
+			from, to = "", nil
+			tp.PrintfLine("250 OK: queued")
+		case "RSET":
+			from, to = "", nil
+			tp.PrintfLine("250 OK")
+		case "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// extractPath returns the address of "FROM:<a@b> ..." or "TO:<a@b>"
+func extractPath(arg string) string {
+	start := strings.Index(arg, "<")
+	end := strings.Index(arg, ">")
+	if start == -1 || end < start {
+		_, addr, _ := strings.Cut(arg, ":")
+		return strings.TrimSpace(addr)
+	}
+	return arg[start+1 : end]
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
-	"strconv"
+	"os"
 	"time"
 
 	"db_intro_backend/config"
@@ -27,13 +27,32 @@ func main() {
 	// Init Services
 	emailService := services.NewEmailService(cfg)
 	excelService := services.NewExcelService()
+	outboxService := services.NewOutboxService(cfg, emailService)
 
 	// Init Handlers
-	projectHandler := handlers.NewProjectHandler(emailService, excelService)
+	projectHandler := handlers.NewProjectHandler(emailService, excelService, outboxService)
+	jobHandler := handlers.NewJobHandler(outboxService)
+	unmatchedHandler := handlers.NewUnmatchedHandler(emailService)
+	importHandler := handlers.NewImportHandler(emailService)
+
+	// Command line mode: ./main import-emails -user <name> [-dry-run] <files...>
+	if len(os.Args) > 1 && os.Args[1] == "import-emails" {
+		if err := runImportCommand(emailService, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Start outbound mail worker
+	outboxService.Start()
 
 	// Start Scheduler
 	if utils.GetEnv("ENABLE_EMAIL_SCHEDULER", "true") == "true" {
-		startEmailFetchScheduler(emailService)
+		if cfg.IMAPIdle {
+			services.NewIdleWatcher(cfg, emailService).Start()
+		} else {
+			startEmailFetchScheduler(cfg, emailService)
+		}
 	}
 
 	r := gin.Default()
@@ -76,10 +95,34 @@ func main() {
 			protected.POST("/projects/:id/members", projectHandler.AddProjectMembers)
 			protected.POST("/projects/:id/dispatch", projectHandler.DispatchProject)
 			protected.GET("/projects/:id/tracking", projectHandler.GetProjectTracking)
+			protected.GET("/projects/:id/replies", projectHandler.GetProjectReplies)
 			protected.POST("/projects/:id/remind", projectHandler.RemindTeachers)
+			protected.GET("/projects/:id/outbox", projectHandler.GetProjectOutbox)
+			protected.POST("/projects/:id/outbox/retry", projectHandler.RetryProjectOutbox)
+			protected.GET("/projects/:id/jobs", jobHandler.GetProjectJobs)
 			protected.POST("/projects/:id/fetch-emails", projectHandler.FetchProjectEmails)
 			protected.POST("/projects/:id/aggregate", projectHandler.AggregateData)
 			protected.GET("/projects/:id/download", projectHandler.DownloadAggregated)
+			protected.GET("/projects/:id/data", projectHandler.GetProjectData)
+			protected.GET("/projects/:id/aggregation-settings", projectHandler.GetAggregationSettings)
+			protected.PUT("/projects/:id/aggregation-settings", projectHandler.UpdateAggregationSettings)
+			protected.GET("/projects/:id/validation-rules", projectHandler.GetValidationRules)
+			protected.PUT("/projects/:id/validation-rules", projectHandler.UpdateValidationRules)
+			protected.GET("/projects/:id/submissions", projectHandler.GetProjectSubmissions)
+			protected.POST("/projects/:id/submissions/:submissionId/pin", projectHandler.PinSubmission)
+			protected.DELETE("/projects/:id/submissions/:submissionId/pin", projectHandler.UnpinSubmission)
+
+			// Dispatch / reminder jobs
+			protected.GET("/jobs/:id", jobHandler.GetJob)
+			protected.GET("/jobs/:id/events", jobHandler.StreamJob)
+
+			// Unmatched email triage
+			protected.GET("/unmatched-emails", unmatchedHandler.GetUnmatchedEmails)
+			protected.POST("/unmatched-emails/:id/assign", unmatchedHandler.AssignUnmatchedEmail)
+			protected.POST("/unmatched-emails/:id/dismiss", unmatchedHandler.DismissUnmatchedEmail)
+
+			// Import .eml files and mbox archives
+			protected.POST("/import-emails", importHandler.ImportEmails)
 		}
 	}
 
@@ -87,11 +130,9 @@ func main() {
 	r.Run(":" + cfg.Port)
 }
 
-func startEmailFetchScheduler(emailService *services.EmailService) {
-	// Get interval from environment (in minutes, default 10 minutes)
-	intervalStr := utils.GetEnv("EMAIL_FETCH_INTERVAL", "10")
-	interval, err := strconv.Atoi(intervalStr)
-	if err != nil {
+func startEmailFetchScheduler(cfg *config.Config, emailService *services.EmailService) {
+	interval := cfg.EmailFetchInterval
+	if interval <= 0 {
 		interval = 10
 	}
 
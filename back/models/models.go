@@ -1,21 +1,34 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	Password     string    `json:"-"` // Don't return password in JSON
-	SMTPHost     string    `json:"smtp_host"`
-	SMTPPort     string    `json:"smtp_port"`
-	SMTPUsername string    `json:"smtp_username"`
-	SMTPPassword string    `json:"-"` // Don't return smtp password in JSON
-	IMAPHost     string    `json:"imap_host"`
-	IMAPPort     string    `json:"imap_port"`
-	IMAPUsername string    `json:"imap_username"`
-	IMAPPassword string    `json:"-"` // Don't return imap password in JSON
-	EmailAddress string    `json:"email_address"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	Password     string `json:"-"` // Don't return password in JSON
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     string `json:"smtp_port"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"-"`             // Don't return smtp password in JSON
+	SMTPSecurity string `json:"smtp_security"` // tls | starttls | none
+	SMTPInsecure bool   `json:"smtp_skip_verify"`
+	MailProtocol string `json:"mail_protocol"` // imap | pop3, read with the imap_* server settings
+	IMAPHost     string `json:"imap_host"`
+	IMAPPort     string `json:"imap_port"`
+	IMAPUsername string `json:"imap_username"`
+	IMAPPassword string `json:"-"` // Don't return imap password in JSON
+	EmailAddress string `json:"email_address"`
+	// PlusAddressing sets Reply-To to email_address with a "+CODE" suffix when
+	// the project code only has letters, digits, "_" and "-"
+	PlusAddressing bool `json:"plus_addressing"`
+	// MailboxAction is applied to processed messages: none | move | flag
+	MailboxAction   string    `json:"mailbox_action"`
+	ProcessedFolder string    `json:"processed_folder"` // replies go to <ProcessedFolder>/<project code>
+	UnmatchedFolder string    `json:"unmatched_folder"`
+	CreatedAt       time.Time `json:"created_at"`
 }
 
 type Project struct {
@@ -33,13 +46,17 @@ type Project struct {
 }
 
 type Teacher struct {
-	ID             int       `json:"id"`
-	Name           string    `json:"name"`
-	Email          string    `json:"email"`
-	DepartmentID   *int      `json:"department_id"`
-	DepartmentName string    `json:"department_name,omitempty"`
-	Phone          string    `json:"phone"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Email          string `json:"email"`
+	DepartmentID   *int   `json:"department_id"`
+	DepartmentName string `json:"department_name,omitempty"`
+	Phone          string `json:"phone"`
+	// EmailStatus is "bounced" once mail to the address failed permanently
+	EmailStatus       string     `json:"email_status"`
+	EmailBounceReason string     `json:"email_bounce_reason,omitempty"`
+	EmailBouncedAt    *time.Time `json:"email_bounced_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
 }
 
 type Department struct {
@@ -57,28 +74,361 @@ type TrackingRecord struct {
 	ReplyTime  *string `json:"reply_time"`
 }
 
+// OutboundEmail is a message waiting in, or delivered through, the outbox
+type OutboundEmail struct {
+	ID             int        `json:"id"`
+	ProjectID      int        `json:"project_id"`
+	TeacherID      int        `json:"teacher_id"`
+	TeacherName    string     `json:"teacher_name,omitempty"`
+	UserID         int        `json:"-"`
+	JobID          int        `json:"job_id"`
+	DispatchID     *int       `json:"dispatch_id"`
+	Kind           string     `json:"kind"`
+	ToEmail        string     `json:"to_email"`
+	Subject        string     `json:"subject"`
+	Body           string     `json:"-"`
+	AttachmentPath string     `json:"-"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"last_error"`
+	MessageID      string     `json:"message_id"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	SentAt         *time.Time `json:"sent_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// EmailJob is one dispatch or reminder run; its counts are derived from the
+// outbound emails it queued
+type EmailJob struct {
+	ID           int            `json:"id"`
+	ProjectID    int            `json:"project_id"`
+	Kind         string         `json:"kind"`
+	Status       string         `json:"status"`
+	TotalCount   int            `json:"total_count"`
+	SentCount    int            `json:"sent_count"`
+	FailedCount  int            `json:"failed_count"`
+	PendingCount int            `json:"pending_count"`
+	StartedAt    *time.Time     `json:"started_at"`
+	FinishedAt   *time.Time     `json:"finished_at"`
+	CreatedAt    time.Time      `json:"created_at"`
+	Recipients   []JobRecipient `json:"recipients,omitempty"`
+}
+
+// JobRecipient is the delivery outcome of a job for a single teacher
+type JobRecipient struct {
+	TeacherID   int        `json:"teacher_id"`
+	TeacherName string     `json:"teacher_name"`
+	Email       string     `json:"email"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error"`
+	SentAt      *time.Time `json:"sent_at"`
+}
+
+// Reply is a teacher's email stored for a project
+type Reply struct {
+	ID          int               `json:"id"`
+	TeacherID   *int              `json:"teacher_id"`
+	TeacherName string            `json:"teacher_name"`
+	FromEmail   string            `json:"from_email"`
+	Subject     string            `json:"subject"`
+	MessageID   string            `json:"message_id"`
+	InReplyTo   string            `json:"in_reply_to"`
+	ReceivedAt  time.Time         `json:"received_at"`
+	BodyText    string            `json:"body_text"`
+	IsAutoReply bool              `json:"is_auto_reply"`
+	RawHeaders  json.RawMessage   `json:"raw_headers,omitempty"`
+	Attachments []ReplyAttachment `json:"attachments"`
+}
+
+// ReplyAttachment is a file received with a reply
+type ReplyAttachment struct {
+	ID               int    `json:"id"`
+	ParentID         *int   `json:"parent_id"` // archive attachment this file was extracted from
+	OriginalFilename string `json:"original_filename"`
+	ContentType      string `json:"content_type"`
+	FileSize         int64  `json:"file_size"`
+	Status           string `json:"status"` // stored | rejected
+	RejectReason     string `json:"reject_reason,omitempty"`
+	// ExtractError tells why an archive was not fully unpacked
+	ExtractError string `json:"extract_error,omitempty"`
+	// ValidationStatus is valid or invalid for Excel files checked against the
+	// project's validation rules, empty when not checked
+	ValidationStatus string            `json:"validation_status,omitempty"`
+	ValidationIssues []ValidationIssue `json:"validation_issues,omitempty"`
+	// ParseStatus is ok or failed once the file was read as a workbook
+	ParseStatus string `json:"parse_status,omitempty"`
+	ParseError  string `json:"parse_error,omitempty"`
+}
+
+// UnmatchedEmail is an incoming email that could not be attributed to a
+// project and waits for manual triage
+type UnmatchedEmail struct {
+	ID                int                   `json:"id"`
+	FromEmail         string                `json:"from_email"`
+	Subject           string                `json:"subject"`
+	MessageID         string                `json:"message_id"`
+	InReplyTo         string                `json:"in_reply_to"`
+	Body              string                `json:"body"`
+	ReceivedAt        time.Time             `json:"received_at"`
+	TeacherID         *int                  `json:"teacher_id"`
+	TeacherName       string                `json:"teacher_name,omitempty"`
+	CandidateProjects []ProjectRef          `json:"candidate_projects"`
+	Status            string                `json:"status"`
+	ProjectID         *int                  `json:"project_id"`
+	ReplyID           *int                  `json:"reply_id"`
+	IngestError       string                `json:"ingest_error,omitempty"` // why the message could not be read
+	Attachments       []UnmatchedAttachment `json:"attachments"`
+	CreatedAt         time.Time             `json:"created_at"`
+	ResolvedAt        *time.Time            `json:"resolved_at"`
+}
+
+// UnmatchedAttachment is a file received with an unmatched email
+type UnmatchedAttachment struct {
+	ID               int    `json:"id"`
+	OriginalFilename string `json:"original_filename"`
+	StoredPath       string `json:"-"`
+	ContentType      string `json:"content_type"`
+	FileSize         int64  `json:"file_size"`
+	Status           string `json:"status"` // stored | rejected
+	RejectReason     string `json:"reject_reason,omitempty"`
+}
+
+// ProjectRef identifies a project by id, code and name
+type ProjectRef struct {
+	ID   int    `json:"id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
 type AttachmentMeta struct {
+	ID           int
 	StoredPath   string
 	OriginalName string
 	TeacherName  string
 	TeacherEmail string
+	Department   string
+	ReplyTime    *time.Time // when the reply carrying the file was received
+	Parsed       bool       // its rows are in submission_rows
+}
+
+// AggregationSettings configures how a project's submissions are merged,
+// stored as JSON in projects.aggregation_settings
+type AggregationSettings struct {
+	// ColumnAliases maps a template header to other headers teachers use for
+	// the same column
+	ColumnAliases map[string][]string `json:"column_aliases"`
+	// ProvenanceColumns are written before the data columns, in this order:
+	// teacher_name | teacher_email | department | reply_time | source_file
+	ProvenanceColumns []string `json:"provenance_columns"`
+	// OrderBy is empty for the order submissions arrived in, or "department"
+	// for department then teacher
+	OrderBy string `json:"order_by"`
+	// Formulas is empty to write the results of formulas, or "preserve" to
+	// keep formulas that only refer to cells of their own row
+	Formulas string `json:"formulas"`
+	// Summaries are written as extra sheets after the aggregated rows
+	Summaries []SummarySpec `json:"summaries"`
+}
+
+// SummarySpec is a summary sheet: the aggregated rows grouped by some
+// columns, with totals of numeric columns per group
+type SummarySpec struct {
+	Name string `json:"name"` // sheet name, e.g. "By Department"
+	// GroupBy are template headers or provenance columns (teacher_name,
+	// teacher_email, department)
+	GroupBy  []string         `json:"group_by"`
+	Measures []SummaryMeasure `json:"measures"`
+}
+
+// SummaryMeasure is one computed column of a summary sheet
+type SummaryMeasure struct {
+	Func   string `json:"func"`            // sum | count | avg | min | max
+	Column string `json:"column"`          // numeric column; empty for count counts rows
+	Label  string `json:"label,omitempty"` // header, generated when empty
+}
+
+// ValidationRules are checked against every Excel attachment of a project
+// when it is received, stored as JSON in projects.validation_rules
+type ValidationRules struct {
+	Columns []ColumnRule `json:"columns"`
+	MinRows int          `json:"min_rows"` // data rows, 0 for no limit
+	MaxRows int          `json:"max_rows"`
+	// SendFeedback emails the teacher the cells that failed
+	SendFeedback bool `json:"send_feedback"`
+}
+
+// ColumnRule constrains one template column
+type ColumnRule struct {
+	Header   string   `json:"header"`
+	Required bool     `json:"required"`      // the column must exist and every data row must fill it
+	Type     string   `json:"type"`          // text | number | date | enum
+	Min      string   `json:"min,omitempty"` // lower bound for number and date columns
+	Max      string   `json:"max,omitempty"`
+	Values   []string `json:"values,omitempty"` // allowed values of an enum column
+}
+
+// ValidationIssue is one failed check; Cell is empty for problems with the
+// sheet as a whole, such as a missing column or too few rows
+type ValidationIssue struct {
+	Cell    string `json:"cell,omitempty"`
+	Column  string `json:"column,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// AggregationResult describes a generated workbook
+type AggregationResult struct {
+	OutputPath  string                   `json:"file_path"`
+	Attachments int                      `json:"attachments"`
+	Rows        int                      `json:"rows"`
+	Headers     []string                 `json:"headers"`
+	Template    bool                     `json:"template"` // headers come from the project's Excel template
+	Report      []AttachmentColumnReport `json:"report"`
+	Summaries   []string                 `json:"summaries"` // summary sheets written
+	// SummaryErrors tell why a summary sheet was left out, e.g. a column the
+	// submissions do not have
+	SummaryErrors []string `json:"summary_errors,omitempty"`
+}
+
+// AttachmentColumnReport tells how the columns of one attachment were mapped
+// to the aggregated headers
+type AttachmentColumnReport struct {
+	AttachmentID    int      `json:"attachment_id"`
+	Filename        string   `json:"filename"`
+	TeacherName     string   `json:"teacher_name"`
+	Rows            int      `json:"rows"`
+	UnmappedColumns []string `json:"unmapped_columns"` // headers that match no template column; their data is left out
+	MissingColumns  []string `json:"missing_columns"`  // template columns the attachment does not have
+	Error           string   `json:"error,omitempty"`  // why the attachment was skipped
+}
+
+// DataPage is a page of a project's aggregated rows from the data API
+type DataPage struct {
+	Headers  []string    `json:"headers"` // data columns of the rows, in template order
+	Rows     []DataRow   `json:"rows"`
+	Total    int         `json:"total"` // rows matching the filters over all pages
+	Page     int         `json:"page"`
+	PageSize int         `json:"page_size"`
+	Groups   []DataGroup `json:"groups,omitempty"` // in row order, when grouped
+	// Pending are Excel attachments whose rows are not parsed yet and so
+	// not included
+	Pending []PendingAttachment `json:"pending,omitempty"`
+}
+
+// PendingAttachment is an attachment waiting to be parsed
+type PendingAttachment struct {
+	AttachmentID int    `json:"attachment_id"`
+	Filename     string `json:"filename"`
+	TeacherName  string `json:"teacher_name"`
+}
+
+// DataRow is one aggregated row with the attachment it came from
+type DataRow struct {
+	AttachmentID int               `json:"attachment_id"`
+	TeacherName  string            `json:"teacher_name"`
+	TeacherEmail string            `json:"teacher_email"`
+	Department   string            `json:"department"`
+	ReplyTime    *time.Time        `json:"reply_time"`
+	SourceFile   string            `json:"source_file"`
+	Values       map[string]string `json:"values"` // non-empty cells keyed by header
+}
+
+// DataGroup is a department or teacher and how many matching rows it has
+type DataGroup struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// Submission is one version of a teacher's Excel data for a project: a reply
+// carrying Excel files, numbered per teacher in the order received
+type Submission struct {
+	ID          int    `json:"id"`
+	ProjectID   int    `json:"project_id"`
+	TeacherID   int    `json:"teacher_id"`
+	TeacherName string `json:"teacher_name"`
+	ReplyID     int    `json:"reply_id"`
+	Version     int    `json:"version"`
+	// ValidationStatus is valid or invalid when the project has validation
+	// rules, empty otherwise
+	ValidationStatus string    `json:"validation_status"`
+	Pinned           bool      `json:"pinned"`   // chosen by the user for aggregation
+	Selected         bool      `json:"selected"` // the version aggregation uses
+	Attachments      []string  `json:"attachments"`
+	ReceivedAt       time.Time `json:"received_at"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// MailboxSyncState tracks how far a user's IMAP mailbox has been fetched
+type MailboxSyncState struct {
+	UserID      int
+	Mailbox     string
+	UIDValidity uint32
+	LastUID     uint32
 }
 
 // EmailMessage represents a received email
 type EmailMessage struct {
+	UID         uint32
 	MessageID   string
 	From        string
 	Subject     string
-	Body        string
+	Body        string // preferred body part as received (text/plain, else text/html)
+	TextBody    string // plain text rendering of Body without quoted history
 	InReplyTo   string
+	References  []string
+	Recipients  []string // To, Cc, Delivered-To and X-Original-To addresses
 	Attachments []AttachmentInfo
 	ReceivedAt  time.Time
-	RawHeaders  map[string]string
+	RawHeaders  map[string][]string
+	Bounce      *BounceReport // set for delivery status notifications reporting a failure
+}
+
+// BounceReport is the failure information of a delivery status notification
+type BounceReport struct {
+	OriginalMessageID string
+	Recipients        []BouncedRecipient
 }
 
-// AttachmentInfo represents an email attachment
+// BouncedRecipient is a recipient whose delivery failed permanently
+type BouncedRecipient struct {
+	Address    string
+	Status     string // enhanced status code, e.g. 5.1.1
+	Diagnostic string
+}
+
+// AttachmentInfo represents an email attachment. Its body lives in the file
+// at Path; rejected attachments have no file.
 type AttachmentInfo struct {
-	Filename    string
-	ContentType string
-	Data        []byte
+	Filename     string
+	ContentType  string
+	Path         string
+	Size         int64
+	RejectReason string // set when the attachment was not stored, e.g. too large
+}
+
+// ImportReport lists what happened, or with DryRun what would happen, to
+// each message of imported .eml files and mbox archives
+type ImportReport struct {
+	DryRun   bool              `json:"dry_run"`
+	Counts   map[string]int    `json:"counts"` // per outcome
+	Messages []ImportedMessage `json:"messages"`
+}
+
+// ImportedMessage is one message of an import and its outcome: reply,
+// unmatched, bounce, duplicate or failed
+type ImportedMessage struct {
+	Source            string       `json:"source"` // file name, with the position inside an mbox
+	MessageID         string       `json:"message_id"`
+	From              string       `json:"from"`
+	Subject           string       `json:"subject"`
+	ReceivedAt        *time.Time   `json:"received_at"`
+	Outcome           string       `json:"outcome"`
+	MatchMethod       string       `json:"match_method,omitempty"`
+	Project           *ProjectRef  `json:"project"`
+	TeacherID         *int         `json:"teacher_id"`
+	TeacherName       string       `json:"teacher_name,omitempty"`
+	CandidateProjects []ProjectRef `json:"candidate_projects"`
+	Attachments       int          `json:"attachments"`
+	Error             string       `json:"error,omitempty"`
 }
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+
+	"github.com/nwaples/rardecode/v2"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+var (
+	errArchiveLimit    = errors.New("archive exceeds the extraction limits")
+	errArchiveUnsafe   = errors.New("archive contains paths outside its root")
+	errSevenZipMissing = errors.New("7z archives need the 7z command, which is not installed")
+)
+
+// sevenZipTimeout bounds listing and extracting a 7z archive
+const sevenZipTimeout = 2 * time.Minute
+
+// archiveLimits bound what is unpacked from one archive
+type archiveLimits struct {
+	entries int   // files per archive
+	total   int64 // bytes over all files
+}
+
+func (s *EmailService) archiveLimits() archiveLimits {
+	limits := archiveLimits{entries: 100, total: 200 << 20}
+	if s.Config != nil {
+		if s.Config.ArchiveMaxEntries > 0 {
+			limits.entries = s.Config.ArchiveMaxEntries
+		}
+		if s.Config.ArchiveMaxTotalMB > 0 {
+			limits.total = int64(s.Config.ArchiveMaxTotalMB) << 20
+		}
+	}
+	return limits
+}
+
+// archiveKind returns "zip", "rar" or "7z" for archive file names
+func archiveKind(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".zip":
+		return "zip"
+	case ".rar":
+		return "rar"
+	case ".7z":
+		return "7z"
+	}
+	return ""
+}
+
+// safeArchivePath cleans the path of an archive entry. Absolute paths and
+// paths that climb out of the archive root ("zip slip") are refused.
+func safeArchivePath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", false
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return clean, true
+}
+
+// archiveVisitor receives each regular file of an archive. size is the
+// declared uncompressed size, negative when unknown.
+type archiveVisitor func(name string, size int64, r io.Reader) error
+
+// extractArchive unpacks an archive attachment of a reply and records every
+// file in it as a child attachment of the archive. Nested archives are kept
+// as files but not unpacked. Why an archive was not fully unpacked is
+// recorded in the archive's extract_error.
+func (s *EmailService) extractArchive(replyID int64, projectID int, teacherID sql.NullInt64, parentID int64, archivePath, archiveName string) {
+	limits := s.archiveLimits()
+	var children []models.AttachmentInfo
+	defer func() { removeSpooledAttachments(children) }()
+
+	var total int64
+	unsafe := 0
+	err := walkArchive(archiveKind(archiveName), archivePath, limits, func(name string, size int64, r io.Reader) error {
+		clean, ok := safeArchivePath(name)
+		if !ok {
+			log.Printf("Skipping unsafe path %q in archive %s", name, archiveName)
+			unsafe++
+			return nil
+		}
+		if len(children) >= limits.entries {
+			return fmt.Errorf("%w: more than %d files", errArchiveLimit, limits.entries)
+		}
+		if size <= 0 {
+			size = -1
+		}
+		// Never write more than the archive has left, whatever the entry
+		// claims to hold
+		remaining := limits.total - total
+		limit := s.maxAttachmentSize()
+		capped := limit == 0 || remaining < limit
+		if capped {
+			limit = remaining
+		}
+		tooLarge := fmt.Errorf("%w: more than %d MB unpacked", errArchiveLimit, limits.total>>20)
+		if limit <= 0 {
+			return tooLarge
+		}
+		child, err := s.spool(r, clean, s.getContentType(clean), size, limit)
+		if err != nil {
+			return err
+		}
+		if child.RejectReason != "" && capped {
+			return tooLarge
+		}
+		total += child.Size
+		children = append(children, child)
+		return nil
+	})
+	extractErr := ""
+	switch {
+	case err != nil:
+		// Files unpacked before the failure are kept
+		log.Printf("Failed to fully extract archive %s: %v", archiveName, err)
+		extractErr = err.Error()
+	case unsafe > 0:
+		extractErr = fmt.Sprintf("skipped %d files with paths outside the archive", unsafe)
+	}
+	if extractErr != "" {
+		if _, err := db.DB.Exec("UPDATE attachments SET extract_error = ? WHERE id = ?",
+			truncateRunes(extractErr, 500), parentID); err != nil {
+			log.Printf("Failed to record extraction error of archive %s: %v", archiveName, err)
+		}
+	}
+
+	uploadDir := "./uploads/replies"
+	for i, child := range children {
+		status, storedPath := AttachmentStatusRejected, ""
+		if child.RejectReason == "" {
+			storedPath = filepath.Join(uploadDir, fmt.Sprintf("%d_%d_%d_%d_%s",
+				projectID, time.Now().Unix(), parentID, i, s.sanitizeAttachmentName(path.Base(child.Filename))))
+			if err := moveFile(child.Path, storedPath); err != nil {
+				log.Printf("Failed to save %s from archive %s: %v", child.Filename, archiveName, err)
+				continue
+			}
+			children[i].Path = ""
+			status = AttachmentStatusStored
+		}
+
+		if _, err := db.DB.Exec(`
+			INSERT INTO attachments (reply_id, project_id, teacher_id, parent_attachment_id, original_filename, stored_path, content_type, file_size, status, reject_reason)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			replyID, projectID, teacherID, parentID, child.Filename, storedPath, child.ContentType, child.Size, status, nullString(child.RejectReason)); err != nil {
+			log.Printf("Failed to insert attachment record: %v", err)
+		}
+	}
+	log.Printf("Extracted %d files from archive %s", len(children), archiveName)
+}
+
+func walkArchive(kind, archivePath string, limits archiveLimits, visit archiveVisitor) error {
+	switch kind {
+	case "zip":
+		return walkZip(archivePath, visit)
+	case "rar":
+		return walkRar(archivePath, visit)
+	case "7z":
+		return walkSevenZip(archivePath, limits, visit)
+	}
+	return fmt.Errorf("unsupported archive type %q", kind)
+}
+
+func walkZip(archivePath string, visit archiveVisitor) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		// Archives made on Chinese Windows store GBK names without the UTF-8 flag
+		name := f.Name
+		if f.NonUTF8 {
+			if decoded, err := simplifiedchinese.GBK.NewDecoder().String(name); err == nil {
+				name = decoded
+			}
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			log.Printf("Skipping %s in zip archive: %v", name, err)
+			continue
+		}
+		err = visit(name, int64(f.UncompressedSize64), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkRar(archivePath string, visit archiveVisitor) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rr, err := rardecode.NewReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		h, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.IsDir || !h.Mode().IsRegular() {
+			continue
+		}
+		if h.Encrypted {
+			log.Printf("Skipping encrypted %s in rar archive", h.Name)
+			continue
+		}
+		size := h.UnPackedSize
+		if h.UnKnownSize {
+			size = -1
+		}
+		if err := visit(h.Name, size, rr); err != nil {
+			return err
+		}
+	}
+}
+
+// sevenZipEntry is a file listed by "7z l -slt"
+type sevenZipEntry struct {
+	path string
+	size int64
+	dir  bool
+}
+
+// walkSevenZip uses the 7z command line tool: the listing is checked against
+// the limits and for unsafe paths first, then the archive is extracted into
+// a private temporary directory.
+func walkSevenZip(archivePath string, limits archiveLimits, visit archiveVisitor) error {
+	bin := sevenZipBinary()
+	if bin == "" {
+		return errSevenZipMissing
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sevenZipTimeout)
+	defer cancel()
+
+	// An empty -p makes encrypted archives fail instead of prompting
+	out, err := exec.CommandContext(ctx, bin, "l", "-slt", "-p", "--", archivePath).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list 7z archive: %w", err)
+	}
+	entries := parseSevenZipListing(out)
+
+	var files []sevenZipEntry
+	var total int64
+	for _, e := range entries {
+		if e.dir {
+			continue
+		}
+		if _, ok := safeArchivePath(e.path); !ok {
+			return errArchiveUnsafe
+		}
+		files = append(files, e)
+		total += e.size
+	}
+	if len(files) > limits.entries {
+		return fmt.Errorf("%w: more than %d files", errArchiveLimit, limits.entries)
+	}
+	if total > limits.total {
+		return fmt.Errorf("%w: more than %d MB unpacked", errArchiveLimit, limits.total>>20)
+	}
+
+	if err := os.MkdirAll(attachmentSpoolDir, 0755); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(attachmentSpoolDir, "7z-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if out, err := exec.CommandContext(ctx, bin, "x", "-y", "-bd", "-p", "-o"+dir, "--", archivePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to extract 7z archive: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	for _, e := range files {
+		clean, _ := safeArchivePath(e.path)
+		full := filepath.Join(dir, filepath.FromSlash(clean))
+		// Only regular files inside the temporary directory are read
+		info, err := os.Lstat(full)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := os.Open(full)
+		if err != nil {
+			continue
+		}
+		err = visit(clean, info.Size(), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sevenZipBinary() string {
+	for _, name := range []string{"7zz", "7z", "7za"} {
+		if p, err := exec.LookPath(name); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// parseSevenZipListing reads the technical listing of "7z l -slt": after a
+// "----------" line, one "Key = Value" block per entry
+func parseSevenZipListing(out []byte) []sevenZipEntry {
+	var entries []sevenZipEntry
+	var cur *sevenZipEntry
+	started := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if !started {
+			started = strings.HasPrefix(line, "----------")
+			continue
+		}
+		key, value, ok := strings.Cut(line, " = ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Path":
+			entries = append(entries, sevenZipEntry{path: value})
+			cur = &entries[len(entries)-1]
+		case "Size":
+			if cur != nil {
+				cur.size, _ = strconv.ParseInt(value, 10, 64)
+			}
+		case "Folder":
+			if cur != nil && value == "+" {
+				cur.dir = true
+			}
+		case "Attributes":
+			if cur != nil && strings.HasPrefix(value, "D") {
+				cur.dir = true
+			}
+		}
+	}
+	return entries
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"db_intro_backend/models"
+)
+
+// Attachment states recorded in attachments.status
+const (
+	AttachmentStatusStored   = "stored"
+	AttachmentStatusRejected = "rejected"
+)
+
+// attachmentSpoolDir holds attachment bodies while their message is being
+// processed; they are moved to their final place once the message is stored.
+const attachmentSpoolDir = "./uploads/tmp"
+
+// maxAttachmentSize returns the configured limit in bytes, 0 meaning none
+func (s *EmailService) maxAttachmentSize() int64 {
+	if s.Config == nil || s.Config.MaxAttachmentMB <= 0 {
+		return 0
+	}
+	return int64(s.Config.MaxAttachmentMB) << 20
+}
+
+// spoolAttachment streams an attachment body to a temporary file. Bodies
+// over the size limit are discarded and returned as rejected.
+func (s *EmailService) spoolAttachment(r io.Reader, filename, contentType string) (models.AttachmentInfo, error) {
+	return s.spool(r, filename, contentType, 0, s.maxAttachmentSize())
+}
+
+// spool writes r to a temporary file, reading at most limit bytes (0 meaning
+// no limit); a longer body is discarded and returned as rejected. knownSize
+// is reported for oversize bodies when positive; 0 drains the rest of r to
+// measure it, and a negative value stops reading at the limit (used for
+// archive entries, whose size may be a lie).
+func (s *EmailService) spool(r io.Reader, filename, contentType string, knownSize, limit int64) (models.AttachmentInfo, error) {
+	att := models.AttachmentInfo{Filename: filename, ContentType: contentType}
+
+	if err := os.MkdirAll(attachmentSpoolDir, 0755); err != nil {
+		return att, err
+	}
+	f, err := os.CreateTemp(attachmentSpoolDir, "att-*")
+	if err != nil {
+		return att, err
+	}
+
+	src := r
+	if limit > 0 {
+		src = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(f, src)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return att, err
+	}
+
+	if limit > 0 && n > limit {
+		os.Remove(f.Name())
+		switch {
+		case knownSize > 0:
+			att.Size = knownSize
+		case knownSize == 0:
+			rest, _ := io.Copy(io.Discard, r)
+			att.Size = n + rest
+		default:
+			att.Size = n
+		}
+		att.RejectReason = fmt.Sprintf("attachment is %.1f MB, exceeding the %d MB limit", float64(att.Size)/(1<<20), limit>>20)
+		log.Printf("Rejected attachment %s: %s", filename, att.RejectReason)
+		return att, nil
+	}
+
+	att.Path = f.Name()
+	att.Size = n
+	return att, nil
+}
+
+// removeSpooledAttachments deletes the temporary files that were not moved
+// into storage
+func removeSpooledAttachments(attachments []models.AttachmentInfo) {
+	for _, att := range attachments {
+		if att.Path == "" {
+			continue
+		}
+		if err := os.Remove(att.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", att.Path, err)
+		}
+	}
+}
+
+// moveFile renames src to dst, copying when they are on different devices
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
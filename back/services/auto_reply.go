@@ -0,0 +1,129 @@
+package services
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"db_intro_backend/models"
+)
+
+// MemberStatusAutoReplied marks a teacher whose only answer so far was an
+// automatic response; they still count as not having replied.
+const MemberStatusAutoReplied = "auto_replied"
+
+// Subject prefixes mail clients put on out-of-office and other automatic
+// responses, e.g. "Automatic reply: ..." or "【自动回复】...". Words such as
+// 外出 or 休假 alone are not enough: "外出培训工作量" is a real submission.
+var autoReplySubject = regexp.MustCompile(`(?i)^\s*[\[【(（]?\s*(out of (the )?office( auto ?reply)?|automatic reply|auto[- ]?reply|auto[- ]?response|autoreply|自动回复|自动答复)\s*([:：\]】)）]|$)`)
+
+// detectAutoReply reports whether an email is an automatic response and why.
+// It looks at the RFC 3834 Auto-Submitted header, the X-Autoreply /
+// X-Autorespond headers set by many servers, Precedence: auto_reply and
+// finally an auto-reply prefix of the subject. Precedence: bulk or junk is
+// not a sign of an automatic reply.
+func detectAutoReply(email models.EmailMessage) (string, bool) {
+	if v := strings.ToLower(headerValue(email.RawHeaders, "Auto-Submitted")); v != "" && v != "no" {
+		return "Auto-Submitted: " + v, true
+	}
+	if v := headerValue(email.RawHeaders, "X-Autoreply"); v != "" && !strings.EqualFold(v, "no") {
+		return "X-Autoreply: " + v, true
+	}
+	if v := headerValue(email.RawHeaders, "X-Autorespond"); v != "" {
+		return "X-Autorespond", true
+	}
+	if v := strings.ToLower(headerValue(email.RawHeaders, "Precedence")); v == "auto_reply" {
+		return "Precedence: " + v, true
+	}
+	if autoReplySubject.MatchString(email.Subject) {
+		return "subject: " + email.Subject, true
+	}
+	return "", false
+}
+
+// headerValue returns the first value of a header, matching the name
+// case-insensitively
+func headerValue(headers map[string][]string, name string) string {
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+	}
+	return ""
+}
+
+var (
+	returnKeywords = regexp.MustCompile(`(?i)(返回|回来|回校|返校|回到|之后|以后|back|return|until|till)`)
+	dateYMD        = regexp.MustCompile(`(\d{4})\s*[-/.年]\s*(\d{1,2})\s*[-/.月]\s*(\d{1,2})`)
+	dateMD         = regexp.MustCompile(`(\d{1,2})\s*月\s*(\d{1,2})\s*[日号]`)
+	dateMonthDay   = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?\s+(\d{1,2})(?:st|nd|rd|th)?\b(?:,?\s+(\d{4}))?`)
+	dateDayMonth   = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?\s+(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?(?:,?\s+(\d{4}))?`)
+)
+
+var monthAbbrevs = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+	"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+	"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+// maxAbsence bounds the return dates that are believed
+const maxAbsence = 120 * 24 * time.Hour
+
+// parseReturnDate finds the date an out-of-office message says the sender is
+// back, e.g. "3月5日返回", "2024-03-05 回校" or "back on March 5". It picks the
+// latest plausible date after received.
+func parseReturnDate(text string, received time.Time) (time.Time, bool) {
+	if !returnKeywords.MatchString(text) {
+		return time.Time{}, false
+	}
+
+	loc := received.Location()
+	var candidates []time.Time
+	add := func(year int, month time.Month, day int) {
+		if month < time.January || month > time.December || day < 1 || day > 31 {
+			return
+		}
+		if year == 0 {
+			year = received.Year()
+			// "1月3日" written in December means next year
+			if time.Date(year, month, day, 0, 0, 0, 0, loc).Before(received.AddDate(0, 0, -1)) {
+				year++
+			}
+		}
+		candidates = append(candidates, time.Date(year, month, day, 0, 0, 0, 0, loc))
+	}
+
+	for _, m := range dateYMD.FindAllStringSubmatch(text, -1) {
+		y, _ := strconv.Atoi(m[1])
+		mo, _ := strconv.Atoi(m[2])
+		d, _ := strconv.Atoi(m[3])
+		add(y, time.Month(mo), d)
+	}
+	for _, m := range dateMD.FindAllStringSubmatch(text, -1) {
+		mo, _ := strconv.Atoi(m[1])
+		d, _ := strconv.Atoi(m[2])
+		add(0, time.Month(mo), d)
+	}
+	for _, m := range dateMonthDay.FindAllStringSubmatch(text, -1) {
+		d, _ := strconv.Atoi(m[2])
+		y, _ := strconv.Atoi(m[3])
+		add(y, monthAbbrevs[strings.ToLower(m[1])], d)
+	}
+	for _, m := range dateDayMonth.FindAllStringSubmatch(text, -1) {
+		d, _ := strconv.Atoi(m[1])
+		y, _ := strconv.Atoi(m[3])
+		add(y, monthAbbrevs[strings.ToLower(m[2])], d)
+	}
+
+	var best time.Time
+	for _, c := range candidates {
+		if c.Before(received.AddDate(0, 0, -1)) || c.Sub(received) > maxAbsence {
+			continue
+		}
+		if c.After(best) {
+			best = c
+		}
+	}
+	return best, !best.IsZero()
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"testing"
+
+	"db_intro_backend/models"
+)
+
+func TestDetectAutoReply(t *testing.T) {
+	tests := []struct {
+		subject string
+		headers map[string][]string
+		want    bool
+	}{
+		{"外出培训工作量", nil, false},
+		{"Re: 休假期间工作量统计", nil, false},
+		{"Re: on leave hours", nil, false},
+		{"Re: 工作量", map[string][]string{"Precedence": {"bulk"}}, false},
+		{"Re: 工作量", map[string][]string{"Auto-Submitted": {"no"}}, false},
+		{"Out of office hours survey", nil, false},
+		{"自动回复：2025年度工作量汇总", nil, true},
+		{"自动答复: 2025年度工作量汇总", nil, true},
+		{"【自动回复】您好，我正在休假", nil, true},
+		{"Automatic reply: 2025 workload", nil, true},
+		{"Out of Office", nil, true},
+		{"Re: 工作量", map[string][]string{"Auto-Submitted": {"auto-replied"}}, true},
+		{"Re: 工作量", map[string][]string{"X-Autoreply": {"yes"}}, true},
+		{"Re: 工作量", map[string][]string{"Precedence": {"auto_reply"}}, true},
+	}
+	for _, tt := range tests {
+		reason, got := detectAutoReply(models.EmailMessage{Subject: tt.subject, RawHeaders: tt.headers})
+		if got != tt.want {
+			t.Errorf("detectAutoReply(%q, %v) = %v (%s), want %v", tt.subject, tt.headers, got, reason, tt.want)
+		}
+	}
+}
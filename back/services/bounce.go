@@ -0,0 +1,221 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+// Status values recorded when a delivery fails permanently
+const (
+	MemberStatusBounced = "bounced"
+	EmailStatusBounced  = "bounced"
+	EmailStatusOK       = "ok"
+)
+
+// parseDeliveryStatus reads the body of a message/delivery-status part
+// (RFC 3464): one block of per-message fields followed by one block per
+// recipient. Only recipients whose delivery failed are returned.
+func parseDeliveryStatus(body []byte) []models.BouncedRecipient {
+	var failed []models.BouncedRecipient
+	for _, block := range splitDSNBlocks(body) {
+		action := strings.ToLower(block.Get("Action"))
+		if action != "failed" {
+			continue
+		}
+		recipient := block.Get("Final-Recipient")
+		if recipient == "" {
+			recipient = block.Get("Original-Recipient")
+		}
+		// "rfc822; someone@example.com"
+		if i := strings.Index(recipient, ";"); i >= 0 {
+			recipient = recipient[i+1:]
+		}
+		failed = append(failed, models.BouncedRecipient{
+			Address:    strings.Trim(strings.TrimSpace(recipient), "<>"),
+			Status:     block.Get("Status"),
+			Diagnostic: block.Get("Diagnostic-Code"),
+		})
+	}
+	return failed
+}
+
+func splitDSNBlocks(body []byte) []textproto.MIMEHeader {
+	var blocks []textproto.MIMEHeader
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(body)))
+	for {
+		// Skip blank lines between blocks
+		for {
+			b, err := r.R.Peek(1)
+			if err != nil {
+				return blocks
+			}
+			if b[0] != '\r' && b[0] != '\n' {
+				break
+			}
+			r.R.ReadByte()
+		}
+		h, err := r.ReadMIMEHeader()
+		if len(h) > 0 {
+			blocks = append(blocks, h)
+		}
+		if err != nil {
+			return blocks
+		}
+	}
+}
+
+// originalMessageID extracts the Message-ID from the returned copy of the
+// original message (message/rfc822 or text/rfc822-headers)
+func originalMessageID(data []byte) string {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	// The headers may be all there is, so a missing body is not an error
+	h, _ := r.ReadMIMEHeader()
+	return strings.TrimSpace(h.Get("Message-Id"))
+}
+
+var (
+	// A failed recipient as listed by Postfix ("<a@b>: host ... said"), qmail
+	// ("<a@b>:") and Exim (the address alone on an indented line)
+	bounceAddressLine = regexp.MustCompile(`^<?([^\s<>@:]+@[^\s<>:]+?)>?(:|$)`)
+	bounceStatusCode  = regexp.MustCompile(`\b([245]\.\d{1,3}\.\d{1,3})\b`)
+	bounceSMTPFailure = regexp.MustCompile(`\b5\d\d[ -]`)
+	bounceQuotedID    = regexp.MustCompile(`(?im)^\s*Message-ID:\s*(<[^>\s]+>)`)
+	// The returned original message starts at one of these lines
+	bounceOriginalStart = regexp.MustCompile(`(?i)^(received:|return-path:|.*original message|.*message headers follow|.*returned message)`)
+)
+
+// isMailerDaemon reports whether address is the sender of non-delivery reports
+func isMailerDaemon(address string) bool {
+	local, _, _ := strings.Cut(strings.ToLower(address), "@")
+	return local == "mailer-daemon" || local == "postmaster"
+}
+
+// parsePlainTextBounce reads a non-delivery report sent by a mail server
+// without a message/delivery-status part. Only permanent failures count: the
+// text must carry a 5.x.x status or a 5xx SMTP reply, so delay warnings are
+// ignored. The original Message-ID is taken from the quoted headers when
+// they are included.
+func parsePlainTextBounce(body string) (*models.BounceReport, bool) {
+	var report models.BounceReport
+	permanent := false
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if bounceOriginalStart.MatchString(line) {
+			break
+		}
+		if code := bounceStatusCode.FindString(line); strings.HasPrefix(code, "5") || bounceSMTPFailure.MatchString(line) {
+			permanent = true
+		}
+		m := bounceAddressLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		// The diagnostic follows the address or is on the next lines
+		diagnostic := strings.TrimSpace(strings.TrimPrefix(line[len(m[0]):], ":"))
+		for j := i + 1; diagnostic == "" && j < len(lines) && j <= i+3; j++ {
+			diagnostic = strings.TrimSpace(lines[j])
+		}
+		status := bounceStatusCode.FindString(diagnostic)
+		report.Recipients = append(report.Recipients, models.BouncedRecipient{
+			Address: m[1], Status: status, Diagnostic: diagnostic,
+		})
+	}
+	if !permanent || len(report.Recipients) == 0 {
+		return nil, false
+	}
+	if m := bounceQuotedID.FindStringSubmatch(body); m != nil {
+		report.OriginalMessageID = m[1]
+	}
+	return &report, true
+}
+
+// processBounce correlates a delivery failure with the email we sent, marks
+// the project member as bounced and flags the teacher's address as suspect.
+// The bounce is recorded together with its effects, so that on an error none
+// of them is kept and the message can be processed again.
+func (s *EmailService) processBounce(user models.User, email models.EmailMessage) error {
+	report := email.Bounce
+
+	var projectID int
+	var teacherID sql.NullInt64
+	if report.OriginalMessageID != "" {
+		if m, ok := lookupSentEmail(user.ID, report.OriginalMessageID); ok {
+			projectID, teacherID = m.ProjectID, m.TeacherID
+		}
+	}
+
+	// Some servers strip the original message; fall back to the failed
+	// recipient and the latest email we sent them
+	if projectID == 0 {
+		for _, rcpt := range report.Recipients {
+			tid := lookupTeacherByEmail(rcpt.Address)
+			if !tid.Valid {
+				continue
+			}
+			teacherID = tid
+			db.DB.QueryRow(`
+				SELECT se.project_id FROM sent_emails se
+				JOIN projects p ON se.project_id = p.id
+				WHERE se.teacher_id = ? AND p.created_by = ?
+				ORDER BY se.sent_at DESC, se.id DESC LIMIT 1`,
+				tid.Int64, user.ID).Scan(&projectID)
+			break
+		}
+	}
+
+	var recipient, status, diagnostic string
+	if len(report.Recipients) > 0 {
+		recipient = report.Recipients[0].Address
+		status = report.Recipients[0].Status
+		diagnostic = report.Recipients[0].Diagnostic
+	}
+	var project sql.NullInt64
+	if projectID != 0 {
+		project = sql.NullInt64{Int64: int64(projectID), Valid: true}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO email_bounces (user_id, message_id, original_message_id, project_id, teacher_id, recipient, status_code, diagnostic, received_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, email.MessageID, report.OriginalMessageID, project, teacherID, recipient, status, diagnostic, email.ReceivedAt); err != nil {
+		return fmt.Errorf("failed to record bounce: %w", err)
+	}
+
+	if !teacherID.Valid {
+		log.Printf("Bounce %s for %s could not be matched to a teacher", email.MessageID, recipient)
+		return tx.Commit()
+	}
+	log.Printf("Delivery to teacher %d failed (%s %s)", teacherID.Int64, status, diagnostic)
+
+	if projectID != 0 {
+		if _, err := tx.Exec(`
+			UPDATE project_members SET current_status = ?
+			WHERE project_id = ? AND teacher_id = ? AND current_status IN (?, ?)`,
+			MemberStatusBounced, projectID, teacherID.Int64, MemberStatusPending, MemberStatusAutoReplied); err != nil {
+			return fmt.Errorf("failed to update project_members: %w", err)
+		}
+	}
+
+	reason := strings.TrimSpace(status + " " + diagnostic)
+	if _, err := tx.Exec("UPDATE teachers SET email_status = ?, email_bounce_reason = ?, email_bounced_at = ? WHERE id = ?",
+		EmailStatusBounced, reason, email.ReceivedAt, teacherID.Int64); err != nil {
+		return fmt.Errorf("failed to flag email of teacher %d: %w", teacherID.Int64, err)
+	}
+	return tx.Commit()
+}
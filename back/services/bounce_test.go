@@ -0,0 +1,151 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+const dsnReport = "From: Mail Delivery System <MAILER-DAEMON@mx.school.test>\r\n" +
+	"To: office@school.test\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Message-ID: <dsn-1@mx.school.test>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=us-ascii\r\n" +
+	"\r\n" +
+	"I'm sorry to have to inform you that your message could not be delivered.\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.school.test\r\n" +
+	"Arrival-Date: Mon, 1 Sep 2025 09:00:00 +0800\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; zhang@school.test\r\n" +
+	"Original-Recipient: rfc822;zhang@school.test\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <zhang@school.test>: Recipient address rejected: User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; li@school.test\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: office@school.test\r\n" +
+	"To: zhang@school.test\r\n" +
+	"Subject: 2025年度工作量汇总\r\n" +
+	"Message-ID: <1756688400.abc@school.test>\r\n" +
+	"\r\n" +
+	"--b1--\r\n"
+
+// TestParseEmailDSN reads a multipart/report: only the recipient whose
+// delivery failed is reported, with the original Message-ID
+func TestParseEmailDSN(t *testing.T) {
+	email, err := (&EmailService{}).parseEmail(strings.NewReader(dsnReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := email.Bounce
+	if b == nil {
+		t.Fatal("delivery status notification not recognised")
+	}
+	if b.OriginalMessageID != "<1756688400.abc@school.test>" {
+		t.Errorf("OriginalMessageID = %q", b.OriginalMessageID)
+	}
+	if len(b.Recipients) != 1 {
+		t.Fatalf("Recipients = %+v, want only the failed one", b.Recipients)
+	}
+	r := b.Recipients[0]
+	if r.Address != "zhang@school.test" || r.Status != "5.1.1" || !strings.Contains(r.Diagnostic, "User unknown") {
+		t.Errorf("recipient = %+v", r)
+	}
+}
+
+func TestParsePlainTextBounce(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		address    string // "" when no bounce should be found
+		status     string
+		originalID string
+	}{
+		{
+			name: "Postfix",
+			body: "This is the mail system at host mx.school.test.\n\n" +
+				"I'm sorry to have to inform you that your message could not\nbe delivered to one or more recipients.\n\n" +
+				"<zhang@school.test>: host mx.school.test[10.0.0.1] said: 550 5.1.1\n    User unknown (in reply to RCPT TO command)\n\n" +
+				"------ This is a copy of the message, including all the headers. ------\n\n" +
+				"Return-Path: <office@school.test>\nMessage-ID: <1756688400.abc@school.test>\nTo: li@school.test\n",
+			address: "zhang@school.test", status: "5.1.1", originalID: "<1756688400.abc@school.test>",
+		},
+		{
+			name: "qmail",
+			body: "Hi. This is the qmail-send program at mail.school.test.\n" +
+				"I'm afraid I wasn't able to deliver your message to the following addresses.\n\n" +
+				"<li@school.test>:\nSorry, no mailbox here by that name. (#5.1.1)\n\n" +
+				"--- Below this line is a copy of the message.\n\nMessage-ID: <1756688401.def@school.test>\n",
+			address: "li@school.test", status: "5.1.1", originalID: "<1756688401.def@school.test>",
+		},
+		{
+			name: "Exim without the original",
+			body: "This message was created automatically by mail delivery software.\n\n" +
+				"A message that you sent could not be delivered to one or more of its\nrecipients. This is a permanent error. The following address(es) failed:\n\n" +
+				"  wang@school.test\n    SMTP error from remote mail server after RCPT TO:<wang@school.test>:\n    550 5.7.1 Mailbox disabled\n",
+			address: "wang@school.test",
+		},
+		{
+			name: "delay warning",
+			body: "This is the mail system at host mx.school.test.\n\n" +
+				"####################################################################\n# THIS IS A WARNING ONLY.  YOU DO NOT NEED TO RESEND YOUR MESSAGE. #\n" +
+				"####################################################################\n\n" +
+				"<zhang@school.test>: connect to mx.school.test[10.0.0.1]:25: Connection timed out\n",
+		},
+		{
+			name: "no recipient",
+			body: "Your message could not be delivered: 550 mailbox full\n",
+		},
+	}
+	for _, tt := range tests {
+		report, ok := parsePlainTextBounce(tt.body)
+		if tt.address == "" {
+			if ok {
+				t.Errorf("%s: reported bounce %+v, want none", tt.name, report)
+			}
+			continue
+		}
+		if !ok || len(report.Recipients) != 1 {
+			t.Errorf("%s: report = %+v, %v; want %s", tt.name, report, ok, tt.address)
+			continue
+		}
+		r := report.Recipients[0]
+		if r.Address != tt.address || r.Status != tt.status || r.Diagnostic == "" || report.OriginalMessageID != tt.originalID {
+			t.Errorf("%s: report = %+v %+v", tt.name, report, r)
+		}
+	}
+}
+
+// TestParseEmailPlainTextBounce only treats text from the mailer daemon as a
+// bounce
+func TestParseEmailPlainTextBounce(t *testing.T) {
+	body := "\r\n<zhang@school.test>: host mx said: 550 5.1.1 User unknown\r\n"
+	for from, want := range map[string]bool{
+		"MAILER-DAEMON@mx.school.test": true,
+		"postmaster@school.test":       true,
+		"li@school.test":               false,
+	} {
+		raw := "From: " + from + "\r\nSubject: Undelivered Mail\r\nMessage-ID: <b@school.test>\r\n" +
+			"Content-Type: text/plain\r\n" + body
+		email, err := (&EmailService{}).parseEmail(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := email.Bounce != nil; got != want {
+			t.Errorf("message from %s: bounce = %v, want %v", from, got, want)
+		}
+	}
+}
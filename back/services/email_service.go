@@ -3,34 +3,39 @@ package services
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/tls"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
-	"net/smtp"
 	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"db_intro_backend/config"
 	"db_intro_backend/db"
 	"db_intro_backend/models"
 
-	"github.com/emersion/go-imap"
-	imapid "github.com/emersion/go-imap-id"
-	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
 	imapmail "github.com/emersion/go-message/mail"
 )
 
 type EmailService struct {
-	Config *config.Config
+	Config        *config.Config
+	Mailer        Mailer
+	MailboxReader MailboxReader // IMAP users
+	POP3Reader    MailboxReader // users with mail_protocol pop3
+	Excel         *ExcelService // validates received submissions
+
+	userLocks sync.Map // user ID -> *sync.Mutex
 }
 
 var (
@@ -39,11 +44,35 @@ var (
 )
 
 func NewEmailService(cfg *config.Config) *EmailService {
-	return &EmailService{Config: cfg}
+	return &EmailService{
+		Config:        cfg,
+		Mailer:        &SMTPMailer{},
+		MailboxReader: &IMAPReader{MaxMessageSize: maxMessageSize(cfg)},
+		POP3Reader:    &POP3Reader{MaxMessageSize: maxMessageSize(cfg)},
+		Excel:         NewExcelService(),
+	}
 }
 
-// SendEmail sends an email with optional attachment
-func (s *EmailService) SendEmail(user models.User, to, subject, body string, attachmentPath string) (string, error) {
+// maxMessageSize returns the configured message size limit in bytes, 0
+// meaning none
+func maxMessageSize(cfg *config.Config) int64 {
+	if cfg == nil || cfg.MaxMessageMB <= 0 {
+		return 0
+	}
+	return int64(cfg.MaxMessageMB) << 20
+}
+
+// readerFor returns the reader for the protocol the user has configured
+func (s *EmailService) readerFor(user models.User) MailboxReader {
+	if user.MailProtocol == MailProtocolPOP3 && s.POP3Reader != nil {
+		return s.POP3Reader
+	}
+	return s.MailboxReader
+}
+
+// SendEmail sends an email with optional attachment. A non-empty replyTo is
+// written as the Reply-To header.
+func (s *EmailService) SendEmail(user models.User, to, replyTo, subject, body string, attachmentPath string) (string, error) {
 	from := user.EmailAddress
 
 	// Generate Message-ID
@@ -61,6 +90,9 @@ func (s *EmailService) SendEmail(user models.User, to, subject, body string, att
 	// Email headers
 	fmt.Fprintf(&msg, "From: %s\r\n", from)
 	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	if replyTo != "" {
+		fmt.Fprintf(&msg, "Reply-To: %s\r\n", replyTo)
+	}
 	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
 	fmt.Fprintf(&msg, "Message-ID: %s\r\n", messageID)
 	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
@@ -87,37 +119,10 @@ func (s *EmailService) SendEmail(user models.User, to, subject, body string, att
 	writer.Close()
 
 	// Send email
-	addr := user.SMTPHost + ":" + user.SMTPPort
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true, // 可设 false，如果你有证书
-		ServerName:         user.SMTPHost,
-	}
-	conn, err := tls.Dial("tcp", addr, tlsConfig)
-	if err != nil {
-		return "", fmt.Errorf("TLS dial error: %w", err)
-	}
-	c, err := smtp.NewClient(conn, user.SMTPHost)
-	if err != nil {
-		return "", err
-	}
-	defer c.Quit()
-	auth := smtp.PlainAuth("", user.SMTPUsername, user.SMTPPassword, user.SMTPHost)
-	if err = c.Auth(auth); err != nil {
-		return "", fmt.Errorf("auth error: %w", err)
-	}
-	c.Mail(from)
-	c.Rcpt(to)
-	w, err := c.Data()
-	if err != nil {
-		log.Printf("Failed to send email to %s: %v", to, err)
-		return "", err
-	}
-	_, err = w.Write(msg.Bytes())
-	if err != nil {
+	if err := s.Mailer.Send(user, from, []string{to}, msg.Bytes()); err != nil {
 		log.Printf("Failed to send email to %s: %v", to, err)
 		return "", err
 	}
-	w.Close()
 
 	log.Printf("Email sent successfully to %s", to)
 	return messageID, nil
@@ -177,86 +182,6 @@ func (s *EmailService) getContentType(filename string) string {
 	}
 }
 
-// FetchEmails fetches emails from IMAP server
-func (s *EmailService) FetchEmails(user models.User) ([]models.EmailMessage, error) {
-	log.Printf("Connecting to IMAP server %s:%s", user.IMAPHost, user.IMAPPort)
-	c, err := client.DialTLS(user.IMAPHost+":"+user.IMAPPort, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to IMAP server: %w", err)
-	}
-	defer c.Logout()
-
-	if err := c.Login(user.IMAPUsername, user.IMAPPassword); err != nil {
-		return nil, fmt.Errorf("failed to login: %w", err)
-	}
-	log.Println("Logged in to IMAP server")
-
-	idClient := imapid.NewClient(c)
-	idParams := map[string]string{
-		"name":          "my-go-client",
-		"version":       "1.0.0",
-		"vendor":        "go-imap",
-		"support-email": "support@example.com",
-	}
-	log.Println("Sending IMAP ID...")
-	_, err = idClient.ID(idParams)
-	if err != nil {
-		log.Fatal("ID command failed: ", err)
-	}
-	log.Println("IMAP ID sent successfully!")
-
-	mbox, err := c.Select("INBOX", false)
-	if err != nil {
-		return nil, fmt.Errorf("failed to select INBOX: %w", err)
-	}
-
-	if mbox.Messages == 0 {
-		log.Println("No messages in mailbox")
-		return []models.EmailMessage{}, nil
-	}
-
-	seqset := new(imap.SeqSet)
-	seqset.AddRange(1, mbox.Messages)
-
-	messages := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
-
-	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{section.FetchItem(), imap.FetchEnvelope, imap.FetchUid}
-
-	go func() {
-		done <- c.Fetch(seqset, items, messages)
-	}()
-
-	var emails []models.EmailMessage
-	for msg := range messages {
-		if msg == nil {
-			continue
-		}
-
-		r := msg.GetBody(section)
-		if r == nil {
-			log.Println("Server didn't return message body")
-			continue
-		}
-
-		emailMsg, err := s.parseEmail(r)
-		if err != nil {
-			log.Printf("Failed to parse email: %v", err)
-			continue
-		}
-
-		emails = append(emails, emailMsg)
-	}
-
-	if err := <-done; err != nil {
-		return nil, fmt.Errorf("failed to fetch messages: %w", err)
-	}
-
-	log.Printf("Fetched %d emails", len(emails))
-	return emails, nil
-}
-
 func (s *EmailService) parseEmail(r io.Reader) (models.EmailMessage, error) {
 	mr, err := imapmail.CreateReader(r)
 	if err != nil {
@@ -264,7 +189,7 @@ func (s *EmailService) parseEmail(r io.Reader) (models.EmailMessage, error) {
 	}
 
 	var emailMsg models.EmailMessage
-	emailMsg.RawHeaders = make(map[string]string)
+	emailMsg.RawHeaders = make(map[string][]string)
 
 	header := mr.Header
 	if date, err := header.Date(); err == nil {
@@ -280,76 +205,191 @@ func (s *EmailService) parseEmail(r io.Reader) (models.EmailMessage, error) {
 	emailMsg.Subject, _ = header.Subject()
 	emailMsg.MessageID = header.Get("Message-ID")
 	emailMsg.InReplyTo = header.Get("In-Reply-To")
+	if ids, err := header.MsgIDList("In-Reply-To"); err == nil && len(ids) > 0 {
+		emailMsg.InReplyTo = "<" + ids[0] + ">"
+	}
+	// sent_emails stores Message-IDs with their angle brackets
+	if ids, err := header.MsgIDList("References"); err == nil {
+		for _, id := range ids {
+			emailMsg.References = append(emailMsg.References, "<"+id+">")
+		}
+	}
+	for _, key := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		if addrs, err := header.AddressList(key); err == nil {
+			for _, a := range addrs {
+				emailMsg.Recipients = append(emailMsg.Recipients, a.Address)
+			}
+		}
+	}
 
 	fields := header.Fields()
 	for fields.Next() {
-		emailMsg.RawHeaders[fields.Key()] = fields.Value()
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		emailMsg.RawHeaders[fields.Key()] = append(emailMsg.RawHeaders[fields.Key()], value)
 	}
 
+	var plainBody, htmlBody strings.Builder
+	var failedRecipients []models.BouncedRecipient
+	var originalID string
 	for {
 		p, err := mr.NextPart()
 		if err == io.EOF {
 			break
+		} else if message.IsUnknownCharset(err) || message.IsUnknownEncoding(err) {
+			log.Printf("Skipping part: %v", err)
+			continue
 		} else if err != nil {
+			// A truncated or malformed body fails the same way for every
+			// following part: keep what was read
 			log.Printf("Error reading part: %v", err)
+			break
+		}
+
+		// Parts of a delivery status notification (multipart/report)
+		partType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			data, _ := io.ReadAll(p.Body)
+			failedRecipients = append(failedRecipients, parseDeliveryStatus(data)...)
+			continue
+		case "message/rfc822", "message/global", "text/rfc822-headers", "message/rfc822-headers", "message/global-headers":
+			data, _ := io.ReadAll(p.Body)
+			originalID = originalMessageID(data)
 			continue
 		}
 
 		switch h := p.Header.(type) {
 		case *imapmail.InlineHeader:
-			body, _ := io.ReadAll(p.Body)
-			emailMsg.Body += string(body)
+			contentType, params, _ := h.ContentType()
+			// Inline parts that carry a file name (e.g. a spreadsheet sent
+			// with Content-Disposition: inline) are kept as attachments
+			if !strings.HasPrefix(contentType, "text/") || params["name"] != "" {
+				if params["name"] == "" {
+					continue
+				}
+				att, err := s.spoolAttachment(p.Body, params["name"], contentType)
+				if err != nil {
+					log.Printf("Failed to read attachment: %v", err)
+					continue
+				}
+				emailMsg.Attachments = append(emailMsg.Attachments, att)
+				continue
+			}
+
+			body, err := io.ReadAll(p.Body)
+			if err != nil {
+				log.Printf("Failed to read body part: %v", err)
+			}
+			if contentType == "text/html" {
+				htmlBody.Write(body)
+			} else {
+				plainBody.Write(body)
+			}
 
 		case *imapmail.AttachmentHeader:
 			filename, _ := h.Filename()
 			contentType, _, _ := h.ContentType()
 
-			data, err := io.ReadAll(p.Body)
+			att, err := s.spoolAttachment(p.Body, filename, contentType)
 			if err != nil {
 				log.Printf("Failed to read attachment: %v", err)
 				continue
 			}
+			emailMsg.Attachments = append(emailMsg.Attachments, att)
+		}
+	}
 
-			emailMsg.Attachments = append(emailMsg.Attachments, models.AttachmentInfo{
-				Filename:    filename,
-				ContentType: contentType,
-				Data:        data,
-			})
+	if len(failedRecipients) > 0 {
+		emailMsg.Bounce = &models.BounceReport{OriginalMessageID: originalID, Recipients: failedRecipients}
+	} else if isMailerDaemon(emailMsg.From) {
+		if report, ok := parsePlainTextBounce(plainBody.String()); ok {
+			if report.OriginalMessageID == "" {
+				report.OriginalMessageID = originalID
+			}
+			emailMsg.Bounce = report
 		}
 	}
 
+	// Prefer the text/plain alternative; fall back to rendering the HTML one
+	if strings.TrimSpace(plainBody.String()) != "" {
+		emailMsg.Body = plainBody.String()
+		emailMsg.TextBody = stripQuotedText(emailMsg.Body)
+	} else {
+		emailMsg.Body = htmlBody.String()
+		emailMsg.TextBody = stripQuotedText(htmlToText(emailMsg.Body))
+	}
+
 	return emailMsg, nil
 }
 
+const userEmailColumns = "id, smtp_host, smtp_port, smtp_username, smtp_password, smtp_security, smtp_skip_verify, imap_host, imap_port, imap_username, imap_password, email_address, plus_addressing, mailbox_action, processed_folder, unmatched_folder, mail_protocol"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUserEmailConfig(row rowScanner) (models.User, error) {
+	var user models.User
+	var smtpHost, smtpPort, smtpUser, smtpPass, smtpSecurity, imapHost, imapPort, imapUser, imapPass, emailAddr, mailboxAction, processedFolder, unmatchedFolder, mailProtocol sql.NullString
+	var smtpSkipVerify, plusAddressing sql.NullBool
+
+	if err := row.Scan(&user.ID, &smtpHost, &smtpPort, &smtpUser, &smtpPass, &smtpSecurity, &smtpSkipVerify,
+		&imapHost, &imapPort, &imapUser, &imapPass, &emailAddr, &plusAddressing,
+		&mailboxAction, &processedFolder, &unmatchedFolder, &mailProtocol); err != nil {
+		return user, err
+	}
+
+	user.SMTPHost = smtpHost.String
+	user.SMTPPort = smtpPort.String
+	user.SMTPUsername = smtpUser.String
+	user.SMTPPassword = smtpPass.String
+	user.SMTPSecurity = smtpSecurity.String
+	user.SMTPInsecure = smtpSkipVerify.Bool
+	user.IMAPHost = imapHost.String
+	user.IMAPPort = imapPort.String
+	user.IMAPUsername = imapUser.String
+	user.IMAPPassword = imapPass.String
+	user.EmailAddress = emailAddr.String
+	user.PlusAddressing = plusAddressing.Bool
+	user.MailboxAction = ResolveMailboxAction(mailboxAction.String)
+	user.ProcessedFolder = processedFolder.String
+	user.UnmatchedFolder = unmatchedFolder.String
+	user.MailProtocol = ResolveMailProtocol(mailProtocol.String)
+	return user, nil
+}
+
+// LoadUserEmailConfig loads the mail server settings of a user
+func LoadUserEmailConfig(userID int) (models.User, error) {
+	user, err := scanUserEmailConfig(db.DB.QueryRow("SELECT "+userEmailColumns+" FROM users WHERE id = ?", userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return user, ErrUserNotFound
+		}
+		return user, err
+	}
+	return user, nil
+}
+
 // ProcessIncomingEmails fetches and processes all new emails for all users
 func (s *EmailService) ProcessIncomingEmails() error {
 	log.Println("Processing incoming emails for all users...")
 
-	rows, err := db.DB.Query("SELECT id, smtp_host, smtp_port, smtp_username, smtp_password, imap_host, imap_port, imap_username, imap_password, email_address FROM users WHERE smtp_host != '' AND email_address != ''")
+	rows, err := db.DB.Query("SELECT " + userEmailColumns + " FROM users WHERE smtp_host != '' AND email_address != ''")
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var user models.User
-		var smtpHost, smtpPort, smtpUser, smtpPass, imapHost, imapPort, imapUser, imapPass, emailAddr sql.NullString
-
-		if err := rows.Scan(&user.ID, &smtpHost, &smtpPort, &smtpUser, &smtpPass, &imapHost, &imapPort, &imapUser, &imapPass, &emailAddr); err != nil {
+		user, err := scanUserEmailConfig(rows)
+		if err != nil {
 			log.Printf("Failed to scan user: %v", err)
 			continue
 		}
 
-		user.SMTPHost = smtpHost.String
-		user.SMTPPort = smtpPort.String
-		user.SMTPUsername = smtpUser.String
-		user.SMTPPassword = smtpPass.String
-		user.IMAPHost = imapHost.String
-		user.IMAPPort = imapPort.String
-		user.IMAPUsername = imapUser.String
-		user.IMAPPassword = imapPass.String
-		user.EmailAddress = emailAddr.String
-
 		if err := s.processUserEmails(user); err != nil {
 			log.Printf("Failed to process emails for user %d: %v", user.ID, err)
 		}
@@ -359,30 +399,11 @@ func (s *EmailService) ProcessIncomingEmails() error {
 
 // ProcessUserEmails fetches and processes emails for a single user
 func (s *EmailService) ProcessUserEmails(userID int) error {
-	var user models.User
-	var smtpHost, smtpPort, smtpUser, smtpPass, imapHost, imapPort, imapUser, imapPass, emailAddr sql.NullString
-
-	err := db.DB.QueryRow(
-		"SELECT id, smtp_host, smtp_port, smtp_username, smtp_password, imap_host, imap_port, imap_username, imap_password, email_address FROM users WHERE id = ?",
-		userID,
-	).Scan(&user.ID, &smtpHost, &smtpPort, &smtpUser, &smtpPass, &imapHost, &imapPort, &imapUser, &imapPass, &emailAddr)
+	user, err := LoadUserEmailConfig(userID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return ErrUserNotFound
-		}
 		return err
 	}
 
-	user.SMTPHost = smtpHost.String
-	user.SMTPPort = smtpPort.String
-	user.SMTPUsername = smtpUser.String
-	user.SMTPPassword = smtpPass.String
-	user.IMAPHost = imapHost.String
-	user.IMAPPort = imapPort.String
-	user.IMAPUsername = imapUser.String
-	user.IMAPPassword = imapPass.String
-	user.EmailAddress = emailAddr.String
-
 	if user.IMAPHost == "" || user.IMAPPort == "" || user.IMAPUsername == "" || user.IMAPPassword == "" || user.EmailAddress == "" {
 		return ErrEmailConfigIncomplete
 	}
@@ -390,140 +411,271 @@ func (s *EmailService) ProcessUserEmails(userID int) error {
 	return s.processUserEmails(user)
 }
 
+// lockUser serialises mailbox processing per user; the scheduler, the IDLE
+// watcher and manual fetches could otherwise ingest the same messages twice.
+func (s *EmailService) lockUser(userID int) func() {
+	m, _ := s.userLocks.LoadOrStore(userID, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
 func (s *EmailService) processUserEmails(user models.User) error {
+	unlock := s.lockUser(user.ID)
+	defer unlock()
+
 	log.Printf("Processing incoming emails for user %d (%s)...", user.ID, user.EmailAddress)
 
-	emails, err := s.FetchEmails(user)
+	state, err := loadMailboxSyncState(user.ID, inboxMailbox)
 	if err != nil {
-		return fmt.Errorf("failed to fetch emails: %w", err)
+		return fmt.Errorf("failed to load mailbox sync state: %w", err)
 	}
 
-	if len(emails) == 0 {
-		log.Println("No new emails to process")
+	processedCount := 0
+	var dispositions []MessageDisposition
+	next, fetchErr := s.readerFor(user).Fetch(user, state, func(raw RawMessage) error {
+		// The start of the message is kept in case it cannot be read
+		var excerpt excerptBuffer
+		if raw.Oversize {
+			excerpt.fill(raw.Body)
+			reason := fmt.Sprintf("message is %.1f MB, exceeding the %d MB limit; it was not downloaded",
+				float64(raw.Size)/(1<<20), s.Config.MaxMessageMB)
+			if err := s.queueUnreadableEmail(user.ID, excerpt.Bytes(), reason); err != nil {
+				return fmt.Errorf("failed to record oversize email (UID %d): %w", raw.UID, err)
+			}
+			if d, ok := unmatchedDisposition(user, raw.UID); ok {
+				dispositions = append(dispositions, d)
+			}
+			return nil
+		}
+		email, err := s.parseEmail(io.TeeReader(raw.Body, &excerpt))
+		if err != nil {
+			excerpt.fill(raw.Body)
+			// Parsing again would fail the same way: keep the message for
+			// triage and move on
+			log.Printf("Failed to parse email (UID %d): %v", raw.UID, err)
+			if err := s.queueUnreadableEmail(user.ID, excerpt.Bytes(), err.Error()); err != nil {
+				return fmt.Errorf("failed to record unparseable email (UID %d): %w", raw.UID, err)
+			}
+			if d, ok := unmatchedDisposition(user, raw.UID); ok {
+				dispositions = append(dispositions, d)
+			}
+			return nil
+		}
+		email.UID = raw.UID
+		defer removeSpooledAttachments(email.Attachments)
+
+		res := s.ingestEmail(user, email, false)
+		switch res.Outcome {
+		case IngestReply:
+			processedCount++
+			if d, ok := replyDisposition(user, res.Match.ProjectID, email.UID); ok {
+				dispositions = append(dispositions, d)
+			}
+		case IngestBounce:
+			processedCount++
+			if d, ok := bounceDisposition(email.UID); ok {
+				dispositions = append(dispositions, d)
+			}
+		case IngestUnmatched:
+			if d, ok := unmatchedDisposition(user, email.UID); ok {
+				dispositions = append(dispositions, d)
+			}
+		case IngestFailed:
+			// Stop before this message so that the next run fetches it again
+			return fmt.Errorf("failed to store email %s (UID %d): %w", email.MessageID, raw.UID, res.Err)
+		}
 		return nil
+	})
+
+	// Whatever was handled before a failure is kept
+	s.organizeMailbox(user, dispositions)
+	if next != state {
+		if err := saveMailboxSyncState(next); err != nil {
+			return fmt.Errorf("failed to save mailbox sync state: %w", err)
+		}
+	}
+	if fetchErr != nil {
+		return fmt.Errorf("failed to fetch emails: %w", fetchErr)
 	}
 
-	uploadDir := "./uploads/replies"
-	os.MkdirAll(uploadDir, 0755)
+	log.Printf("Processed %d new emails", processedCount)
+	return nil
+}
 
-	processedCount := 0
-	for _, email := range emails {
-		var existingID int
-		err := db.DB.QueryRow("SELECT id FROM replies WHERE message_id = ?", email.MessageID).Scan(&existingID)
-		if err == nil {
-			continue
-		}
+// Outcomes of ingesting one message
+const (
+	IngestReply     = "reply"
+	IngestUnmatched = "unmatched"
+	IngestBounce    = "bounce"
+	IngestDuplicate = "duplicate"
+	IngestFailed    = "failed"
+)
+
+type ingestResult struct {
+	Outcome string
+	Match   replyMatch
+	Err     error
+}
+
+// ingestEmail runs one parsed message through the shared pipeline: bounces
+// update the delivery status, replies are stored under their project and the
+// rest is queued for triage. With dryRun nothing is written and the result
+// only tells what would happen.
+func (s *EmailService) ingestEmail(user models.User, email models.EmailMessage, dryRun bool) ingestResult {
+	if s.isKnownMessage(user.ID, email.MessageID) {
+		return ingestResult{Outcome: IngestDuplicate}
+	}
 
-		var projectID int
-		var teacherID sql.NullInt64
-
-		if email.InReplyTo != "" {
-			var tid int
-			log.Printf("Looking up project from In-Reply-To: %s", email.InReplyTo)
-			// Ensure project belongs to user
-			err := db.DB.QueryRow(`
-				SELECT se.project_id, se.teacher_id 
-				FROM sent_emails se
-				JOIN projects p ON se.project_id = p.id
-				WHERE se.message_id = ? AND p.created_by = ?`,
-				email.InReplyTo, user.ID).Scan(&projectID, &tid)
-			if err == nil {
-				teacherID.Int64 = int64(tid)
-				teacherID.Valid = true
-				log.Printf("Identified project %d from In-Reply-To %s", projectID, email.InReplyTo)
+	if email.Bounce != nil {
+		if !dryRun {
+			if err := s.processBounce(user, email); err != nil {
+				log.Printf("Failed to process bounce %s: %v", email.MessageID, err)
+				return ingestResult{Outcome: IngestFailed, Err: err}
 			}
 		}
+		return ingestResult{Outcome: IngestBounce}
+	}
 
-		if projectID == 0 {
-			var tid int
-			err := db.DB.QueryRow("SELECT id FROM teachers WHERE email = ?", email.From).Scan(&tid)
-			if err == nil {
-				teacherID.Int64 = int64(tid)
-				teacherID.Valid = true
-
-				rows, err := db.DB.Query(`
-					SELECT p.id FROM projects p
-					JOIN project_members pm ON p.id = pm.project_id
-					WHERE pm.teacher_id = ? AND p.status = 'active' AND p.created_by = ?
-				`, tid, user.ID)
-				if err == nil {
-					var pids []int
-					for rows.Next() {
-						var pid int
-						rows.Scan(&pid)
-						pids = append(pids, pid)
-					}
-					rows.Close()
-
-					if len(pids) == 1 {
-						projectID = pids[0]
-						log.Printf("Identified project %d from sender %s (single active project)", projectID, email.From)
-					} else if len(pids) > 1 {
-						log.Printf("Ambiguous project for sender %s (multiple active projects: %v)", email.From, pids)
-					}
-				}
+	match := s.identifyProject(user, email)
+	if match.ProjectID == 0 {
+		if !dryRun {
+			log.Printf("Could not identify project for email %s, queueing it for triage", email.MessageID)
+			if err := s.queueUnmatchedEmail(user.ID, email, match); err != nil {
+				log.Printf("Failed to queue unmatched email %s: %v", email.MessageID, err)
+				return ingestResult{Outcome: IngestFailed, Match: match, Err: err}
 			}
 		}
+		return ingestResult{Outcome: IngestUnmatched, Match: match}
+	}
 
-		if projectID == 0 {
-			log.Printf("Skipping email %s: could not identify project", email.MessageID)
-			continue
+	if !dryRun {
+		if _, err := s.storeReply(match.ProjectID, match.TeacherID, email); err != nil {
+			log.Printf("Failed to insert reply: %v", err)
+			return ingestResult{Outcome: IngestFailed, Match: match, Err: err}
 		}
+	}
+	return ingestResult{Outcome: IngestReply, Match: match}
+}
 
-		headersJSON := "{}"
+// isKnownMessage reports whether a Message-ID was already stored as a reply,
+// queued for triage or recorded as a bounce
+func (s *EmailService) isKnownMessage(userID int, messageID string) bool {
+	var existingID int
+	if err := db.DB.QueryRow("SELECT id FROM replies WHERE message_id = ?", messageID).Scan(&existingID); err == nil {
+		return true
+	}
+	if err := db.DB.QueryRow("SELECT id FROM unmatched_emails WHERE user_id = ? AND message_id = ?", userID, messageID).Scan(&existingID); err == nil {
+		return true
+	}
+	err := db.DB.QueryRow("SELECT id FROM email_bounces WHERE user_id = ? AND message_id = ?", userID, messageID).Scan(&existingID)
+	return err == nil
+}
 
-		result, err := db.DB.Exec(`
-			INSERT INTO replies (project_id, teacher_id, from_email, subject, message_id, in_reply_to, received_at, raw_headers, raw_body)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			projectID, teacherID, email.From, email.Subject, email.MessageID, email.InReplyTo, email.ReceivedAt, headersJSON, email.Body)
+// storeReply records an email as a reply to a project: it inserts the reply,
+// saves its attachments and marks the teacher as replied. Automatic matching
+// and manual triage both go through here.
+func (s *EmailService) storeReply(projectID int, teacherID sql.NullInt64, email models.EmailMessage) (int64, error) {
+	headersJSON, err := json.Marshal(email.RawHeaders)
+	if err != nil || email.RawHeaders == nil {
+		headersJSON = []byte("{}")
+	}
 
-		if err != nil {
-			log.Printf("Failed to insert reply: %v", err)
-			continue
-		}
+	autoReason, isAutoReply := detectAutoReply(email)
 
-		replyID, _ := result.LastInsertId()
+	result, err := db.DB.Exec(`
+		INSERT INTO replies (project_id, teacher_id, from_email, subject, message_id, in_reply_to, received_at, raw_headers, raw_body, body_text, is_auto_reply)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		projectID, teacherID, email.From, email.Subject, email.MessageID, email.InReplyTo, email.ReceivedAt,
+		string(headersJSON), email.Body, email.TextBody, isAutoReply)
+	if err != nil {
+		return 0, err
+	}
 
-		for _, att := range email.Attachments {
+	replyID, _ := result.LastInsertId()
+
+	uploadDir := "./uploads/replies"
+	os.MkdirAll(uploadDir, 0755)
+
+	for i, att := range email.Attachments {
+		status, storedPath := AttachmentStatusRejected, ""
+		if att.RejectReason == "" {
 			timestamp := time.Now().Unix()
 			safeName := s.sanitizeAttachmentName(att.Filename)
-			storedFilename := fmt.Sprintf("%d_%d_%s", projectID, timestamp, safeName)
-			storedPath := filepath.Join(uploadDir, storedFilename)
+			storedFilename := fmt.Sprintf("%d_%d_%d_%s", projectID, timestamp, i, safeName)
+			storedPath = filepath.Join(uploadDir, storedFilename)
 
-			if err := os.WriteFile(storedPath, att.Data, 0644); err != nil {
+			if err := moveFile(att.Path, storedPath); err != nil {
 				log.Printf("Failed to save attachment %s: %v", att.Filename, err)
 				continue
 			}
-
+			status = AttachmentStatusStored
 			log.Printf("Saved attachment: %s", storedPath)
+		}
 
-			_, err := db.DB.Exec(`
-				INSERT INTO attachments (reply_id, project_id, teacher_id, original_filename, stored_path, content_type, file_size)
-				VALUES (?, ?, ?, ?, ?, ?, ?)`,
-				replyID, projectID, teacherID, att.Filename, storedPath, att.ContentType, len(att.Data))
+		res, err := db.DB.Exec(`
+			INSERT INTO attachments (reply_id, project_id, teacher_id, original_filename, stored_path, content_type, file_size, status, reject_reason)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			replyID, projectID, teacherID, att.Filename, storedPath, att.ContentType, att.Size, status, nullString(att.RejectReason))
 
-			if err != nil {
-				log.Printf("Failed to insert attachment record: %v", err)
-			}
+		if err != nil {
+			log.Printf("Failed to insert attachment record: %v", err)
+			continue
+		}
+		if status == AttachmentStatusStored && archiveKind(att.Filename) != "" {
+			attachmentID, _ := res.LastInsertId()
+			s.extractArchive(replyID, projectID, teacherID, attachmentID, storedPath, att.Filename)
 		}
+	}
 
-		if teacherID.Valid {
-			_, err = db.DB.Exec(`
-				UPDATE project_members 
-				SET current_status = 'replied', last_reply_at = ?
-				WHERE project_id = ? AND teacher_id = ?`,
-				email.ReceivedAt, projectID, teacherID.Int64)
+	// The attachments of an automatic reply are kept but not aggregated
+	var parsed []parsedAttachment
+	if !isAutoReply {
+		parsed = s.parseReplyAttachments(projectID, replyID)
+	}
 
-			if err != nil {
-				log.Printf("Failed to update project_members: %v", err)
+	if teacherID.Valid && isAutoReply {
+		// An out-of-office answer must not mark the teacher as done
+		log.Printf("Email %s is an automatic reply (%s)", email.MessageID, autoReason)
+		_, err = db.DB.Exec(`
+			UPDATE project_members 
+			SET current_status = ?
+			WHERE project_id = ? AND teacher_id = ? AND current_status IN ('pending', ?)`,
+			MemberStatusAutoReplied, projectID, teacherID.Int64, MemberStatusAutoReplied)
+		if err != nil {
+			log.Printf("Failed to update project_members: %v", err)
+		}
+
+		if s.Config != nil && s.Config.AutoReplyFollowUp {
+			if returnDate, ok := parseReturnDate(email.TextBody, email.ReceivedAt); ok {
+				scheduleFollowUpReminder(projectID, teacherID.Int64, replyID, returnDate)
 			}
 		}
+	} else if teacherID.Valid {
+		// A failed submission asks for a revision; a reply without any checked
+		// file does not clear an earlier request
+		checked, failed := s.validateReplyAttachments(projectID, teacherID, parsed)
+		s.recordSubmission(projectID, teacherID.Int64, replyID, submissionValidation(checked, failed))
+		status := "IF(current_status = '" + MemberStatusNeedsRevision + "', current_status, 'replied')"
+		switch {
+		case failed > 0:
+			status = "'" + MemberStatusNeedsRevision + "'"
+		case checked > 0:
+			status = "'replied'"
+		}
+		_, err = db.DB.Exec(`
+			UPDATE project_members 
+			SET current_status = `+status+`, last_reply_at = ?
+			WHERE project_id = ? AND teacher_id = ?`,
+			email.ReceivedAt, projectID, teacherID.Int64)
 
-		processedCount++
+		if err != nil {
+			log.Printf("Failed to update project_members: %v", err)
+		}
+		cancelScheduledReminders(projectID, teacherID.Int64)
 	}
 
-	log.Printf("Processed %d new emails", processedCount)
-	return nil
+	return replyID, nil
 }
 
 func (s *EmailService) sanitizeAttachmentName(name string) string {
@@ -0,0 +1,568 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Kinds of typed cells; text cells have none
+const (
+	cellNumber = "n"
+	cellDate   = "d"
+	cellBool   = "b"
+	cellError  = "e"
+)
+
+// How the aggregated sheet treats formulas of the submissions
+const (
+	AggregationFormulasValue    = ""         // their results
+	AggregationFormulasPreserve = "preserve" // the formulas, where their references can follow the row
+)
+
+// Number formats of dates and times whose format is locale-dependent or not
+// known
+const (
+	dateFormatCode     = "yyyy-mm-dd"
+	dateTimeFormatCode = "yyyy-mm-dd hh:mm:ss"
+	timeFormatCode     = "hh:mm:ss"
+)
+
+// builtinFormats are the codes of the built-in number formats. The short
+// date formats 14 and 22 follow the system locale in Excel and are written
+// in ISO form.
+var builtinFormats = map[int]string{
+	1: "0", 2: "0.00", 3: "#,##0", 4: "#,##0.00", 9: "0%", 10: "0.00%",
+	11: "0.00E+00", 12: "# ?/?", 13: "# ??/??",
+	14: dateFormatCode, 15: "d-mmm-yy", 16: "d-mmm", 17: "mmm-yy",
+	18: "h:mm AM/PM", 19: "h:mm:ss AM/PM", 20: "hh:mm", 21: timeFormatCode, 22: "yyyy-mm-dd hh:mm",
+	37: "#,##0 ;(#,##0)", 38: "#,##0 ;[Red](#,##0)", 39: "#,##0.00;(#,##0.00)", 40: "#,##0.00;[Red](#,##0.00)",
+	45: "mm:ss", 46: "[h]:mm:ss", 47: "mm:ss.0", 48: "##0.0E+0", 49: "@",
+}
+
+// formatCode returns the code of number format id: a custom code first, then
+// a built-in one. The CJK built-in dates and times get a default code.
+func formatCode(id int, custom map[int]string) string {
+	if code, ok := custom[id]; ok {
+		return code
+	}
+	if code, ok := builtinFormats[id]; ok {
+		return code
+	}
+	switch {
+	case id >= 32 && id <= 35, id == 55 || id == 56:
+		return timeFormatCode
+	case id >= 27 && id <= 36, id >= 50 && id <= 58:
+		return dateFormatCode
+	}
+	return ""
+}
+
+// styleFormat returns the number format code of a cell style
+func styleFormat(style *excelize.Style) string {
+	if style.CustomNumFmt != nil {
+		return *style.CustomNumFmt
+	}
+	return formatCode(style.NumFmt, nil)
+}
+
+// sheetCell is a worksheet cell. text is what header matching, validation
+// and the data API see: numbers without formatting, dates as "2006-01-02",
+// booleans as TRUE or FALSE. Numbers, dates and booleans also keep their
+// value, so they are written back to the aggregated workbook as such.
+type sheetCell struct {
+	text   string
+	kind   string  // cellNumber, cellDate, cellBool, cellError; "" for text
+	number float64 // the number, the date serial in the 1900 date system, or 1 for TRUE
+	format string  // number format code of the source cell; "" for General
+	// formula is the formula of the source cell with its references
+	// translated to column headers (see translateFormula)
+	formula []formulaPart
+	// source is the formula as read, until mapSheet translates it
+	source string
+}
+
+func numberCell(n float64, format string) sheetCell {
+	return sheetCell{text: numberText(n), kind: cellNumber, number: n, format: format}
+}
+
+func boolCell(b bool) sheetCell {
+	if b {
+		return sheetCell{text: "TRUE", kind: cellBool, number: 1}
+	}
+	return sheetCell{text: "FALSE", kind: cellBool}
+}
+
+// dateCell makes a date or time cell from an Excel serial number
+func dateCell(serial float64, date1904 bool, format string) (sheetCell, bool) {
+	t, err := excelize.ExcelDateToTime(serial, date1904)
+	if err != nil {
+		return sheetCell{}, false
+	}
+	// Times of day are the same in both date systems
+	if date1904 && serial >= 1 {
+		serial += 1462
+	}
+	cell := sheetCell{kind: cellDate, number: serial, format: format}
+	switch {
+	case serial < 1:
+		cell.text = t.Format("15:04:05")
+	case serial == math.Trunc(serial):
+		cell.text = t.Format("2006-01-02")
+	default:
+		cell.text = t.Format("2006-01-02 15:04:05")
+	}
+	return cell, true
+}
+
+// timeCell makes a date cell of the wall-clock time of t
+func timeCell(t time.Time, format string) sheetCell {
+	cell, _ := dateCell(excelSerial(t), false, format)
+	return cell
+}
+
+// excelSerial converts the wall-clock time of t to a serial number of the
+// 1900 date system
+func excelSerial(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	return float64(wall.Unix()-epoch.Unix()) / 86400
+}
+
+// numberText renders a number as a General cell shows it: to 15 significant
+// digits and without exponent
+func numberText(n float64) string {
+	n, _ = strconv.ParseFloat(strconv.FormatFloat(n, 'g', 15, 64), 64)
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// value is what the aggregated workbook stores for the cell
+func (c sheetCell) value() interface{} {
+	switch c.kind {
+	case cellNumber, cellDate:
+		return c.number
+	case cellBool:
+		return c.number != 0
+	}
+	return c.text
+}
+
+// withFormat applies the number format of a template column: text that
+// reads as a number, or as a date in a date column, is typed, and numbers
+// and dates take the template's format
+func (c sheetCell) withFormat(code string) sheetCell {
+	if code == "" || code == "@" {
+		return c
+	}
+	date := isDateFormatCode(code)
+	if c.kind == "" {
+		if t, ok := parseCellDate(c.text); ok && date {
+			c = timeCell(t, "")
+		} else if n, ok := parseCellNumber(c.text); ok && !date {
+			c = numberCell(n, "")
+		}
+	}
+	if c.kind == cellNumber || c.kind == cellDate {
+		c.format = code
+	}
+	return c
+}
+
+// storedCell is the JSON form of a typed cell in submission_rows; text
+// cells are stored as plain strings
+type storedCell struct {
+	Text    string        `json:"v"`
+	Kind    string        `json:"t,omitempty"`
+	Number  float64       `json:"n,omitempty"`
+	Format  string        `json:"f,omitempty"`
+	Formula []formulaPart `json:"fx,omitempty"`
+}
+
+func (c sheetCell) MarshalJSON() ([]byte, error) {
+	if c.kind == "" && c.formula == nil {
+		return json.Marshal(c.text)
+	}
+	return json.Marshal(storedCell{Text: c.text, Kind: c.kind, Number: c.number, Format: c.format, Formula: c.formula})
+}
+
+func (c *sheetCell) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*c = sheetCell{}
+		return json.Unmarshal(data, &c.text)
+	}
+	var stored storedCell
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*c = sheetCell{text: stored.Text, kind: stored.Kind, number: stored.Number, format: stored.Format, formula: stored.Formula}
+	return nil
+}
+
+// cellTexts returns the texts of rows of cells
+func cellTexts(rows [][]sheetCell) [][]string {
+	texts := make([][]string, len(rows))
+	for i, row := range rows {
+		texts[i] = make([]string, len(row))
+		for j, cell := range row {
+			texts[i][j] = cell.text
+		}
+	}
+	return texts
+}
+
+// readXLSX reads the first worksheet of an .xlsx or .xlsm workbook with the
+// type and number format of every cell. Formulas without a cached result,
+// as some generators write them, are evaluated.
+func readXLSX(path string) ([][]sheetCell, error) {
+	file, err := excelize.OpenFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open attachment: %w", err)
+	}
+	defer file.Close()
+
+	sheets := file.GetSheetList()
+	if len(sheets) == 0 {
+		return nil, errors.New("workbook has no sheets")
+	}
+	sheet := sheets[0]
+	raw, err := file.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+	props, _ := file.GetWorkbookProps()
+	date1904 := props.Date1904 != nil && *props.Date1904
+
+	formats := make(map[int]string) // cell style -> number format code
+	format := func(axis string) string {
+		idx, err := file.GetCellStyle(sheet, axis)
+		if err != nil {
+			return ""
+		}
+		code, ok := formats[idx]
+		if !ok {
+			if style, err := file.GetStyle(idx); err == nil {
+				code = styleFormat(style)
+			}
+			formats[idx] = code
+		}
+		return code
+	}
+
+	// Formula cells without a result are empty in raw. They are only looked
+	// for under the header, the first non-blank row, whose columns are all a
+	// submission is read by; elsewhere only cells holding a value are
+	// visited, so a stray cell far to the right does not widen every row.
+	var header []int
+	for _, rawRow := range raw {
+		for c, value := range rawRow {
+			if strings.TrimSpace(value) != "" {
+				header = append(header, c)
+			}
+		}
+		if header != nil {
+			break
+		}
+	}
+	isHeader := make(map[int]bool, len(header))
+	for _, c := range header {
+		isHeader[c] = true
+	}
+
+	rows := make([][]sheetCell, len(raw))
+	for r, rawRow := range raw {
+		var row []sheetCell
+		visit := func(c int) {
+			axis, _ := excelize.CoordinatesToCellName(c+1, r+1)
+			value := ""
+			if c < len(rawRow) {
+				value = rawRow[c]
+			}
+			formula, _ := file.GetCellFormula(sheet, axis)
+			if value == "" && formula == "" {
+				return
+			}
+			typ, _ := file.GetCellType(sheet, axis)
+			if value == "" {
+				value, _ = file.CalcCellValue(sheet, axis, excelize.Options{RawCellValue: true})
+				switch {
+				case value == "TRUE" || value == "FALSE":
+					typ = excelize.CellTypeBool
+				case strings.HasPrefix(value, "#"):
+					typ = excelize.CellTypeError
+				default:
+					typ = excelize.CellTypeUnset
+				}
+			}
+			for len(row) < c {
+				row = append(row, sheetCell{})
+			}
+			cell := xlsxCell(typ, value, format(axis), date1904)
+			cell.source = formula
+			row = append(row, cell)
+		}
+		for c, value := range rawRow {
+			if value != "" || isHeader[c] {
+				visit(c)
+			}
+		}
+		for _, c := range header {
+			if c >= len(rawRow) {
+				visit(c)
+			}
+		}
+		rows[r] = row
+	}
+	return rows, nil
+}
+
+// xlsxCell types the raw value of an .xlsx cell
+func xlsxCell(typ excelize.CellType, value, format string, date1904 bool) sheetCell {
+	switch typ {
+	case excelize.CellTypeBool:
+		return boolCell(value == "1" || value == "TRUE")
+	case excelize.CellTypeError:
+		return sheetCell{text: value, kind: cellError}
+	case excelize.CellTypeDate:
+		// ISO 8601 dates of cells with t="d"
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return timeCell(t, format)
+			}
+		}
+	case excelize.CellTypeNumber, excelize.CellTypeUnset:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			break
+		}
+		if isDateFormatCode(format) {
+			if cell, ok := dateCell(n, date1904, format); ok {
+				return cell
+			}
+		}
+		return numberCell(n, format)
+	}
+	return sheetCell{text: value}
+}
+
+// formulaPart is literal formula text, or a reference to cells of the
+// formula's own row by column header: one column, or several for a range
+// such as B2:D2
+type formulaPart struct {
+	Text    string   `json:"s,omitempty"`
+	Columns []string `json:"c,omitempty"`
+}
+
+// translateFormula rewrites the references of a formula in the given row to
+// column headers, so the formula can follow its row into the aggregated
+// sheet. header names the column of a reference, from 1. Only formulas
+// whose references all lie in their own row and in mapped columns are
+// translated: references to other rows, sheets or defined names would point
+// elsewhere once the rows of many files are merged.
+func translateFormula(formula string, row int, header func(col int) (string, bool)) ([]formulaPart, bool) {
+	var parts []formulaPart
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			parts = append(parts, formulaPart{Text: text.String()})
+			text.Reset()
+		}
+	}
+	// ref reads the word at i as a reference to a column of the row
+	ref := func(i int) (col, end int, ok bool) {
+		end = i
+		for end < len(formula) && isFormulaWordByte(formula[end]) {
+			end++
+		}
+		col, r, err := excelize.CellNameToCoordinates(strings.ReplaceAll(formula[i:end], "$", ""))
+		return col, end, err == nil && r == row
+	}
+
+	for i := 0; i < len(formula); {
+		ch := formula[i]
+		switch {
+		case ch == '"':
+			end := i + 1
+			for end < len(formula) {
+				if formula[end] == '"' {
+					if end+1 < len(formula) && formula[end+1] == '"' {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			if end >= len(formula) {
+				return nil, false
+			}
+			text.WriteString(formula[i : end+1])
+			i = end + 1
+		case ch == '\'' || ch == '[' || ch == '!' || ch == ':':
+			// Other sheets, other workbooks, tables and whole rows or columns
+			return nil, false
+		case ch >= '0' && ch <= '9' || ch == '.':
+			end := i
+			for end < len(formula) && (formula[end] >= '0' && formula[end] <= '9' || formula[end] == '.') {
+				end++
+			}
+			if end+1 < len(formula) && (formula[end] == 'E' || formula[end] == 'e') &&
+				(formula[end+1] == '+' || formula[end+1] == '-' || formula[end+1] >= '0' && formula[end+1] <= '9') {
+				end += 2
+				for end < len(formula) && formula[end] >= '0' && formula[end] <= '9' {
+					end++
+				}
+			}
+			text.WriteString(formula[i:end])
+			i = end
+		case isFormulaWordByte(ch):
+			end := i
+			for end < len(formula) && isFormulaWordByte(formula[end]) {
+				end++
+			}
+			word := formula[i:end]
+			if end < len(formula) && formula[end] == '(' {
+				text.WriteString(word)
+				i = end
+				break
+			}
+			if w := strings.ToUpper(word); w == "TRUE" || w == "FALSE" {
+				text.WriteString(word)
+				i = end
+				break
+			}
+			first, end, ok := ref(i)
+			if !ok {
+				return nil, false
+			}
+			last := first
+			if end+1 < len(formula) && formula[end] == ':' {
+				if last, end, ok = ref(end + 1); !ok {
+					return nil, false
+				}
+			}
+			if first > last {
+				first, last = last, first
+			}
+			var columns []string
+			for col := first; col <= last; col++ {
+				h, ok := header(col)
+				if !ok {
+					return nil, false
+				}
+				columns = append(columns, h)
+			}
+			flush()
+			parts = append(parts, formulaPart{Columns: columns})
+			i = end
+		default:
+			text.WriteByte(ch)
+			i++
+		}
+	}
+	flush()
+	return parts, true
+}
+
+func isFormulaWordByte(ch byte) bool {
+	return ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+		ch == '_' || ch == '.' || ch == '$' || ch == '\\' || ch >= 0x80
+}
+
+// renderFormula writes a translated formula for a cell in the given row;
+// column gives the sheet column of a header, from 1. It fails when a range
+// no longer covers adjacent columns in the same order.
+func renderFormula(parts []formulaPart, row int, column func(header string) (int, bool)) (string, bool) {
+	var b strings.Builder
+	for _, part := range parts {
+		if part.Columns == nil {
+			b.WriteString(part.Text)
+			continue
+		}
+		first, ok := column(part.Columns[0])
+		if !ok {
+			return "", false
+		}
+		for i, h := range part.Columns[1:] {
+			if col, ok := column(h); !ok || col != first+i+1 {
+				return "", false
+			}
+		}
+		ref, _ := excelize.CoordinatesToCellName(first, row)
+		b.WriteString(ref)
+		if n := len(part.Columns); n > 1 {
+			end, _ := excelize.CoordinatesToCellName(first+n-1, row)
+			b.WriteString(":" + end)
+		}
+	}
+	return b.String(), true
+}
+
+// cellWriter streams rows of typed cells to a sheet, with one style per
+// number format. The stream keeps formula results numeric, which setting a
+// formula on a written cell does not.
+type cellWriter struct {
+	book   *excelize.File
+	stream *excelize.StreamWriter
+	styles map[string]int
+}
+
+func newCellWriter(book *excelize.File, sheet string) (*cellWriter, error) {
+	stream, err := book.NewStreamWriter(sheet)
+	if err != nil {
+		return nil, err
+	}
+	return &cellWriter{book: book, stream: stream, styles: make(map[string]int)}, nil
+}
+
+// cell returns the stream cell of c with formula, if any. Numbers and dates
+// get their number format; dates without one a default date or time format.
+func (w *cellWriter) cell(c sheetCell, formula string) (interface{}, error) {
+	if c.text == "" && c.kind == "" {
+		return nil, nil
+	}
+	code := c.format
+	if code == "" && c.kind == cellDate {
+		switch {
+		case c.number < 1:
+			code = timeFormatCode
+		case c.number == math.Trunc(c.number):
+			code = dateFormatCode
+		default:
+			code = dateTimeFormatCode
+		}
+	}
+	cell := excelize.Cell{Value: c.value(), Formula: formula}
+	if code == "" || (c.kind != cellNumber && c.kind != cellDate) {
+		return cell, nil
+	}
+	style, ok := w.styles[code]
+	if !ok {
+		var err error
+		if style, err = w.book.NewStyle(&excelize.Style{CustomNumFmt: &code}); err != nil {
+			return nil, err
+		}
+		w.styles[code] = style
+	}
+	cell.StyleID = style
+	return cell, nil
+}
+
+// row writes the cells of row, from 1
+func (w *cellWriter) row(row int, cells []interface{}) error {
+	axis, err := excelize.CoordinatesToCellName(1, row)
+	if err != nil {
+		return err
+	}
+	return w.stream.SetRow(axis, cells)
+}
+
+// flush ends the sheet; the workbook can be changed again afterwards
+func (w *cellWriter) flush() error {
+	return w.stream.Flush()
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// TestReadXLSXSparse reads a sheet with a formula lacking a cached result
+// and stray cells in the last column, which must not widen the other rows
+func TestReadXLSXSparse(t *testing.T) {
+	f := excelize.NewFile()
+	sheet := f.GetSheetName(0)
+	f.SetSheetRow(sheet, "A1", &[]interface{}{"姓名", "学时", "合计"})
+	f.SetCellValue(sheet, "XFD1", "备注")
+	const n = 1000
+	for r := 2; r <= n+1; r++ {
+		cell, _ := excelize.CoordinatesToCellName(1, r)
+		f.SetSheetRow(sheet, cell, &[]interface{}{"张三", r})
+		cell, _ = excelize.CoordinatesToCellName(3, r)
+		f.SetCellFormula(sheet, cell, "B"+cell[1:]+"*2")
+	}
+	f.SetCellValue(sheet, "XFD3", "x")
+	path := filepath.Join(t.TempDir(), "sparse.xlsx")
+	if err := f.SaveAs(path); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := readXLSX(path)
+	if err != nil {
+		t.Fatalf("readXLSX: %v", err)
+	}
+	if len(rows) != n+1 {
+		t.Fatalf("%d rows, want %d", len(rows), n+1)
+	}
+	if got := rows[1][2]; got.text != "4" || got.source != "B2*2" {
+		t.Errorf("C2 = %q (%q), want the evaluated formula", got.text, got.source)
+	}
+	if len(rows[0]) != 16384 || rows[0][16383].text != "备注" {
+		t.Errorf("header has %d cells, want the one in XFD1", len(rows[0]))
+	}
+	if len(rows[2]) != 16384 || rows[2][16383].text != "x" {
+		t.Errorf("row 3 has %d cells, want the one in XFD3", len(rows[2]))
+	}
+	if len(rows[3]) != 3 {
+		t.Errorf("row 4 has %d cells, want 3", len(rows[3]))
+	}
+}
@@ -0,0 +1,778 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/richardlehane/mscfb"
+)
+
+// Workbook formats recognized by their content, not their extension
+const (
+	WorkbookFormatXLSX = "xlsx"
+	WorkbookFormatXLS  = "xls"  // Excel 97-2003 (BIFF8)
+	WorkbookFormatXLSB = "xlsb" // Excel binary workbook (BIFF12)
+)
+
+var errUnknownWorkbook = errors.New("not an Excel workbook")
+
+// workbookFormat sniffs the format of a workbook: an OLE compound file is a
+// legacy .xls, a zip package with xl/workbook.bin is .xlsb, any other zip is
+// left to excelize
+func workbookFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return "", errUnknownWorkbook
+	}
+	switch {
+	case bytes.Equal(magic, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}):
+		return WorkbookFormatXLS, nil
+	case bytes.HasPrefix(magic, []byte("PK")):
+		info, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return "", errUnknownWorkbook
+		}
+		for _, entry := range zr.File {
+			if strings.EqualFold(entry.Name, "xl/workbook.bin") {
+				return WorkbookFormatXLSB, nil
+			}
+		}
+		return WorkbookFormatXLSX, nil
+	}
+	return "", errUnknownWorkbook
+}
+
+// Size of a worksheet in Excel 2007 and later; cells beyond it mark a
+// corrupt file
+const (
+	sheetMaxRows    = 1048576
+	sheetMaxColumns = 16384
+)
+
+// sheetGrid collects cells by position and turns them into rows the way
+// excelize's GetRows does: trailing empty cells and rows are dropped
+type sheetGrid map[int]map[int]sheetCell
+
+// set stores a cell; a position outside the worksheet panics, which the
+// readers report as a corrupt file
+func (g sheetGrid) set(row, col int, cell sheetCell) {
+	if row < 0 || row >= sheetMaxRows || col < 0 || col >= sheetMaxColumns {
+		panic(fmt.Sprintf("cell (%d, %d) is outside the worksheet", row, col))
+	}
+	if cell.text == "" {
+		return
+	}
+	if g[row] == nil {
+		g[row] = make(map[int]sheetCell)
+	}
+	g[row][col] = cell
+}
+
+// setText sets a text cell
+func (g sheetGrid) setText(row, col int, text string) {
+	g.set(row, col, sheetCell{text: text})
+}
+
+func (g sheetGrid) rows() [][]sheetCell {
+	var indexes []int
+	for r := range g {
+		indexes = append(indexes, r)
+	}
+	sort.Ints(indexes)
+	if len(indexes) == 0 {
+		return nil
+	}
+	rows := make([][]sheetCell, indexes[len(indexes)-1]+1)
+	for _, r := range indexes {
+		last := 0
+		for c := range g[r] {
+			if c+1 > last {
+				last = c + 1
+			}
+		}
+		row := make([]sheetCell, last)
+		for c, v := range g[r] {
+			row[c] = v
+		}
+		rows[r] = row
+	}
+	return rows
+}
+
+// numberFormats tells date cells from plain numbers by the number format of
+// their cell style
+type numberFormats struct {
+	xfFormats []int          // cell style index -> number format id
+	custom    map[int]string // number format id -> format code
+	date1904  bool
+}
+
+// cell types a numeric cell by the number format of its style: dates and
+// times, or plain numbers
+func (n *numberFormats) cell(xf int, value float64) sheetCell {
+	code := ""
+	if xf >= 0 && xf < len(n.xfFormats) {
+		code = formatCode(n.xfFormats[xf], n.custom)
+	}
+	if isDateFormatCode(code) {
+		if cell, ok := dateCell(value, n.date1904, code); ok {
+			return cell
+		}
+	}
+	return numberCell(value, code)
+}
+
+// isDateFormatCode reports whether a custom number format shows a date or a
+// time, ignoring quoted text, escaped characters and bracketed colors or
+// locales
+func isDateFormatCode(code string) bool {
+	var b strings.Builder
+	inQuote := false
+	for i := 0; i < len(code); i++ {
+		ch := code[i]
+		switch {
+		case inQuote:
+			inQuote = ch != '"'
+		case ch == '"':
+			inQuote = true
+		case ch == '\\' || ch == '_' || ch == '*':
+			i++
+		case ch == '[':
+			end := strings.IndexByte(code[i:], ']')
+			if end < 0 {
+				return false
+			}
+			// [h], [mm] and [ss] are elapsed times
+			if inner := strings.ToLower(code[i+1 : i+end]); strings.Trim(inner, "hms") == "" && inner != "" {
+				b.WriteString(inner)
+			}
+			i += end
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	section, _, _ := strings.Cut(strings.ToLower(b.String()), ";")
+	if section == "general" {
+		return false
+	}
+	return strings.ContainsAny(section, "ymdhs")
+}
+
+// decodeRK decodes the compressed number of BIFF8 RK and BIFF12 RkNumber cells
+func decodeRK(rk uint32) float64 {
+	var value float64
+	if rk&0x02 != 0 {
+		value = float64(int32(rk) >> 2)
+	} else {
+		value = math.Float64frombits(uint64(rk&0xFFFFFFFC) << 32)
+	}
+	if rk&0x01 != 0 {
+		value /= 100
+	}
+	return value
+}
+
+// cellErrors maps BIFF error codes to their display text
+var cellErrors = map[byte]string{
+	0x00: "#NULL!", 0x07: "#DIV/0!", 0x0F: "#VALUE!", 0x17: "#REF!",
+	0x1D: "#NAME?", 0x24: "#NUM!", 0x2A: "#N/A", 0x2B: "#GETTING_DATA",
+}
+
+func errorCell(code byte) sheetCell {
+	return sheetCell{text: cellErrors[code], kind: cellError}
+}
+
+// readXLS reads the first worksheet of an Excel 97-2003 workbook
+func readXLS(path string) (rows [][]sheetCell, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The compound file reader may panic on a malformed file too
+	defer func() {
+		if r := recover(); r != nil {
+			rows, err = nil, fmt.Errorf("corrupt .xls file: %v", r)
+		}
+	}()
+
+	doc, err := mscfb.New(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid .xls file: %w", err)
+	}
+	var stream []byte
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		if entry.Name == "Workbook" {
+			if stream, err = io.ReadAll(entry); err != nil {
+				return nil, fmt.Errorf("failed to read workbook stream: %w", err)
+			}
+			break
+		}
+		if entry.Name == "Book" {
+			return nil, errors.New("Excel 5.0/95 workbooks are not supported; save the file as .xlsx")
+		}
+	}
+	if stream == nil {
+		return nil, errors.New("invalid .xls file: no workbook stream")
+	}
+	return parseBIFF8(stream)
+}
+
+// biffRecord is one record of a BIFF8 stream
+type biffRecord struct {
+	id   uint16
+	data []byte
+}
+
+func biffRecords(stream []byte, offset int) []biffRecord {
+	var records []biffRecord
+	for offset+4 <= len(stream) {
+		id := binary.LittleEndian.Uint16(stream[offset:])
+		size := int(binary.LittleEndian.Uint16(stream[offset+2:]))
+		offset += 4
+		if offset+size > len(stream) {
+			break
+		}
+		records = append(records, biffRecord{id: id, data: stream[offset : offset+size]})
+		offset += size
+		if id == 0x000A { // EOF
+			break
+		}
+	}
+	return records
+}
+
+// parseBIFF8 reads the first worksheet of a BIFF8 workbook stream
+func parseBIFF8(stream []byte) (rows [][]sheetCell, err error) {
+	// Malformed records would index out of range; report them as a bad file
+	defer func() {
+		if r := recover(); r != nil {
+			rows, err = nil, fmt.Errorf("corrupt .xls file: %v", r)
+		}
+	}()
+
+	globals := biffRecords(stream, 0)
+	if len(globals) == 0 || globals[0].id != 0x0809 {
+		return nil, errors.New("invalid .xls file: missing BOF record")
+	}
+	if version := binary.LittleEndian.Uint16(globals[0].data); version != 0x0600 {
+		return nil, errors.New("only Excel 97-2003 (BIFF8) .xls files are supported")
+	}
+
+	formats := &numberFormats{custom: make(map[int]string)}
+	var sst []string
+	sheetOffset := -1
+	for i := 0; i < len(globals); i++ {
+		rec := globals[i]
+		switch rec.id {
+		case 0x002F: // FILEPASS
+			return nil, errors.New("workbook is password protected")
+		case 0x0022: // DATEMODE
+			formats.date1904 = binary.LittleEndian.Uint16(rec.data) == 1
+		case 0x041E: // FORMAT
+			id := int(binary.LittleEndian.Uint16(rec.data))
+			r := &biffReader{segments: [][]byte{rec.data[2:]}}
+			formats.custom[id] = r.unicodeString(2)
+		case 0x00E0: // XF
+			formats.xfFormats = append(formats.xfFormats, int(binary.LittleEndian.Uint16(rec.data[2:])))
+		case 0x0085: // BOUNDSHEET
+			// The first worksheet; chart and macro sheets have a non-zero type
+			if sheetOffset == -1 && rec.data[5] == 0 {
+				sheetOffset = int(binary.LittleEndian.Uint32(rec.data))
+			}
+		case 0x00FC: // SST, continued in CONTINUE records
+			segments := [][]byte{rec.data[8:]}
+			for i+1 < len(globals) && globals[i+1].id == 0x003C {
+				i++
+				segments = append(segments, globals[i].data)
+			}
+			count := int(binary.LittleEndian.Uint32(rec.data[4:]))
+			sst = readSST(&biffReader{segments: segments}, count)
+		}
+	}
+	if sheetOffset < 0 || sheetOffset >= len(stream) {
+		return nil, errors.New("workbook has no sheets")
+	}
+
+	grid := sheetGrid{}
+	cell := func(data []byte) (row, col, xf int) {
+		return int(binary.LittleEndian.Uint16(data)), int(binary.LittleEndian.Uint16(data[2:])), int(binary.LittleEndian.Uint16(data[4:]))
+	}
+	records := biffRecords(stream, sheetOffset)
+	for i, rec := range records {
+		switch rec.id {
+		case 0x00FD: // LABELSST
+			row, col, _ := cell(rec.data)
+			if idx := int(binary.LittleEndian.Uint32(rec.data[6:])); idx < len(sst) {
+				grid.setText(row, col, sst[idx])
+			}
+		case 0x0204, 0x00D6: // LABEL, RSTRING
+			row, col, _ := cell(rec.data)
+			r := &biffReader{segments: [][]byte{rec.data[6:]}}
+			grid.setText(row, col, r.unicodeString(2))
+		case 0x0203: // NUMBER
+			row, col, xf := cell(rec.data)
+			value := math.Float64frombits(binary.LittleEndian.Uint64(rec.data[6:]))
+			grid.set(row, col, formats.cell(xf, value))
+		case 0x027E: // RK
+			row, col, xf := cell(rec.data)
+			grid.set(row, col, formats.cell(xf, decodeRK(binary.LittleEndian.Uint32(rec.data[6:]))))
+		case 0x00BD: // MULRK
+			row := int(binary.LittleEndian.Uint16(rec.data))
+			col := int(binary.LittleEndian.Uint16(rec.data[2:]))
+			for p := 4; p+6 <= len(rec.data)-2; p += 6 {
+				xf := int(binary.LittleEndian.Uint16(rec.data[p:]))
+				grid.set(row, col, formats.cell(xf, decodeRK(binary.LittleEndian.Uint32(rec.data[p+2:]))))
+				col++
+			}
+		case 0x0205: // BOOLERR
+			row, col, _ := cell(rec.data)
+			if rec.data[7] == 0 {
+				grid.set(row, col, boolCell(rec.data[6] != 0))
+			} else {
+				grid.set(row, col, errorCell(rec.data[6]))
+			}
+		case 0x0006: // FORMULA: the cached result; formulas are not kept
+			row, col, xf := cell(rec.data)
+			result := rec.data[6:14]
+			if result[6] != 0xFF || result[7] != 0xFF {
+				grid.set(row, col, formats.cell(xf, math.Float64frombits(binary.LittleEndian.Uint64(result))))
+				continue
+			}
+			switch result[0] {
+			case 0: // string, stored in the following STRING record
+				for _, next := range records[i+1:] {
+					if next.id == 0x0207 {
+						r := &biffReader{segments: [][]byte{next.data}}
+						grid.setText(row, col, r.unicodeString(2))
+						break
+					}
+					if next.id != 0x04BC && next.id != 0x0221 { // SHRFMLA, ARRAY
+						break
+					}
+				}
+			case 1:
+				grid.set(row, col, boolCell(result[2] != 0))
+			case 2:
+				grid.set(row, col, errorCell(result[2]))
+			}
+		}
+	}
+	return grid.rows(), nil
+}
+
+// readSST reads the shared strings of a BIFF8 workbook. count comes from the
+// file, so it only bounds the loop: the list grows with the strings actually
+// read.
+func readSST(r *biffReader, count int) []string {
+	var list []string
+	for i := 0; i < count && !r.done(); i++ {
+		list = append(list, r.richString())
+	}
+	return list
+}
+
+// biffReader reads BIFF8 strings from a record and its CONTINUE records.
+// When the characters of a string run into the next CONTINUE record, that
+// record starts with a fresh option byte telling whether they are one or two
+// bytes wide.
+type biffReader struct {
+	segments [][]byte
+	seg, pos int
+}
+
+func (r *biffReader) done() bool {
+	for r.seg < len(r.segments) && r.pos >= len(r.segments[r.seg]) {
+		r.seg++
+		r.pos = 0
+	}
+	return r.seg >= len(r.segments)
+}
+
+// remaining returns the bytes left in the record and its CONTINUE records
+func (r *biffReader) remaining() int {
+	if r.done() {
+		return 0
+	}
+	n := len(r.segments[r.seg]) - r.pos
+	for _, seg := range r.segments[r.seg+1:] {
+		n += len(seg)
+	}
+	return n
+}
+
+func (r *biffReader) bytes(n int) []byte {
+	// Lengths come from the file; check them before allocating
+	if n < 0 || n > r.remaining() {
+		panic("truncated string")
+	}
+	out := make([]byte, 0, n)
+	for len(out) < n && !r.done() {
+		seg := r.segments[r.seg]
+		take := n - len(out)
+		if avail := len(seg) - r.pos; take > avail {
+			take = avail
+		}
+		out = append(out, seg[r.pos:r.pos+take]...)
+		r.pos += take
+	}
+	if len(out) < n {
+		panic("truncated string")
+	}
+	return out
+}
+
+func (r *biffReader) uint16() int {
+	return int(binary.LittleEndian.Uint16(r.bytes(2)))
+}
+
+// unicodeString reads an XLUnicodeString whose length field has lenSize bytes
+func (r *biffReader) unicodeString(lenSize int) string {
+	var count int
+	if lenSize == 1 {
+		count = int(r.bytes(1)[0])
+	} else {
+		count = r.uint16()
+	}
+	flags := r.bytes(1)[0]
+	return r.chars(count, flags&0x01 != 0)
+}
+
+// richString reads an XLUnicodeRichExtendedString, skipping formatting runs
+// and phonetic data
+func (r *biffReader) richString() string {
+	count := r.uint16()
+	flags := r.bytes(1)[0]
+	runs, ext := 0, 0
+	if flags&0x08 != 0 {
+		runs = r.uint16()
+	}
+	if flags&0x04 != 0 {
+		ext = int(binary.LittleEndian.Uint32(r.bytes(4)))
+	}
+	s := r.chars(count, flags&0x01 != 0)
+	r.bytes(runs*4 + ext)
+	return s
+}
+
+func (r *biffReader) chars(count int, wide bool) string {
+	// Every character takes at least one byte
+	if count > r.remaining() {
+		panic("truncated string")
+	}
+	units := make([]uint16, 0, count)
+	for len(units) < count {
+		if r.seg >= len(r.segments) {
+			panic("truncated string")
+		}
+		seg := r.segments[r.seg]
+		if r.pos >= len(seg) {
+			// Continued in the next record with its own option byte
+			r.seg++
+			if r.seg >= len(r.segments) || len(r.segments[r.seg]) == 0 {
+				panic("truncated string")
+			}
+			wide = r.segments[r.seg][0]&0x01 != 0
+			r.pos = 1
+			continue
+		}
+		if wide {
+			if r.pos+2 > len(seg) {
+				panic("truncated string")
+			}
+			units = append(units, binary.LittleEndian.Uint16(seg[r.pos:]))
+			r.pos += 2
+		} else {
+			units = append(units, uint16(seg[r.pos]))
+			r.pos++
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// readXLSB reads the first worksheet of an Excel binary workbook
+func readXLSB(path string) ([][]sheetCell, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid .xlsb file: %w", err)
+	}
+	defer zr.Close()
+
+	parts := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		parts[strings.ToLower(f.Name)] = f
+	}
+	read := func(name string) ([]byte, error) {
+		f, ok := parts[strings.ToLower(name)]
+		if !ok {
+			return nil, nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, xlsbPartMaxSize))
+	}
+	return parseXLSB(read)
+}
+
+// parseXLSB reads the first worksheet of an Excel binary workbook whose parts
+// read returns, nil for a missing part
+func parseXLSB(read func(name string) ([]byte, error)) (rows [][]sheetCell, err error) {
+	// Malformed records would index out of range; report them as a bad file
+	defer func() {
+		if r := recover(); r != nil {
+			rows, err = nil, fmt.Errorf("corrupt .xlsb file: %v", r)
+		}
+	}()
+
+	workbook, err := read("xl/workbook.bin")
+	if err != nil {
+		return nil, err
+	}
+	rels, err := read("xl/_rels/workbook.bin.rels")
+	if err != nil {
+		return nil, err
+	}
+	sheetPath, date1904, err := xlsbFirstSheet(workbook, rels)
+	if err != nil {
+		return nil, err
+	}
+
+	formats := &numberFormats{custom: make(map[int]string), date1904: date1904}
+	if styles, err := read("xl/styles.bin"); err == nil && styles != nil {
+		xlsbStyles(styles, formats)
+	}
+	var sst []string
+	if shared, err := read("xl/sharedStrings.bin"); err == nil && shared != nil {
+		sst = xlsbSharedStrings(shared)
+	}
+	sheet, err := read(sheetPath)
+	if err != nil {
+		return nil, err
+	}
+	if sheet == nil {
+		return nil, fmt.Errorf("invalid .xlsb file: missing %s", sheetPath)
+	}
+	return xlsbSheet(sheet, sst, formats), nil
+}
+
+// BIFF12 record types
+const (
+	brtRowHdr         = 0
+	brtCellBlank      = 1
+	brtCellRk         = 2
+	brtCellError      = 3
+	brtCellBool       = 4
+	brtCellReal       = 5
+	brtCellSt         = 6
+	brtCellIsst       = 7
+	brtFmlaString     = 8
+	brtFmlaNum        = 9
+	brtFmlaBool       = 10
+	brtFmlaError      = 11
+	brtSSTItem        = 19
+	brtFmt            = 44
+	brtXF             = 47
+	brtEndSheetData   = 146
+	brtWbProp         = 153
+	brtBundleSh       = 156
+	brtBeginCellXFs   = 617
+	brtEndCellXFs     = 618
+	relTypeWorksheet  = "/worksheet"
+	xlsbRecordMaxSize = 1 << 24
+	xlsbPartMaxSize   = 256 << 20 // bytes read from one part of the package
+)
+
+// xlsbRecords calls fn for every record of a BIFF12 part until it returns false
+func xlsbRecords(data []byte, fn func(typ int, body []byte) bool) {
+	pos := 0
+	varint := func(maxBytes int) (int, bool) {
+		value := 0
+		for i := 0; i < maxBytes; i++ {
+			if pos >= len(data) {
+				return 0, false
+			}
+			b := data[pos]
+			pos++
+			value |= int(b&0x7F) << (7 * i)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		return value, true
+	}
+	for pos < len(data) {
+		typ, ok := varint(2)
+		if !ok {
+			return
+		}
+		size, ok := varint(4)
+		if !ok || size > xlsbRecordMaxSize || pos+size > len(data) {
+			return
+		}
+		body := data[pos : pos+size]
+		pos += size
+		if !fn(typ, body) {
+			return
+		}
+	}
+}
+
+// xlsbString reads an XLWideString at offset, returning it and the offset
+// after it. A length running past the record panics.
+func xlsbString(body []byte, offset int) (string, int) {
+	raw := binary.LittleEndian.Uint32(body[offset:])
+	offset += 4
+	if raw == 0xFFFFFFFF { // XLNullableWideString
+		return "", offset
+	}
+	count := int(raw)
+	if count > (len(body)-offset)/2 {
+		panic("truncated string")
+	}
+	units := make([]uint16, count)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(body[offset+2*i:])
+	}
+	return string(utf16.Decode(units)), offset + 2*count
+}
+
+// xlsbFirstSheet returns the part name of the first worksheet and whether
+// the workbook uses the 1904 date system
+func xlsbFirstSheet(workbook, rels []byte) (string, bool, error) {
+	if workbook == nil {
+		return "", false, errors.New("invalid .xlsb file: missing workbook")
+	}
+	var relations struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Type   string `xml:"Type,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := xml.Unmarshal(rels, &relations); err != nil {
+		return "", false, fmt.Errorf("invalid .xlsb file: %w", err)
+	}
+
+	var sheetPath string
+	date1904 := false
+	xlsbRecords(workbook, func(typ int, body []byte) bool {
+		switch typ {
+		case brtWbProp:
+			date1904 = binary.LittleEndian.Uint32(body)&0x01 != 0
+		case brtBundleSh:
+			relID, _ := xlsbString(body, 8)
+			for _, rel := range relations.Relationships {
+				if rel.ID == relID && strings.HasSuffix(rel.Type, relTypeWorksheet) {
+					target := rel.Target
+					if strings.HasPrefix(target, "/") {
+						sheetPath = strings.TrimPrefix(target, "/")
+					} else {
+						sheetPath = path.Join("xl", target)
+					}
+				}
+			}
+			return sheetPath == ""
+		}
+		return true
+	})
+	if sheetPath == "" {
+		return "", false, errors.New("workbook has no sheets")
+	}
+	return sheetPath, date1904, nil
+}
+
+func xlsbStyles(data []byte, formats *numberFormats) {
+	inCellXFs := false
+	xlsbRecords(data, func(typ int, body []byte) bool {
+		switch typ {
+		case brtFmt:
+			code, _ := xlsbString(body, 2)
+			formats.custom[int(binary.LittleEndian.Uint16(body))] = code
+		case brtBeginCellXFs:
+			inCellXFs = true
+		case brtEndCellXFs:
+			inCellXFs = false
+		case brtXF:
+			if inCellXFs {
+				formats.xfFormats = append(formats.xfFormats, int(binary.LittleEndian.Uint16(body[2:])))
+			}
+		}
+		return true
+	})
+}
+
+func xlsbSharedStrings(data []byte) []string {
+	var sst []string
+	xlsbRecords(data, func(typ int, body []byte) bool {
+		if typ == brtSSTItem {
+			s, _ := xlsbString(body, 1)
+			sst = append(sst, s)
+		}
+		return true
+	})
+	return sst
+}
+
+func xlsbSheet(data []byte, sst []string, formats *numberFormats) [][]sheetCell {
+	grid := sheetGrid{}
+	row := 0
+	xlsbRecords(data, func(typ int, body []byte) bool {
+		if typ == brtRowHdr {
+			row = int(binary.LittleEndian.Uint32(body))
+			return true
+		}
+		if typ == brtEndSheetData {
+			return false
+		}
+		if typ < brtCellBlank || typ > brtFmlaError {
+			return true
+		}
+		col := int(binary.LittleEndian.Uint32(body))
+		xf := int(binary.LittleEndian.Uint32(body[4:]) & 0xFFFFFF)
+		value := body[8:]
+		switch typ {
+		case brtCellRk:
+			grid.set(row, col, formats.cell(xf, decodeRK(binary.LittleEndian.Uint32(value))))
+		case brtCellError, brtFmlaError:
+			grid.set(row, col, errorCell(value[0]))
+		case brtCellBool, brtFmlaBool:
+			grid.set(row, col, boolCell(value[0] != 0))
+		case brtCellReal, brtFmlaNum:
+			grid.set(row, col, formats.cell(xf, math.Float64frombits(binary.LittleEndian.Uint64(value))))
+		case brtCellSt, brtFmlaString:
+			s, _ := xlsbString(value, 0)
+			grid.setText(row, col, s)
+		case brtCellIsst:
+			if idx := int(binary.LittleEndian.Uint32(value)); idx < len(sst) {
+				grid.setText(row, col, sst[idx])
+			}
+		}
+		return true
+	})
+	return grid.rows()
+}
@@ -0,0 +1,262 @@
+package services
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// biffRec encodes one BIFF8 record
+func biffRec(id uint16, data ...[]byte) []byte {
+	var body []byte
+	for _, d := range data {
+		body = append(body, d...)
+	}
+	out := binary.LittleEndian.AppendUint16(nil, id)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(body)))
+	return append(out, body...)
+}
+
+func le16(v ...int) []byte {
+	var out []byte
+	for _, n := range v {
+		out = binary.LittleEndian.AppendUint16(out, uint16(n))
+	}
+	return out
+}
+
+func le32(v ...int) []byte {
+	var out []byte
+	for _, n := range v {
+		out = binary.LittleEndian.AppendUint32(out, uint32(n))
+	}
+	return out
+}
+
+// biffString encodes an uncompressed XLUnicodeString with a 2-byte length,
+// which is also a rich string without runs
+func biffString(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	out := append(le16(len(units)), 1)
+	for _, u := range units {
+		out = binary.LittleEndian.AppendUint16(out, u)
+	}
+	return out
+}
+
+// testBIFF8 builds a workbook stream with the encoded shared strings sst
+// whose first sheet holds sheet records
+func testBIFF8(sst [][]byte, sheet ...[]byte) []byte {
+	bof := biffRec(0x0809, le16(0x0600, 0x0005))
+	var strs []byte
+	for _, s := range sst {
+		strs = append(strs, s...)
+	}
+	sstRec := biffRec(0x00FC, le32(len(sst), len(sst)), strs)
+	xf := biffRec(0x00E0, le16(0, 0), make([]byte, 16))
+	dateXF := biffRec(0x00E0, le16(0, 14), make([]byte, 16))
+	boundsheet := biffRec(0x0085, le32(0), []byte{0, 0}, []byte{1, 0}, []byte("S"))
+	eof := biffRec(0x000A)
+	offset := len(bof) + len(xf) + len(dateXF) + len(sstRec) + len(boundsheet) + len(eof)
+	copy(boundsheet[4:], le32(offset))
+
+	stream := append([]byte{}, bof...)
+	stream = append(stream, xf...)
+	stream = append(stream, dateXF...)
+	stream = append(stream, sstRec...)
+	stream = append(stream, boundsheet...)
+	stream = append(stream, eof...)
+	stream = append(stream, bof...)
+	for _, rec := range sheet {
+		stream = append(stream, rec...)
+	}
+	return append(stream, eof...)
+}
+
+func TestParseBIFF8(t *testing.T) {
+	number := binary.LittleEndian.AppendUint64(le16(1, 1, 0), math.Float64bits(12.5))
+	stream := testBIFF8([][]byte{biffString("姓名"), biffString("工作量")},
+		biffRec(0x00FD, le16(0, 0, 0), le32(0)),          // LABELSST
+		biffRec(0x00FD, le16(0, 1, 0), le32(1)),          // LABELSST
+		biffRec(0x0204, le16(1, 0, 0), biffString("张三")), // LABEL
+		biffRec(0x0203, number),                          // NUMBER
+		biffRec(0x027E, le16(2, 1, 1), le32(45000<<2|2)), // RK, date style
+		biffRec(0x0205, le16(2, 0, 0), []byte{1, 0}),     // BOOLERR
+	)
+	rows, err := parseBIFF8(stream)
+	if err != nil {
+		t.Fatalf("parseBIFF8: %v", err)
+	}
+	want := [][]string{{"姓名", "工作量"}, {"张三", "12.5"}, {"TRUE", "2023-03-15"}}
+	if got := cellTexts(rows); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows = %q, want %q", got, want)
+	}
+	if rows[1][1].kind != cellNumber || rows[2][1].kind != cellDate || rows[2][0].kind != cellBool {
+		t.Errorf("kinds = %q %q %q", rows[1][1].kind, rows[2][1].kind, rows[2][0].kind)
+	}
+}
+
+func TestParseBIFF8Malformed(t *testing.T) {
+	tests := map[string][]byte{
+		// Declares four billion shared strings but holds none
+		"sst count": func() []byte {
+			s := testBIFF8(nil)
+			i := strings.Index(string(s), string(le16(0x00FC)))
+			copy(s[i+4:], le32(math.MaxInt32, math.MaxInt32))
+			return s
+		}(),
+		// Shared string with a phonetic block of four gigabytes
+		"rich string":  testBIFF8([][]byte{append(le16(1), 0x04, 0xFF, 0xFF, 0xFF, 0xFF, 'a')}),
+		"label length": testBIFF8(nil, biffRec(0x0204, le16(0, 0, 0), le16(60000), []byte{1}, []byte("ab"))),
+		"column":       testBIFF8(nil, biffRec(0x027E, le16(0, 20000, 0), le32(1<<2|2))),
+		"short record": testBIFF8(nil, biffRec(0x0203, le16(0, 0))),
+	}
+	for name, stream := range tests {
+		t.Run(name, func(t *testing.T) {
+			rows, err := parseBIFF8(stream)
+			if name == "sst count" {
+				// The strings simply run out
+				if err != nil || rows != nil {
+					t.Fatalf("got %v, %v; want an empty sheet", rows, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got %v, want an error", rows)
+			}
+		})
+	}
+}
+
+func FuzzParseBIFF8(f *testing.F) {
+	f.Add(testBIFF8([][]byte{biffString("a"), biffString("b")},
+		biffRec(0x00FD, le16(0, 0, 0), le32(0)),
+		biffRec(0x027E, le16(1, 0, 1), le32(45000<<2|2)),
+		biffRec(0x00BD, le16(2, 0), le16(0), le32(4<<2|2), le16(0), le32(5<<2|2), le16(1)),
+		biffRec(0x0006, le16(3, 0, 0), []byte{0, 0, 0, 0, 0, 0, 0xFF, 0xFF}, make([]byte, 6)),
+		biffRec(0x0207, biffString("x")),
+	))
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		rows, err := parseBIFF8(stream)
+		if err == nil && len(rows) > sheetMaxRows {
+			t.Fatalf("%d rows", len(rows))
+		}
+	})
+}
+
+// xlsbRec encodes one BIFF12 record
+func xlsbRec(typ int, data ...[]byte) []byte {
+	var body []byte
+	for _, d := range data {
+		body = append(body, d...)
+	}
+	varint := func(out []byte, v int) []byte {
+		for {
+			b := byte(v & 0x7F)
+			v >>= 7
+			if v == 0 {
+				return append(out, b)
+			}
+			out = append(out, b|0x80)
+		}
+	}
+	out := varint(varint(nil, typ), len(body))
+	return append(out, body...)
+}
+
+// wideString encodes an XLWideString
+func wideString(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	out := le32(len(units))
+	for _, u := range units {
+		out = binary.LittleEndian.AppendUint16(out, u)
+	}
+	return out
+}
+
+const testXLSBRels = `<Relationships><Relationship Id="rId1" ` +
+	`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" ` +
+	`Target="worksheets/sheet1.bin"/></Relationships>`
+
+// testXLSB returns the part reader of a binary workbook
+func testXLSB(shared, styles, sheet []byte) func(string) ([]byte, error) {
+	parts := map[string][]byte{
+		"xl/workbook.bin":            xlsbRec(brtBundleSh, le32(0, 1), wideString("rId1"), wideString("S")),
+		"xl/_rels/workbook.bin.rels": []byte(testXLSBRels),
+		"xl/sharedStrings.bin":       shared,
+		"xl/styles.bin":              styles,
+		"xl/worksheets/sheet1.bin":   sheet,
+	}
+	return func(name string) ([]byte, error) {
+		return parts[name], nil
+	}
+}
+
+func testXLSBParts() (shared, styles, sheet []byte) {
+	shared = append(xlsbRec(brtSSTItem, []byte{0}, wideString("姓名")),
+		xlsbRec(brtSSTItem, []byte{0}, wideString("日期"))...)
+	styles = append(xlsbRec(brtBeginCellXFs),
+		append(xlsbRec(brtXF, le16(0, 0), make([]byte, 12)),
+			append(xlsbRec(brtXF, le16(0, 14), make([]byte, 12)), xlsbRec(brtEndCellXFs)...)...)...)
+	real := binary.LittleEndian.AppendUint64(le32(1, 1), math.Float64bits(45000))
+	for _, rec := range [][]byte{
+		xlsbRec(brtRowHdr, le32(0), make([]byte, 9)),
+		xlsbRec(brtCellIsst, le32(0, 0, 0)),
+		xlsbRec(brtCellIsst, le32(1, 0, 1)),
+		xlsbRec(brtRowHdr, le32(1), make([]byte, 9)),
+		xlsbRec(brtCellSt, le32(0, 0), wideString("张三")),
+		xlsbRec(brtCellReal, real),
+		xlsbRec(brtEndSheetData),
+	} {
+		sheet = append(sheet, rec...)
+	}
+	return shared, styles, sheet
+}
+
+func TestParseXLSB(t *testing.T) {
+	rows, err := parseXLSB(testXLSB(testXLSBParts()))
+	if err != nil {
+		t.Fatalf("parseXLSB: %v", err)
+	}
+	want := [][]string{{"姓名", "日期"}, {"张三", "2023-03-15"}}
+	if got := cellTexts(rows); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows = %q, want %q", got, want)
+	}
+	if rows[1][1].kind != cellDate {
+		t.Errorf("kind = %q, want a date", rows[1][1].kind)
+	}
+}
+
+func TestParseXLSBMalformed(t *testing.T) {
+	shared, styles, _ := testXLSBParts()
+	tests := map[string]func(string) ([]byte, error){
+		// A six-byte shared string declaring two billion characters
+		"string length": testXLSB(xlsbRec(brtSSTItem, []byte{0}, le32(math.MaxInt32), []byte{'a'}), styles,
+			xlsbRec(brtCellSt, le32(0, 0), le32(math.MaxInt32))),
+		"row": testXLSB(shared, styles,
+			append(xlsbRec(brtRowHdr, le32(-16), make([]byte, 9)), xlsbRec(brtCellIsst, le32(0, 0, 0))...)),
+		"column":       testXLSB(shared, styles, xlsbRec(brtCellIsst, le32(sheetMaxColumns, 0, 0))),
+		"short record": testXLSB(shared, styles, xlsbRec(brtCellReal, le32(0, 0))),
+	}
+	for name, read := range tests {
+		t.Run(name, func(t *testing.T) {
+			if rows, err := parseXLSB(read); err == nil {
+				t.Fatalf("got %v, want an error", rows)
+			}
+		})
+	}
+}
+
+func FuzzParseXLSB(f *testing.F) {
+	shared, styles, sheet := testXLSBParts()
+	f.Add(shared, styles, sheet)
+	f.Fuzz(func(t *testing.T, shared, styles, sheet []byte) {
+		rows, err := parseXLSB(testXLSB(shared, styles, sheet))
+		if err == nil && len(rows) > sheetMaxRows {
+			t.Fatalf("%d rows", len(rows))
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+
+	"db_intro_backend/models"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// Provenance columns that can precede the data in the aggregated sheet
+const (
+	ProvenanceTeacherName  = "teacher_name"
+	ProvenanceTeacherEmail = "teacher_email"
+	ProvenanceDepartment   = "department"
+	ProvenanceReplyTime    = "reply_time"
+	ProvenanceSourceFile   = "source_file"
+)
+
+// Orders of the aggregated rows
+const (
+	AggregationOrderReceived   = ""
+	AggregationOrderDepartment = "department"
+)
+
+// provenanceHeaders are the sheet headers of the provenance columns
+var provenanceHeaders = map[string]string{
+	ProvenanceTeacherName:  "教师姓名",
+	ProvenanceTeacherEmail: "教师邮箱",
+	ProvenanceDepartment:   "所在系",
+	ProvenanceReplyTime:    "回复时间",
+	ProvenanceSourceFile:   "来源文件",
+}
+
+func validateProvenance(settings *models.AggregationSettings) error {
+	seen := make(map[string]bool)
+	var columns []string
+	for _, column := range settings.ProvenanceColumns {
+		if _, ok := provenanceHeaders[column]; !ok {
+			return fmt.Errorf("provenance_columns: unknown column %q", column)
+		}
+		if !seen[column] {
+			seen[column] = true
+			columns = append(columns, column)
+		}
+	}
+	settings.ProvenanceColumns = columns
+
+	switch settings.OrderBy {
+	case AggregationOrderReceived, AggregationOrderDepartment:
+		return nil
+	default:
+		return fmt.Errorf("order_by must be empty or %q", AggregationOrderDepartment)
+	}
+}
+
+// provenanceValues returns the provenance cells of rows from att; the reply
+// time is a date cell
+func provenanceValues(columns []string, att models.AttachmentMeta) []sheetCell {
+	values := make([]sheetCell, len(columns))
+	for i, column := range columns {
+		switch column {
+		case ProvenanceTeacherName:
+			values[i].text = att.TeacherName
+		case ProvenanceTeacherEmail:
+			values[i].text = att.TeacherEmail
+		case ProvenanceDepartment:
+			values[i].text = att.Department
+		case ProvenanceReplyTime:
+			if att.ReplyTime != nil {
+				values[i] = timeCell(*att.ReplyTime, dateTimeFormatCode)
+			}
+		case ProvenanceSourceFile:
+			values[i].text = att.OriginalName
+		}
+	}
+	return values
+}
+
+// sortByDepartment orders rows by department and then teacher, both in
+// pinyin order; rows without a department come last. Rows of one teacher keep
+// the order they were received in.
+func sortByDepartment(rows []aggregatedRow) {
+	compare := textComparer()
+	sort.SliceStable(rows, func(i, j int) bool {
+		if d := compare(rows[i].source.Department, rows[j].source.Department); d != 0 {
+			return d < 0
+		}
+		return compare(rows[i].source.TeacherName, rows[j].source.TeacherName) < 0
+	})
+}
+
+// textComparer returns a comparison of Chinese text in pinyin order that puts
+// empty values last
+func textComparer() func(a, b string) int {
+	c := collate.New(language.Chinese)
+	return func(a, b string) int {
+		switch {
+		case a == b:
+			return 0
+		case a == "":
+			return 1
+		case b == "":
+			return -1
+		}
+		return c.CompareString(a, b)
+	}
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"db_intro_backend/models"
+)
+
+func TestValidateProvenance(t *testing.T) {
+	settings := models.AggregationSettings{
+		ProvenanceColumns: []string{ProvenanceDepartment, ProvenanceTeacherName, ProvenanceDepartment, ProvenanceReplyTime},
+		OrderBy:           AggregationOrderDepartment,
+	}
+	if err := validateProvenance(&settings); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{ProvenanceDepartment, ProvenanceTeacherName, ProvenanceReplyTime}; !reflect.DeepEqual(settings.ProvenanceColumns, want) {
+		t.Errorf("ProvenanceColumns = %q, want %q", settings.ProvenanceColumns, want)
+	}
+
+	for _, bad := range []models.AggregationSettings{
+		{ProvenanceColumns: []string{"teacher_phone"}},
+		{OrderBy: "teacher"},
+	} {
+		if err := validateProvenance(&bad); err == nil {
+			t.Errorf("validateProvenance(%+v) accepted", bad)
+		}
+	}
+}
+
+func TestProvenanceValues(t *testing.T) {
+	received := time.Date(2025, 9, 1, 14, 30, 0, 0, time.FixedZone("CST", 8*3600))
+	att := models.AttachmentMeta{
+		OriginalName: "工作量.xlsx", TeacherName: "张三", TeacherEmail: "zhang@school.test",
+		Department: "计算机系", ReplyTime: &received,
+	}
+	values := provenanceValues([]string{ProvenanceSourceFile, ProvenanceTeacherName, ProvenanceTeacherEmail,
+		ProvenanceDepartment, ProvenanceReplyTime}, att)
+
+	var texts []string
+	for _, v := range values[:4] {
+		texts = append(texts, v.text)
+	}
+	if want := []string{"工作量.xlsx", "张三", "zhang@school.test", "计算机系"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("values = %q, want %q", texts, want)
+	}
+	// The reply time is a date cell of the local wall-clock time
+	reply := values[4]
+	if reply.kind != cellDate || reply.format != dateTimeFormatCode || reply.number != excelSerial(received) {
+		t.Errorf("reply time = %+v", reply)
+	}
+	if reply.text != "2025-09-01 14:30:00" {
+		t.Errorf("reply time text = %q", reply.text)
+	}
+
+	if values := provenanceValues([]string{ProvenanceReplyTime}, models.AttachmentMeta{}); !reflect.DeepEqual(values[0], sheetCell{}) {
+		t.Errorf("reply time without a reply = %+v, want an empty cell", values[0])
+	}
+}
+
+// TestSortByDepartment orders departments and teachers by pinyin, puts rows
+// without a department last and keeps each teacher's rows in order
+func TestSortByDepartment(t *testing.T) {
+	row := func(department, teacher, course string) aggregatedRow {
+		return aggregatedRow{
+			source: models.AttachmentMeta{Department: department, TeacherName: teacher},
+			cells:  []sheetCell{{text: course}},
+		}
+	}
+	rows := []aggregatedRow{
+		row("数学系", "张三", "高等数学"),
+		row("", "赵六", "体育"),
+		row("计算机系", "王五", "操作系统"),
+		row("数学系", "李四", "线性代数"),
+		row("计算机系", "王五", "编译原理"),
+		row("化学系", "钱七", "有机化学"),
+		row("计算机系", "陈八", "数据库导论"),
+	}
+	sortByDepartment(rows)
+
+	var got []string
+	for _, r := range rows {
+		got = append(got, r.source.Department+"/"+r.source.TeacherName+"/"+r.cells[0].text)
+	}
+	want := []string{
+		"化学系/钱七/有机化学",
+		"计算机系/陈八/数据库导论",
+		"计算机系/王五/操作系统",
+		"计算机系/王五/编译原理",
+		"数学系/李四/线性代数",
+		"数学系/张三/高等数学",
+		"/赵六/体育",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+}
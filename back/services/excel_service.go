@@ -1,6 +1,7 @@
 package services
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"db_intro_backend/db"
 	"db_intro_backend/models"
@@ -19,143 +21,331 @@ var (
 	ErrNoExcelAttachments = errors.New("no Excel attachments found for this project")
 )
 
-type ExcelService struct{}
+// Parse states recorded in attachments.parse_status
+const (
+	ParseStatusOK     = "ok"
+	ParseStatusFailed = "failed"
+)
+
+type ExcelService struct {
+	dataCache sync.Map // project ID -> *cachedRows, see projectRows
+}
 
 func NewExcelService() *ExcelService {
 	return &ExcelService{}
 }
 
-func (s *ExcelService) AggregateProjectExcel(projectID int) (string, int, int, error) {
-	attachments, err := s.fetchProjectExcelAttachments(projectID)
+// AggregateProjectExcel merges the Excel attachments of a project into one
+// workbook. Columns are matched to the project template by header name (see
+// columnSchema); the result reports per attachment which columns could not be
+// mapped and which template columns were missing. Numbers, dates and
+// booleans are written as such, in the template column's number format or
+// else the source cell's; formulas are kept when the settings ask for it.
+func (s *ExcelService) AggregateProjectExcel(projectID int) (*models.AggregationResult, error) {
+	if err := s.ParsePending(projectID); err != nil {
+		return nil, err
+	}
+	merged, err := s.mergeProjectRows(projectID)
 	if err != nil {
-		return "", 0, 0, err
+		return nil, err
 	}
-	if len(attachments) == 0 {
-		return "", 0, 0, ErrNoExcelAttachments
+	if len(merged.headers) == 0 {
+		return nil, ErrNoExcelAttachments
 	}
+	settings, result := merged.settings, merged.result
 
 	if err := os.MkdirAll("./uploads/aggregated", 0755); err != nil {
-		return "", 0, 0, fmt.Errorf("failed to prepare aggregated directory: %w", err)
+		return nil, fmt.Errorf("failed to prepare aggregated directory: %w", err)
+	}
+	result.OutputPath = s.AggregatedFilePath(strconv.Itoa(projectID))
+
+	for _, column := range settings.ProvenanceColumns {
+		result.Headers = append(result.Headers, provenanceHeaders[column])
 	}
+	result.Headers = append(result.Headers, merged.headers...)
 
-	outputPath := s.AggregatedFilePath(strconv.Itoa(projectID))
 	book := excelize.NewFile()
 	defer book.Close()
 
-	sheetName := "Aggregated"
+	sheetName := aggregatedSheet
 	book.SetSheetName(book.GetSheetName(0), sheetName)
-	headerRow := []string{}
-	headerWritten := false
-	dataColumns := 0
-	rowCursor := 2
-	processedAttachments := 0
-	appendedRows := 0
+	writer, err := newCellWriter(book, sheetName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write aggregated workbook: %w", err)
+	}
+	header := make([]interface{}, len(result.Headers))
+	for i, h := range result.Headers {
+		header[i] = h
+	}
+	if err := writer.row(1, header); err != nil {
+		return nil, fmt.Errorf("failed to write aggregated workbook: %w", err)
+	}
 
-	for _, att := range attachments {
-		if !s.isExcelFile(att.OriginalName) && !s.isExcelFile(att.StoredPath) {
-			continue
+	// Data columns by header, for the references of kept formulas
+	offset := len(settings.ProvenanceColumns)
+	columns := make(map[string]int, len(merged.headers))
+	for i, h := range merged.headers {
+		if key := normalizeHeader(h); columns[key] == 0 {
+			columns[key] = offset + i + 1
+		}
+	}
+	column := func(header string) (int, bool) {
+		col, ok := columns[normalizeHeader(header)]
+		return col, ok
+	}
+	preserve := settings.Formulas == AggregationFormulasPreserve
+
+	for i, row := range merged.rows {
+		rowNum := i + 2
+		values := make([]interface{}, 0, offset+len(row.cells))
+		add := func(cell sheetCell, formula string) error {
+			value, err := writer.cell(cell, formula)
+			values = append(values, value)
+			return err
+		}
+		for _, cell := range provenanceValues(settings.ProvenanceColumns, row.source) {
+			if err := add(cell, ""); err != nil {
+				return nil, fmt.Errorf("failed to write row %d: %w", rowNum, err)
+			}
+		}
+		for j, cell := range row.cells {
+			if merged.formats != nil {
+				cell = cell.withFormat(merged.formats[j])
+			}
+			formula := ""
+			if preserve && cell.formula != nil {
+				// A formula whose columns are no longer adjacent keeps only
+				// its result
+				formula, _ = renderFormula(cell.formula, rowNum, column)
+			}
+			if err := add(cell, formula); err != nil {
+				return nil, fmt.Errorf("failed to write row %d: %w", rowNum, err)
+			}
 		}
+		if err := writer.row(rowNum, values); err != nil {
+			return nil, fmt.Errorf("failed to write row %d: %w", rowNum, err)
+		}
+	}
+	if err := writer.flush(); err != nil {
+		return nil, fmt.Errorf("failed to write aggregated workbook: %w", err)
+	}
+	if preserve {
+		// Have Excel recalculate the kept formulas when the file is opened
+		fullCalc := true
+		book.SetCalcProps(&excelize.CalcPropsOptions{FullCalcOnLoad: &fullCalc})
+	}
+	if err := s.writeSummarySheets(book, merged, result); err != nil {
+		return nil, err
+	}
 
-		if _, err := os.Stat(att.StoredPath); err != nil {
-			log.Printf("Attachment missing (%s): %v", att.StoredPath, err)
-			continue
+	if err := book.SaveAs(result.OutputPath); err != nil {
+		return nil, fmt.Errorf("failed to save aggregated workbook: %w", err)
+	}
+
+	return result, nil
+}
+
+// mergedRows are the rows of a project's selected submissions mapped to one
+// column schema, in the order of the aggregated sheet
+type mergedRows struct {
+	settings models.AggregationSettings
+	headers  []string // data columns; provenance columns are not included
+	formats  []string // number format of each data column in the template; nil without one
+	rows     []aggregatedRow
+	result   *models.AggregationResult // counts and per-attachment report
+	pending  []models.AttachmentMeta   // attachments not parsed yet, left out
+}
+
+// ParsePending parses the Excel attachments of a project that were stored
+// before parsing at ingestion, or whose rows were invalidated by new column
+// aliases
+func (s *ExcelService) ParsePending(projectID int) error {
+	attachments, err := s.fetchProjectExcelAttachments(projectID)
+	if err != nil {
+		return err
+	}
+	for _, att := range attachments {
+		if !att.Parsed && (isExcelFile(att.OriginalName) || isExcelFile(att.StoredPath)) {
+			if err := s.ParseAttachment(projectID, att.ID); err != nil {
+				return fmt.Errorf("failed to parse attachment %d: %w", att.ID, err)
+			}
 		}
+	}
+	return nil
+}
 
-		file, err := excelize.OpenFile(att.StoredPath)
-		if err != nil {
-			log.Printf("Failed to open attachment %s: %v", att.StoredPath, err)
-			continue
+// mergeProjectRows merges the stored rows of a project's Excel attachments.
+// It backs both the aggregated workbook and the data API and only reads:
+// attachments that are not parsed yet are listed as pending. With only
+// pending attachments the result has no headers.
+func (s *ExcelService) mergeProjectRows(projectID int) (*mergedRows, error) {
+	settings, err := LoadAggregationSettings(projectID)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := s.projectSchema(projectID, settings)
+	if err != nil {
+		return nil, err
+	}
+	var formats []string
+	if schema.template {
+		if formats, err = s.templateFormats(projectID, schema); err != nil {
+			return nil, err
 		}
+	}
+
+	attachments, err := s.fetchProjectExcelAttachments(projectID)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		return nil, ErrNoExcelAttachments
+	}
+
+	result := &models.AggregationResult{
+		Template: schema.template,
+		Report:   []models.AttachmentColumnReport{},
+	}
 
-		sheets := file.GetSheetList()
-		if len(sheets) == 0 {
-			file.Close()
+	// Rows are collected first: without a template the header grows while
+	// attachments are read
+	var outputRows []aggregatedRow
+	type mappedAttachment struct {
+		report  int
+		mapping []int
+	}
+	var mapped []mappedAttachment
+	var pending []models.AttachmentMeta
+
+	sheets, err := loadParsedSheets(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, att := range attachments {
+		if !isExcelFile(att.OriginalName) && !isExcelFile(att.StoredPath) {
 			continue
 		}
-
-		rows, err := file.GetRows(sheets[0])
-		file.Close()
-		if err != nil {
-			log.Printf("Failed to read rows from %s: %v", att.StoredPath, err)
+		sheet, ok := sheets[att.ID]
+		if !ok {
+			pending = append(pending, att)
 			continue
 		}
 
-		headerIdx, headerCells := s.firstNonEmptyRow(rows)
-		if headerIdx == -1 {
+		report := models.AttachmentColumnReport{
+			AttachmentID:    att.ID,
+			Filename:        att.OriginalName,
+			TeacherName:     att.TeacherName,
+			UnmappedColumns: []string{},
+			MissingColumns:  []string{},
+		}
+		if sheet.status == ParseStatusFailed {
+			log.Printf("Skipping attachment %s: %s", att.StoredPath, sheet.err)
+			report.Error = sheet.err
+			result.Report = append(result.Report, report)
 			continue
 		}
-
-		if !headerWritten {
-			headerRow = append(headerRow[:0], headerCells...)
-			dataColumns = len(headerCells)
-			headCopy := make([]string, len(headerRow))
-			copy(headCopy, headerRow)
-			book.SetSheetRow(sheetName, "A1", &headCopy)
-			headerWritten = true
-		} else if len(headerCells) > dataColumns {
-			headerRow = append(headerRow, headerCells[dataColumns:]...)
-			rowCopy := make([]string, len(headerRow))
-			copy(rowCopy, headerRow)
-			book.SetSheetRow(sheetName, "A1", &rowCopy)
-			dataColumns = len(headerCells)
-		}
-
-		dataRows := rows[headerIdx+1:]
-		if len(dataRows) == 0 {
-			processedAttachments++
+		if len(sheet.columns) == 0 && len(sheet.unmapped) == 0 {
+			report.Error = "worksheet is empty"
+			result.Report = append(result.Report, report)
 			continue
 		}
 
-		for _, dataRow := range dataRows {
-			if s.rowIsEmpty(dataRow) {
-				continue
-			}
-
-			if len(dataRow) > dataColumns {
-				extra := len(dataRow) - dataColumns
-				for i := 0; i < extra; i++ {
-					headerRow = append(headerRow, fmt.Sprintf("ExtraCol_%d", dataColumns+i+1))
+		// Stored columns are already template headers, or the attachment's
+		// own headers that the growing schema picks up here
+		mapping, unmapped := schema.mapHeader(sheet.columns)
+		report.UnmappedColumns = append(report.UnmappedColumns, sheet.unmapped...)
+		report.UnmappedColumns = append(report.UnmappedColumns, unmapped...)
+
+		for _, values := range sheet.rows {
+			out := make([]sheetCell, len(schema.headers))
+			for i, column := range sheet.columns {
+				if mapping[i] >= 0 {
+					out[mapping[i]] = values[column]
 				}
-				dataColumns = len(dataRow)
-				rowCopy := make([]string, len(headerRow))
-				copy(rowCopy, headerRow)
-				book.SetSheetRow(sheetName, "A1", &rowCopy)
 			}
-
-			if len(dataRow) < dataColumns {
-				padding := make([]string, dataColumns-len(dataRow))
-				dataRow = append(dataRow, padding...)
-			}
-
-			rowCopy := make([]string, len(dataRow))
-			copy(rowCopy, dataRow)
-			book.SetSheetRow(sheetName, fmt.Sprintf("A%d", rowCursor), &rowCopy)
-			rowCursor++
-			appendedRows++
+			outputRows = append(outputRows, aggregatedRow{source: att, cells: out})
+			report.Rows++
 		}
 
-		processedAttachments++
+		mapped = append(mapped, mappedAttachment{report: len(result.Report), mapping: mapping})
+		result.Report = append(result.Report, report)
+		result.Attachments++
+		result.Rows += report.Rows
 	}
 
-	if !headerWritten {
-		return "", 0, 0, ErrNoExcelAttachments
+	if len(schema.headers) == 0 && len(pending) == 0 {
+		return nil, ErrNoExcelAttachments
+	}
+	// Missing columns are only known once the header is complete
+	for _, m := range mapped {
+		if missing := schema.missing(m.mapping); missing != nil {
+			result.Report[m.report].MissingColumns = missing
+		}
+	}
+	if settings.OrderBy == AggregationOrderDepartment {
+		sortByDepartment(outputRows)
 	}
 
-	if err := book.SaveAs(outputPath); err != nil {
-		return "", 0, 0, fmt.Errorf("failed to save aggregated workbook: %w", err)
+	return &mergedRows{settings: settings, headers: schema.headers, formats: formats, rows: outputRows, result: result, pending: pending}, nil
+}
+
+// aggregatedRow is a data row mapped to the schema, with the attachment it
+// came from
+type aggregatedRow struct {
+	source models.AttachmentMeta
+	cells  []sheetCell
+}
+
+// readFirstSheet returns the cell texts of a workbook's first sheet
+func (s *ExcelService) readFirstSheet(path string) ([][]string, error) {
+	rows, err := s.readSheetCells(path)
+	if err != nil {
+		return nil, err
 	}
+	return cellTexts(rows), nil
+}
 
-	return outputPath, processedAttachments, appendedRows, nil
+// readSheetCells returns the typed cells of a workbook's first sheet. Legacy
+// .xls and binary .xlsb workbooks, which excelize cannot open, are read by
+// readXLS and readXLSB.
+func (s *ExcelService) readSheetCells(path string) ([][]sheetCell, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("attachment missing: %w", err)
+	}
+	format, err := workbookFormat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open attachment: %w", err)
+	}
+	switch format {
+	case WorkbookFormatXLS:
+		return readXLS(path)
+	case WorkbookFormatXLSB:
+		return readXLSB(path)
+	}
+	return readXLSX(path)
 }
 
+// fetchProjectExcelAttachments returns the stored attachments that go into
+// the aggregation: for teachers with versioned submissions only those of the
+// selected submission (see selectSubmissions), otherwise every attachment
+// except those of automatic replies.
 func (s *ExcelService) fetchProjectExcelAttachments(projectID int) ([]models.AttachmentMeta, error) {
+	selected, versioned, err := selectedSubmissionReplies(projectID)
+	if err != nil {
+		return nil, err
+	}
+
 	rows, err := db.DB.Query(`
-		SELECT a.stored_path, a.original_filename, COALESCE(t.name, ''), COALESCE(t.email, '')
+		SELECT a.id, a.stored_path, a.original_filename, COALESCE(t.name, ''), COALESCE(t.email, ''),
+			COALESCE(d.name, ''), r.received_at, a.teacher_id, a.reply_id, a.parsed
 		FROM attachments a
 		LEFT JOIN teachers t ON a.teacher_id = t.id
-		WHERE a.project_id = ?
+		LEFT JOIN departments d ON t.department_id = d.id
+		LEFT JOIN replies r ON a.reply_id = r.id
+		WHERE a.project_id = ? AND a.status = ? AND COALESCE(r.is_auto_reply, FALSE) = FALSE
 		ORDER BY a.created_at ASC, a.id ASC
-	`, projectID)
+	`, projectID, AttachmentStatusStored)
 	if err != nil {
 		return nil, err
 	}
@@ -164,9 +354,18 @@ func (s *ExcelService) fetchProjectExcelAttachments(projectID int) ([]models.Att
 	var attachments []models.AttachmentMeta
 	for rows.Next() {
 		var att models.AttachmentMeta
-		if err := rows.Scan(&att.StoredPath, &att.OriginalName, &att.TeacherName, &att.TeacherEmail); err != nil {
+		var replyTime sql.NullTime
+		var teacherID, replyID sql.NullInt64
+		if err := rows.Scan(&att.ID, &att.StoredPath, &att.OriginalName, &att.TeacherName, &att.TeacherEmail,
+			&att.Department, &replyTime, &teacherID, &replyID, &att.Parsed); err != nil {
 			continue
 		}
+		if teacherID.Valid && versioned[int(teacherID.Int64)] && !selected[int(replyID.Int64)] {
+			continue
+		}
+		if replyTime.Valid {
+			att.ReplyTime = &replyTime.Time
+		}
 		attachments = append(attachments, att)
 	}
 	if err := rows.Err(); err != nil {
@@ -193,7 +392,9 @@ func (s *ExcelService) rowIsEmpty(row []string) bool {
 	return true
 }
 
-func (s *ExcelService) isExcelFile(name string) bool {
+// isExcelFile reports whether name has the extension of a workbook the
+// aggregation reads
+func isExcelFile(name string) bool {
 	ext := strings.ToLower(filepath.Ext(name))
 	switch ext {
 	case ".xlsx", ".xls", ".xlsm", ".xlsb":
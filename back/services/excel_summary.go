@@ -0,0 +1,267 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"db_intro_backend/models"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Functions of a summary measure
+const (
+	SummarySum   = "sum"
+	SummaryCount = "count"
+	SummaryAvg   = "avg"
+	SummaryMin   = "min"
+	SummaryMax   = "max"
+)
+
+// summaryLabels name the generated headers of measures
+var summaryLabels = map[string]string{
+	SummarySum:   "合计",
+	SummaryCount: "计数",
+	SummaryAvg:   "平均",
+	SummaryMin:   "最小",
+	SummaryMax:   "最大",
+}
+
+// aggregatedSheet is the name of the sheet holding the merged rows
+const aggregatedSheet = "Aggregated"
+
+// validateSummaries checks the summary specs of settings. Columns are only
+// resolved when aggregating, since without a template they depend on the
+// submissions.
+func validateSummaries(settings *models.AggregationSettings) error {
+	names := map[string]bool{strings.ToLower(aggregatedSheet): true}
+	for i := range settings.Summaries {
+		spec := &settings.Summaries[i]
+		spec.Name = strings.TrimSpace(spec.Name)
+		switch {
+		case spec.Name == "":
+			return fmt.Errorf("summaries[%d]: name must not be empty", i)
+		case len([]rune(spec.Name)) > 31 || strings.ContainsAny(spec.Name, `:\/?*[]`):
+			return fmt.Errorf("summaries[%d]: %q is not a valid sheet name (at most 31 characters, none of : \\ / ? * [ ])", i, spec.Name)
+		case names[strings.ToLower(spec.Name)]:
+			return fmt.Errorf("summaries[%d]: sheet name %q is already used", i, spec.Name)
+		}
+		names[strings.ToLower(spec.Name)] = true
+
+		var groupBy []string
+		for _, column := range spec.GroupBy {
+			if column = strings.TrimSpace(column); column != "" {
+				groupBy = append(groupBy, column)
+			}
+		}
+		if len(groupBy) == 0 {
+			return fmt.Errorf("summaries[%d]: group_by must name at least one column", i)
+		}
+		spec.GroupBy = groupBy
+
+		if len(spec.Measures) == 0 {
+			return fmt.Errorf("summaries[%d]: at least one measure is required", i)
+		}
+		for j := range spec.Measures {
+			m := &spec.Measures[j]
+			m.Column = strings.TrimSpace(m.Column)
+			m.Label = strings.TrimSpace(m.Label)
+			if _, ok := summaryLabels[m.Func]; !ok {
+				return fmt.Errorf("summaries[%d].measures[%d]: func must be sum, count, avg, min or max", i, j)
+			}
+			if m.Column == "" && m.Func != SummaryCount {
+				return fmt.Errorf("summaries[%d].measures[%d]: %s needs a column", i, j, m.Func)
+			}
+		}
+	}
+	return nil
+}
+
+// summaryAccumulator computes one measure over the rows of a group
+type summaryAccumulator struct {
+	count    int // rows, or non-empty cells of the column
+	numbers  int // numeric cells
+	sum      float64
+	min, max float64
+}
+
+// add counts a cell; numbers, and text that reads as one, are summed
+func (a *summaryAccumulator) add(cell sheetCell, countRows bool) {
+	if countRows || strings.TrimSpace(cell.text) != "" {
+		a.count++
+	}
+	n, ok := cell.number, cell.kind == cellNumber
+	if cell.kind == "" {
+		n, ok = parseCellNumber(cell.text)
+	}
+	if !ok {
+		return
+	}
+	if a.numbers == 0 || n < a.min {
+		a.min = n
+	}
+	if a.numbers == 0 || n > a.max {
+		a.max = n
+	}
+	a.numbers++
+	a.sum += n
+}
+
+// result returns the measure, or nil for an empty cell when no number was
+// seen
+func (a *summaryAccumulator) result(fn string) interface{} {
+	if fn == SummaryCount {
+		return a.count
+	}
+	if a.numbers == 0 {
+		return nil
+	}
+	switch fn {
+	case SummarySum:
+		return roundSummary(a.sum)
+	case SummaryAvg:
+		return roundSummary(a.sum / float64(a.numbers))
+	case SummaryMin:
+		return a.min
+	default:
+		return a.max
+	}
+}
+
+// roundSummary drops the binary noise of summed decimals (0.1+0.2)
+func roundSummary(n float64) float64 {
+	return math.Round(n*1e9) / 1e9
+}
+
+// writeSummarySheets adds a sheet per summary spec to book. Specs naming a
+// column that the merged rows do not have are skipped with an error in
+// result; failing to write a sheet fails the aggregation.
+func (s *ExcelService) writeSummarySheets(book *excelize.File, merged *mergedRows, result *models.AggregationResult) error {
+	result.Summaries = []string{}
+	compareText := textComparer()
+
+	for _, spec := range merged.settings.Summaries {
+		var groupColumns []dataColumn
+		var measureColumns []dataColumn
+		var missing []string
+		for _, name := range spec.GroupBy {
+			col, ok := merged.column(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			groupColumns = append(groupColumns, col)
+		}
+		for _, m := range spec.Measures {
+			col := dataColumn{index: -1}
+			if m.Column != "" {
+				var ok bool
+				if col, ok = merged.column(m.Column); !ok {
+					missing = append(missing, m.Column)
+				}
+			}
+			measureColumns = append(measureColumns, col)
+		}
+		if missing != nil {
+			result.SummaryErrors = append(result.SummaryErrors,
+				fmt.Sprintf("%s: unknown columns %s", spec.Name, strings.Join(missing, ", ")))
+			continue
+		}
+
+		type group struct {
+			keys     []string
+			measures []summaryAccumulator
+		}
+		groups := make(map[string]*group)
+		var order []*group
+		total := make([]summaryAccumulator, len(spec.Measures))
+		for _, row := range merged.rows {
+			keys := make([]string, len(groupColumns))
+			for i, col := range groupColumns {
+				keys[i] = strings.TrimSpace(col.value(row))
+			}
+			id := strings.Join(keys, "\x00")
+			g, ok := groups[id]
+			if !ok {
+				g = &group{keys: keys, measures: make([]summaryAccumulator, len(spec.Measures))}
+				groups[id] = g
+				order = append(order, g)
+			}
+			for i, m := range spec.Measures {
+				var cell sheetCell
+				if measureColumns[i].index >= 0 || measureColumns[i].provenance != "" {
+					cell = measureColumns[i].cell(row)
+				}
+				countRows := m.Column == ""
+				g.measures[i].add(cell, countRows)
+				total[i].add(cell, countRows)
+			}
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			for k := range order[i].keys {
+				if d := compareText(order[i].keys[k], order[j].keys[k]); d != 0 {
+					return d < 0
+				}
+			}
+			return false
+		})
+
+		index, err := book.NewSheet(spec.Name)
+		if err != nil || index < 0 {
+			result.SummaryErrors = append(result.SummaryErrors, fmt.Sprintf("%s: %v", spec.Name, err))
+			continue
+		}
+		header := make([]interface{}, 0, len(spec.GroupBy)+len(spec.Measures))
+		for i, name := range spec.GroupBy {
+			if col := groupColumns[i]; col.provenance != "" {
+				name = provenanceHeaders[col.provenance]
+			}
+			header = append(header, name)
+		}
+		for _, m := range spec.Measures {
+			header = append(header, summaryLabel(m))
+		}
+		if err := book.SetSheetRow(spec.Name, "A1", &header); err != nil {
+			return fmt.Errorf("failed to write summary sheet %s: %w", spec.Name, err)
+		}
+
+		writeRow := func(rowNum int, keys []string, measures []summaryAccumulator) error {
+			cells := make([]interface{}, 0, len(header))
+			for _, key := range keys {
+				cells = append(cells, key)
+			}
+			for i, m := range spec.Measures {
+				cells = append(cells, measures[i].result(m.Func))
+			}
+			if err := book.SetSheetRow(spec.Name, fmt.Sprintf("A%d", rowNum), &cells); err != nil {
+				return fmt.Errorf("failed to write summary sheet %s: %w", spec.Name, err)
+			}
+			return nil
+		}
+		for i, g := range order {
+			if err := writeRow(i+2, g.keys, g.measures); err != nil {
+				return err
+			}
+		}
+		totalKeys := make([]string, len(spec.GroupBy))
+		totalKeys[0] = "总计"
+		if err := writeRow(len(order)+2, totalKeys, total); err != nil {
+			return err
+		}
+
+		result.Summaries = append(result.Summaries, spec.Name)
+	}
+	return nil
+}
+
+// summaryLabel is the header of a measure, e.g. "工作量合计" or "行数"
+func summaryLabel(m models.SummaryMeasure) string {
+	switch {
+	case m.Label != "":
+		return m.Label
+	case m.Column == "":
+		return "行数"
+	}
+	return m.Column + summaryLabels[m.Func]
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"db_intro_backend/models"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestWriteSummarySheets(t *testing.T) {
+	row := func(department, teacher, course string, hours sheetCell) aggregatedRow {
+		return aggregatedRow{
+			source: models.AttachmentMeta{Department: department, TeacherName: teacher},
+			cells:  []sheetCell{{text: course}, hours},
+		}
+	}
+	number := func(n float64, text string) sheetCell {
+		return sheetCell{text: text, kind: cellNumber, number: n}
+	}
+	merged := &mergedRows{
+		headers: []string{"课程", "学时"},
+		rows: []aggregatedRow{
+			row("数学系", "张三", "高等数学", number(64, "64")),
+			row("计算机系", "王五", "操作系统", number(48, "48")),
+			row("数学系", "李四", "线性代数", sheetCell{text: "32"}), // typed as text
+			row("计算机系", "王五", "编译原理", number(0.1, "0.1")),
+			row("计算机系", "陈八", "数据库导论", number(0.2, "0.2")),
+			row("数学系", "张三", "概率论", sheetCell{text: "待定"}),
+		},
+		settings: models.AggregationSettings{Summaries: []models.SummarySpec{
+			{
+				Name:    "按系",
+				GroupBy: []string{ProvenanceDepartment},
+				Measures: []models.SummaryMeasure{
+					{Func: SummarySum, Column: "学时"},
+					{Func: SummaryAvg, Column: "学时"},
+					{Func: SummaryMin, Column: "学时"},
+					{Func: SummaryMax, Column: "学时"},
+					{Func: SummaryCount, Column: "学时"},
+					{Func: SummaryCount, Label: "课程数"},
+				},
+			},
+			{
+				Name:     "按教师",
+				GroupBy:  []string{"所在系", "教师姓名"},
+				Measures: []models.SummaryMeasure{{Func: SummarySum, Column: "学时"}},
+			},
+			{
+				Name:     "按职称",
+				GroupBy:  []string{"职称"},
+				Measures: []models.SummaryMeasure{{Func: SummarySum, Column: "工作量"}},
+			},
+		}},
+	}
+	book := excelize.NewFile()
+	defer book.Close()
+	result := &models.AggregationResult{}
+	if err := (&ExcelService{}).writeSummarySheets(book, merged, result); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"按系", "按教师"}; !reflect.DeepEqual(result.Summaries, want) {
+		t.Errorf("Summaries = %q, want %q", result.Summaries, want)
+	}
+	if want := []string{"按职称: unknown columns 职称, 工作量"}; !reflect.DeepEqual(result.SummaryErrors, want) {
+		t.Errorf("SummaryErrors = %q, want %q", result.SummaryErrors, want)
+	}
+	if index, _ := book.GetSheetIndex("按职称"); index != -1 {
+		t.Error("sheet written for the summary with unknown columns")
+	}
+
+	tests := []struct {
+		sheet string
+		want  [][]string
+	}{
+		{"按系", [][]string{
+			{"所在系", "学时合计", "学时平均", "学时最小", "学时最大", "学时计数", "课程数"},
+			{"计算机系", "48.3", "16.1", "0.1", "48", "3", "3"},
+			{"数学系", "96", "48", "32", "64", "3", "3"},
+			{"总计", "144.3", "28.86", "0.1", "64", "6", "6"},
+		}},
+		{"按教师", [][]string{
+			{"所在系", "教师姓名", "学时合计"},
+			{"计算机系", "陈八", "0.2"},
+			{"计算机系", "王五", "48.1"},
+			{"数学系", "李四", "32"},
+			{"数学系", "张三", "64"},
+			{"总计", "", "144.3"},
+		}},
+	}
+	for _, tt := range tests {
+		rows, err := book.GetRows(tt.sheet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rows, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.sheet, rows, tt.want)
+		}
+	}
+}
+
+func TestSummaryAccumulatorEmpty(t *testing.T) {
+	var a summaryAccumulator
+	a.add(sheetCell{text: "待定"}, false)
+	a.add(sheetCell{}, false)
+	for _, fn := range []string{SummarySum, SummaryAvg, SummaryMin, SummaryMax} {
+		if got := a.result(fn); got != nil {
+			t.Errorf("%s without numbers = %v, want an empty cell", fn, got)
+		}
+	}
+	if got := a.result(SummaryCount); got != 1 {
+		t.Errorf("count = %v, want the one non-empty cell", got)
+	}
+}
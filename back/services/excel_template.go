@@ -0,0 +1,323 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/width"
+)
+
+// TemplateDir holds the Excel templates uploaded with projects
+const TemplateDir = "./uploads/templates"
+
+var ErrProjectNotFound = errors.New("project not found")
+
+// LoadAggregationSettings reads the aggregation settings of a project; a
+// project without any yields empty settings
+func LoadAggregationSettings(projectID int) (models.AggregationSettings, error) {
+	var settings models.AggregationSettings
+	var raw sql.NullString
+	err := db.DB.QueryRow("SELECT aggregation_settings FROM projects WHERE id = ?", projectID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, ErrProjectNotFound
+	}
+	if err != nil {
+		return settings, err
+	}
+	if raw.Valid && raw.String != "" {
+		if err := json.Unmarshal([]byte(raw.String), &settings); err != nil {
+			return settings, fmt.Errorf("invalid aggregation settings: %w", err)
+		}
+	}
+	return settings, nil
+}
+
+// SaveAggregationSettings stores the aggregation settings of a project. The
+// stored rows of its attachments are keyed with the column aliases, so when
+// these change the attachments are parsed again on the next aggregation.
+func SaveAggregationSettings(projectID int, settings models.AggregationSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous models.AggregationSettings
+	var raw sql.NullString
+	err = tx.QueryRow("SELECT aggregation_settings FROM projects WHERE id = ? FOR UPDATE", projectID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrProjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if raw.Valid && raw.String != "" {
+		// Unreadable old settings are simply replaced
+		json.Unmarshal([]byte(raw.String), &previous)
+	}
+
+	if _, err := tx.Exec("UPDATE projects SET aggregation_settings = ? WHERE id = ?", string(data), projectID); err != nil {
+		return err
+	}
+	if !sameAliases(previous.ColumnAliases, settings.ColumnAliases) {
+		if _, err := tx.Exec("UPDATE attachments SET parsed = FALSE WHERE project_id = ?", projectID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sameAliases compares column aliases, treating a missing header like one
+// without aliases
+func sameAliases(a, b map[string][]string) bool {
+	for _, pair := range [][2]map[string][]string{{a, b}, {b, a}} {
+		for header, list := range pair[0] {
+			other := pair[1][header]
+			if len(list) != len(other) {
+				return false
+			}
+			for i := range list {
+				if list[i] != other[i] {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// ValidateAggregationSettings checks settings submitted by a user, dropping
+// blank aliases and repeated provenance columns
+func ValidateAggregationSettings(settings *models.AggregationSettings) error {
+	cleaned := make(map[string][]string, len(settings.ColumnAliases))
+	for header, aliases := range settings.ColumnAliases {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			return errors.New("column_aliases: header must not be empty")
+		}
+		var kept []string
+		for _, alias := range aliases {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				kept = append(kept, alias)
+			}
+		}
+		cleaned[header] = kept
+	}
+	settings.ColumnAliases = cleaned
+	if err := validateProvenance(settings); err != nil {
+		return err
+	}
+	switch settings.Formulas {
+	case AggregationFormulasValue, AggregationFormulasPreserve:
+	default:
+		return fmt.Errorf("formulas must be empty or %q", AggregationFormulasPreserve)
+	}
+	return validateSummaries(settings)
+}
+
+// normalizeHeader makes header matching ignore case, full-width forms,
+// whitespace and trailing colons, so "工作量（学时）：" matches "工作量(学时)"
+func normalizeHeader(header string) string {
+	header = width.Fold.String(header)
+	header = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, header)
+	return strings.TrimRight(header, ":")
+}
+
+// columnSchema is the set of aggregated headers. With a template it is fixed;
+// without one it grows with the headers of each submission in the order they
+// are first seen.
+type columnSchema struct {
+	headers  []string
+	index    map[string]int // normalized header or alias -> column
+	template bool
+}
+
+func newColumnSchema(headers []string, aliases map[string][]string, template bool) *columnSchema {
+	schema := &columnSchema{index: make(map[string]int), template: template}
+	for _, h := range headers {
+		schema.add(h)
+	}
+	// Headers take precedence over aliases that happen to equal them
+	for header, list := range aliases {
+		col, ok := schema.index[normalizeHeader(header)]
+		if !ok {
+			continue
+		}
+		for _, alias := range list {
+			if _, taken := schema.index[normalizeHeader(alias)]; !taken {
+				schema.index[normalizeHeader(alias)] = col
+			}
+		}
+	}
+	return schema
+}
+
+func (c *columnSchema) add(header string) int {
+	col := len(c.headers)
+	c.headers = append(c.headers, strings.TrimSpace(header))
+	if key := normalizeHeader(header); key != "" {
+		if _, exists := c.index[key]; !exists {
+			c.index[key] = col
+		}
+	}
+	return col
+}
+
+// mapHeader maps the columns of a submission's header row to schema columns,
+// -1 for columns that are left out. Headers that match nothing, or a column
+// already matched by an earlier header, are returned as unmapped; blank
+// headers are ignored.
+func (c *columnSchema) mapHeader(header []string) (mapping []int, unmapped []string) {
+	mapping = make([]int, len(header))
+	used := make(map[int]bool)
+	for i, cell := range header {
+		mapping[i] = -1
+		key := normalizeHeader(cell)
+		if key == "" {
+			continue
+		}
+		col, ok := c.index[key]
+		if !ok && !c.template {
+			col, ok = c.add(cell), true
+		}
+		if !ok || used[col] {
+			unmapped = append(unmapped, strings.TrimSpace(cell))
+			continue
+		}
+		used[col] = true
+		mapping[i] = col
+	}
+	return mapping, unmapped
+}
+
+// missing lists the schema headers not covered by mapping
+func (c *columnSchema) missing(mapping []int) []string {
+	covered := make(map[int]bool, len(mapping))
+	for _, col := range mapping {
+		covered[col] = true
+	}
+	var missing []string
+	for col, h := range c.headers {
+		if !covered[col] {
+			missing = append(missing, h)
+		}
+	}
+	return missing
+}
+
+// projectSchema builds the column schema of a project from its Excel
+// template. Projects without a readable Excel template, including one whose
+// file is missing, get a schema that grows from the submissions.
+func (s *ExcelService) projectSchema(projectID int, settings models.AggregationSettings) (*columnSchema, error) {
+	path, err := s.templatePath(projectID)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return newColumnSchema(nil, settings.ColumnAliases, false), nil
+	}
+
+	headers, err := s.templateHeaders(path)
+	if err != nil {
+		log.Printf("Failed to read template of project %d, using the submitted headers: %v", projectID, err)
+		return newColumnSchema(nil, settings.ColumnAliases, false), nil
+	}
+	if len(headers) == 0 {
+		return newColumnSchema(nil, settings.ColumnAliases, false), nil
+	}
+	return newColumnSchema(headers, settings.ColumnAliases, true), nil
+}
+
+// templatePath returns the path of a project's Excel template, or "" when it
+// has none
+func (s *ExcelService) templatePath(projectID int) (string, error) {
+	var templateName sql.NullString
+	if err := db.DB.QueryRow("SELECT excel_template_filename FROM projects WHERE id = ?", projectID).Scan(&templateName); err != nil {
+		return "", err
+	}
+	if templateName.String == "" || !isExcelFile(templateName.String) {
+		return "", nil
+	}
+	return filepath.Join(TemplateDir, templateName.String), nil
+}
+
+// templateFormats returns the number format of each schema column, taken
+// from the template cell below its header; "" where there is none. Only
+// .xlsx templates are looked at, as only they keep the formats of empty
+// cells.
+func (s *ExcelService) templateFormats(projectID int, schema *columnSchema) ([]string, error) {
+	formats := make([]string, len(schema.headers))
+	path, err := s.templatePath(projectID)
+	if err != nil || path == "" {
+		return formats, err
+	}
+	if format, err := workbookFormat(path); err != nil || format != WorkbookFormatXLSX {
+		return formats, nil
+	}
+	file, err := excelize.OpenFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read project template: %w", err)
+	}
+	defer file.Close()
+
+	sheet := file.GetSheetName(0)
+	rows, err := file.GetRows(sheet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read project template: %w", err)
+	}
+	headerIdx, header := s.firstNonEmptyRow(rows)
+	if headerIdx == -1 {
+		return formats, nil
+	}
+	mapping, _ := schema.mapHeader(header)
+	for i, col := range mapping {
+		if col < 0 {
+			continue
+		}
+		axis, _ := excelize.CoordinatesToCellName(i+1, headerIdx+2)
+		idx, err := file.GetCellStyle(sheet, axis)
+		if err != nil {
+			continue
+		}
+		if style, err := file.GetStyle(idx); err == nil {
+			formats[col] = styleFormat(style)
+		}
+	}
+	return formats, nil
+}
+
+// templateHeaders returns the non-blank cells of the first non-empty row of
+// the template's first sheet
+func (s *ExcelService) templateHeaders(path string) ([]string, error) {
+	rows, err := s.readFirstSheet(path)
+	if err != nil {
+		return nil, err
+	}
+	_, header := s.firstNonEmptyRow(rows)
+	var headers []string
+	for _, cell := range header {
+		if strings.TrimSpace(cell) != "" {
+			headers = append(headers, strings.TrimSpace(cell))
+		}
+	}
+	return headers, nil
+}
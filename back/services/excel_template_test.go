@@ -0,0 +1,56 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMapHeader(t *testing.T) {
+	template := []string{"姓名", "课程", "工作量(学时)"}
+	aliases := map[string][]string{"姓名": {"教师姓名", "Name"}, "工作量(学时)": {"学时"}}
+	tests := []struct {
+		name     string
+		header   []string
+		mapping  []int
+		unmapped []string
+		missing  []string
+	}{
+		{"same order", []string{"姓名", "课程", "工作量(学时)"}, []int{0, 1, 2}, nil, nil},
+		{"reordered", []string{"工作量(学时)", "姓名", "课程"}, []int{2, 0, 1}, nil, nil},
+		{"aliases", []string{"教师姓名", "课程", "学时"}, []int{0, 1, 2}, nil, nil},
+		{"normalized", []string{" name ", "课程：", "工作量（学时）"}, []int{0, 1, 2}, nil, nil},
+		{"missing", []string{"姓名", "学时"}, []int{0, 2}, nil, []string{"课程"}},
+		{"extra", []string{"姓名", "课程", "备注", "学时"}, []int{0, 1, -1, 2}, []string{"备注"}, nil},
+		{"blank", []string{"姓名", "", "课程", "学时"}, []int{0, -1, 1, 2}, nil, nil},
+		{"header and its alias", []string{"姓名", "教师姓名", "课程", "学时"}, []int{0, -1, 1, 2}, []string{"教师姓名"}, nil},
+	}
+	for _, tt := range tests {
+		schema := newColumnSchema(template, aliases, true)
+		mapping, unmapped := schema.mapHeader(tt.header)
+		if !reflect.DeepEqual(mapping, tt.mapping) || !reflect.DeepEqual(unmapped, tt.unmapped) {
+			t.Errorf("%s: mapHeader = %v, %q; want %v, %q", tt.name, mapping, unmapped, tt.mapping, tt.unmapped)
+		}
+		if missing := schema.missing(mapping); !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("%s: missing = %q, want %q", tt.name, missing, tt.missing)
+		}
+		if len(schema.headers) != len(template) {
+			t.Errorf("%s: template schema grew to %q", tt.name, schema.headers)
+		}
+	}
+}
+
+// TestMapHeaderWithoutTemplate grows the schema with the headers of each
+// submission, in the order they are first seen
+func TestMapHeaderWithoutTemplate(t *testing.T) {
+	schema := newColumnSchema(nil, nil, false)
+	if mapping, unmapped := schema.mapHeader([]string{"姓名", "学时"}); !reflect.DeepEqual(mapping, []int{0, 1}) || unmapped != nil {
+		t.Fatalf("first header = %v, %q", mapping, unmapped)
+	}
+	mapping, unmapped := schema.mapHeader([]string{"备注", "学时 ", "姓名", "学时"})
+	if want := []int{2, 1, 0, -1}; !reflect.DeepEqual(mapping, want) || !reflect.DeepEqual(unmapped, []string{"学时"}) {
+		t.Fatalf("second header = %v, %q; want %v and the repeated column unmapped", mapping, unmapped, want)
+	}
+	if want := []string{"姓名", "学时", "备注"}; !reflect.DeepEqual(schema.headers, want) {
+		t.Fatalf("headers = %q, want %q", schema.headers, want)
+	}
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"db_intro_backend/models"
+
+	"github.com/emersion/go-imap"
+	imapid "github.com/emersion/go-imap-id"
+	"github.com/emersion/go-imap/client"
+)
+
+// IMAPReader reads the user's mailbox over IMAP with implicit TLS. A nil
+// TLSConfig verifies the server against the system roots.
+type IMAPReader struct {
+	TLSConfig *tls.Config
+	// MaxMessageSize in bytes; larger messages are handed out with only
+	// their header (see RawMessage.Oversize). 0 disables the limit.
+	MaxMessageSize int64
+}
+
+// dial connects and logs in to the user's IMAP server
+func (r *IMAPReader) dial(user models.User) (*client.Client, error) {
+	log.Printf("Connecting to IMAP server %s:%s", user.IMAPHost, user.IMAPPort)
+	c, err := client.DialTLS(user.IMAPHost+":"+user.IMAPPort, r.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to IMAP server: %w", err)
+	}
+
+	if err := c.Login(user.IMAPUsername, user.IMAPPassword); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("failed to login: %w", err)
+	}
+	log.Println("Logged in to IMAP server")
+
+	// Some providers (163.com among them) refuse SELECT until the client identifies itself
+	idClient := imapid.NewClient(c)
+	idParams := map[string]string{
+		"name":          "my-go-client",
+		"version":       "1.0.0",
+		"vendor":        "go-imap",
+		"support-email": "support@example.com",
+	}
+	log.Println("Sending IMAP ID...")
+	if _, err := idClient.ID(idParams); err != nil {
+		log.Printf("IMAP ID command failed, continuing without it: %v", err)
+	} else {
+		log.Println("IMAP ID sent successfully!")
+	}
+	return c, nil
+}
+
+// Fetch hands the messages after state.LastUID to handle. The UIDs are listed
+// first with their sizes and each message is then downloaded on its own, so
+// only one message is held in memory at a time and messages above
+// MaxMessageSize are never downloaded. Messages are fetched with PEEK; only
+// Organize marks them read. A UIDVALIDITY change invalidates the
+// stored UIDs and triggers a full resync.
+func (r *IMAPReader) Fetch(user models.User, state models.MailboxSyncState, handle func(RawMessage) error) (models.MailboxSyncState, error) {
+	c, err := r.dial(user)
+	if err != nil {
+		return state, err
+	}
+	defer c.Logout()
+
+	mbox, err := c.Select(state.Mailbox, false)
+	if err != nil {
+		return state, fmt.Errorf("failed to select %s: %w", state.Mailbox, err)
+	}
+
+	next := state
+	if state.UIDValidity != mbox.UidValidity {
+		if state.UIDValidity != 0 {
+			log.Printf("UIDVALIDITY of %s changed (%d -> %d), performing full resync", state.Mailbox, state.UIDValidity, mbox.UidValidity)
+		}
+		next.UIDValidity = mbox.UidValidity
+		next.LastUID = 0
+	}
+
+	if mbox.Messages == 0 || (mbox.UidNext != 0 && next.LastUID+1 >= mbox.UidNext) {
+		log.Println("No new messages in mailbox")
+		return next, nil
+	}
+
+	uids, sizes, err := newUIDs(c, next.LastUID)
+	if err != nil {
+		return next, err
+	}
+
+	full := &imap.BodySectionName{Peek: true}
+	header := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+	fetched := 0
+	for _, uid := range uids {
+		size := int64(sizes[uid])
+		oversize := r.MaxMessageSize > 0 && size > r.MaxMessageSize
+		section := full
+		if oversize {
+			log.Printf("Message %d is %d bytes, over the limit; fetching its header only", uid, size)
+			section = header
+		}
+
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uid)
+		items := []imap.FetchItem{section.FetchItem(), imap.FetchUid}
+		messages := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, items, messages)
+		}()
+
+		// The literal goes to handle as it is, so the parser spools the
+		// attachments from it without another copy of the message
+		var body imap.Literal
+		for msg := range messages {
+			if msg == nil || msg.Uid != uid {
+				continue
+			}
+			if literal := msg.GetBody(section); literal != nil {
+				body = literal
+			}
+		}
+		if err := <-done; err != nil {
+			return next, fmt.Errorf("failed to fetch message %d: %w", uid, err)
+		}
+		// Stop before a message that could not be read, so that the next
+		// fetch tries it again instead of skipping it
+		if body == nil {
+			return next, fmt.Errorf("server returned no body for message %d", uid)
+		}
+
+		if err := handle(RawMessage{UID: uid, Body: body, Oversize: oversize, Size: size}); err != nil {
+			return next, err
+		}
+		fetched++
+		next.LastUID = uid
+	}
+
+	log.Printf("Fetched %d new emails (UID %d..%d)", fetched, state.LastUID+1, next.LastUID)
+	return next, nil
+}
+
+// newUIDs lists the UIDs above lastSeen in ascending order, with the size of
+// each message
+func newUIDs(c *client.Client, lastSeen uint32) ([]uint32, map[uint32]uint32, error) {
+	// "n:*" always matches the newest message, even when its UID is below n,
+	// so results are filtered against the last seen UID again
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(lastSeen+1, 0)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}, messages)
+	}()
+
+	var uids []uint32
+	sizes := make(map[uint32]uint32)
+	for msg := range messages {
+		if msg != nil && msg.Uid > lastSeen {
+			uids = append(uids, msg.Uid)
+			sizes[msg.Uid] = msg.Size
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, nil, fmt.Errorf("failed to list new messages: %w", err)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, sizes, nil
+}
+
+// Organize moves or flags processed messages in mailbox. Missing target
+// folders are created; "/" in folder names is mapped to the server's
+// hierarchy delimiter.
+func (r *IMAPReader) Organize(user models.User, mailbox string, dispositions []MessageDisposition) error {
+	c, err := r.dial(user)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	if _, err := c.Select(mailbox, false); err != nil {
+		return fmt.Errorf("failed to select %s: %w", mailbox, err)
+	}
+
+	seen := new(imap.SeqSet)
+	flagged := new(imap.SeqSet)
+	moves := make(map[string]*imap.SeqSet)
+	for _, d := range dispositions {
+		if d.Seen {
+			seen.AddNum(d.UID)
+		}
+		if d.Flag {
+			flagged.AddNum(d.UID)
+		}
+		if d.Folder == "" {
+			continue
+		}
+		if moves[d.Folder] == nil {
+			moves[d.Folder] = new(imap.SeqSet)
+		}
+		moves[d.Folder].AddNum(d.UID)
+	}
+
+	// Flags are stored before the moves, which carry them along
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if !seen.Empty() {
+		if err := c.UidStore(seen, item, []interface{}{imap.SeenFlag}, nil); err != nil {
+			return fmt.Errorf("failed to mark messages read: %w", err)
+		}
+	}
+	if !flagged.Empty() {
+		if err := c.UidStore(flagged, item, []interface{}{imap.FlaggedFlag}, nil); err != nil {
+			return fmt.Errorf("failed to flag messages: %w", err)
+		}
+	}
+
+	if len(moves) == 0 {
+		return nil
+	}
+	delimiter, err := hierarchyDelimiter(c)
+	if err != nil {
+		return err
+	}
+	for folder, uids := range moves {
+		name := strings.ReplaceAll(folder, "/", delimiter)
+		if err := ensureMailbox(c, name, delimiter); err != nil {
+			return err
+		}
+		if err := c.UidMove(uids, name); err != nil {
+			return fmt.Errorf("failed to move messages to %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// hierarchyDelimiter asks the server for its folder separator
+func hierarchyDelimiter(c *client.Client) (string, error) {
+	ch := make(chan *imap.MailboxInfo, 1)
+	if err := c.List("", "", ch); err != nil {
+		return "", fmt.Errorf("failed to query hierarchy delimiter: %w", err)
+	}
+	delimiter := "/"
+	for info := range ch {
+		if info.Delimiter != "" {
+			delimiter = info.Delimiter
+		}
+	}
+	return delimiter, nil
+}
+
+// ensureMailbox creates name and any missing parent folders
+func ensureMailbox(c *client.Client, name, delimiter string) error {
+	parts := strings.Split(name, delimiter)
+	for i := range parts {
+		path := strings.Join(parts[:i+1], delimiter)
+		ch := make(chan *imap.MailboxInfo, 10)
+		if err := c.List("", path, ch); err != nil {
+			return fmt.Errorf("failed to list %s: %w", path, err)
+		}
+		exists := false
+		for range ch {
+			exists = true
+		}
+		if exists {
+			continue
+		}
+		if err := c.Create(path); err != nil {
+			return fmt.Errorf("failed to create folder %s: %w", path, err)
+		}
+		log.Printf("Created IMAP folder %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"db_intro_backend/config"
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	idleRefreshInterval = 5 * time.Minute  // how often the set of watched users is reloaded
+	idleRestartInterval = 25 * time.Minute // IDLE is re-issued before servers drop it (RFC 2177: 29 min)
+	idleDebounce        = 2 * time.Second  // lets a burst of new messages settle before fetching
+	idleMinBackoff      = 5 * time.Second
+	idleMaxBackoff      = 5 * time.Minute
+	idleStableAfter     = 2 * time.Minute // a session this long resets the reconnect backoff
+)
+
+var errIdleUnsupported = errors.New("IMAP server does not support IDLE")
+
+// IdleWatcher keeps one IMAP connection per configured user in IDLE and
+// processes new mail as soon as the server announces it. Users whose server
+// lacks IDLE, and POP3 users, are polled every EmailFetchInterval minutes
+// instead.
+type IdleWatcher struct {
+	EmailService *EmailService
+	Config       *config.Config
+	Reader       *IMAPReader
+
+	mu       sync.Mutex
+	watching map[int]idleWatch
+	stop     chan struct{}
+	workers  sync.WaitGroup
+}
+
+type idleWatch struct {
+	cancel      context.CancelFunc
+	fingerprint string
+}
+
+func NewIdleWatcher(cfg *config.Config, emailService *EmailService) *IdleWatcher {
+	reader, ok := emailService.MailboxReader.(*IMAPReader)
+	if !ok {
+		reader = &IMAPReader{}
+	}
+	return &IdleWatcher{
+		EmailService: emailService,
+		Config:       cfg,
+		Reader:       reader,
+		watching:     make(map[int]idleWatch),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Start begins watching every user with a complete IMAP configuration and
+// picks up configuration changes periodically.
+func (w *IdleWatcher) Start() {
+	log.Printf("Starting IMAP IDLE watcher")
+	w.workers.Add(1)
+	go func() {
+		defer w.workers.Done()
+		ticker := time.NewTicker(idleRefreshInterval)
+		defer ticker.Stop()
+		for {
+			w.refresh()
+			select {
+			case <-ticker.C:
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends every session and waits for them. Mail announced during the
+// debounce is left for the next start.
+func (w *IdleWatcher) Stop() {
+	w.mu.Lock()
+	close(w.stop)
+	for id, current := range w.watching {
+		current.cancel()
+		delete(w.watching, id)
+	}
+	w.mu.Unlock()
+	w.workers.Wait()
+}
+
+// refresh starts watchers for new or reconfigured users and stops those of
+// users whose configuration was removed
+func (w *IdleWatcher) refresh() {
+	rows, err := db.DB.Query("SELECT " + userEmailColumns + " FROM users WHERE imap_host != '' AND imap_username != '' AND email_address != ''")
+	if err != nil {
+		log.Printf("IDLE watcher failed to load users: %v", err)
+		return
+	}
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUserEmailConfig(rows)
+		if err != nil {
+			log.Printf("Failed to scan user: %v", err)
+			continue
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.stop:
+		return
+	default:
+	}
+
+	seen := make(map[int]bool)
+	for _, user := range users {
+		seen[user.ID] = true
+		fingerprint := user.MailProtocol + "|" + user.IMAPHost + "|" + user.IMAPPort + "|" + user.IMAPUsername + "|" + user.IMAPPassword
+		if current, ok := w.watching[user.ID]; ok {
+			if current.fingerprint == fingerprint {
+				continue
+			}
+			current.cancel()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		w.watching[user.ID] = idleWatch{cancel: cancel, fingerprint: fingerprint}
+		w.workers.Add(1)
+		go func(user models.User) {
+			defer w.workers.Done()
+			if user.MailProtocol == MailProtocolPOP3 {
+				w.poll(ctx, user)
+			} else {
+				w.watch(ctx, user)
+			}
+		}(user)
+	}
+	for id, current := range w.watching {
+		if !seen[id] {
+			current.cancel()
+			delete(w.watching, id)
+		}
+	}
+}
+
+// watch runs IDLE sessions for a user, reconnecting with exponential backoff
+func (w *IdleWatcher) watch(ctx context.Context, user models.User) {
+	backoff := idleMinBackoff
+	for {
+		started := time.Now()
+		err := w.session(ctx, user)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errIdleUnsupported) {
+			log.Printf("IMAP server of user %d does not support IDLE, falling back to polling", user.ID)
+			w.poll(ctx, user)
+			return
+		}
+
+		if time.Since(started) > idleStableAfter {
+			backoff = idleMinBackoff
+		}
+		log.Printf("IMAP IDLE for user %d interrupted: %v, reconnecting in %v", user.ID, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > idleMaxBackoff {
+			backoff = idleMaxBackoff
+		}
+	}
+}
+
+// session holds one IDLE connection until it fails or ctx is cancelled.
+// Mail is fetched through the regular pipeline on a separate connection.
+func (w *IdleWatcher) session(ctx context.Context, user models.User) error {
+	c, err := w.Reader.dial(user)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	if ok, err := c.Support("IDLE"); err != nil {
+		return err
+	} else if !ok {
+		return errIdleUnsupported
+	}
+
+	// The client blocks until updates are consumed, so they are drained for
+	// the whole session and reduced to a single "new mail" signal
+	updates := make(chan client.Update, 16)
+	c.Updates = updates
+	newMail := make(chan struct{}, 1)
+	sessionDone := make(chan struct{})
+	defer close(sessionDone)
+	go func() {
+		for {
+			select {
+			case <-sessionDone:
+				return
+			case u := <-updates:
+				if _, ok := u.(*client.MailboxUpdate); ok {
+					select {
+					case newMail <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	if _, err := c.Select(inboxMailbox, true); err != nil {
+		return err
+	}
+	log.Printf("IMAP IDLE watching INBOX of user %d", user.ID)
+
+	// Catch up on mail that arrived while disconnected
+	w.process(user.ID)
+
+	for {
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Idle(stop, &client.IdleOptions{LogoutTimeout: idleRestartInterval})
+		}()
+
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-done
+			return nil
+		case err := <-done:
+			if err == nil {
+				err = errors.New("IDLE ended unexpectedly")
+			}
+			return err
+		case <-newMail:
+			close(stop)
+			if err := <-done; err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(idleDebounce):
+		}
+		w.process(user.ID)
+	}
+}
+
+// poll is the fallback for servers without IDLE
+func (w *IdleWatcher) poll(ctx context.Context, user models.User) {
+	interval := time.Duration(w.Config.EmailFetchInterval) * time.Minute
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.process(user.ID)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *IdleWatcher) process(userID int) {
+	if err := w.EmailService.ProcessUserEmails(userID); err != nil {
+		log.Printf("Failed to process emails for user %d: %v", userID, err)
+	}
+}
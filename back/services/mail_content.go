@@ -0,0 +1,131 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func init() {
+	// Chinese mail clients often label GBK text as GB2312; decoding it as GBK
+	// (a superset) keeps characters outside GB2312 intact.
+	charset.RegisterEncoding("gb2312", simplifiedchinese.GBK)
+	charset.RegisterEncoding("gbk", simplifiedchinese.GBK)
+	charset.RegisterEncoding("x-gbk", simplifiedchinese.GBK)
+	charset.RegisterEncoding("cp936", simplifiedchinese.GBK)
+	charset.RegisterEncoding("gb18030", simplifiedchinese.GB18030)
+}
+
+// Elements whose boundaries start a new line in the text rendering
+var htmlBlockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "tr": true, "li": true, "table": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "hr": true, "ul": true, "ol": true,
+}
+
+// htmlToText renders an HTML body as plain text: tags are dropped, block
+// elements become line breaks and table cells are separated by tabs.
+func htmlToText(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	var b strings.Builder
+	skip := 0 // depth inside <script>, <style> or <head>
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return normalizeText(b.String())
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			switch tag {
+			case "script", "style", "head", "title":
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+				continue
+			case "td", "th":
+				if tt == html.StartTagToken {
+					b.WriteByte('\t')
+				}
+				continue
+			}
+			if htmlBlockElements[tag] {
+				b.WriteByte('\n')
+			}
+		}
+	}
+}
+
+var (
+	horizontalSpace = regexp.MustCompile(`[ \t\x{00a0}\x{3000}]+`)
+	blankLines      = regexp.MustCompile(`\n{3,}`)
+)
+
+// normalizeText collapses runs of spaces, trims every line and keeps at most
+// one empty line in a row
+func normalizeText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(horizontalSpace.ReplaceAllString(line, " "))
+	}
+	s = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(s)
+}
+
+var (
+	// Lines that introduce the quoted original message
+	quoteSeparators = []*regexp.Regexp{
+		regexp.MustCompile(`^-{2,}\s*(Original Message|Forwarded message)\s*-{2,}$`),
+		regexp.MustCompile(`^-{2,}\s*(原始邮件|邮件原件|转发邮件|回复的原邮件)\s*-{2,}$`),
+		regexp.MustCompile(`^On .+ wrote:$`),
+		regexp.MustCompile(`^在.+写道[:：]$`),
+		regexp.MustCompile(`^_{10,}$`), // Outlook separator line
+	}
+	// Outlook-style quoted header block: "From: ..." followed by "Sent: ..."
+	quoteHeaderFrom = regexp.MustCompile(`^(From|发件人)\s*[:：]`)
+	quoteHeaderNext = regexp.MustCompile(`^(Sent|Date|To|发送时间|时间|日期|收件人)\s*[:：]`)
+)
+
+// stripQuotedText removes the quoted history from a reply body: everything
+// after a separator such as "On ... wrote:", "在 ... 写道：", "原始邮件" or an
+// Outlook header block, as well as lines starting with ">".
+func stripQuotedText(body string) string {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	var kept []string
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(horizontalSpace.ReplaceAllString(line, " "))
+		if isQuoteSeparator(trimmed) {
+			break
+		}
+		if quoteHeaderFrom.MatchString(trimmed) && i+1 < len(lines) &&
+			quoteHeaderNext.MatchString(strings.TrimSpace(horizontalSpace.ReplaceAllString(lines[i+1], " "))) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return normalizeText(strings.Join(kept, "\n"))
+}
+
+func isQuoteSeparator(line string) bool {
+	for _, re := range quoteSeparators {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"db_intro_backend/models"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func gbk(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestParseEmailGBK reads a body in GBK and a subject labelled GB2312 that
+// uses a character only GBK has (赟)
+func TestParseEmailGBK(t *testing.T) {
+	subject := "=?gb2312?B?" + base64.StdEncoding.EncodeToString(gbk(t, "王赟的工作量")) + "?="
+	raw := "From: wang@school.test\r\nSubject: " + subject + "\r\nMessage-ID: <gbk@school.test>\r\n" +
+		"Content-Type: text/plain; charset=GBK\r\nContent-Transfer-Encoding: 8bit\r\n\r\n" +
+		string(gbk(t, "老师您好，工作量见附件。\r\n"))
+
+	email, err := (&EmailService{}).parseEmail(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.Subject != "王赟的工作量" {
+		t.Errorf("Subject = %q", email.Subject)
+	}
+	if email.TextBody != "老师您好，工作量见附件。" {
+		t.Errorf("TextBody = %q", email.TextBody)
+	}
+}
+
+// TestParseEmailHTMLOnly renders the text of a message without a text/plain
+// alternative
+func TestParseEmailHTMLOnly(t *testing.T) {
+	raw := "From: li@school.test\r\nSubject: Re: 工作量\r\nMessage-ID: <html@school.test>\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<html><head><title>x</title><style>p{color:red}</style></head><body>" +
+		"<p>已填写，&nbsp;见附件</p><table><tr><td>课程</td><td>学时</td></tr><tr><td>数据库</td><td>32</td></tr></table>" +
+		"<div>On Mon, 1 Sep 2025, office wrote:</div><blockquote>请填写</blockquote></body></html>"
+
+	email, err := (&EmailService{}).parseEmail(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "已填写， 见附件\n\n课程 学时\n\n数据库 32"; email.TextBody != want {
+		t.Errorf("TextBody = %q, want %q", email.TextBody, want)
+	}
+	if !strings.Contains(email.Body, "<table>") {
+		t.Errorf("Body = %q, want the HTML kept", email.Body)
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		html, want string
+	}{
+		{"<p>第一段</p><p>第二段</p>", "第一段\n\n第二段"},
+		{"一行<br>两行<br/>三行", "一行\n两行\n三行"},
+		{"<script>alert(1)</script>正文", "正文"},
+		{"<ul><li>A</li><li>B</li></ul>", "A\n\nB"},
+		{"a&amp;b&lt;c", "a&b<c"},
+		{"  多个　　空格  ", "多个 空格"},
+	}
+	for _, tt := range tests {
+		if got := htmlToText(tt.html); got != tt.want {
+			t.Errorf("htmlToText(%q) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
+
+func TestStripQuotedText(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+	}{
+		{"no quote", "已填写\n见附件", "已填写\n见附件"},
+		{"Gmail", "已填写，见附件\n\nOn Mon, Sep 1, 2025 at 9:00 AM Office <office@school.test> wrote:\n> 请填写工作量\n> 谢谢",
+			"已填写，见附件"},
+		{"Gmail in Chinese", "好的\n\n在 2025年9月1日周一 09:00，教务办 <office@school.test> 写道：\n> 请填写", "好的"},
+		{"Outlook", "见附件\r\n\r\n________________________________\r\nFrom: Office <office@school.test>\r\nSent: Monday, September 1, 2025 9:00 AM\r\nSubject: 工作量\r\n\r\n请填写",
+			"见附件"},
+		{"Outlook header block", "见附件\n\nFrom: Office\nSent: Monday\n请填写", "见附件"},
+		{"Outlook in Chinese", "已提交\n\n发件人: 教务办 <office@school.test>\n发送时间: 2025年9月1日 9:00\n收件人: 张三", "已提交"},
+		{"Foxmail", "收到\n------------------ 原始邮件 ------------------\n发件人: 教务办", "收到"},
+		{"From line that is not a quote", "From: 张三\n课程: 数据库", "From: 张三\n课程: 数据库"},
+		{"inline quotes", "> 请填写\n已填写\n> 谢谢\n不客气", "已填写\n不客气"},
+	}
+	for _, tt := range tests {
+		if got := stripQuotedText(tt.body); got != tt.want {
+			t.Errorf("%s: stripQuotedText = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestParseEmailTruncated keeps the parts read before a multipart body that
+// ends without its closing boundary
+func TestParseEmailTruncated(t *testing.T) {
+	raw := "From: zhang@school.test\r\nMessage-ID: <cut@school.test>\r\n" +
+		"Content-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+		"--b1\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n见附件\r\n" +
+		"--b1\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=scan.pdf\r\n\r\nJVBERi0x"
+
+	done := make(chan error, 1)
+	var email models.EmailMessage
+	go func() {
+		var err error
+		email, err = (&EmailService{}).parseEmail(strings.NewReader(raw))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("parseEmail did not return")
+	}
+	if email.TextBody != "见附件" {
+		t.Errorf("TextBody = %q", email.TextBody)
+	}
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+// NewImportReport starts an empty report
+func NewImportReport(dryRun bool) *models.ImportReport {
+	return &models.ImportReport{
+		DryRun:   dryRun,
+		Counts:   make(map[string]int),
+		Messages: []models.ImportedMessage{},
+	}
+}
+
+// ImportMessages ingests a single .eml message or an mbox archive for a user,
+// through the same parsing, matching and storage as fetched mail. Messages
+// are read and processed one at a time and added to report.
+func (s *EmailService) ImportMessages(user models.User, r io.Reader, source string, dryRun bool, report *models.ImportReport) error {
+	unlock := s.lockUser(user.ID)
+	defer unlock()
+
+	projects, err := userProjectRefs(user.ID)
+	if err != nil {
+		return err
+	}
+	add := func(m models.ImportedMessage) {
+		report.Counts[m.Outcome]++
+		report.Messages = append(report.Messages, m)
+	}
+
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(5); string(head) != "From " {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		add(s.importMessage(user, data, source, dryRun, projects))
+		return nil
+	}
+
+	n := 0
+	return readMbox(br, func(data []byte) {
+		n++
+		add(s.importMessage(user, data, fmt.Sprintf("%s #%d", source, n), dryRun, projects))
+	})
+}
+
+// readMbox splits an mbox stream into messages. A "From " line at the start
+// or after an empty line begins a new message; ">From " quoting (mboxrd) is
+// undone.
+func readMbox(br *bufio.Reader, handle func([]byte)) error {
+	var msg bytes.Buffer
+	inMessage, prevBlank := false, true
+
+	flush := func() {
+		if !inMessage {
+			return
+		}
+		// The empty line before the next separator belongs to the mbox
+		data := bytes.TrimSuffix(msg.Bytes(), []byte("\n"))
+		data = bytes.TrimSuffix(data, []byte("\r"))
+		handle(data)
+		msg.Reset()
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if prevBlank && bytes.HasPrefix(line, []byte("From ")) {
+				flush()
+				inMessage = true
+			} else if inMessage {
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				msg.Write(line)
+			}
+			prevBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if err == io.EOF {
+			flush()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *EmailService) importMessage(user models.User, data []byte, source string, dryRun bool, projects map[int]models.ProjectRef) models.ImportedMessage {
+	item := models.ImportedMessage{Source: source, CandidateProjects: []models.ProjectRef{}}
+
+	email, err := s.parseEmail(bytes.NewReader(data))
+	if err != nil {
+		item.Outcome = IngestFailed
+		item.Error = err.Error()
+		return item
+	}
+	defer removeSpooledAttachments(email.Attachments)
+
+	// Without a Message-ID the content hash keeps re-imports idempotent
+	if email.MessageID == "" {
+		email.MessageID = fmt.Sprintf("<%x@import.local>", sha256.Sum256(data))
+	}
+
+	item.MessageID = email.MessageID
+	item.From = email.From
+	item.Subject = email.Subject
+	item.ReceivedAt = &email.ReceivedAt
+	item.Attachments = len(email.Attachments)
+
+	res := s.ingestEmail(user, email, dryRun)
+	item.Outcome = res.Outcome
+	item.MatchMethod = res.Match.Method
+	if res.Err != nil {
+		item.Error = res.Err.Error()
+	}
+	if p, ok := projects[res.Match.ProjectID]; ok {
+		item.Project = &p
+	}
+	for _, id := range res.Match.Candidates {
+		if p, ok := projects[id]; ok {
+			item.CandidateProjects = append(item.CandidateProjects, p)
+		}
+	}
+	if res.Match.TeacherID.Valid {
+		item.TeacherID = nullIntPtr(res.Match.TeacherID)
+		db.DB.QueryRow("SELECT name FROM teachers WHERE id = ?", res.Match.TeacherID.Int64).Scan(&item.TeacherName)
+	}
+
+	if !dryRun {
+		log.Printf("Imported %s (%s): %s", source, email.MessageID, item.Outcome)
+	}
+	return item
+}
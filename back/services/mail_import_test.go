@@ -0,0 +1,63 @@
+package services
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadMbox(t *testing.T) {
+	tests := []struct {
+		name string
+		mbox string
+		want []string
+	}{
+		{
+			name: "separators",
+			mbox: "From zhang@school.test Mon Sep  1 09:00:00 2025\nSubject: 1\n\n见附件\n\n" +
+				"From li@school.test Mon Sep  1 10:00:00 2025\nSubject: 2\n\n已填写\n\n",
+			want: []string{"Subject: 1\n\n见附件\n", "Subject: 2\n\n已填写\n"},
+		},
+		{
+			name: "From inside a paragraph",
+			mbox: "From zhang@school.test Mon Sep  1 09:00:00 2025\nSubject: 1\n\n课程如下\nFrom 周一起上课\n\n",
+			want: []string{"Subject: 1\n\n课程如下\nFrom 周一起上课\n"},
+		},
+		{
+			name: "quoted From lines",
+			mbox: "From zhang@school.test Mon Sep  1 09:00:00 2025\nSubject: 1\n\n>From the office\n>>From the office\n> From the office\n\n",
+			want: []string{"Subject: 1\n\nFrom the office\n>From the office\n> From the office\n"},
+		},
+		{
+			name: "no trailing newline",
+			mbox: "From zhang@school.test Mon Sep  1 09:00:00 2025\nSubject: 1\n\n见附件\n\n" +
+				"From li@school.test Mon Sep  1 10:00:00 2025\nSubject: 2\n\n已填写",
+			want: []string{"Subject: 1\n\n见附件\n", "Subject: 2\n\n已填写"},
+		},
+		{
+			name: "CRLF",
+			mbox: "From zhang@school.test Mon Sep  1 09:00:00 2025\r\nSubject: 1\r\n\r\n见附件\r\n\r\n" +
+				"From li@school.test Mon Sep  1 10:00:00 2025\r\nSubject: 2\r\n\r\n已填写\r\n\r\n",
+			want: []string{"Subject: 1\r\n\r\n见附件\r\n", "Subject: 2\r\n\r\n已填写\r\n"},
+		},
+		{
+			name: "text before the first separator",
+			mbox: "not a message\n\nFrom zhang@school.test Mon Sep  1 09:00:00 2025\nSubject: 1\n\n见附件\n\n",
+			want: []string{"Subject: 1\n\n见附件\n"},
+		},
+		{name: "empty", mbox: "", want: nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := readMbox(bufio.NewReader(strings.NewReader(tt.mbox)), func(data []byte) {
+			got = append(got, string(data))
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%s: messages = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"log"
+	"strings"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+// What happens to a message on the server once it has been processed
+const (
+	MailboxActionNone = "none"
+	MailboxActionMove = "move"
+	MailboxActionFlag = "flag"
+)
+
+// Folders used when the user has not configured their own
+const (
+	DefaultProcessedFolder = "DB_Intro"
+	DefaultUnmatchedFolder = "DB_Intro/Unmatched"
+)
+
+// ResolveMailboxAction returns the stored action, treating unknown values as none
+func ResolveMailboxAction(action string) string {
+	switch action {
+	case MailboxActionMove, MailboxActionFlag:
+		return action
+	default:
+		return MailboxActionNone
+	}
+}
+
+// ValidMailboxAction reports whether action can be stored; empty means none
+func ValidMailboxAction(action string) bool {
+	switch action {
+	case "", MailboxActionNone, MailboxActionMove, MailboxActionFlag:
+		return true
+	default:
+		return false
+	}
+}
+
+// replyDisposition marks a matched reply read and files it under
+// <processed folder>/<project code>, or flags it in place
+func replyDisposition(user models.User, projectID int, uid uint32) (MessageDisposition, bool) {
+	if uid == 0 {
+		return MessageDisposition{}, false
+	}
+	d := MessageDisposition{UID: uid, Seen: true}
+	switch user.MailboxAction {
+	case MailboxActionFlag:
+		d.Flag = true
+	case MailboxActionMove:
+		base := strings.Trim(user.ProcessedFolder, "/")
+		if base == "" {
+			base = DefaultProcessedFolder
+		}
+		var code string
+		db.DB.QueryRow("SELECT COALESCE(code, '') FROM projects WHERE id = ?", projectID).Scan(&code)
+		// The code becomes a single folder level
+		if code = strings.NewReplacer("/", "_", ".", "_").Replace(strings.TrimSpace(code)); code != "" {
+			base += "/" + code
+		}
+		d.Folder = base
+	}
+	return d, true
+}
+
+// bounceDisposition marks a processed bounce read
+func bounceDisposition(uid uint32) (MessageDisposition, bool) {
+	if uid == 0 {
+		return MessageDisposition{}, false
+	}
+	return MessageDisposition{UID: uid, Seen: true}, true
+}
+
+// unmatchedDisposition moves mail queued for triage to the unmatched folder.
+// It is fetched with PEEK and left unread, so that it stays visible in the
+// user's mail client.
+func unmatchedDisposition(user models.User, uid uint32) (MessageDisposition, bool) {
+	if uid == 0 || user.MailboxAction != MailboxActionMove {
+		return MessageDisposition{}, false
+	}
+	folder := strings.Trim(user.UnmatchedFolder, "/")
+	if folder == "" {
+		folder = DefaultUnmatchedFolder
+	}
+	return MessageDisposition{UID: uid, Folder: folder}, true
+}
+
+// organizeMailbox applies the dispositions on the server. Failures are only
+// logged: the messages are already stored and the sync state skips them anyway.
+func (s *EmailService) organizeMailbox(user models.User, dispositions []MessageDisposition) {
+	if len(dispositions) == 0 {
+		return
+	}
+	organizer, ok := s.readerFor(user).(MailboxOrganizer)
+	if !ok {
+		return
+	}
+	if err := organizer.Organize(user, inboxMailbox, dispositions); err != nil {
+		log.Printf("Failed to organize mailbox of user %d: %v", user.ID, err)
+		return
+	}
+	log.Printf("Filed %d processed messages of user %d (%s)", len(dispositions), user.ID, user.MailboxAction)
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+const inboxMailbox = "INBOX"
+
+// loadMailboxSyncState returns the stored sync position of a user's mailbox.
+// A mailbox that has never been synced yields a zero state, which makes the
+// next fetch a full sync.
+func loadMailboxSyncState(userID int, mailbox string) (models.MailboxSyncState, error) {
+	state := models.MailboxSyncState{UserID: userID, Mailbox: mailbox}
+	err := db.DB.QueryRow(
+		"SELECT uid_validity, last_uid FROM mailbox_sync_state WHERE user_id = ? AND mailbox = ?",
+		userID, mailbox,
+	).Scan(&state.UIDValidity, &state.LastUID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return state, err
+	}
+	return state, nil
+}
+
+func saveMailboxSyncState(state models.MailboxSyncState) error {
+	_, err := db.DB.Exec(`
+		INSERT INTO mailbox_sync_state (user_id, mailbox, uid_validity, last_uid, last_synced_at)
+		VALUES (?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE uid_validity = VALUES(uid_validity), last_uid = VALUES(last_uid), last_synced_at = NOW()`,
+		state.UserID, state.Mailbox, state.UIDValidity, state.LastUID)
+	return err
+}
+
+// loadSeenUIDLs returns the POP3 unique ids already processed for a user
+func loadSeenUIDLs(userID int) (map[string]bool, error) {
+	rows, err := db.DB.Query("SELECT uidl FROM pop3_seen_uids WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var uidl string
+		if err := rows.Scan(&uidl); err != nil {
+			return nil, err
+		}
+		seen[uidl] = true
+	}
+	return seen, rows.Err()
+}
+
+func markUIDLSeen(userID int, uidl string) error {
+	_, err := db.DB.Exec("INSERT IGNORE INTO pop3_seen_uids (user_id, uidl, seen_at) VALUES (?, ?, NOW())", userID, uidl)
+	return err
+}
+
+// forgetUIDLs drops ids of messages that are no longer on the server
+func forgetUIDLs(userID int, uidls []string) error {
+	for _, uidl := range uidls {
+		if _, err := db.DB.Exec("DELETE FROM pop3_seen_uids WHERE user_id = ? AND uidl = ?", userID, uidl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
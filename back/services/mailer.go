@@ -0,0 +1,47 @@
+package services
+
+import (
+	"io"
+
+	"db_intro_backend/models"
+)
+
+// Mailer delivers an already composed RFC 5322 message
+type Mailer interface {
+	Send(user models.User, from string, to []string, msg []byte) error
+}
+
+// MailboxReader passes the messages of a user's mailbox that are newer than
+// the given sync state to handle, one at a time in UID order. It returns the
+// state to persist, which covers the messages handled so far even when it
+// fails part way. An error from handle stops the fetch before that message,
+// so the next fetch hands it out again.
+type MailboxReader interface {
+	Fetch(user models.User, state models.MailboxSyncState, handle func(RawMessage) error) (models.MailboxSyncState, error)
+}
+
+// RawMessage is an unparsed message as handed out by a MailboxReader
+type RawMessage struct {
+	UID uint32
+	// Body streams the message and is only valid until handle returns
+	Body io.Reader
+	// Oversize is set when the message exceeds the reader's size limit: it
+	// was not downloaded and Body holds only its header
+	Oversize bool
+	Size     int64
+}
+
+// MailboxOrganizer is implemented by readers that can file processed
+// messages on the server
+type MailboxOrganizer interface {
+	Organize(user models.User, mailbox string, dispositions []MessageDisposition) error
+}
+
+// MessageDisposition says what to do with a processed message: mark it
+// read, flag it and/or move it to Folder
+type MessageDisposition struct {
+	UID    uint32
+	Seen   bool
+	Flag   bool
+	Folder string
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+const jobColumns = `
+	j.id, j.project_id, j.kind, j.status, j.total_count,
+	COUNT(CASE WHEN o.status = 'sent' THEN 1 END),
+	COUNT(CASE WHEN o.status IN ('failed', 'unknown') THEN 1 END),
+	COUNT(CASE WHEN o.status IN ('queued', 'sending') THEN 1 END),
+	j.started_at, j.finished_at, j.created_at`
+
+func scanJob(row rowScanner) (models.EmailJob, error) {
+	var job models.EmailJob
+	var startedAt, finishedAt sql.NullTime
+	if err := row.Scan(&job.ID, &job.ProjectID, &job.Kind, &job.Status, &job.TotalCount,
+		&job.SentCount, &job.FailedCount, &job.PendingCount,
+		&startedAt, &finishedAt, &job.CreatedAt); err != nil {
+		return job, err
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, nil
+}
+
+// ListProjectJobs returns the dispatch and reminder jobs of a project, newest first
+func (s *OutboxService) ListProjectJobs(projectID int) ([]models.EmailJob, error) {
+	rows, err := db.DB.Query(`
+		SELECT `+jobColumns+`
+		FROM email_jobs j
+		LEFT JOIN outbound_emails o ON o.job_id = j.id
+		WHERE j.project_id = ?
+		GROUP BY j.id
+		ORDER BY j.created_at DESC, j.id DESC`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []models.EmailJob{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// GetJob returns a job owned by the given user. With withRecipients set the
+// per-teacher delivery outcomes are loaded as well.
+func (s *OutboxService) GetJob(jobID, userID int, withRecipients bool) (models.EmailJob, error) {
+	job, err := scanJob(db.DB.QueryRow(`
+		SELECT `+jobColumns+`
+		FROM email_jobs j
+		JOIN projects p ON j.project_id = p.id
+		LEFT JOIN outbound_emails o ON o.job_id = j.id
+		WHERE j.id = ? AND p.created_by = ?
+		GROUP BY j.id`, jobID, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return job, ErrJobNotFound
+		}
+		return job, err
+	}
+	if !withRecipients {
+		return job, nil
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT o.teacher_id, COALESCE(t.name, ''), o.to_email, o.status, o.attempts, COALESCE(o.last_error, ''), o.sent_at
+		FROM outbound_emails o
+		LEFT JOIN teachers t ON o.teacher_id = t.id
+		WHERE o.job_id = ?
+		ORDER BY o.id ASC`, jobID)
+	if err != nil {
+		return job, err
+	}
+	defer rows.Close()
+
+	job.Recipients = []models.JobRecipient{}
+	for rows.Next() {
+		var r models.JobRecipient
+		var sentAt sql.NullTime
+		if err := rows.Scan(&r.TeacherID, &r.TeacherName, &r.Email, &r.Status, &r.Attempts, &r.LastError, &sentAt); err != nil {
+			return job, err
+		}
+		if sentAt.Valid {
+			r.SentAt = &sentAt.Time
+		}
+		job.Recipients = append(job.Recipients, r)
+	}
+	return job, rows.Err()
+}
+
+func markJobStarted(jobID int) {
+	if _, err := db.DB.Exec("UPDATE email_jobs SET status = ?, started_at = NOW() WHERE id = ? AND started_at IS NULL",
+		JobStatusRunning, jobID); err != nil {
+		log.Printf("Failed to mark job %d started: %v", jobID, err)
+	}
+}
+
+// refreshJobStatus closes a job once none of its messages is waiting for
+// delivery any more.
+func refreshJobStatus(jobID int) {
+	if err := closeJobIfDone(jobID); err != nil {
+		log.Printf("Failed to update status of job %d: %v", jobID, err)
+	}
+}
+
+func closeJobIfDone(jobID int) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The job row is locked first, so that a concurrent RetryFailed either
+	// sees the job closed or is seen requeueing its messages
+	var finished sql.NullTime
+	err = tx.QueryRow("SELECT finished_at FROM email_jobs WHERE id = ? FOR UPDATE", jobID).Scan(&finished)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && finished.Valid) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var waiting int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM outbound_emails WHERE job_id = ? AND status IN (?, ?)",
+		jobID, OutboundStatusQueued, OutboundStatusSending).Scan(&waiting); err != nil {
+		return err
+	}
+	if waiting > 0 {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE email_jobs SET status = ?, finished_at = NOW() WHERE id = ?", JobStatusCompleted, jobID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
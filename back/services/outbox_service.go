@@ -0,0 +1,498 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"db_intro_backend/config"
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+const (
+	OutboundKindDispatch = "dispatch"
+	OutboundKindReminder = "reminder"
+	OutboundKindFeedback = "feedback" // validation failures sent back to the teacher
+
+	OutboundStatusQueued  = "queued"
+	OutboundStatusSending = "sending"
+	OutboundStatusSent    = "sent"
+	OutboundStatusFailed  = "failed"
+	OutboundStatusUnknown = "unknown" // interrupted while sending: it may have been delivered
+)
+
+const (
+	outboxBatchSize   = 20
+	outboxBaseBackoff = time.Minute
+	outboxMaxBackoff  = time.Hour
+)
+
+// OutboxService delivers queued emails from the outbound_emails table.
+// Messages are persisted before sending, so a restart or a transient SMTP
+// failure only delays them.
+type OutboxService struct {
+	EmailService *EmailService
+	Config       *config.Config
+
+	wake    chan struct{}
+	stop    chan struct{}
+	workers sync.WaitGroup
+	// repairSent is set when a delivered message may lack its sent_emails row
+	repairSent atomic.Bool
+}
+
+func NewOutboxService(cfg *config.Config, emailService *EmailService) *OutboxService {
+	return &OutboxService{
+		EmailService: emailService,
+		Config:       cfg,
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Start marks messages left in "sending" by a previous process as unknown
+// and starts the delivery worker. Such a message may have been delivered
+// just before the process stopped, so it is only sent again by RetryFailed.
+func (s *OutboxService) Start() {
+	s.markInterrupted()
+	s.repairSent.Store(true)
+
+	interval := time.Duration(s.Config.OutboxPollInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	log.Printf("Starting outbox worker with %v poll interval", interval)
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.repairSentEmails()
+			s.processScheduledReminders()
+			s.processDue()
+			select {
+			case <-ticker.C:
+			case <-s.wake:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the delivery worker after its current round and waits for it.
+func (s *OutboxService) Stop() {
+	close(s.stop)
+	s.workers.Wait()
+}
+
+// Notify wakes the worker so freshly queued messages go out without waiting
+// for the next poll.
+func (s *OutboxService) Notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue stores messages in the outbox as one job of the given kind and
+// returns the job ID. Job and messages are written in a single transaction.
+func (s *OutboxService) Enqueue(projectID, userID int, kind string, messages []models.OutboundEmail) (int, error) {
+	jobID, err := enqueueOutbound(projectID, userID, kind, messages)
+	if err != nil {
+		return 0, err
+	}
+	s.Notify()
+	return jobID, nil
+}
+
+// enqueueOutbound writes a job and its messages; without a Notify they are
+// sent on the worker's next poll
+func enqueueOutbound(projectID, userID int, kind string, messages []models.OutboundEmail) (int, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	jobID, err := enqueueOutboundTx(tx, projectID, userID, kind, messages)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return jobID, nil
+}
+
+// enqueueOutboundTx writes a job and its messages in tx, so that callers can
+// record what the job was queued for in the same transaction
+func enqueueOutboundTx(tx *sql.Tx, projectID, userID int, kind string, messages []models.OutboundEmail) (int, error) {
+	res, err := tx.Exec("INSERT INTO email_jobs (project_id, created_by, kind, status, total_count) VALUES (?, ?, ?, ?, ?)",
+		projectID, userID, kind, JobStatusQueued, len(messages))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create job: %w", err)
+	}
+	lastID, _ := res.LastInsertId()
+	jobID := int(lastID)
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO outbound_emails (project_id, teacher_id, user_id, job_id, dispatch_id, kind, to_email, subject, body, attachment_path, status, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for _, m := range messages {
+		if _, err := stmt.Exec(m.ProjectID, m.TeacherID, m.UserID, jobID, m.DispatchID, kind, m.ToEmail,
+			m.Subject, m.Body, m.AttachmentPath, OutboundStatusQueued); err != nil {
+			return 0, fmt.Errorf("failed to enqueue email to %s: %w", m.ToEmail, err)
+		}
+	}
+	return jobID, nil
+}
+
+// markInterrupted moves messages left in "sending" to "unknown" and closes
+// the jobs that were only waiting for them
+func (s *OutboxService) markInterrupted() {
+	rows, err := db.DB.Query("SELECT DISTINCT job_id FROM outbound_emails WHERE status = ? AND job_id IS NOT NULL",
+		OutboundStatusSending)
+	if err != nil {
+		log.Printf("Failed to load interrupted outbound emails: %v", err)
+		return
+	}
+	var jobIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			jobIDs = append(jobIDs, id)
+		}
+	}
+	rows.Close()
+
+	res, err := db.DB.Exec("UPDATE outbound_emails SET status = ?, last_error = ? WHERE status = ?",
+		OutboundStatusUnknown, "interrupted by a restart while sending; it may have been delivered", OutboundStatusSending)
+	if err != nil {
+		log.Printf("Failed to mark interrupted outbound emails: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Marked %d outbound emails interrupted by a restart as unknown; retry them manually", n)
+	}
+	for _, id := range jobIDs {
+		refreshJobStatus(id)
+	}
+}
+
+func (s *OutboxService) processDue() {
+	for {
+		batch, err := s.dueMessages()
+		if err != nil {
+			log.Printf("Failed to load outbound emails: %v", err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+		claimed := 0
+		for _, m := range batch {
+			if s.claim(m.ID) {
+				s.deliver(m)
+				claimed++
+			}
+		}
+		if claimed == 0 {
+			return
+		}
+	}
+}
+
+func (s *OutboxService) dueMessages() ([]models.OutboundEmail, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, project_id, teacher_id, user_id, job_id, dispatch_id, kind, to_email, subject, body, attachment_path, attempts
+		FROM outbound_emails
+		WHERE status = ? AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at ASC, id ASC
+		LIMIT ?`, OutboundStatusQueued, outboxBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.OutboundEmail
+	for rows.Next() {
+		var m models.OutboundEmail
+		var jobID, dispatchID sql.NullInt64
+		var attachment sql.NullString
+		if err := rows.Scan(&m.ID, &m.ProjectID, &m.TeacherID, &m.UserID, &jobID, &dispatchID, &m.Kind,
+			&m.ToEmail, &m.Subject, &m.Body, &attachment, &m.Attempts); err != nil {
+			log.Printf("Failed to scan outbound email: %v", err)
+			continue
+		}
+		m.JobID = int(jobID.Int64)
+		if dispatchID.Valid {
+			id := int(dispatchID.Int64)
+			m.DispatchID = &id
+		}
+		m.AttachmentPath = attachment.String
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// claim marks a queued message as sending; it returns false if another
+// worker got there first.
+func (s *OutboxService) claim(id int) bool {
+	res, err := db.DB.Exec("UPDATE outbound_emails SET status = ? WHERE id = ? AND status = ?",
+		OutboundStatusSending, id, OutboundStatusQueued)
+	if err != nil {
+		log.Printf("Failed to claim outbound email %d: %v", id, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+func (s *OutboxService) deliver(m models.OutboundEmail) {
+	if m.JobID != 0 {
+		markJobStarted(m.JobID)
+		defer refreshJobStatus(m.JobID)
+	}
+
+	user, err := LoadUserEmailConfig(m.UserID)
+	if err == nil && (user.SMTPHost == "" || user.EmailAddress == "") {
+		err = ErrEmailConfigIncomplete
+	}
+	if err != nil {
+		// Retrying cannot fix a missing account or configuration
+		s.markFailed(m, err, true)
+		return
+	}
+
+	replyTo := ""
+	if user.PlusAddressing {
+		var code string
+		if err := db.DB.QueryRow("SELECT code FROM projects WHERE id = ?", m.ProjectID).Scan(&code); err == nil {
+			replyTo = PlusAddress(user.EmailAddress, code)
+		}
+	}
+
+	msgID, err := s.EmailService.SendEmail(user, m.ToEmail, replyTo, m.Subject, m.Body, m.AttachmentPath)
+	if err != nil {
+		s.markFailed(m, err, false)
+		return
+	}
+
+	if err := s.markSent(m, msgID); err != nil {
+		log.Printf("Email %d to %s was sent but recording it failed: %v", m.ID, m.ToEmail, err)
+		s.markSentFallback(m, msgID)
+	}
+}
+
+// markSentFallback records a delivered message step by step after markSent
+// failed. It is never left in "sending", or a restart would send it again.
+// Its sent_emails row, which replies are matched by, is written on its own;
+// if that fails too, repairSentEmails adds it on the next round.
+func (s *OutboxService) markSentFallback(m models.OutboundEmail, msgID string) {
+	if _, err := db.DB.Exec("UPDATE outbound_emails SET status = ?, message_id = ?, sent_at = ? WHERE id = ?",
+		OutboundStatusSent, msgID, time.Now(), m.ID); err != nil {
+		log.Printf("Failed to mark email %d sent: %v", m.ID, err)
+	}
+	// The failed transaction may have committed the row after all
+	if _, err := db.DB.Exec(`
+		INSERT INTO sent_emails (project_id, teacher_id, message_id) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE message_id = message_id`, m.ProjectID, m.TeacherID, msgID); err != nil {
+		log.Printf("Failed to record Message-ID of email %d, retrying on the next round: %v", m.ID, err)
+		s.repairSent.Store(true)
+	}
+}
+
+// repairSentEmails adds the missing sent_emails rows of sent messages, so
+// that replies to them are matched
+func (s *OutboxService) repairSentEmails() {
+	if !s.repairSent.Swap(false) {
+		return
+	}
+	res, err := db.DB.Exec(`
+		INSERT INTO sent_emails (project_id, teacher_id, message_id, sent_at)
+		SELECT o.project_id, o.teacher_id, o.message_id, COALESCE(o.sent_at, NOW())
+		FROM outbound_emails o
+		LEFT JOIN sent_emails se ON se.message_id = o.message_id
+		WHERE o.status = ? AND o.message_id IS NOT NULL AND se.id IS NULL`, OutboundStatusSent)
+	if err != nil {
+		log.Printf("Failed to repair sent emails: %v", err)
+		s.repairSent.Store(true)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Recorded the Message-IDs of %d sent emails", n)
+	}
+}
+
+func (s *OutboxService) markSent(m models.OutboundEmail, msgID string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.Exec(`
+		UPDATE outbound_emails
+		SET status = ?, attempts = attempts + 1, message_id = ?, last_error = NULL, sent_at = ?
+		WHERE id = ?`, OutboundStatusSent, msgID, now, m.ID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO sent_emails (project_id, teacher_id, message_id) VALUES (?, ?, ?)",
+		m.ProjectID, m.TeacherID, msgID); err != nil {
+		return err
+	}
+
+	if m.Kind == OutboundKindDispatch {
+		if _, err := tx.Exec(
+			"INSERT INTO project_members (project_id, teacher_id, sent_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE sent_at=?",
+			m.ProjectID, m.TeacherID, now, now,
+		); err != nil {
+			return err
+		}
+	}
+
+	if m.DispatchID != nil {
+		if _, err := tx.Exec("UPDATE dispatches SET sent_count = COALESCE(sent_count, 0) + 1 WHERE id = ?", *m.DispatchID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *OutboxService) markFailed(m models.OutboundEmail, sendErr error, permanent bool) {
+	attempts := m.Attempts + 1
+	status := OutboundStatusQueued
+	if permanent || attempts >= s.Config.OutboxMaxAttempts {
+		status = OutboundStatusFailed
+	}
+
+	next := time.Now().Add(outboxBackoff(attempts))
+	if _, err := db.DB.Exec(`
+		UPDATE outbound_emails
+		SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?
+		WHERE id = ?`, status, attempts, sendErr.Error(), next, m.ID); err != nil {
+		log.Printf("Failed to record delivery failure of email %d: %v", m.ID, err)
+	}
+
+	if status == OutboundStatusFailed {
+		log.Printf("Giving up on email %d to %s after %d attempts: %v", m.ID, m.ToEmail, attempts, sendErr)
+	} else {
+		log.Printf("Failed to send email %d to %s (attempt %d), retrying at %s: %v",
+			m.ID, m.ToEmail, attempts, next.Format("15:04:05"), sendErr)
+	}
+}
+
+// outboxBackoff doubles the retry delay with every attempt, capped at an hour
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxBaseBackoff
+	for i := 1; i < attempts && delay < outboxMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+	return delay
+}
+
+// ListProjectOutbox returns the outbox entries of a project, newest first
+func (s *OutboxService) ListProjectOutbox(projectID int) ([]models.OutboundEmail, error) {
+	rows, err := db.DB.Query(`
+		SELECT o.id, o.project_id, o.teacher_id, COALESCE(t.name, ''), COALESCE(o.job_id, 0), o.dispatch_id, o.kind, o.to_email, o.subject,
+			o.status, o.attempts, COALESCE(o.last_error, ''), COALESCE(o.message_id, ''), o.next_attempt_at, o.sent_at, o.created_at
+		FROM outbound_emails o
+		LEFT JOIN teachers t ON o.teacher_id = t.id
+		WHERE o.project_id = ?
+		ORDER BY o.created_at DESC, o.id DESC`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []models.OutboundEmail{}
+	for rows.Next() {
+		var m models.OutboundEmail
+		var dispatchID sql.NullInt64
+		var sentAt sql.NullTime
+		if err := rows.Scan(&m.ID, &m.ProjectID, &m.TeacherID, &m.TeacherName, &m.JobID, &dispatchID, &m.Kind, &m.ToEmail, &m.Subject,
+			&m.Status, &m.Attempts, &m.LastError, &m.MessageID, &m.NextAttemptAt, &sentAt, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if dispatchID.Valid {
+			id := int(dispatchID.Int64)
+			m.DispatchID = &id
+		}
+		if sentAt.Valid {
+			m.SentAt = &sentAt.Time
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// RetryFailed puts failed messages of a project back into the queue, along
+// with those whose delivery was interrupted (status "unknown")
+func (s *OutboxService) RetryFailed(projectID int) (int, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT DISTINCT job_id FROM outbound_emails WHERE project_id = ? AND status IN (?, ?) AND job_id IS NOT NULL",
+		projectID, OutboundStatusFailed, OutboundStatusUnknown)
+	if err != nil {
+		return 0, err
+	}
+	var jobIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		jobIDs = append(jobIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`
+		UPDATE outbound_emails SET status = ?, attempts = 0, next_attempt_at = NOW()
+		WHERE project_id = ? AND status IN (?, ?)`, OutboundStatusQueued, projectID, OutboundStatusFailed, OutboundStatusUnknown)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	// Their jobs are running again until the requeued messages are done
+	for _, id := range jobIDs {
+		if _, err := tx.Exec("UPDATE email_jobs SET status = ?, finished_at = NULL WHERE id = ?", JobStatusRunning, id); err != nil {
+			return 0, fmt.Errorf("failed to reopen job %d: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.Notify()
+	}
+	return int(n), nil
+}
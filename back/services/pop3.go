@@ -0,0 +1,330 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"db_intro_backend/models"
+)
+
+// Protocols for reading a user's mailbox
+const (
+	MailProtocolIMAP = "imap"
+	MailProtocolPOP3 = "pop3"
+)
+
+// ResolveMailProtocol returns the stored protocol, treating unknown values as IMAP
+func ResolveMailProtocol(protocol string) string {
+	if protocol == MailProtocolPOP3 {
+		return MailProtocolPOP3
+	}
+	return MailProtocolIMAP
+}
+
+// ValidMailProtocol reports whether protocol can be stored; empty means IMAP
+func ValidMailProtocol(protocol string) bool {
+	switch protocol {
+	case "", MailProtocolIMAP, MailProtocolPOP3:
+		return true
+	default:
+		return false
+	}
+}
+
+// pop3Timeout bounds every exchange with a POP3 server
+const pop3Timeout = 2 * time.Minute
+
+var errPOP3NoTLS = errors.New("POP3 server on port 110 does not offer STLS; refusing to send the password in clear text")
+
+// POP3Reader reads the user's mailbox over POP3, using the same host and
+// credential settings as IMAP. Port 110 is upgraded with STLS, any other port
+// uses implicit TLS. A nil TLSConfig verifies the server against the system
+// roots. Messages above MaxMessageSize bytes (0 disables the limit) are not
+// downloaded; only their header is read with TOP (see RawMessage.Oversize).
+//
+// POP3 has no folders and no persistent numeric UIDs, so messages are handed
+// out with UID 0 (nothing is moved or flagged) and the UIDL of every handled
+// message is remembered in pop3_seen_uids. Messages are left on the server.
+type POP3Reader struct {
+	TLSConfig      *tls.Config
+	MaxMessageSize int64
+}
+
+// Fetch hands the messages whose UIDL has not been seen before to handle, in
+// the server's order. A UIDL is only recorded once handle accepted its
+// message; an error stops the fetch and the message is downloaded again next
+// time. state is returned unchanged.
+func (r *POP3Reader) Fetch(user models.User, state models.MailboxSyncState, handle func(RawMessage) error) (models.MailboxSyncState, error) {
+	c, err := r.dial(user)
+	if err != nil {
+		return state, err
+	}
+	defer c.quit()
+
+	listing, err := c.uidl()
+	if err != nil {
+		return state, err
+	}
+	sizes, err := c.list()
+	if err != nil {
+		return state, err
+	}
+	seen, err := loadSeenUIDLs(user.ID)
+	if err != nil {
+		return state, fmt.Errorf("failed to load seen POP3 messages: %w", err)
+	}
+
+	fetched := 0
+	for _, m := range listing {
+		if seen[m.uidl] {
+			continue
+		}
+		raw := RawMessage{Size: sizes[m.num]}
+		if r.MaxMessageSize > 0 && raw.Size > r.MaxMessageSize {
+			log.Printf("POP3 message %s is %d bytes, over the limit; fetching its header only", m.uidl, raw.Size)
+			raw.Oversize = true
+			var header []byte
+			header, err = c.top(m.num)
+			raw.Body = bytes.NewReader(header)
+			var refused pop3ServerError
+			if errors.As(err, &refused) {
+				// TOP is optional: queue the message without its header
+				log.Printf("POP3 server refused TOP %d: %v", m.num, err)
+				err = nil
+			}
+		} else {
+			var data []byte
+			data, err = c.retr(m.num)
+			raw.Body = bytes.NewReader(data)
+		}
+		if err != nil {
+			return state, fmt.Errorf("failed to fetch message %d: %w", m.num, err)
+		}
+		if err := handle(raw); err != nil {
+			// Not stored: leave it unseen
+			return state, err
+		}
+		if err := markUIDLSeen(user.ID, m.uidl); err != nil {
+			return state, fmt.Errorf("failed to record POP3 message %s: %w", m.uidl, err)
+		}
+		fetched++
+	}
+
+	// Forget messages that were deleted from the server
+	present := make(map[string]bool, len(listing))
+	for _, m := range listing {
+		present[m.uidl] = true
+	}
+	var gone []string
+	for uidl := range seen {
+		if !present[uidl] {
+			gone = append(gone, uidl)
+		}
+	}
+	if err := forgetUIDLs(user.ID, gone); err != nil {
+		log.Printf("Failed to prune seen POP3 messages of user %d: %v", user.ID, err)
+	}
+
+	log.Printf("Fetched %d new emails over POP3 (%d on server)", fetched, len(listing))
+	return state, nil
+}
+
+// pop3Client speaks the subset of RFC 1939 needed to download mail
+type pop3Client struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+type pop3Message struct {
+	num  int
+	uidl string
+}
+
+// dial connects and logs in to the user's POP3 server
+func (r *POP3Reader) dial(user models.User) (*pop3Client, error) {
+	addr := net.JoinHostPort(user.IMAPHost, user.IMAPPort)
+	log.Printf("Connecting to POP3 server %s", addr)
+
+	tlsConfig := r.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = user.IMAPHost
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if user.IMAPPort == "110" {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to POP3 server: %w", err)
+	}
+
+	c := newPOP3Client(conn)
+	if _, err := c.response(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("POP3 server greeting: %w", err)
+	}
+
+	if user.IMAPPort == "110" {
+		if err := c.startTLS(tlsConfig); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := c.cmd("USER %s", user.IMAPUsername); err != nil {
+		c.quit()
+		return nil, fmt.Errorf("failed to login: %w", err)
+	}
+	if _, err := c.cmd("PASS %s", user.IMAPPassword); err != nil {
+		c.quit()
+		return nil, fmt.Errorf("failed to login: %w", err)
+	}
+	log.Println("Logged in to POP3 server")
+	return c, nil
+}
+
+func newPOP3Client(conn net.Conn) *pop3Client {
+	return &pop3Client{conn: conn, text: textproto.NewConn(conn)}
+}
+
+func (c *pop3Client) startTLS(config *tls.Config) error {
+	capabilities, err := c.multiline("CAPA")
+	if err != nil {
+		return errPOP3NoTLS
+	}
+	supported := false
+	for _, line := range strings.Split(string(capabilities), "\n") {
+		if strings.EqualFold(strings.TrimSpace(line), "STLS") {
+			supported = true
+		}
+	}
+	if !supported {
+		return errPOP3NoTLS
+	}
+	if _, err := c.cmd("STLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, config)
+	c.conn.SetDeadline(time.Now().Add(pop3Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("POP3 STLS handshake: %w", err)
+	}
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+	return nil
+}
+
+// pop3ServerError is a -ERR reply; the connection remains usable
+type pop3ServerError string
+
+func (e pop3ServerError) Error() string {
+	return "POP3 server: " + string(e)
+}
+
+// response reads a status line and returns its text after "+OK"
+func (c *pop3Client) response() (string, error) {
+	c.conn.SetDeadline(time.Now().Add(pop3Timeout))
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if status, rest, _ := strings.Cut(line, " "); status == "+OK" {
+		return rest, nil
+	} else if status == "-ERR" {
+		return "", pop3ServerError(rest)
+	}
+	return "", fmt.Errorf("unexpected POP3 response %q", line)
+}
+
+func (c *pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(pop3Timeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+// multiline runs a command whose reply is a dot-terminated block
+func (c *pop3Client) multiline(format string, args ...interface{}) ([]byte, error) {
+	if _, err := c.cmd(format, args...); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(c.text.DotReader())
+}
+
+// uidl lists the messages with their unique ids
+func (c *pop3Client) uidl() ([]pop3Message, error) {
+	data, err := c.multiline("UIDL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	var messages []pop3Message
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		num, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		messages = append(messages, pop3Message{num: num, uidl: fields[1]})
+	}
+	return messages, nil
+}
+
+// list returns the size in octets of each message by number
+func (c *pop3Client) list() (map[int]int64, error) {
+	data, err := c.multiline("LIST")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list message sizes: %w", err)
+	}
+	sizes := make(map[int]int64)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		num, err1 := strconv.Atoi(fields[0])
+		size, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		sizes[num] = size
+	}
+	return sizes, nil
+}
+
+func (c *pop3Client) retr(num int) ([]byte, error) {
+	return c.multiline("RETR %d", num)
+}
+
+// top returns the header of a message
+func (c *pop3Client) top(num int) ([]byte, error) {
+	return c.multiline("TOP %d 0", num)
+}
+
+func (c *pop3Client) quit() {
+	c.cmd("QUIT")
+	c.conn.Close()
+}
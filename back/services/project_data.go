@@ -0,0 +1,368 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+
+	"golang.org/x/text/width"
+)
+
+// Groupings of the data API
+const (
+	DataGroupDepartment = "department"
+	DataGroupTeacher    = "teacher"
+)
+
+// Page sizes of the data API
+const (
+	defaultDataPageSize = 50
+	maxDataPageSize     = 1000
+)
+
+var ErrInvalidDataQuery = errors.New("invalid data query")
+
+// DataQuery selects and orders the aggregated rows of a project. Columns are
+// template headers, matched like submission headers, or one of the
+// provenance keys (teacher_name, teacher_email, department, reply_time,
+// source_file).
+type DataQuery struct {
+	Page     int
+	PageSize int
+	Columns  []string          // data columns to return; all when empty
+	Filters  map[string]string // column -> text its cells must contain
+	Search   string            // text any data or provenance cell must contain
+	SortBy   string
+	Desc     bool
+	GroupBy  string // department | teacher
+}
+
+// dataColumn is a column of the data API: a schema column, or a provenance
+// value of the row's attachment when provenance is set
+type dataColumn struct {
+	index      int
+	provenance string
+}
+
+func (c dataColumn) value(row aggregatedRow) string {
+	return c.cell(row).text
+}
+
+func (c dataColumn) cell(row aggregatedRow) sheetCell {
+	if c.provenance != "" {
+		return provenanceValues([]string{c.provenance}, row.source)[0]
+	}
+	if c.index < len(row.cells) {
+		return row.cells[c.index]
+	}
+	return sheetCell{}
+}
+
+// column resolves a column name: a provenance key, a data header matched
+// like submission headers, or the sheet header of a provenance column
+func (m *mergedRows) column(name string) (dataColumn, bool) {
+	if _, ok := provenanceHeaders[name]; ok {
+		return dataColumn{provenance: name}, true
+	}
+	key := normalizeHeader(name)
+	for i, h := range m.headers {
+		if normalizeHeader(h) == key {
+			return dataColumn{index: i}, true
+		}
+	}
+	for provenance, header := range provenanceHeaders {
+		if key == normalizeHeader(header) {
+			return dataColumn{provenance: provenance}, true
+		}
+	}
+	return dataColumn{}, false
+}
+
+// QueryProjectData returns a page of a project's aggregated rows. Rows are
+// merged exactly as for the aggregated workbook and then filtered, searched,
+// sorted and grouped; with a grouping the groups are listed with their row
+// counts and rows are ordered by group first. Nothing is parsed here:
+// attachments without parsed rows are listed as pending.
+func (s *ExcelService) QueryProjectData(projectID int, query DataQuery) (*models.DataPage, error) {
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize < 1 {
+		query.PageSize = defaultDataPageSize
+	}
+	if query.PageSize > maxDataPageSize {
+		query.PageSize = maxDataPageSize
+	}
+	switch query.GroupBy {
+	case "", DataGroupDepartment, DataGroupTeacher:
+	default:
+		return nil, fmt.Errorf("%w: group_by must be %q or %q", ErrInvalidDataQuery, DataGroupDepartment, DataGroupTeacher)
+	}
+
+	page := &models.DataPage{Page: query.Page, PageSize: query.PageSize, Headers: []string{}, Rows: []models.DataRow{}}
+	merged, err := s.projectRows(projectID)
+	if errors.Is(err, ErrNoExcelAttachments) {
+		return page, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, att := range merged.pending {
+		page.Pending = append(page.Pending, models.PendingAttachment{
+			AttachmentID: att.ID, Filename: att.OriginalName, TeacherName: att.TeacherName,
+		})
+	}
+
+	resolve := func(name string) (dataColumn, error) {
+		if col, ok := merged.column(name); ok {
+			return col, nil
+		}
+		return dataColumn{}, fmt.Errorf("%w: unknown column %q", ErrInvalidDataQuery, name)
+	}
+
+	returned := make([]int, 0, len(merged.headers))
+	if len(query.Columns) == 0 {
+		for i := range merged.headers {
+			returned = append(returned, i)
+		}
+	}
+	for _, name := range query.Columns {
+		col, err := resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		if col.provenance != "" {
+			return nil, fmt.Errorf("%w: %q is returned with every row and cannot be selected", ErrInvalidDataQuery, name)
+		}
+		returned = append(returned, col.index)
+	}
+
+	type filter struct {
+		column dataColumn
+		text   string
+	}
+	var filters []filter
+	for name, text := range query.Filters {
+		col, err := resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		if text = foldText(text); text != "" {
+			filters = append(filters, filter{column: col, text: text})
+		}
+	}
+	search := foldText(query.Search)
+
+	var rows []aggregatedRow
+	for _, row := range merged.rows {
+		keep := true
+		for _, f := range filters {
+			if !strings.Contains(foldText(f.column.value(row)), f.text) {
+				keep = false
+				break
+			}
+		}
+		if keep && search != "" {
+			keep = rowContains(row, search)
+		}
+		if keep {
+			rows = append(rows, row)
+		}
+	}
+
+	var sortColumn *dataColumn
+	if query.SortBy != "" {
+		col, err := resolve(query.SortBy)
+		if err != nil {
+			return nil, err
+		}
+		sortColumn = &col
+	}
+	groupKey := func(row aggregatedRow) string {
+		switch query.GroupBy {
+		case DataGroupDepartment:
+			return row.source.Department
+		case DataGroupTeacher:
+			return row.source.TeacherName
+		}
+		return ""
+	}
+	compareText := textComparer()
+	sort.SliceStable(rows, func(i, j int) bool {
+		if d := compareText(groupKey(rows[i]), groupKey(rows[j])); d != 0 {
+			return d < 0
+		}
+		if sortColumn == nil {
+			return false
+		}
+		a, b := sortColumn.value(rows[i]), sortColumn.value(rows[j])
+		// Empty cells stay last in either direction
+		if (a == "") != (b == "") {
+			return b == ""
+		}
+		d := compareCells(compareText, a, b)
+		if query.Desc {
+			return d > 0
+		}
+		return d < 0
+	})
+
+	if query.GroupBy != "" {
+		page.Groups = []models.DataGroup{}
+		for _, row := range rows {
+			key := groupKey(row)
+			if n := len(page.Groups); n > 0 && page.Groups[n-1].Key == key {
+				page.Groups[n-1].Count++
+				continue
+			}
+			page.Groups = append(page.Groups, models.DataGroup{Key: key, Count: 1})
+		}
+	}
+
+	for _, i := range returned {
+		page.Headers = append(page.Headers, merged.headers[i])
+	}
+	page.Total = len(rows)
+	start := (query.Page - 1) * query.PageSize
+	if start > len(rows) {
+		start = len(rows)
+	}
+	end := start + query.PageSize
+	if end > len(rows) {
+		end = len(rows)
+	}
+	for _, row := range rows[start:end] {
+		values := make(map[string]string, len(returned))
+		for _, i := range returned {
+			if i < len(row.cells) && row.cells[i].text != "" {
+				values[merged.headers[i]] = row.cells[i].text
+			}
+		}
+		page.Rows = append(page.Rows, models.DataRow{
+			AttachmentID: row.source.ID,
+			TeacherName:  row.source.TeacherName,
+			TeacherEmail: row.source.TeacherEmail,
+			Department:   row.source.Department,
+			ReplyTime:    row.source.ReplyTime,
+			SourceFile:   row.source.OriginalName,
+			Values:       values,
+		})
+	}
+	return page, nil
+}
+
+// dataCacheTTL bounds how long merged rows are reused for the data API.
+// New attachments, parses, settings and submission choices are noticed at
+// once through rowsSignature; renamed teachers and departments only after
+// this.
+const dataCacheTTL = time.Minute
+
+// cachedRows are the merged rows of a project as of signature
+type cachedRows struct {
+	signature string
+	merged    *mergedRows
+	expires   time.Time
+}
+
+// projectRows returns the merged rows of a project, reusing the last merge
+// while the project's signature is unchanged, so that paging through the
+// data does not merge every attachment again for each page. The cached rows
+// are shared and must not be modified.
+func (s *ExcelService) projectRows(projectID int) (*mergedRows, error) {
+	signature, err := rowsSignature(projectID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if v, ok := s.dataCache.Load(projectID); ok {
+		if c := v.(*cachedRows); c.signature == signature && now.Before(c.expires) {
+			return c.merged, nil
+		}
+	}
+
+	merged, err := s.mergeProjectRows(projectID)
+	if err != nil {
+		s.dataCache.Delete(projectID)
+		return nil, err
+	}
+	// Drop expired entries of other projects
+	s.dataCache.Range(func(key, v interface{}) bool {
+		if !now.Before(v.(*cachedRows).expires) {
+			s.dataCache.Delete(key)
+		}
+		return true
+	})
+	s.dataCache.Store(projectID, &cachedRows{signature: signature, merged: merged, expires: now.Add(dataCacheTTL)})
+	return merged, nil
+}
+
+// rowsSignature summarizes what the merged rows of a project depend on: its
+// aggregation settings, its attachments and their parse state, and its
+// submissions with the IDs of the pinned ones
+func rowsSignature(projectID int) (string, error) {
+	var settings sql.NullString
+	if err := db.DB.QueryRow("SELECT aggregation_settings FROM projects WHERE id = ?", projectID).Scan(&settings); err != nil {
+		return "", err
+	}
+	var attachments, lastAttachment, parsed int
+	var lastParsed sql.NullTime
+	if err := db.DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(SUM(CASE WHEN parsed THEN 1 ELSE 0 END), 0), MAX(parsed_at)
+		FROM attachments WHERE project_id = ? AND status = ?`, projectID, AttachmentStatusStored).
+		Scan(&attachments, &lastAttachment, &parsed, &lastParsed); err != nil {
+		return "", err
+	}
+	var submissions int
+	var pinned sql.NullString
+	if err := db.DB.QueryRow(`
+		SELECT COUNT(*), GROUP_CONCAT(CASE WHEN pinned THEN id END ORDER BY id)
+		FROM submissions WHERE project_id = ?`, projectID).Scan(&submissions, &pinned); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s|%d/%d/%d/%s|%d/%s", settings.String, attachments, lastAttachment, parsed,
+		lastParsed.Time.Format(time.RFC3339Nano), submissions, pinned.String), nil
+}
+
+// foldText prepares text for case- and width-insensitive matching
+func foldText(text string) string {
+	return strings.ToLower(strings.TrimSpace(width.Fold.String(text)))
+}
+
+// rowContains reports whether any data or provenance cell of row contains
+// the folded text
+func rowContains(row aggregatedRow, text string) bool {
+	for _, cell := range row.cells {
+		if strings.Contains(foldText(cell.text), text) {
+			return true
+		}
+	}
+	for _, value := range []string{row.source.TeacherName, row.source.TeacherEmail, row.source.Department, row.source.OriginalName} {
+		if strings.Contains(foldText(value), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareCells orders two non-empty cells numerically when both are numbers
+// and as text otherwise
+func compareCells(compareText func(a, b string) int, a, b string) int {
+	if x, ok := parseCellNumber(a); ok {
+		if y, ok := parseCellNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return compareText(a, b)
+}
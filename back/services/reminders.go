@@ -0,0 +1,174 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+// Scheduled reminder states
+const (
+	ScheduledReminderPending   = "pending"
+	ScheduledReminderQueued    = "queued"
+	ScheduledReminderCancelled = "cancelled"
+)
+
+// MemberStatusPending marks a teacher who has not answered the request yet
+const MemberStatusPending = "pending"
+
+// RemindableStatuses are the member states that get reminders: no answer
+// yet, only an automatic one, or a submission that failed validation
+var RemindableStatuses = []string{MemberStatusPending, MemberStatusAutoReplied, MemberStatusNeedsRevision}
+
+// followUpHour is the local hour at which a follow-up reminder goes out on
+// the day after the teacher's stated return
+const followUpHour = 9
+
+// ReplaceTemplateVars fills the teacher and project name into a subject or
+// body template
+func ReplaceTemplateVars(text, teacherName, projectName string) string {
+	text = strings.ReplaceAll(text, "{{teacher_name}}", teacherName)
+	text = strings.ReplaceAll(text, "{{project_name}}", projectName)
+	text = strings.ReplaceAll(text, "{{Teacher_Name}}", teacherName)
+	text = strings.ReplaceAll(text, "{{Project_Name}}", projectName)
+	return text
+}
+
+// BuildReminder composes the reminder email for one teacher of a project
+func BuildReminder(p models.Project, teacherID int, name, email string) models.OutboundEmail {
+	return models.OutboundEmail{
+		ProjectID: p.ID,
+		TeacherID: teacherID,
+		UserID:    p.CreatedBy,
+		ToEmail:   email,
+		Subject:   "催促提醒: " + ReplaceTemplateVars(p.EmailSubjectTemplate, name, p.Name),
+		Body: fmt.Sprintf("尊敬的%s老师：\n\n这是一封催促提醒邮件。\n\n%s\n\n请尽快完成并回复，谢谢！\n\n原邮件内容：\n%s",
+			name, p.Name, ReplaceTemplateVars(p.EmailBodyTemplate, name, p.Name)),
+	}
+}
+
+// scheduleFollowUpReminder plans a reminder for the morning after a teacher's
+// out-of-office return date. An existing pending plan is moved instead of
+// duplicated.
+func scheduleFollowUpReminder(projectID int, teacherID int64, replyID int64, returnDate time.Time) {
+	day := returnDate.AddDate(0, 0, 1)
+	dueAt := time.Date(day.Year(), day.Month(), day.Day(), followUpHour, 0, 0, 0, returnDate.Location())
+
+	res, err := db.DB.Exec("UPDATE scheduled_reminders SET due_at = ?, source_reply_id = ? WHERE project_id = ? AND teacher_id = ? AND status = ?",
+		dueAt, replyID, projectID, teacherID, ScheduledReminderPending)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Moved follow-up reminder for teacher %d in project %d to %s", teacherID, projectID, dueAt.Format("2006-01-02 15:04"))
+			return
+		}
+		_, err = db.DB.Exec("INSERT INTO scheduled_reminders (project_id, teacher_id, source_reply_id, due_at, status) VALUES (?, ?, ?, ?, ?)",
+			projectID, teacherID, replyID, dueAt, ScheduledReminderPending)
+	}
+	if err != nil {
+		log.Printf("Failed to schedule follow-up reminder for teacher %d in project %d: %v", teacherID, projectID, err)
+		return
+	}
+	log.Printf("Scheduled follow-up reminder for teacher %d in project %d at %s", teacherID, projectID, dueAt.Format("2006-01-02 15:04"))
+}
+
+// cancelScheduledReminders drops planned follow-ups once the teacher replied
+func cancelScheduledReminders(projectID int, teacherID int64) {
+	if _, err := db.DB.Exec("UPDATE scheduled_reminders SET status = ? WHERE project_id = ? AND teacher_id = ? AND status = ?",
+		ScheduledReminderCancelled, projectID, teacherID, ScheduledReminderPending); err != nil {
+		log.Printf("Failed to cancel follow-up reminders for teacher %d in project %d: %v", teacherID, projectID, err)
+	}
+}
+
+// processScheduledReminders queues the follow-up reminders that are due. A
+// teacher who has replied in the meantime is skipped.
+func (s *OutboxService) processScheduledReminders() {
+	rows, err := db.DB.Query(`
+		SELECT sr.id, sr.teacher_id, COALESCE(pm.current_status, ''), t.name, t.email,
+			p.id, p.name, p.email_subject_template, p.email_body_template, p.created_by
+		FROM scheduled_reminders sr
+		JOIN projects p ON sr.project_id = p.id
+		JOIN teachers t ON sr.teacher_id = t.id
+		LEFT JOIN project_members pm ON pm.project_id = sr.project_id AND pm.teacher_id = sr.teacher_id
+		WHERE sr.status = ? AND sr.due_at <= NOW()
+		ORDER BY sr.due_at ASC
+		LIMIT ?`, ScheduledReminderPending, outboxBatchSize)
+	if err != nil {
+		log.Printf("Failed to load scheduled reminders: %v", err)
+		return
+	}
+
+	type dueReminder struct {
+		id, teacherID int
+		status        string
+		name, email   string
+		project       models.Project
+	}
+	var due []dueReminder
+	for rows.Next() {
+		var r dueReminder
+		var subject, body sql.NullString
+		if err := rows.Scan(&r.id, &r.teacherID, &r.status, &r.name, &r.email,
+			&r.project.ID, &r.project.Name, &subject, &body, &r.project.CreatedBy); err != nil {
+			log.Printf("Failed to scan scheduled reminder: %v", err)
+			continue
+		}
+		r.project.EmailSubjectTemplate = subject.String
+		r.project.EmailBodyTemplate = body.String
+		due = append(due, r)
+	}
+	rows.Close()
+
+	for _, r := range due {
+		if !slices.Contains(RemindableStatuses, r.status) {
+			if _, err := db.DB.Exec("UPDATE scheduled_reminders SET status = ? WHERE id = ?", ScheduledReminderCancelled, r.id); err != nil {
+				log.Printf("Failed to cancel follow-up reminder %d: %v", r.id, err)
+			}
+			continue
+		}
+
+		jobID, err := queueScheduledReminder(r.id, BuildReminder(r.project, r.teacherID, r.name, r.email))
+		if err != nil {
+			log.Printf("Failed to queue follow-up reminder %d: %v", r.id, err)
+			continue
+		}
+		if jobID == 0 {
+			continue
+		}
+		s.Notify()
+		log.Printf("Queued follow-up reminder for teacher %d in project %d as job %d", r.teacherID, r.project.ID, jobID)
+	}
+}
+
+// queueScheduledReminder enqueues the reminder and marks the plan queued in
+// one transaction, so a plan is never sent twice. It returns 0 when the plan
+// was no longer pending.
+func queueScheduledReminder(reminderID int, msg models.OutboundEmail) (int, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	jobID, err := enqueueOutboundTx(tx, msg.ProjectID, msg.UserID, OutboundKindReminder, []models.OutboundEmail{msg})
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("UPDATE scheduled_reminders SET status = ?, job_id = ? WHERE id = ? AND status = ?",
+		ScheduledReminderQueued, jobID, reminderID, ScheduledReminderPending)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return jobID, nil
+}
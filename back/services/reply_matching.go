@@ -0,0 +1,207 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+// Ways a reply can be attributed to a project, strongest first
+const (
+	MatchInReplyTo   = "in_reply_to"
+	MatchReferences  = "references"
+	MatchPlusAddress = "plus_address"
+	MatchSubjectCode = "subject_code"
+	MatchSender      = "sender"
+)
+
+// replyMatch is the project (and teacher, if known) an incoming email belongs to
+type replyMatch struct {
+	ProjectID int
+	TeacherID sql.NullInt64
+	Method    string
+	// Candidates lists the active projects of the sender when the sender
+	// lookup was ambiguous
+	Candidates []int
+}
+
+// identifyProject attributes an email to one of the user's projects. It tries
+// the In-Reply-To header, then every message of the References chain, then a
+// plus-addressed recipient (secretary+CODE@host), then a project code in the
+// subject, and finally the sender when they belong to a single active project.
+func (s *EmailService) identifyProject(user models.User, email models.EmailMessage) replyMatch {
+	var match replyMatch
+
+	if email.InReplyTo != "" {
+		if m, ok := lookupSentEmail(user.ID, email.InReplyTo); ok {
+			m.Method = MatchInReplyTo
+			log.Printf("Identified project %d from In-Reply-To %s", m.ProjectID, email.InReplyTo)
+			return m
+		}
+	}
+
+	// Newest reference first: it is the message actually being answered
+	for i := len(email.References) - 1; i >= 0; i-- {
+		if m, ok := lookupSentEmail(user.ID, email.References[i]); ok {
+			m.Method = MatchReferences
+			log.Printf("Identified project %d from References %s", m.ProjectID, email.References[i])
+			return m
+		}
+	}
+
+	teacherID := lookupTeacherByEmail(email.From)
+
+	if code := plusAddressToken(user.EmailAddress, email.Recipients); code != "" {
+		if pid, ok := lookupProjectByCode(user.ID, code); ok {
+			log.Printf("Identified project %d from plus address token %s", pid, code)
+			return replyMatch{ProjectID: pid, TeacherID: teacherID, Method: MatchPlusAddress}
+		}
+	}
+
+	if pid, ok := projectFromSubject(user.ID, email.Subject); ok {
+		log.Printf("Identified project %d from subject %q", pid, email.Subject)
+		return replyMatch{ProjectID: pid, TeacherID: teacherID, Method: MatchSubjectCode}
+	}
+
+	if !teacherID.Valid {
+		return match
+	}
+	match.TeacherID = teacherID
+
+	rows, err := db.DB.Query(`
+		SELECT p.id FROM projects p
+		JOIN project_members pm ON p.id = pm.project_id
+		WHERE pm.teacher_id = ? AND p.status = 'active' AND p.created_by = ?
+	`, teacherID.Int64, user.ID)
+	if err != nil {
+		log.Printf("Failed to look up projects of teacher %d: %v", teacherID.Int64, err)
+		return match
+	}
+	var pids []int
+	for rows.Next() {
+		var pid int
+		if err := rows.Scan(&pid); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	rows.Close()
+
+	if len(pids) == 1 {
+		match.ProjectID = pids[0]
+		match.Method = MatchSender
+		log.Printf("Identified project %d from sender %s (single active project)", match.ProjectID, email.From)
+	} else if len(pids) > 1 {
+		match.Candidates = pids
+		log.Printf("Ambiguous project for sender %s (multiple active projects: %v)", email.From, pids)
+	}
+	return match
+}
+
+// lookupSentEmail finds the project and teacher of a message we sent,
+// restricted to projects owned by the user
+func lookupSentEmail(userID int, messageID string) (replyMatch, bool) {
+	var m replyMatch
+	var tid int
+	err := db.DB.QueryRow(`
+		SELECT se.project_id, se.teacher_id
+		FROM sent_emails se
+		JOIN projects p ON se.project_id = p.id
+		WHERE se.message_id = ? AND p.created_by = ?`,
+		messageID, userID).Scan(&m.ProjectID, &tid)
+	if err != nil {
+		return m, false
+	}
+	m.TeacherID = sql.NullInt64{Int64: int64(tid), Valid: true}
+	return m, true
+}
+
+func lookupTeacherByEmail(address string) sql.NullInt64 {
+	var tid int64
+	if err := db.DB.QueryRow("SELECT id FROM teachers WHERE email = ?", address).Scan(&tid); err != nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: tid, Valid: true}
+}
+
+func lookupProjectByCode(userID int, code string) (int, bool) {
+	var pid int
+	err := db.DB.QueryRow("SELECT id FROM projects WHERE LOWER(code) = LOWER(?) AND created_by = ?", code, userID).Scan(&pid)
+	return pid, err == nil
+}
+
+// projectFromSubject matches the codes of the user's active projects as
+// whole tokens of the subject. It only succeeds when exactly one project matches.
+func projectFromSubject(userID int, subject string) (int, bool) {
+	if strings.TrimSpace(subject) == "" {
+		return 0, false
+	}
+	rows, err := db.DB.Query("SELECT id, code FROM projects WHERE status = 'active' AND created_by = ?", userID)
+	if err != nil {
+		log.Printf("Failed to load project codes: %v", err)
+		return 0, false
+	}
+	defer rows.Close()
+
+	tokens := make(map[string]bool)
+	for _, t := range strings.FieldsFunc(strings.ToLower(subject), isNotCodeChar) {
+		tokens[t] = true
+	}
+
+	found := 0
+	for rows.Next() {
+		var pid int
+		var code string
+		if err := rows.Scan(&pid, &code); err != nil {
+			continue
+		}
+		if code != "" && tokens[strings.ToLower(code)] {
+			if found != 0 && found != pid {
+				return 0, false
+			}
+			found = pid
+		}
+	}
+	return found, found != 0
+}
+
+func isNotCodeChar(r rune) bool {
+	return !(r == '_' || r == '-' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'))
+}
+
+// PlusAddress returns address with a "+token" suffix on its local part, the
+// Reply-To used to tie replies to a project. A token with characters outside
+// [A-Za-z0-9_-] leaves address unchanged: it could not be read back as the
+// project code.
+func PlusAddress(address, token string) string {
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || token == "" || strings.IndexFunc(token, isNotCodeChar) >= 0 {
+		return address
+	}
+	return address[:at] + "+" + token + address[at:]
+}
+
+// plusAddressToken returns the token of the first recipient that is a plus
+// address of the user's own mailbox
+func plusAddressToken(own string, recipients []string) string {
+	at := strings.LastIndex(own, "@")
+	if at <= 0 {
+		return ""
+	}
+	prefix := strings.ToLower(own[:at]) + "+"
+	domain := strings.ToLower(own[at:])
+
+	for _, rcpt := range recipients {
+		rcpt = strings.ToLower(rcpt)
+		if !strings.HasSuffix(rcpt, domain) {
+			continue
+		}
+		local := strings.TrimSuffix(rcpt, domain)
+		if strings.HasPrefix(local, prefix) && len(local) > len(prefix) {
+			return local[len(prefix):]
+		}
+	}
+	return ""
+}
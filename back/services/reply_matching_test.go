@@ -0,0 +1,59 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlusAddressToken(t *testing.T) {
+	const own = "Office@School.test"
+	tests := []struct {
+		recipients []string
+		want       string
+	}{
+		{nil, ""},
+		{[]string{"office@school.test"}, ""},
+		{[]string{"office+@school.test"}, ""},
+		{[]string{"office+WL2025@school.test"}, "wl2025"},
+		{[]string{"OFFICE+wl2025@SCHOOL.TEST"}, "wl2025"},
+		{[]string{"office+wl2025@other.test"}, ""},
+		{[]string{"backoffice+wl2025@school.test"}, ""},
+		{[]string{"zhang@school.test", "office+ky-2025@school.test"}, "ky-2025"},
+	}
+	for _, tt := range tests {
+		if got := plusAddressToken(own, tt.recipients); got != tt.want {
+			t.Errorf("plusAddressToken(%q, %q) = %q, want %q", own, tt.recipients, got, tt.want)
+		}
+	}
+	if got := plusAddressToken("not-an-address", []string{"not-an-address+x"}); got != "" {
+		t.Errorf("plusAddressToken without a domain = %q, want none", got)
+	}
+}
+
+func TestPlusAddress(t *testing.T) {
+	tests := []struct {
+		address, token, want string
+	}{
+		{"office@school.test", "WL2025", "office+WL2025@school.test"},
+		{"office@school.test", "ky_2025-b", "office+ky_2025-b@school.test"},
+		// Codes that would lose characters get no plus address
+		{"office@school.test", "工作量 2025", "office@school.test"},
+		{"office@school.test", "WL 2025", "office@school.test"},
+		{"office@school.test", "WL.2025", "office@school.test"},
+		{"office@school.test", "工作量", "office@school.test"},
+		{"office@school.test", "", "office@school.test"},
+		{"office", "WL2025", "office"},
+	}
+	for _, tt := range tests {
+		got := PlusAddress(tt.address, tt.token)
+		if got != tt.want {
+			t.Errorf("PlusAddress(%q, %q) = %q, want %q", tt.address, tt.token, got, tt.want)
+		}
+		// A plus address reads back as the whole code
+		if got != tt.address {
+			if token := plusAddressToken(tt.address, []string{got}); token != strings.ToLower(tt.token) {
+				t.Errorf("plusAddressToken(%q) = %q, want %q", got, token, strings.ToLower(tt.token))
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+
+	"db_intro_backend/models"
+)
+
+// SMTP connection security modes, stored in users.smtp_security
+const (
+	SMTPSecurityTLS      = "tls"      // implicit TLS, usually port 465
+	SMTPSecurityStartTLS = "starttls" // plain connection upgraded with STARTTLS, usually port 587
+	SMTPSecurityNone     = "none"     // no encryption, e.g. a campus relay on port 25
+)
+
+const smtpDialTimeout = 30 * time.Second
+
+var (
+	ErrStartTLSUnsupported = errors.New("SMTP server does not support STARTTLS")
+	ErrUnencryptedAuth     = errors.New("refusing to send SMTP credentials over an unencrypted connection; set security mode none to allow it")
+)
+
+// ResolveSMTPSecurity returns the configured mode, or guesses one from the
+// port when none is stored.
+func ResolveSMTPSecurity(mode, port string) string {
+	switch mode {
+	case SMTPSecurityTLS, SMTPSecurityStartTLS, SMTPSecurityNone:
+		return mode
+	}
+	switch port {
+	case "587":
+		return SMTPSecurityStartTLS
+	case "25":
+		return SMTPSecurityNone
+	default:
+		return SMTPSecurityTLS
+	}
+}
+
+// ValidSMTPSecurity reports whether mode can be stored as a security mode;
+// empty means "derive from the port".
+func ValidSMTPSecurity(mode string) bool {
+	switch mode {
+	case "", SMTPSecurityTLS, SMTPSecurityStartTLS, SMTPSecurityNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// SMTPMailer sends mail through the user's own SMTP server. A nil TLSConfig
+// verifies the server against the system roots.
+type SMTPMailer struct {
+	TLSConfig *tls.Config
+}
+
+func (m *SMTPMailer) Send(user models.User, from string, to []string, msg []byte) error {
+	c, err := m.dial(user)
+	if err != nil {
+		return err
+	}
+	defer c.Quit()
+
+	if user.SMTPUsername != "" {
+		// Credentials only go out in the clear when the user chose mode
+		// "none"; a mode guessed from port 25 does not count
+		_, encrypted := c.TLSConnectionState()
+		if !encrypted && user.SMTPSecurity != SMTPSecurityNone {
+			return ErrUnencryptedAuth
+		}
+		var auth smtp.Auth
+		if encrypted {
+			auth = smtp.PlainAuth("", user.SMTPUsername, user.SMTPPassword, user.SMTPHost)
+		} else {
+			auth = &plaintextAuth{username: user.SMTPUsername, password: user.SMTPPassword}
+		}
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("auth error: %w", err)
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("MAIL FROM rejected: %w", err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("RCPT TO %s rejected: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// dial connects to the user's SMTP server using the configured security
+// mode. Without a stored mode a plain connection is upgraded with STARTTLS
+// whenever the server offers it.
+func (m *SMTPMailer) dial(user models.User) (*smtp.Client, error) {
+	addr := net.JoinHostPort(user.SMTPHost, user.SMTPPort)
+	tlsConfig := &tls.Config{}
+	if m.TLSConfig != nil {
+		tlsConfig = m.TLSConfig.Clone()
+	}
+	tlsConfig.InsecureSkipVerify = user.SMTPInsecure
+	tlsConfig.ServerName = user.SMTPHost
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	mode := ResolveSMTPSecurity(user.SMTPSecurity, user.SMTPPort)
+	if mode == SMTPSecurityTLS {
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("TLS dial error: %w", err)
+		}
+		c, err := smtp.NewClient(conn, user.SMTPHost)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial error: %w", err)
+	}
+	c, err := smtp.NewClient(conn, user.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	offered, _ := c.Extension("STARTTLS")
+	if mode == SMTPSecurityStartTLS && !offered {
+		c.Close()
+		return nil, ErrStartTLSUnsupported
+	}
+	if mode == SMTPSecurityStartTLS || (offered && user.SMTPSecurity != SMTPSecurityNone) {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("STARTTLS error: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// plaintextAuth is PLAIN authentication without net/smtp's refusal to send
+// credentials over an unencrypted connection. It is only used when the user
+// explicitly configured security mode "none".
+type plaintextAuth struct {
+	username, password string
+}
+
+func (a *plaintextAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a *plaintextAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
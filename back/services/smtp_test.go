@@ -0,0 +1,74 @@
+package services_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"db_intro_backend/mailtest"
+	"db_intro_backend/models"
+	"db_intro_backend/services"
+)
+
+func TestSMTPMailerSecurity(t *testing.T) {
+	srv, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	const from, to = "office@mail.test", "zhang@mail.test"
+	for _, address := range []string{from, to} {
+		if err := srv.AddAccount(address, "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		addr     string
+		security string
+		wantErr  bool
+		is       error // the expected error, if any particular one
+	}{
+		{"implicit TLS", srv.SMTPTLSAddr, services.SMTPSecurityTLS, false, nil},
+		{"STARTTLS", srv.SMTPStartTLSAddr, services.SMTPSecurityStartTLS, false, nil},
+		{"STARTTLS not offered", srv.SMTPAddr, services.SMTPSecurityStartTLS, true, services.ErrStartTLSUnsupported},
+		{"none", srv.SMTPAddr, services.SMTPSecurityNone, false, nil},
+		// Mode none does not upgrade, so a server requiring TLS refuses AUTH
+		{"none against a TLS-only server", srv.SMTPStartTLSAddr, services.SMTPSecurityNone, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := srv.User(from, "secret")
+			user.SMTPHost, user.SMTPPort, _ = net.SplitHostPort(tt.addr)
+			user.SMTPSecurity = tt.security
+			before := inboxSize(t, srv, to)
+
+			err := srv.SMTPMailer().Send(user, from, []string{to}, []byte("Subject: 工作量\r\n\r\n请填写附件\r\n"))
+			if (err != nil) != tt.wantErr || (tt.is != nil && !errors.Is(err, tt.is)) {
+				t.Fatalf("Send = %v, want error %v (%v)", err, tt.wantErr, tt.is)
+			}
+			want := 1
+			if tt.wantErr {
+				want = 0
+			}
+			if delivered := inboxSize(t, srv, to) - before; delivered != want {
+				t.Fatalf("delivered %d messages, want %d", delivered, want)
+			}
+		})
+	}
+}
+
+func inboxSize(t *testing.T, srv *mailtest.Server, address string) int {
+	t.Helper()
+	n := 0
+	_, err := srv.IMAPReader().Fetch(srv.User(address, "secret"), models.MailboxSyncState{Mailbox: "INBOX"},
+		func(services.RawMessage) error {
+			n++
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"db_intro_backend/db"
+)
+
+// submissionRowBatch bounds the rows inserted by one statement
+const submissionRowBatch = 200
+
+// submissionRow is a data row of an attachment with its cells keyed by
+// column header
+type submissionRow struct {
+	index  int // row number in the worksheet, from 1
+	values map[string]sheetCell
+}
+
+// parsedSheet is an attachment's first worksheet mapped to the project's
+// columns
+type parsedSheet struct {
+	columns  []string // header of every mapped column, in worksheet order
+	sources  []int    // worksheet column of each mapped column, from 0
+	unmapped []string // headers that match no template column
+	rows     []submissionRow
+}
+
+// empty reports whether the worksheet had no header row
+func (p parsedSheet) empty() bool {
+	return len(p.columns) == 0 && len(p.unmapped) == 0
+}
+
+// ParseAttachment reads an Excel attachment once into submission_rows and
+// marks it parsed, replacing rows from an earlier parse. Cells are keyed by
+// template header; without a template by the attachment's own header. Typed
+// cells keep their value, number format and translated formula. A file
+// that cannot be read is marked parsed with parse_status failed; only
+// database errors are returned.
+func (s *ExcelService) ParseAttachment(projectID, attachmentID int) error {
+	_, _, err := s.parseAttachment(projectID, attachmentID)
+	return err
+}
+
+// parseAttachment is ParseAttachment returning the parsed sheet, or why the
+// file could not be read
+func (s *ExcelService) parseAttachment(projectID, attachmentID int) (sheet parsedSheet, readErr error, err error) {
+	var path string
+	var teacherID sql.NullInt64
+	err = db.DB.QueryRow("SELECT stored_path, teacher_id FROM attachments WHERE id = ? AND project_id = ?",
+		attachmentID, projectID).Scan(&path, &teacherID)
+	if err != nil {
+		return sheet, nil, err
+	}
+	settings, err := LoadAggregationSettings(projectID)
+	if err != nil {
+		return sheet, nil, err
+	}
+	// A fresh schema each time: without a template it grows with the
+	// attachment's own headers
+	schema, err := s.projectSchema(projectID, settings)
+	if err != nil {
+		return sheet, nil, err
+	}
+
+	rows, readErr := s.readSheetCells(path)
+	if readErr == nil {
+		sheet = s.mapSheet(schema, rows)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return sheet, nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM submission_rows WHERE attachment_id = ?", attachmentID); err != nil {
+		return sheet, nil, err
+	}
+	for start := 0; start < len(sheet.rows); start += submissionRowBatch {
+		end := start + submissionRowBatch
+		if end > len(sheet.rows) {
+			end = len(sheet.rows)
+		}
+		placeholders := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 5*(end-start))
+		for _, row := range sheet.rows[start:end] {
+			data, err := json.Marshal(row.values)
+			if err != nil {
+				return sheet, nil, err
+			}
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+			args = append(args, projectID, teacherID, attachmentID, row.index, string(data))
+		}
+		if _, err := tx.Exec("INSERT INTO submission_rows (project_id, teacher_id, attachment_id, row_index, data) VALUES "+
+			strings.Join(placeholders, ", "), args...); err != nil {
+			return sheet, nil, fmt.Errorf("failed to store rows: %w", err)
+		}
+	}
+
+	status, message := ParseStatusOK, ""
+	if readErr != nil {
+		status, message = ParseStatusFailed, readErr.Error()
+		if r := []rune(message); len(r) > 500 {
+			message = string(r[:500])
+		}
+	}
+	columnsJSON, _ := json.Marshal(sheet.columns)
+	unmappedJSON, _ := json.Marshal(sheet.unmapped)
+	if _, err := tx.Exec(`
+		UPDATE attachments
+		SET parsed = TRUE, parsed_at = NOW(), parse_status = ?, parse_error = ?, parsed_columns = ?, unmapped_columns = ?
+		WHERE id = ?`,
+		status, nullString(message), string(columnsJSON), string(unmappedJSON), attachmentID); err != nil {
+		return sheet, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return sheet, nil, err
+	}
+
+	if readErr != nil {
+		log.Printf("Failed to parse attachment %d (%s): %v", attachmentID, path, readErr)
+	} else {
+		log.Printf("Parsed attachment %d: %d rows, %d columns", attachmentID, len(sheet.rows), len(sheet.columns))
+	}
+	return sheet, readErr, nil
+}
+
+// mapSheet maps the data rows below the first non-empty row, the header, to
+// schema columns. Empty rows are skipped; a row whose cells all fall in
+// unmapped columns is kept without values. Formulas are translated to the
+// headers of the columns they refer to; one that cannot be keeps only its
+// result.
+func (s *ExcelService) mapSheet(schema *columnSchema, rows [][]sheetCell) parsedSheet {
+	sheet := parsedSheet{columns: []string{}, unmapped: []string{}}
+	texts := cellTexts(rows)
+	headerIdx, headerCells := s.firstNonEmptyRow(texts)
+	if headerIdx == -1 {
+		return sheet
+	}
+
+	mapping, unmapped := schema.mapHeader(headerCells)
+	if unmapped != nil {
+		sheet.unmapped = unmapped
+	}
+	for i, col := range mapping {
+		if col >= 0 {
+			sheet.columns = append(sheet.columns, schema.headers[col])
+			sheet.sources = append(sheet.sources, i)
+		}
+	}
+
+	header := func(col int) (string, bool) {
+		if col > len(mapping) || mapping[col-1] < 0 {
+			return "", false
+		}
+		return schema.headers[mapping[col-1]], true
+	}
+	for offset, dataRow := range rows[headerIdx+1:] {
+		if s.rowIsEmpty(texts[headerIdx+1+offset]) {
+			continue
+		}
+		index := headerIdx + offset + 2
+		values := make(map[string]sheetCell)
+		for i, cell := range dataRow {
+			if i >= len(mapping) || mapping[i] < 0 || cell.text == "" {
+				continue
+			}
+			if cell.source != "" {
+				cell.formula, _ = translateFormula(cell.source, index, header)
+				cell.source = ""
+			}
+			values[schema.headers[mapping[i]]] = cell
+		}
+		sheet.rows = append(sheet.rows, submissionRow{index: index, values: values})
+	}
+	return sheet
+}
+
+// parsedAttachment is an Excel attachment of a reply as parsed at ingestion
+type parsedAttachment struct {
+	id      int
+	name    string
+	sheet   parsedSheet
+	readErr error // why the file could not be read
+}
+
+// parseReplyAttachments parses the stored Excel attachments of a reply,
+// including files unpacked from archives, and returns them for validation.
+// Attachments whose rows could not be stored are left out.
+func (s *EmailService) parseReplyAttachments(projectID int, replyID int64) []parsedAttachment {
+	rows, err := db.DB.Query("SELECT id, COALESCE(original_filename, '') FROM attachments WHERE reply_id = ? AND status = ? ORDER BY id ASC",
+		replyID, AttachmentStatusStored)
+	if err != nil {
+		log.Printf("Failed to load attachments of reply %d: %v", replyID, err)
+		return nil
+	}
+	var attachments []parsedAttachment
+	for rows.Next() {
+		var a parsedAttachment
+		if err := rows.Scan(&a.id, &a.name); err == nil && isExcelFile(a.name) {
+			attachments = append(attachments, a)
+		}
+	}
+	rows.Close()
+
+	parsed := attachments[:0]
+	for _, a := range attachments {
+		var err error
+		if a.sheet, a.readErr, err = s.Excel.parseAttachment(projectID, a.id); err != nil {
+			log.Printf("Failed to store rows of attachment %d: %v", a.id, err)
+			continue
+		}
+		parsed = append(parsed, a)
+	}
+	return parsed
+}
+
+// storedSheet is a parsed attachment as read back from the database
+type storedSheet struct {
+	status, err       string
+	columns, unmapped []string
+	rows              []map[string]sheetCell
+}
+
+// loadParsedSheets reads the parse results and rows of a project's parsed
+// attachments, keyed by attachment ID
+func loadParsedSheets(projectID int) (map[int]*storedSheet, error) {
+	sheets := make(map[int]*storedSheet)
+	rows, err := db.DB.Query(`
+		SELECT id, COALESCE(parse_status, ''), COALESCE(parse_error, ''), parsed_columns, unmapped_columns
+		FROM attachments WHERE project_id = ? AND parsed = TRUE`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var columns, unmapped sql.NullString
+		sheet := &storedSheet{}
+		if err := rows.Scan(&id, &sheet.status, &sheet.err, &columns, &unmapped); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if columns.Valid {
+			json.Unmarshal([]byte(columns.String), &sheet.columns)
+		}
+		if unmapped.Valid {
+			json.Unmarshal([]byte(unmapped.String), &sheet.unmapped)
+		}
+		sheets[id] = sheet
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	dataRows, err := db.DB.Query("SELECT attachment_id, data FROM submission_rows WHERE project_id = ? ORDER BY attachment_id ASC, row_index ASC", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer dataRows.Close()
+	for dataRows.Next() {
+		var attachmentID int
+		var data string
+		if err := dataRows.Scan(&attachmentID, &data); err != nil {
+			return nil, err
+		}
+		sheet, ok := sheets[attachmentID]
+		if !ok {
+			continue
+		}
+		values := make(map[string]sheetCell)
+		if err := json.Unmarshal([]byte(data), &values); err != nil {
+			return nil, fmt.Errorf("invalid row data of attachment %d: %w", attachmentID, err)
+		}
+		sheet.rows = append(sheet.rows, values)
+	}
+	return sheets, dataRows.Err()
+}
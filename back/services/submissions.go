@@ -0,0 +1,241 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+var ErrSubmissionNotFound = errors.New("submission not found")
+
+// submissionAttempts bounds the retries of a submission whose version was
+// taken concurrently
+const submissionAttempts = 3
+
+// recordSubmission numbers a reply that carries Excel files as the teacher's
+// next submission to the project. validation is the outcome of the project's
+// rules, empty when there are none.
+func (s *EmailService) recordSubmission(projectID int, teacherID int64, replyID int64, validation string) {
+	var excelFiles int
+	rows, err := db.DB.Query("SELECT COALESCE(original_filename, '') FROM attachments WHERE reply_id = ? AND status = ?", replyID, AttachmentStatusStored)
+	if err != nil {
+		log.Printf("Failed to load attachments of reply %d: %v", replyID, err)
+		return
+	}
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil && isExcelFile(name) {
+			excelFiles++
+		}
+	}
+	rows.Close()
+	if excelFiles == 0 {
+		return
+	}
+
+	// A submission recorded concurrently (a triaged email being assigned)
+	// can take the same version; the unique key rejects it and the next
+	// attempt numbers it after that one
+	for attempt := 1; ; attempt++ {
+		_, err = db.DB.Exec(`
+			INSERT INTO submissions (project_id, teacher_id, reply_id, version, validation_status)
+			SELECT ?, ?, ?, COALESCE(MAX(version), 0) + 1, ?
+			FROM submissions WHERE project_id = ? AND teacher_id = ?`,
+			projectID, teacherID, replyID, nullString(validation), projectID, teacherID)
+		if !db.IsDuplicateKey(err) || attempt == submissionAttempts {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to record submission of teacher %d in project %d: %v", teacherID, projectID, err)
+	}
+}
+
+// ListSubmissions returns the submission history of a project, newest first
+// per teacher, marking the one aggregation uses. teacherID 0 lists everyone.
+func ListSubmissions(projectID, teacherID int) ([]models.Submission, error) {
+	query := `
+		SELECT s.id, s.project_id, s.teacher_id, t.name, s.reply_id, s.version,
+			COALESCE(s.validation_status, ''), s.pinned, r.received_at, s.created_at
+		FROM submissions s
+		JOIN teachers t ON s.teacher_id = t.id
+		JOIN replies r ON s.reply_id = r.id
+		WHERE s.project_id = ?`
+	args := []interface{}{projectID}
+	if teacherID != 0 {
+		query += " AND s.teacher_id = ?"
+		args = append(args, teacherID)
+	}
+	query += " ORDER BY t.name ASC, s.teacher_id ASC, s.version DESC"
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	submissions := []models.Submission{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var sub models.Submission
+		if err := rows.Scan(&sub.ID, &sub.ProjectID, &sub.TeacherID, &sub.TeacherName, &sub.ReplyID, &sub.Version,
+			&sub.ValidationStatus, &sub.Pinned, &sub.ReceivedAt, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		sub.Attachments = []string{}
+		index[sub.ReplyID] = len(submissions)
+		submissions = append(submissions, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range selectSubmissions(submissions) {
+		for i := range submissions {
+			if submissions[i].ID == id {
+				submissions[i].Selected = true
+			}
+		}
+	}
+
+	if len(submissions) == 0 {
+		return submissions, nil
+	}
+	attRows, err := db.DB.Query(`
+		SELECT a.reply_id, COALESCE(a.original_filename, '')
+		FROM attachments a
+		JOIN submissions s ON s.reply_id = a.reply_id
+		WHERE s.project_id = ? AND a.status = ?
+		ORDER BY a.id ASC`, projectID, AttachmentStatusStored)
+	if err != nil {
+		return nil, err
+	}
+	defer attRows.Close()
+	for attRows.Next() {
+		var replyID int
+		var name string
+		if err := attRows.Scan(&replyID, &name); err != nil || !isExcelFile(name) {
+			continue
+		}
+		if i, ok := index[replyID]; ok {
+			submissions[i].Attachments = append(submissions[i].Attachments, name)
+		}
+	}
+	return submissions, nil
+}
+
+// selectSubmissions picks the submission aggregation uses for each teacher:
+// the pinned one, else the latest that did not fail validation, else the
+// latest. It returns submission IDs.
+func selectSubmissions(submissions []models.Submission) []int {
+	type choice struct {
+		pinned, valid, latest *models.Submission
+	}
+	choices := make(map[int]*choice)
+	var order []int
+	for i := range submissions {
+		sub := &submissions[i]
+		c, ok := choices[sub.TeacherID]
+		if !ok {
+			c = &choice{}
+			choices[sub.TeacherID] = c
+			order = append(order, sub.TeacherID)
+		}
+		if sub.Pinned {
+			c.pinned = sub
+		}
+		if sub.ValidationStatus != ValidationStatusInvalid && (c.valid == nil || sub.Version > c.valid.Version) {
+			c.valid = sub
+		}
+		if c.latest == nil || sub.Version > c.latest.Version {
+			c.latest = sub
+		}
+	}
+
+	var ids []int
+	for _, teacherID := range order {
+		c := choices[teacherID]
+		switch {
+		case c.pinned != nil:
+			ids = append(ids, c.pinned.ID)
+		case c.valid != nil:
+			ids = append(ids, c.valid.ID)
+		default:
+			ids = append(ids, c.latest.ID)
+		}
+	}
+	return ids
+}
+
+// selectedSubmissionReplies returns the replies aggregation uses, and the
+// teachers that have any submission at all
+func selectedSubmissionReplies(projectID int) (replies map[int]bool, teachers map[int]bool, err error) {
+	submissions, err := ListSubmissions(projectID, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	replies = make(map[int]bool)
+	teachers = make(map[int]bool)
+	for _, sub := range submissions {
+		teachers[sub.TeacherID] = true
+		if sub.Selected {
+			replies[sub.ReplyID] = true
+		}
+	}
+	return replies, teachers, nil
+}
+
+// PinSubmission makes aggregation use a submission instead of the latest
+// valid one; any other pin of the same teacher is cleared
+func PinSubmission(projectID, submissionID int) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var teacherID int
+	err = tx.QueryRow("SELECT teacher_id FROM submissions WHERE id = ? AND project_id = ?", submissionID, projectID).Scan(&teacherID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrSubmissionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE submissions SET pinned = (id = ?) WHERE project_id = ? AND teacher_id = ?", submissionID, projectID, teacherID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnpinSubmission returns the teacher of a submission to the default choice
+func UnpinSubmission(projectID, submissionID int) error {
+	res, err := db.DB.Exec(`
+		UPDATE submissions SET pinned = FALSE
+		WHERE project_id = ? AND teacher_id = (SELECT teacher_id FROM (SELECT teacher_id FROM submissions WHERE id = ? AND project_id = ?) AS s)`,
+		projectID, submissionID, projectID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists int
+		if err := db.DB.QueryRow("SELECT COUNT(*) FROM submissions WHERE id = ? AND project_id = ?", submissionID, projectID).Scan(&exists); err != nil || exists == 0 {
+			return ErrSubmissionNotFound
+		}
+	}
+	return nil
+}
+
+// submissionValidation summarizes validateReplyAttachments for a submission
+func submissionValidation(checked, failed int) string {
+	switch {
+	case failed > 0:
+		return ValidationStatusInvalid
+	case checked > 0:
+		return ValidationStatusValid
+	}
+	return ""
+}
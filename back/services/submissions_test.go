@@ -0,0 +1,91 @@
+package services
+
+import (
+	"slices"
+	"testing"
+
+	"db_intro_backend/models"
+)
+
+func TestSelectSubmissions(t *testing.T) {
+	sub := func(id, teacherID, version int, status string, pinned bool) models.Submission {
+		return models.Submission{ID: id, TeacherID: teacherID, Version: version, ValidationStatus: status, Pinned: pinned}
+	}
+	tests := []struct {
+		name        string
+		submissions []models.Submission
+		want        []int
+	}{
+		{
+			name: "latest without rules",
+			submissions: []models.Submission{
+				sub(2, 1, 2, "", false),
+				sub(1, 1, 1, "", false),
+			},
+			want: []int{2},
+		},
+		{
+			name: "latest valid over a later invalid",
+			submissions: []models.Submission{
+				sub(3, 1, 3, ValidationStatusInvalid, false),
+				sub(2, 1, 2, ValidationStatusValid, false),
+				sub(1, 1, 1, ValidationStatusValid, false),
+			},
+			want: []int{2},
+		},
+		{
+			name: "latest when every version is invalid",
+			submissions: []models.Submission{
+				sub(2, 1, 2, ValidationStatusInvalid, false),
+				sub(1, 1, 1, ValidationStatusInvalid, false),
+			},
+			want: []int{2},
+		},
+		{
+			name: "pinned over the latest valid",
+			submissions: []models.Submission{
+				sub(3, 1, 3, ValidationStatusValid, false),
+				sub(2, 1, 2, ValidationStatusInvalid, true),
+				sub(1, 1, 1, ValidationStatusValid, false),
+			},
+			want: []int{2},
+		},
+		{
+			name: "one per teacher in listing order",
+			submissions: []models.Submission{
+				sub(4, 7, 2, "", false),
+				sub(1, 7, 1, "", false),
+				sub(3, 5, 2, ValidationStatusInvalid, false),
+				sub(2, 5, 1, ValidationStatusValid, false),
+			},
+			want: []int{4, 2},
+		},
+		{
+			name: "none",
+		},
+	}
+	for _, tt := range tests {
+		if got := selectSubmissions(tt.submissions); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: selectSubmissions = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsExcelFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"工作量.xlsx":     true,
+		"工作量.XLS":      true,
+		"report.xlsm":  true,
+		"report.xlsb":  true,
+		"工作量.csv":      false,
+		"工作量.xlsx.zip": false,
+		"工作量.xls.bak":  false,
+		"工作量.xlsx ":    false,
+		"xlsx":         false,
+		"":             false,
+	} {
+		if got := isExcelFile(name); got != want {
+			t.Errorf("isExcelFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package services
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+)
+
+// Triage states of an unmatched email
+const (
+	UnmatchedStatusPending   = "pending"
+	UnmatchedStatusAssigned  = "assigned"
+	UnmatchedStatusDismissed = "dismissed"
+)
+
+const unmatchedUploadDir = "./uploads/unmatched"
+
+var (
+	ErrUnmatchedEmailNotFound   = errors.New("unmatched email not found or already resolved")
+	ErrUnmatchedEmailUnreadable = errors.New("the email could not be read and only an excerpt was kept; ask the sender to send it again")
+)
+
+// queueUnmatchedEmail stores an email that could not be attributed to a
+// project, together with its attachments, for manual triage.
+func (s *EmailService) queueUnmatchedEmail(userID int, email models.EmailMessage, match replyMatch) error {
+	headersJSON, err := json.Marshal(email.RawHeaders)
+	if err != nil {
+		headersJSON = []byte("{}")
+	}
+	var candidates interface{}
+	if len(match.Candidates) > 0 {
+		data, _ := json.Marshal(match.Candidates)
+		candidates = string(data)
+	}
+
+	result, err := db.DB.Exec(`
+		INSERT INTO unmatched_emails (user_id, from_email, subject, message_id, in_reply_to, received_at, raw_headers, raw_body, body_text, teacher_id, candidate_project_ids, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, email.From, email.Subject, email.MessageID, email.InReplyTo, email.ReceivedAt,
+		string(headersJSON), email.Body, email.TextBody, match.TeacherID, candidates, UnmatchedStatusPending)
+	if err != nil {
+		return err
+	}
+	unmatchedID, _ := result.LastInsertId()
+
+	os.MkdirAll(unmatchedUploadDir, 0755)
+	for i, att := range email.Attachments {
+		status, storedPath := AttachmentStatusRejected, ""
+		if att.RejectReason == "" {
+			storedPath = filepath.Join(unmatchedUploadDir,
+				fmt.Sprintf("%d_%d_%s", unmatchedID, i, s.sanitizeAttachmentName(att.Filename)))
+			if err := moveFile(att.Path, storedPath); err != nil {
+				log.Printf("Failed to save attachment %s: %v", att.Filename, err)
+				continue
+			}
+			status = AttachmentStatusStored
+		}
+		if _, err := db.DB.Exec(`
+			INSERT INTO unmatched_email_attachments (unmatched_email_id, original_filename, stored_path, content_type, file_size, status, reject_reason)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			unmatchedID, att.Filename, storedPath, att.ContentType, att.Size, status, nullString(att.RejectReason)); err != nil {
+			log.Printf("Failed to insert attachment record: %v", err)
+		}
+	}
+	return nil
+}
+
+// unreadableExcerptSize bounds the raw text kept of a message that could not
+// be read
+const unreadableExcerptSize = 64 << 10
+
+// excerptBuffer keeps the first unreadableExcerptSize bytes written to it
+// and discards the rest
+type excerptBuffer struct {
+	buf bytes.Buffer
+}
+
+func (b *excerptBuffer) Write(p []byte) (int, error) {
+	if room := unreadableExcerptSize - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// fill reads from r until the excerpt is complete or r ends
+func (b *excerptBuffer) fill(r io.Reader) {
+	if room := unreadableExcerptSize - b.buf.Len(); room > 0 {
+		io.CopyN(b, r, int64(room))
+	}
+}
+
+func (b *excerptBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// queueUnreadableEmail records a message that cannot be processed, with the
+// reason, in the triage queue. The mailbox then moves past it without losing
+// it. Only the headers that can still be read and the start of the raw
+// message are kept.
+func (s *EmailService) queueUnreadableEmail(userID int, raw []byte, reason string) error {
+	email := models.EmailMessage{ReceivedAt: time.Now()}
+	header := lenientHeader(raw)
+	if from, err := mail.ParseAddress(header.Get("From")); err == nil {
+		email.From = from.Address
+	}
+	dec := new(mime.WordDecoder)
+	var err error
+	if email.Subject, err = dec.DecodeHeader(header.Get("Subject")); err != nil {
+		email.Subject = header.Get("Subject")
+	}
+	email.MessageID = header.Get("Message-ID")
+	if date, err := header.Date(); err == nil {
+		email.ReceivedAt = date
+	}
+	if email.MessageID != "" && s.isKnownMessage(userID, email.MessageID) {
+		return nil
+	}
+	if len(raw) > unreadableExcerptSize {
+		raw = raw[:unreadableExcerptSize]
+	}
+	// Text columns reject invalid UTF-8
+	excerpt := strings.ToValidUTF8(string(raw), "\uFFFD")
+
+	_, err = db.DB.Exec(`
+		INSERT INTO unmatched_emails (user_id, from_email, subject, message_id, received_at, raw_body, body_text, status, ingest_error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, email.From, truncateRunes(email.Subject, 255), nullString(email.MessageID), email.ReceivedAt,
+		excerpt, excerpt, UnmatchedStatusPending, truncateRunes(reason, 500))
+	return err
+}
+
+// lenientHeader reads the header fields of a raw message that may be
+// malformed, skipping lines that are not fields
+func lenientHeader(raw []byte) mail.Header {
+	header := make(mail.Header)
+	block := raw
+	if end := bytes.Index(raw, []byte("\n\r\n")); end >= 0 {
+		block = raw[:end]
+	}
+	if end := bytes.Index(block, []byte("\n\n")); end >= 0 {
+		block = block[:end]
+	}
+	var key string
+	for _, line := range strings.Split(string(block), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			// Folded continuation of the previous field
+			if values := header[key]; key != "" && len(values) > 0 {
+				values[len(values)-1] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			key = ""
+			continue
+		}
+		key = textproto.CanonicalMIMEHeaderKey(name)
+		header[key] = append(header[key], strings.TrimSpace(value))
+	}
+	return header
+}
+
+// truncateRunes cuts s to at most n characters, for headers of unknown
+// length stored in VARCHAR columns
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// ListUnmatchedEmails returns the user's unmatched emails with the given
+// status (all of them when status is empty), newest first
+func (s *EmailService) ListUnmatchedEmails(userID int, status string) ([]models.UnmatchedEmail, error) {
+	query := `
+		SELECT u.id, u.from_email, COALESCE(u.subject, ''), COALESCE(u.message_id, ''), COALESCE(u.in_reply_to, ''),
+			COALESCE(u.body_text, ''), u.received_at, u.teacher_id, COALESCE(t.name, ''), u.candidate_project_ids,
+			u.status, u.project_id, u.reply_id, COALESCE(u.ingest_error, ''), u.created_at, u.resolved_at
+		FROM unmatched_emails u
+		LEFT JOIN teachers t ON u.teacher_id = t.id
+		WHERE u.user_id = ?`
+	args := []interface{}{userID}
+	if status != "" {
+		query += " AND u.status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY u.received_at DESC, u.id DESC"
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects, err := userProjectRefs(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := []models.UnmatchedEmail{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var e models.UnmatchedEmail
+		var teacherID, projectID, replyID sql.NullInt64
+		var candidates sql.NullString
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.FromEmail, &e.Subject, &e.MessageID, &e.InReplyTo,
+			&e.Body, &e.ReceivedAt, &teacherID, &e.TeacherName, &candidates,
+			&e.Status, &projectID, &replyID, &e.IngestError, &e.CreatedAt, &resolvedAt); err != nil {
+			return nil, err
+		}
+		e.TeacherID = nullIntPtr(teacherID)
+		e.ProjectID = nullIntPtr(projectID)
+		e.ReplyID = nullIntPtr(replyID)
+		if resolvedAt.Valid {
+			e.ResolvedAt = &resolvedAt.Time
+		}
+
+		e.CandidateProjects = []models.ProjectRef{}
+		if candidates.Valid {
+			var ids []int
+			json.Unmarshal([]byte(candidates.String), &ids)
+			for _, id := range ids {
+				if p, ok := projects[id]; ok {
+					e.CandidateProjects = append(e.CandidateProjects, p)
+				}
+			}
+		}
+		e.Attachments = []models.UnmatchedAttachment{}
+
+		index[e.ID] = len(emails)
+		emails = append(emails, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(emails) == 0 {
+		return emails, nil
+	}
+
+	attRows, err := db.DB.Query(`
+		SELECT a.id, a.unmatched_email_id, COALESCE(a.original_filename, ''), a.stored_path, COALESCE(a.content_type, ''), COALESCE(a.file_size, 0),
+			a.status, COALESCE(a.reject_reason, '')
+		FROM unmatched_email_attachments a
+		JOIN unmatched_emails u ON a.unmatched_email_id = u.id
+		WHERE u.user_id = ?
+		ORDER BY a.id ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer attRows.Close()
+	for attRows.Next() {
+		var a models.UnmatchedAttachment
+		var emailID int
+		if err := attRows.Scan(&a.ID, &emailID, &a.OriginalFilename, &a.StoredPath, &a.ContentType, &a.FileSize,
+			&a.Status, &a.RejectReason); err != nil {
+			return nil, err
+		}
+		if i, ok := index[emailID]; ok {
+			emails[i].Attachments = append(emails[i].Attachments, a)
+		}
+	}
+	return emails, attRows.Err()
+}
+
+// AssignUnmatchedEmail files a pending unmatched email as a reply to the given
+// project. Without an explicit teacher the sender's address is looked up. The
+// reply goes through storeReply, exactly like an automatically matched email.
+// Emails that could not be read are refused: only an excerpt of them was
+// kept, without attachments.
+func (s *EmailService) AssignUnmatchedEmail(userID, unmatchedID, projectID int, teacherID sql.NullInt64) (int64, error) {
+	// Claim the email first so that two concurrent assignments cannot both
+	// create a reply
+	res, err := db.DB.Exec("UPDATE unmatched_emails SET status = ?, project_id = ? WHERE id = ? AND user_id = ? AND status = ? AND ingest_error IS NULL",
+		UnmatchedStatusAssigned, projectID, unmatchedID, userID, UnmatchedStatusPending)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var unreadable bool
+		err := db.DB.QueryRow("SELECT ingest_error IS NOT NULL FROM unmatched_emails WHERE id = ? AND user_id = ? AND status = ?",
+			unmatchedID, userID, UnmatchedStatusPending).Scan(&unreadable)
+		if err == nil && unreadable {
+			return 0, ErrUnmatchedEmailUnreadable
+		}
+		return 0, ErrUnmatchedEmailNotFound
+	}
+
+	replyID, err := s.assignClaimedEmail(unmatchedID, projectID, teacherID)
+	if err != nil {
+		if _, revertErr := db.DB.Exec("UPDATE unmatched_emails SET status = ?, project_id = NULL WHERE id = ?",
+			UnmatchedStatusPending, unmatchedID); revertErr != nil {
+			log.Printf("Failed to return unmatched email %d to the queue: %v", unmatchedID, revertErr)
+		}
+		return 0, err
+	}
+	return replyID, nil
+}
+
+func (s *EmailService) assignClaimedEmail(unmatchedID, projectID int, teacherID sql.NullInt64) (int64, error) {
+	var email models.EmailMessage
+	var storedTeacher sql.NullInt64
+	var headersJSON sql.NullString
+	err := db.DB.QueryRow(`
+		SELECT from_email, COALESCE(subject, ''), COALESCE(message_id, ''), COALESCE(in_reply_to, ''), received_at,
+			raw_headers, COALESCE(raw_body, ''), COALESCE(body_text, ''), teacher_id
+		FROM unmatched_emails WHERE id = ?`, unmatchedID).Scan(
+		&email.From, &email.Subject, &email.MessageID, &email.InReplyTo, &email.ReceivedAt,
+		&headersJSON, &email.Body, &email.TextBody, &storedTeacher)
+	if err != nil {
+		return 0, err
+	}
+	if headersJSON.Valid {
+		json.Unmarshal([]byte(headersJSON.String), &email.RawHeaders)
+	}
+	if !teacherID.Valid {
+		teacherID = storedTeacher
+	}
+	if !teacherID.Valid {
+		teacherID = lookupTeacherByEmail(email.From)
+	}
+
+	attachments, err := unmatchedAttachments(unmatchedID)
+	if err != nil {
+		return 0, err
+	}
+	// storeReply moves the triage copies into the reply storage
+	for _, a := range attachments {
+		if a.Status == AttachmentStatusStored {
+			if _, err := os.Stat(a.StoredPath); err != nil {
+				return 0, fmt.Errorf("failed to read attachment %s: %w", a.OriginalFilename, err)
+			}
+		}
+		email.Attachments = append(email.Attachments, models.AttachmentInfo{
+			Filename:     a.OriginalFilename,
+			ContentType:  a.ContentType,
+			Path:         a.StoredPath,
+			Size:         a.FileSize,
+			RejectReason: a.RejectReason,
+		})
+	}
+
+	replyID, err := s.storeReply(projectID, teacherID, email)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := db.DB.Exec("UPDATE unmatched_emails SET reply_id = ?, teacher_id = ?, resolved_at = NOW() WHERE id = ?",
+		replyID, teacherID, unmatchedID); err != nil {
+		log.Printf("Failed to record assignment of unmatched email %d: %v", unmatchedID, err)
+	}
+	removeUnmatchedAttachments(unmatchedID, attachments)
+	return replyID, nil
+}
+
+// DismissUnmatchedEmail marks a pending unmatched email as not relevant and
+// deletes its stored attachments
+func (s *EmailService) DismissUnmatchedEmail(userID, unmatchedID int) error {
+	res, err := db.DB.Exec("UPDATE unmatched_emails SET status = ?, resolved_at = NOW() WHERE id = ? AND user_id = ? AND status = ?",
+		UnmatchedStatusDismissed, unmatchedID, userID, UnmatchedStatusPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnmatchedEmailNotFound
+	}
+
+	attachments, err := unmatchedAttachments(unmatchedID)
+	if err != nil {
+		log.Printf("Failed to load attachments of unmatched email %d: %v", unmatchedID, err)
+		return nil
+	}
+	removeUnmatchedAttachments(unmatchedID, attachments)
+	return nil
+}
+
+func unmatchedAttachments(unmatchedID int) ([]models.UnmatchedAttachment, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, COALESCE(original_filename, ''), stored_path, COALESCE(content_type, ''), COALESCE(file_size, 0),
+			status, COALESCE(reject_reason, '')
+		FROM unmatched_email_attachments WHERE unmatched_email_id = ? ORDER BY id ASC`, unmatchedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []models.UnmatchedAttachment
+	for rows.Next() {
+		var a models.UnmatchedAttachment
+		if err := rows.Scan(&a.ID, &a.OriginalFilename, &a.StoredPath, &a.ContentType, &a.FileSize, &a.Status, &a.RejectReason); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// removeUnmatchedAttachments deletes the triage copies of the attachments once
+// the email is resolved
+func removeUnmatchedAttachments(unmatchedID int, attachments []models.UnmatchedAttachment) {
+	for _, a := range attachments {
+		if a.StoredPath == "" {
+			continue
+		}
+		if err := os.Remove(a.StoredPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", a.StoredPath, err)
+		}
+	}
+	if _, err := db.DB.Exec("DELETE FROM unmatched_email_attachments WHERE unmatched_email_id = ?", unmatchedID); err != nil {
+		log.Printf("Failed to delete attachment records of unmatched email %d: %v", unmatchedID, err)
+	}
+}
+
+// userProjectRefs returns the projects of a user keyed by id
+func userProjectRefs(userID int) (map[int]models.ProjectRef, error) {
+	rows, err := db.DB.Query("SELECT id, code, name FROM projects WHERE created_by = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make(map[int]models.ProjectRef)
+	for rows.Next() {
+		var p models.ProjectRef
+		var code sql.NullString
+		if err := rows.Scan(&p.ID, &code, &p.Name); err != nil {
+			return nil, err
+		}
+		p.Code = strings.TrimSpace(code.String)
+		refs[p.ID] = p
+	}
+	return refs, rows.Err()
+}
+
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	i := int(v.Int64)
+	return &i
+}
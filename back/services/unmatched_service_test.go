@@ -0,0 +1,31 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestExcerptBuffer keeps the start of a message that was partly consumed
+// by the parser and completes it from the rest
+func TestExcerptBuffer(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789"), unreadableExcerptSize/5)
+	r := bytes.NewReader(msg)
+	var excerpt excerptBuffer
+	if _, err := io.CopyN(io.Discard, io.TeeReader(r, &excerpt), 4096); err != nil {
+		t.Fatal(err)
+	}
+	excerpt.fill(r)
+	if got := excerpt.Bytes(); !bytes.Equal(got, msg[:unreadableExcerptSize]) {
+		t.Fatalf("excerpt has %d bytes, want the first %d of the message", len(got), unreadableExcerptSize)
+	}
+	if rest := r.Len(); rest != len(msg)-unreadableExcerptSize {
+		t.Fatalf("%d bytes left unread, want %d", rest, len(msg)-unreadableExcerptSize)
+	}
+
+	var short excerptBuffer
+	short.fill(bytes.NewReader([]byte("From: x\r\n")))
+	if string(short.Bytes()) != "From: x\r\n" {
+		t.Fatalf("excerpt of a short message = %q", short.Bytes())
+	}
+}
@@ -0,0 +1,390 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"db_intro_backend/db"
+	"db_intro_backend/models"
+
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/width"
+)
+
+// Results recorded in attachments.validation_status
+const (
+	ValidationStatusValid   = "valid"
+	ValidationStatusInvalid = "invalid"
+)
+
+// MemberStatusNeedsRevision marks a teacher whose latest submission failed
+// validation; it stays until a valid one arrives
+const MemberStatusNeedsRevision = "needs_revision"
+
+// Column types of a ColumnRule
+const (
+	ColumnTypeText   = "text"
+	ColumnTypeNumber = "number"
+	ColumnTypeDate   = "date"
+	ColumnTypeEnum   = "enum"
+)
+
+// maxFeedbackIssues bounds the cells listed per attachment in a feedback email
+const maxFeedbackIssues = 50
+
+// LoadValidationRules reads the validation rules of a project; a project
+// without any yields empty rules
+func LoadValidationRules(projectID int) (models.ValidationRules, error) {
+	var rules models.ValidationRules
+	var raw sql.NullString
+	err := db.DB.QueryRow("SELECT validation_rules FROM projects WHERE id = ?", projectID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rules, ErrProjectNotFound
+	}
+	if err != nil {
+		return rules, err
+	}
+	if raw.Valid && raw.String != "" {
+		if err := json.Unmarshal([]byte(raw.String), &rules); err != nil {
+			return rules, fmt.Errorf("invalid validation rules: %w", err)
+		}
+	}
+	return rules, nil
+}
+
+// SaveValidationRules stores the validation rules of a project
+func SaveValidationRules(projectID int, rules models.ValidationRules) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec("UPDATE projects SET validation_rules = ? WHERE id = ?", string(data), projectID)
+	return err
+}
+
+// ValidateValidationRules checks rules submitted by a user and normalizes them
+func ValidateValidationRules(rules *models.ValidationRules) error {
+	if rules.MinRows < 0 || rules.MaxRows < 0 {
+		return errors.New("min_rows and max_rows must not be negative")
+	}
+	if rules.MaxRows > 0 && rules.MinRows > rules.MaxRows {
+		return errors.New("min_rows is greater than max_rows")
+	}
+	for i := range rules.Columns {
+		rule := &rules.Columns[i]
+		rule.Header = strings.TrimSpace(rule.Header)
+		rule.Min = strings.TrimSpace(rule.Min)
+		rule.Max = strings.TrimSpace(rule.Max)
+		if rule.Header == "" {
+			return fmt.Errorf("columns[%d]: header must not be empty", i)
+		}
+		if rule.Type == "" {
+			rule.Type = ColumnTypeText
+		}
+		switch rule.Type {
+		case ColumnTypeText:
+		case ColumnTypeNumber:
+			for _, bound := range []string{rule.Min, rule.Max} {
+				if _, ok := parseCellNumber(bound); bound != "" && !ok {
+					return fmt.Errorf("columns[%d]: %q is not a number", i, bound)
+				}
+			}
+		case ColumnTypeDate:
+			for _, bound := range []string{rule.Min, rule.Max} {
+				if _, ok := parseCellDate(bound); bound != "" && !ok {
+					return fmt.Errorf("columns[%d]: %q is not a date", i, bound)
+				}
+			}
+		case ColumnTypeEnum:
+			var values []string
+			for _, v := range rule.Values {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+			if len(values) == 0 {
+				return fmt.Errorf("columns[%d]: enum column needs values", i)
+			}
+			rule.Values = values
+		default:
+			return fmt.Errorf("columns[%d]: type must be one of text, number, date, enum", i)
+		}
+	}
+	return nil
+}
+
+// hasRules reports whether there is anything to check
+func hasRules(rules models.ValidationRules) bool {
+	return len(rules.Columns) > 0 || rules.MinRows > 0 || rules.MaxRows > 0
+}
+
+// validateSheet checks a parsed submission against the project's rules.
+// Rule headers are matched like aggregation does, through the template and
+// its aliases; schema is the project's column schema.
+func validateSheet(schema *columnSchema, rules models.ValidationRules, sheet parsedSheet) []models.ValidationIssue {
+	issues := []models.ValidationIssue{}
+	if sheet.empty() {
+		return append(issues, models.ValidationIssue{Message: "工作表为空"})
+	}
+	// The stored columns are schema headers, or without a template the
+	// attachment's own headers, which the schema picks up here
+	mapping, _ := schema.mapHeader(sheet.columns)
+
+	// Parsed column of every rule, -1 when the submission lacks it
+	ruleColumns := make([]int, len(rules.Columns))
+	for i, rule := range rules.Columns {
+		ruleColumns[i] = -1
+		col, ok := schema.index[normalizeHeader(rule.Header)]
+		if !ok {
+			continue
+		}
+		for j, target := range mapping {
+			if target == col {
+				ruleColumns[i] = j
+				break
+			}
+		}
+		if ruleColumns[i] == -1 && rule.Required {
+			issues = append(issues, models.ValidationIssue{Column: rule.Header, Message: "缺少必填列"})
+		}
+	}
+
+	for _, row := range sheet.rows {
+		for i, rule := range rules.Columns {
+			j := ruleColumns[i]
+			if j == -1 {
+				continue
+			}
+			value := strings.TrimSpace(row.values[sheet.columns[j]].text)
+			if msg := checkCell(rule, value); msg != "" {
+				cell, _ := excelize.CoordinatesToCellName(sheet.sources[j]+1, row.index)
+				issues = append(issues, models.ValidationIssue{Cell: cell, Column: rule.Header, Value: value, Message: msg})
+			}
+		}
+	}
+
+	dataRows := len(sheet.rows)
+	if rules.MinRows > 0 && dataRows < rules.MinRows {
+		issues = append(issues, models.ValidationIssue{Message: fmt.Sprintf("数据行数为 %d，至少需要 %d 行", dataRows, rules.MinRows)})
+	}
+	if rules.MaxRows > 0 && dataRows > rules.MaxRows {
+		issues = append(issues, models.ValidationIssue{Message: fmt.Sprintf("数据行数为 %d，最多允许 %d 行", dataRows, rules.MaxRows)})
+	}
+	return issues
+}
+
+// checkCell returns why value breaks rule, or "" when it is fine
+func checkCell(rule models.ColumnRule, value string) string {
+	if value == "" {
+		if rule.Required {
+			return "必填项为空"
+		}
+		return ""
+	}
+
+	switch rule.Type {
+	case ColumnTypeNumber:
+		n, ok := parseCellNumber(value)
+		if !ok {
+			return "应为数字"
+		}
+		if min, ok := parseCellNumber(rule.Min); ok && n < min {
+			return "应不小于 " + rule.Min
+		}
+		if max, ok := parseCellNumber(rule.Max); ok && n > max {
+			return "应不大于 " + rule.Max
+		}
+	case ColumnTypeDate:
+		d, ok := parseCellDate(value)
+		if !ok {
+			return "应为日期，例如 2025-03-01"
+		}
+		if min, ok := parseCellDate(rule.Min); ok && d.Before(min) {
+			return "应不早于 " + rule.Min
+		}
+		if max, ok := parseCellDate(rule.Max); ok && d.After(max) {
+			return "应不晚于 " + rule.Max
+		}
+	case ColumnTypeEnum:
+		for _, allowed := range rule.Values {
+			if value == allowed {
+				return ""
+			}
+		}
+		return "应为以下之一：" + strings.Join(rule.Values, "、")
+	}
+	return ""
+}
+
+// parseCellNumber accepts numbers as typed by people: thousands separators,
+// full-width digits and surrounding spaces
+func parseCellNumber(value string) (float64, bool) {
+	value = strings.TrimSpace(width.Fold.String(value))
+	value = strings.ReplaceAll(value, ",", "")
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n, true
+}
+
+var cellDateLayouts = []string{
+	"2006-01-02", "2006/01/02", "2006.01.02", "2006-1-2", "2006/1/2", "2006.1.2",
+	"2006年1月2日",
+	"2006-01-02 15:04:05", "2006/1/2 15:04",
+}
+
+// parseCellDate reads the usual ways a date is displayed, and Excel serial
+// numbers for cells without a date format
+func parseCellDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(width.Fold.String(value))
+	if value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range cellDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	if serial, err := strconv.ParseFloat(value, 64); err == nil && serial >= 1 && serial < 2958466 {
+		if t, err := excelize.ExcelDateToTime(serial, false); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// validateReplyAttachments checks the parsed Excel attachments of a reply,
+// including files unpacked from archives, and records the results. It
+// returns how many were checked and how many failed. Failures are emailed to
+// the teacher when the rules ask for it.
+func (s *EmailService) validateReplyAttachments(projectID int, teacherID sql.NullInt64, attachments []parsedAttachment) (checked, failed int) {
+	rules, err := LoadValidationRules(projectID)
+	if err != nil {
+		log.Printf("Failed to load validation rules of project %d: %v", projectID, err)
+		return 0, 0
+	}
+	if !hasRules(rules) || len(attachments) == 0 {
+		return 0, 0
+	}
+	settings, err := LoadAggregationSettings(projectID)
+	if err != nil {
+		log.Printf("Failed to load aggregation settings of project %d: %v", projectID, err)
+		return 0, 0
+	}
+	schema, err := s.Excel.projectSchema(projectID, settings)
+	if err != nil {
+		log.Printf("Failed to load column schema of project %d: %v", projectID, err)
+		return 0, 0
+	}
+
+	var report []attachmentIssues
+	for _, a := range attachments {
+		var issues []models.ValidationIssue
+		if a.readErr != nil {
+			issues = []models.ValidationIssue{{Message: "无法读取文件：" + a.readErr.Error()}}
+		} else {
+			issues = validateSheet(schema, rules, a.sheet)
+		}
+		status := ValidationStatusValid
+		if len(issues) > 0 {
+			status = ValidationStatusInvalid
+			failed++
+			report = append(report, attachmentIssues{Filename: a.name, Issues: issues})
+		}
+		checked++
+
+		issuesJSON, _ := json.Marshal(issues)
+		if _, err := db.DB.Exec("UPDATE attachments SET validation_status = ?, validation_errors = ? WHERE id = ?",
+			status, string(issuesJSON), a.id); err != nil {
+			log.Printf("Failed to record validation of attachment %d: %v", a.id, err)
+		}
+		log.Printf("Validated attachment %s: %s (%d issues)", a.name, status, len(issues))
+	}
+
+	if failed > 0 && rules.SendFeedback && teacherID.Valid {
+		queueValidationFeedback(projectID, int(teacherID.Int64), report)
+	}
+	return checked, failed
+}
+
+// attachmentIssues are the failed checks of one attachment
+type attachmentIssues struct {
+	Filename string
+	Issues   []models.ValidationIssue
+}
+
+// BuildValidationFeedback composes the email that tells a teacher which cells
+// of their submission need fixing
+func BuildValidationFeedback(p models.Project, teacherID int, name, email string, report []attachmentIssues) models.OutboundEmail {
+	var b strings.Builder
+	fmt.Fprintf(&b, "尊敬的%s老师：\n\n您提交的《%s》数据未通过校验，请修改以下内容后重新回复本邮件：\n", name, p.Name)
+	for _, att := range report {
+		fmt.Fprintf(&b, "\n附件 %s：\n", att.Filename)
+		for i, issue := range att.Issues {
+			if i == maxFeedbackIssues {
+				fmt.Fprintf(&b, "  ……另有 %d 处问题\n", len(att.Issues)-maxFeedbackIssues)
+				break
+			}
+			b.WriteString("  ")
+			if issue.Cell != "" {
+				b.WriteString(issue.Cell + " ")
+			}
+			if issue.Column != "" {
+				b.WriteString("[" + issue.Column + "] ")
+			}
+			b.WriteString(issue.Message)
+			if issue.Value != "" {
+				fmt.Fprintf(&b, "（当前值：%s）", issue.Value)
+			}
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("\n谢谢！")
+
+	return models.OutboundEmail{
+		ProjectID: p.ID,
+		TeacherID: teacherID,
+		UserID:    p.CreatedBy,
+		ToEmail:   email,
+		Subject:   "数据校验未通过: " + ReplaceTemplateVars(p.EmailSubjectTemplate, name, p.Name),
+		Body:      b.String(),
+	}
+}
+
+// queueValidationFeedback puts the feedback email into the outbox, where the
+// worker picks it up on its next poll
+func queueValidationFeedback(projectID, teacherID int, report []attachmentIssues) {
+	var p models.Project
+	var subject sql.NullString
+	if err := db.DB.QueryRow("SELECT id, name, email_subject_template, created_by FROM projects WHERE id = ?", projectID).
+		Scan(&p.ID, &p.Name, &subject, &p.CreatedBy); err != nil {
+		log.Printf("Failed to load project %d for validation feedback: %v", projectID, err)
+		return
+	}
+	p.EmailSubjectTemplate = subject.String
+
+	var name, email string
+	if err := db.DB.QueryRow("SELECT name, email FROM teachers WHERE id = ?", teacherID).Scan(&name, &email); err != nil {
+		log.Printf("Failed to load teacher %d for validation feedback: %v", teacherID, err)
+		return
+	}
+
+	msg := BuildValidationFeedback(p, teacherID, name, email, report)
+	jobID, err := enqueueOutbound(p.ID, p.CreatedBy, OutboundKindFeedback, []models.OutboundEmail{msg})
+	if err != nil {
+		log.Printf("Failed to queue validation feedback for teacher %d in project %d: %v", teacherID, projectID, err)
+		return
+	}
+	log.Printf("Queued validation feedback for teacher %d in project %d as job %d", teacherID, projectID, jobID)
+}
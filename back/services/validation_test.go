@@ -0,0 +1,167 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"db_intro_backend/models"
+)
+
+func TestCheckCell(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  models.ColumnRule
+		value string
+		want  string
+	}{
+		{"text", models.ColumnRule{Type: ColumnTypeText}, "数据库导论", ""},
+		{"optional empty", models.ColumnRule{Type: ColumnTypeNumber}, "", ""},
+		{"required empty", models.ColumnRule{Type: ColumnTypeText, Required: true}, "", "必填项为空"},
+
+		{"number", models.ColumnRule{Type: ColumnTypeNumber}, "32", ""},
+		{"number with separators", models.ColumnRule{Type: ColumnTypeNumber}, "1,024.5", ""},
+		{"full-width number", models.ColumnRule{Type: ColumnTypeNumber}, "３２", ""},
+		{"not a number", models.ColumnRule{Type: ColumnTypeNumber}, "三十二", "应为数字"},
+		{"below min", models.ColumnRule{Type: ColumnTypeNumber, Min: "0"}, "-1", "应不小于 0"},
+		{"above max", models.ColumnRule{Type: ColumnTypeNumber, Max: "200"}, "320", "应不大于 200"},
+		{"on the bounds", models.ColumnRule{Type: ColumnTypeNumber, Min: "0", Max: "200"}, "200", ""},
+
+		{"date", models.ColumnRule{Type: ColumnTypeDate}, "2025-03-01", ""},
+		{"Chinese date", models.ColumnRule{Type: ColumnTypeDate}, "2025年3月1日", ""},
+		{"date serial", models.ColumnRule{Type: ColumnTypeDate}, "45717", ""},
+		{"not a date", models.ColumnRule{Type: ColumnTypeDate}, "下周一", "应为日期，例如 2025-03-01"},
+		{"ambiguous US date", models.ColumnRule{Type: ColumnTypeDate}, "3/4/25", "应为日期，例如 2025-03-01"},
+		{"ambiguous US date with dashes", models.ColumnRule{Type: ColumnTypeDate}, "03-04-25", "应为日期，例如 2025-03-01"},
+		{"date and time", models.ColumnRule{Type: ColumnTypeDate}, "2025/3/4 08:00", ""},
+		{"before min", models.ColumnRule{Type: ColumnTypeDate, Min: "2025-01-01"}, "2024/12/31", "应不早于 2025-01-01"},
+		{"after max", models.ColumnRule{Type: ColumnTypeDate, Max: "2025-12-31"}, "2026.1.1", "应不晚于 2025-12-31"},
+
+		{"enum", models.ColumnRule{Type: ColumnTypeEnum, Values: []string{"讲师", "副教授", "教授"}}, "教授", ""},
+		{"not in enum", models.ColumnRule{Type: ColumnTypeEnum, Values: []string{"讲师", "副教授", "教授"}}, "助教", "应为以下之一：讲师、副教授、教授"},
+	}
+	for _, tt := range tests {
+		if got := checkCell(tt.rule, tt.value); got != tt.want {
+			t.Errorf("%s: checkCell(%q) = %q, want %q", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+// sheet builds a parsed submission whose header is columns, placed in the
+// worksheet from column A, with data rows from row 2
+func sheet(columns []string, rows ...[]string) parsedSheet {
+	p := parsedSheet{columns: columns}
+	for i := range columns {
+		p.sources = append(p.sources, i)
+	}
+	for i, values := range rows {
+		row := submissionRow{index: i + 2, values: make(map[string]sheetCell)}
+		for j, v := range values {
+			row.values[columns[j]] = sheetCell{text: v}
+		}
+		p.rows = append(p.rows, row)
+	}
+	return p
+}
+
+func TestValidateSheet(t *testing.T) {
+	template := []string{"姓名", "职称", "学时", "开课日期"}
+	aliases := map[string][]string{"学时": {"工作量"}}
+	rules := models.ValidationRules{Columns: []models.ColumnRule{
+		{Header: "姓名", Type: ColumnTypeText, Required: true},
+		{Header: "职称", Type: ColumnTypeEnum, Values: []string{"讲师", "教授"}},
+		{Header: "工作量", Type: ColumnTypeNumber, Min: "0", Max: "200"},
+		{Header: "开课日期", Type: ColumnTypeDate, Required: true},
+	}}
+	tests := []struct {
+		name  string
+		rules models.ValidationRules
+		sheet parsedSheet
+		want  []models.ValidationIssue
+	}{
+		{
+			name:  "valid",
+			rules: rules,
+			sheet: sheet(template, []string{"张三", "教授", "32", "2025-03-01"}),
+			want:  []models.ValidationIssue{},
+		},
+		{
+			name:  "bad cells",
+			rules: rules,
+			sheet: sheet(template,
+				[]string{"张三", "助教", "32", "2025-03-01"},
+				[]string{"", "讲师", "三十", "2025-03-01"},
+				[]string{"王五", "讲师", "300", "下周"}),
+			want: []models.ValidationIssue{
+				{Cell: "B2", Column: "职称", Value: "助教", Message: "应为以下之一：讲师、教授"},
+				{Cell: "A3", Column: "姓名", Message: "必填项为空"},
+				{Cell: "C3", Column: "工作量", Value: "三十", Message: "应为数字"},
+				{Cell: "C4", Column: "工作量", Value: "300", Message: "应不大于 200"},
+				{Cell: "D4", Column: "开课日期", Value: "下周", Message: "应为日期，例如 2025-03-01"},
+			},
+		},
+		{
+			name:  "missing columns",
+			rules: rules,
+			sheet: sheet([]string{"姓名", "学时"}, []string{"张三", "-2"}),
+			want: []models.ValidationIssue{
+				{Column: "开课日期", Message: "缺少必填列"},
+				{Cell: "B2", Column: "工作量", Value: "-2", Message: "应不小于 0"},
+			},
+		},
+		{
+			name:  "row counts",
+			rules: models.ValidationRules{MinRows: 2},
+			sheet: sheet(template, []string{"张三", "教授", "32", "2025-03-01"}),
+			want:  []models.ValidationIssue{{Message: "数据行数为 1，至少需要 2 行"}},
+		},
+		{
+			name:  "too many rows",
+			rules: models.ValidationRules{MaxRows: 1},
+			sheet: sheet(template, []string{"张三"}, []string{"李四"}),
+			want:  []models.ValidationIssue{{Message: "数据行数为 2，最多允许 1 行"}},
+		},
+		{
+			name:  "empty worksheet",
+			rules: rules,
+			sheet: parsedSheet{},
+			want:  []models.ValidationIssue{{Message: "工作表为空"}},
+		},
+	}
+	for _, tt := range tests {
+		schema := newColumnSchema(template, aliases, true)
+		if got := validateSheet(schema, tt.rules, tt.sheet); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: validateSheet = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildValidationFeedback(t *testing.T) {
+	p := models.Project{ID: 1, Name: "2025年度工作量汇总", EmailSubjectTemplate: "请{{teacher_name}}老师填写{{project_name}}", CreatedBy: 2}
+	issues := make([]models.ValidationIssue, maxFeedbackIssues+3)
+	for i := range issues {
+		issues[i] = models.ValidationIssue{Cell: "C2", Column: "学时", Value: "x", Message: "应为数字"}
+	}
+	msg := BuildValidationFeedback(p, 3, "张三", "zhang@school.test", []attachmentIssues{{Filename: "工作量.xlsx", Issues: issues}})
+
+	if want := "数据校验未通过: 请张三老师填写2025年度工作量汇总"; msg.Subject != want {
+		t.Errorf("Subject = %q, want %q", msg.Subject, want)
+	}
+	if !strings.Contains(msg.Body, "C2 [学时] 应为数字（当前值：x）") || !strings.Contains(msg.Body, "另有 3 处问题") {
+		t.Errorf("Body = %q", msg.Body)
+	}
+	if msg.ToEmail != "zhang@school.test" || msg.TeacherID != 3 || msg.UserID != 2 {
+		t.Errorf("message = %+v", msg)
+	}
+}
+
+func TestBuildReminder(t *testing.T) {
+	p := models.Project{Name: "2025年度工作量汇总", EmailSubjectTemplate: "{{Project_Name}}", EmailBodyTemplate: "{{teacher_name}}老师您好"}
+	msg := BuildReminder(p, 3, "张三", "zhang@school.test")
+	if msg.Subject != "催促提醒: 2025年度工作量汇总" {
+		t.Errorf("Subject = %q", msg.Subject)
+	}
+	if strings.Contains(msg.Body, "{{") || !strings.Contains(msg.Body, "张三老师您好") {
+		t.Errorf("Body = %q", msg.Body)
+	}
+}
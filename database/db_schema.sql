@@ -31,6 +31,9 @@ CREATE TABLE
         email VARCHAR(255) NOT NULL UNIQUE,
         department_id INT,
         phone VARCHAR(50),
+        email_status VARCHAR(20) NOT NULL DEFAULT 'ok', -- ok | bounced (退信，邮箱地址可疑)
+        email_bounce_reason VARCHAR(500), -- 退信状态码及诊断信息
+        email_bounced_at DATETIME,
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
         FOREIGN KEY (department_id) REFERENCES departments (id) ON DELETE SET NULL
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -47,11 +50,18 @@ CREATE TABLE
         smtp_port VARCHAR(10),
         smtp_username VARCHAR(255),
         smtp_password VARCHAR(255),
+        smtp_security VARCHAR(20) DEFAULT 'tls', -- tls (隐式 TLS) | starttls | none
+        smtp_skip_verify BOOLEAN DEFAULT FALSE, -- 是否跳过 SMTP 服务器证书校验
+        mail_protocol VARCHAR(10) DEFAULT 'imap', -- 收信协议: imap | pop3，两者都使用 imap_* 的服务器与账号设置
         imap_host VARCHAR(255),
         imap_port VARCHAR(10),
         imap_username VARCHAR(255),
         imap_password VARCHAR(255),
         email_address VARCHAR(255),
+        plus_addressing BOOLEAN DEFAULT FALSE, -- 发信时 Reply-To 使用 地址+项目代码 (如 office+DB2024@example.com)
+        mailbox_action VARCHAR(10) DEFAULT 'none', -- 处理后的邮件: none 保留 | move 移入文件夹 | flag 加星标
+        processed_folder VARCHAR(255), -- 已处理回复的上级文件夹，按项目代码分子文件夹，默认 DB_Intro
+        unmatched_folder VARCHAR(255), -- 无法识别项目的邮件移入的文件夹，默认 DB_Intro/Unmatched
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
 
@@ -67,6 +77,8 @@ CREATE TABLE
         email_subject_template VARCHAR(255),
         email_body_template TEXT,
         excel_template_filename VARCHAR(255), -- 存储在 file storage 下的模板文件名
+        aggregation_settings JSON, -- 汇总设置，例如 {"column_aliases":{"工作量":["课时","学时"]}}
+        validation_rules JSON, -- 附件校验规则：必填列、类型 (number/date/enum)、取值范围、行数限制、是否自动发送修改意见
         created_by INT NOT NULL, -- 管理员 user id
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
         FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE
@@ -82,7 +94,7 @@ CREATE TABLE
         teacher_id INT NOT NULL,
         invited_at DATETIME DEFAULT CURRENT_TIMESTAMP,
         sent_at DATETIME, -- 邮件发送时间
-        current_status VARCHAR(50) DEFAULT 'pending', -- pending | replied | ignored
+        current_status VARCHAR(50) DEFAULT 'pending', -- pending | replied | auto_replied (仅收到自动回复/外出答复) | needs_revision (提交的表格未通过校验) | bounced (退信) | ignored
         last_reply_at DATETIME,
         UNIQUE KEY uq_project_teacher (project_id, teacher_id),
         FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
@@ -118,6 +130,53 @@ CREATE TABLE
         FOREIGN KEY (teacher_id) REFERENCES teachers (id) ON DELETE CASCADE
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
 
+-- Email Jobs: 每次发送/催办任务，进度由其下的 outbound_emails 汇总得出
+DROP TABLE IF EXISTS email_jobs;
+
+CREATE TABLE
+    email_jobs (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        project_id INT NOT NULL,
+        created_by INT,
+        kind VARCHAR(20) NOT NULL, -- dispatch | reminder | feedback (校验未通过的修改意见)
+        status VARCHAR(20) NOT NULL DEFAULT 'queued', -- queued | running | completed
+        total_count INT NOT NULL DEFAULT 0,
+        started_at DATETIME, -- 第一封邮件开始发送的时间
+        finished_at DATETIME, -- 所有邮件均已发送或最终失败的时间
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Outbound Emails: 持久化的发件队列，由后台 worker 发送并在失败时退避重试
+DROP TABLE IF EXISTS outbound_emails;
+
+CREATE TABLE
+    outbound_emails (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        project_id INT NOT NULL,
+        teacher_id INT NOT NULL,
+        user_id INT NOT NULL, -- 使用哪个用户的 SMTP 配置发送
+        job_id INT, -- 所属 email_jobs 任务
+        dispatch_id INT, -- 所属 dispatch（催办邮件为空）
+        kind VARCHAR(20) NOT NULL, -- dispatch | reminder | feedback (校验未通过的修改意见)
+        to_email VARCHAR(255) NOT NULL,
+        subject VARCHAR(255),
+        body TEXT,
+        attachment_path VARCHAR(500),
+        status VARCHAR(20) NOT NULL DEFAULT 'queued', -- queued | sending | sent | failed | unknown (重启时正在发送，可能已送达，需手动重试)
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT,
+        message_id VARCHAR(255), -- 发送成功后的 Message-ID
+        next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        sent_at DATETIME,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+        FOREIGN KEY (teacher_id) REFERENCES teachers (id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+        FOREIGN KEY (job_id) REFERENCES email_jobs (id) ON DELETE CASCADE,
+        FOREIGN KEY (dispatch_id) REFERENCES dispatches (id) ON DELETE SET NULL
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
 -- Replies: 从邮件服务器解析到的一封回复（按邮件 message-id）
 DROP TABLE IF EXISTS replies;
 
@@ -131,8 +190,10 @@ CREATE TABLE
         message_id VARCHAR(255) UNIQUE, -- 邮件服务器的 message-id
         in_reply_to VARCHAR(255),
         received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-        raw_headers JSON,
-        raw_body LONGTEXT,
+        raw_headers JSON, -- 全部邮件头，{"Header-Name": ["值", ...]}
+        raw_body LONGTEXT, -- 原始正文（优先 text/plain，否则 text/html）
+        body_text LONGTEXT, -- 去除引用历史后的纯文本正文
+        is_auto_reply BOOLEAN DEFAULT FALSE, -- 自动回复/外出答复（Auto-Submitted、X-Autoreply、Precedence: auto_reply 邮件头或主题的自动回复前缀识别），其附件不参与汇总
         FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
         FOREIGN KEY (teacher_id) REFERENCES teachers (id)
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -146,16 +207,179 @@ CREATE TABLE
         reply_id INT,
         project_id INT NOT NULL,
         teacher_id INT,
-        original_filename VARCHAR(255),
-        stored_path VARCHAR(500) NOT NULL, -- 本地或云存储路径
+        parent_attachment_id INT, -- 从压缩包附件 (zip/rar/7z) 中解压出的文件指向该压缩包
+        original_filename VARCHAR(255), -- 解压出的文件为其在压缩包内的路径
+        stored_path VARCHAR(500) NOT NULL, -- 本地或云存储路径，被拒收的附件为空
         content_type VARCHAR(100),
-        file_size INT,
-        parsed BOOLEAN DEFAULT FALSE,
+        file_size BIGINT,
+        status VARCHAR(20) NOT NULL DEFAULT 'stored', -- stored | rejected (超过大小限制等，未保存文件)
+        reject_reason VARCHAR(255),
+        extract_error VARCHAR(500), -- 压缩包未能完整解压的原因（超出文件数或总大小限制、文件损坏、路径不安全等），已解压的文件仍保留
+        validation_status VARCHAR(20), -- valid | invalid，项目未配置校验规则或非 Excel 文件时为空
+        validation_errors JSON, -- 未通过的检查，[{"cell":"C5","column":"工作量","value":"abc","message":"应为数字"}]
+        parse_status VARCHAR(20), -- ok | failed，解析 Excel 的结果（支持 .xlsx/.xlsm/.xls/.xlsb），非 Excel 文件为空
+        parse_error VARCHAR(500), -- 读取失败的原因
+        parsed BOOLEAN DEFAULT FALSE, -- 已解析入 submission_rows；修改列别名后重置并在后台重新解析（汇总前也会补解析）
         parsed_at DATETIME,
+        parsed_columns JSON, -- 解析出的列（模板表头，无模板时为附件自身表头），按工作表中的顺序
+        unmapped_columns JSON, -- 与模板表头对应不上、未入库的列
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
         FOREIGN KEY (reply_id) REFERENCES replies (id) ON DELETE CASCADE,
         FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
-        FOREIGN KEY (teacher_id) REFERENCES teachers (id)
+        FOREIGN KEY (teacher_id) REFERENCES teachers (id),
+        FOREIGN KEY (parent_attachment_id) REFERENCES attachments (id) ON DELETE CASCADE
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Submission rows: Excel 附件解析后的数据行，汇总从此表生成而不再重新打开文件
+DROP TABLE IF EXISTS submission_rows;
+
+CREATE TABLE
+    submission_rows (
+        id BIGINT AUTO_INCREMENT PRIMARY KEY,
+        project_id INT NOT NULL,
+        teacher_id INT,
+        attachment_id INT NOT NULL,
+        row_index INT NOT NULL, -- 在工作表中的行号，从 1 开始
+        data JSON NOT NULL, -- 单元格值，以模板表头为键，如 {"姓名":"张三","工作量":{"v":"12","t":"n","n":12}}；文本单元格为字符串，数字/日期/布尔值带类型 t、数值 n、数字格式 f 与公式 fx；空单元格省略
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+        FOREIGN KEY (teacher_id) REFERENCES teachers (id),
+        FOREIGN KEY (attachment_id) REFERENCES attachments (id) ON DELETE CASCADE
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Submissions: 教师对同一项目的每次 Excel 提交（带 Excel 附件的回复）按收到顺序编号，
+-- 汇总默认使用每位教师最新的未校验失败版本，可固定到指定版本
+DROP TABLE IF EXISTS submissions;
+
+CREATE TABLE
+    submissions (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        project_id INT NOT NULL,
+        teacher_id INT NOT NULL,
+        reply_id INT NOT NULL,
+        version INT NOT NULL, -- 该教师在项目中的第几次提交，从 1 开始
+        validation_status VARCHAR(20), -- valid | invalid，项目未配置校验规则时为空
+        pinned BOOLEAN NOT NULL DEFAULT FALSE, -- 用户固定用于汇总的版本，每位教师至多一个
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE KEY uq_submission_version (project_id, teacher_id, version),
+        UNIQUE KEY uq_submission_reply (reply_id),
+        FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+        FOREIGN KEY (teacher_id) REFERENCES teachers (id),
+        FOREIGN KEY (reply_id) REFERENCES replies (id) ON DELETE CASCADE
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Unmatched emails: 无法自动归属到项目的来信，等待人工分拣（指派到项目/教师或忽略）
+DROP TABLE IF EXISTS unmatched_email_attachments;
+
+DROP TABLE IF EXISTS unmatched_emails;
+
+CREATE TABLE
+    unmatched_emails (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        user_id INT NOT NULL, -- 收件邮箱所属用户
+        from_email VARCHAR(255) NOT NULL,
+        subject VARCHAR(255),
+        message_id VARCHAR(255),
+        in_reply_to VARCHAR(255),
+        received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        raw_headers JSON,
+        raw_body LONGTEXT,
+        body_text LONGTEXT,
+        teacher_id INT, -- 按发件地址匹配到的教师
+        candidate_project_ids JSON, -- 发件教师参与的多个进行中项目（歧义时）
+        status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending | assigned | dismissed
+        project_id INT, -- 指派到的项目
+        reply_id INT, -- 指派后生成的 replies 记录
+        ingest_error VARCHAR(500), -- 无法解析或超过大小上限的邮件记录原因，此时 raw_body 仅保存原文开头或邮件头
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        resolved_at DATETIME,
+        UNIQUE KEY uq_unmatched_user_message (user_id, message_id),
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+        FOREIGN KEY (teacher_id) REFERENCES teachers (id) ON DELETE SET NULL,
+        FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE SET NULL,
+        FOREIGN KEY (reply_id) REFERENCES replies (id) ON DELETE SET NULL
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE
+    unmatched_email_attachments (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        unmatched_email_id INT NOT NULL,
+        original_filename VARCHAR(255),
+        stored_path VARCHAR(500) NOT NULL,
+        content_type VARCHAR(100),
+        file_size BIGINT,
+        status VARCHAR(20) NOT NULL DEFAULT 'stored', -- stored | rejected
+        reject_reason VARCHAR(255),
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (unmatched_email_id) REFERENCES unmatched_emails (id) ON DELETE CASCADE
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Email bounces: 退信（DSN）记录，按原邮件 Message-ID 关联到 sent_emails
+DROP TABLE IF EXISTS email_bounces;
+
+CREATE TABLE
+    email_bounces (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        user_id INT NOT NULL,
+        message_id VARCHAR(255), -- 退信本身的 Message-ID
+        original_message_id VARCHAR(255), -- 被退回的原邮件 Message-ID
+        project_id INT,
+        teacher_id INT,
+        recipient VARCHAR(255), -- 投递失败的地址 (Final-Recipient)
+        status_code VARCHAR(20), -- 如 5.1.1
+        diagnostic TEXT, -- Diagnostic-Code
+        received_at DATETIME,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE KEY uq_bounce_user_message (user_id, message_id),
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+        FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE SET NULL,
+        FOREIGN KEY (teacher_id) REFERENCES teachers (id) ON DELETE SET NULL
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Scheduled reminders: 根据外出自动回复中的返回日期，计划在返回后次日自动催办
+DROP TABLE IF EXISTS scheduled_reminders;
+
+CREATE TABLE
+    scheduled_reminders (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        project_id INT NOT NULL,
+        teacher_id INT NOT NULL,
+        source_reply_id INT, -- 触发计划的自动回复
+        due_at DATETIME NOT NULL,
+        status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending | queued | cancelled
+        job_id INT, -- 到期后生成的催办任务
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+        FOREIGN KEY (teacher_id) REFERENCES teachers (id) ON DELETE CASCADE,
+        FOREIGN KEY (source_reply_id) REFERENCES replies (id) ON DELETE SET NULL,
+        FOREIGN KEY (job_id) REFERENCES email_jobs (id) ON DELETE SET NULL
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Mailbox sync state: 记录每个用户邮箱文件夹的增量同步位置（IMAP UIDVALIDITY + 最后处理的 UID）
+DROP TABLE IF EXISTS mailbox_sync_state;
+
+CREATE TABLE
+    mailbox_sync_state (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        user_id INT NOT NULL,
+        mailbox VARCHAR(255) NOT NULL DEFAULT 'INBOX',
+        uid_validity BIGINT UNSIGNED NOT NULL DEFAULT 0, -- UIDVALIDITY 变化时需全量重新同步
+        last_uid BIGINT UNSIGNED NOT NULL DEFAULT 0,
+        last_synced_at DATETIME,
+        UNIQUE KEY uq_user_mailbox (user_id, mailbox),
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+    ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+DROP TABLE IF EXISTS pop3_seen_uids;
+
+CREATE TABLE
+    pop3_seen_uids (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        user_id INT NOT NULL,
+        uidl VARCHAR(255) NOT NULL, -- POP3 UIDL，已处理的邮件不再下载；服务器上删除后随之清除
+        seen_at DATETIME,
+        UNIQUE KEY uq_user_uidl (user_id, uidl),
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
     ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
 
 -- 索引建议
@@ -167,5 +391,15 @@ CREATE INDEX idx_replies_project ON replies (project_id);
 
 CREATE INDEX idx_attachments_project ON attachments (project_id);
 
+CREATE INDEX idx_submission_rows_project ON submission_rows (project_id, attachment_id, row_index);
+
+CREATE INDEX idx_unmatched_emails_status ON unmatched_emails (user_id, status);
+
+CREATE INDEX idx_scheduled_reminders_due ON scheduled_reminders (status, due_at);
+
+CREATE INDEX idx_outbound_emails_due ON outbound_emails (status, next_attempt_at);
+
+CREATE INDEX idx_email_jobs_project ON email_jobs (project_id);
+
 SET
     FOREIGN_KEY_CHECKS = 1;
\ No newline at end of file
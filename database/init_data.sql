@@ -29,12 +29,12 @@ VALUES
 INSERT INTO
     users (
         username, password, 
-        smtp_host, smtp_port, smtp_username, smtp_password, 
+        smtp_host, smtp_port, smtp_username, smtp_password, smtp_security,
         imap_host, imap_port, imap_username, imap_password, email_address
     )
 VALUES
     (
         'admin', '$2a$10$l570xRhUYWPIHUShwUup5.Wqfkgs6NawDzn34zA3eRwCZlVP8uhpC', 
-        'smtp.163.com', '587', '19857338587@163.com', 'WUb4GAbRrYp25tK6', 
+        'smtp.163.com', '587', '19857338587@163.com', 'WUb4GAbRrYp25tK6', 'starttls',
         'imap.163.com', '993', '19857338587@163.com', 'WUb4GAbRrYp25tK6', '19857338587@163.com'
     );
@@ -6,6 +6,7 @@ import Projects from './pages/Projects';
 import ProjectDetail from './pages/ProjectDetail';
 import Teachers from './pages/Teachers';
 import Settings from './pages/Settings';
+import Unmatched from './pages/Unmatched';
 
 function PrivateRoute({ children }) {
   const token = localStorage.getItem('token');
@@ -30,6 +31,7 @@ function App() {
           <Route path="projects" element={<Projects />} />
           <Route path="projects/:id" element={<ProjectDetail />} />
           <Route path="teachers" element={<Teachers />} />
+          <Route path="unmatched" element={<Unmatched />} />
           <Route path="settings" element={<Settings />} />
         </Route>
       </Routes>
@@ -30,11 +30,87 @@ export const projectsAPI = {
   addMembers: (id, data) => api.post(`/projects/${id}/members`, data),
   dispatch: (id) => api.post(`/projects/${id}/dispatch`),
   getTracking: (id) => api.get(`/projects/${id}/tracking`),
+  getReplies: (id, params) => api.get(`/projects/${id}/replies`, { params }),
   remind: (id, data) => api.post(`/projects/${id}/remind`, data),
   fetchEmails: (id) => api.post(`/projects/${id}/fetch-emails`),
   aggregate: (id) => api.post(`/projects/${id}/aggregate`),
   download: (id) =>
     api.get(`/projects/${id}/download`, { responseType: "blob" }),
+  getData: (id, params) => api.get(`/projects/${id}/data`, { params }),
+  getAggregationSettings: (id) => api.get(`/projects/${id}/aggregation-settings`),
+  updateAggregationSettings: (id, data) =>
+    api.put(`/projects/${id}/aggregation-settings`, data),
+  getValidationRules: (id) => api.get(`/projects/${id}/validation-rules`),
+  updateValidationRules: (id, data) =>
+    api.put(`/projects/${id}/validation-rules`, data),
+  getSubmissions: (id, params) =>
+    api.get(`/projects/${id}/submissions`, { params }),
+  pinSubmission: (id, submissionId) =>
+    api.post(`/projects/${id}/submissions/${submissionId}/pin`),
+  unpinSubmission: (id, submissionId) =>
+    api.delete(`/projects/${id}/submissions/${submissionId}/pin`),
+  getJobs: (id) => api.get(`/projects/${id}/jobs`),
+};
+
+// Reads a job's Server-Sent Events stream. EventSource cannot send the
+// Authorization header, so the stream is consumed through fetch instead.
+// Returns a function that stops listening.
+const streamJob = (id, onEvent) => {
+  const controller = new AbortController();
+  const token = localStorage.getItem("token");
+
+  fetch(`/api/jobs/${id}/events`, {
+    headers: token ? { Authorization: `Bearer ${token}` } : {},
+    signal: controller.signal,
+  })
+    .then(async (res) => {
+      if (!res.ok || !res.body) return;
+      const reader = res.body.getReader();
+      const decoder = new TextDecoder();
+      let buffer = "";
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) break;
+        buffer += decoder.decode(value, { stream: true });
+        let sep;
+        while ((sep = buffer.indexOf("\n\n")) !== -1) {
+          const chunk = buffer.slice(0, sep);
+          buffer = buffer.slice(sep + 2);
+          let event = "message";
+          let data = "";
+          chunk.split("\n").forEach((line) => {
+            if (line.startsWith("event:")) event = line.slice(6).trim();
+            else if (line.startsWith("data:")) data += line.slice(5).trim();
+          });
+          if (data) onEvent(event, JSON.parse(data));
+        }
+      }
+    })
+    .catch((err) => {
+      if (err.name !== "AbortError") console.error("任务进度流中断：", err);
+    });
+
+  return () => controller.abort();
+};
+
+export const jobsAPI = {
+  get: (id) => api.get(`/jobs/${id}`),
+  stream: streamJob,
+};
+
+export const unmatchedAPI = {
+  getAll: (params) => api.get("/unmatched-emails", { params }),
+  assign: (id, data) => api.post(`/unmatched-emails/${id}/assign`, data),
+  dismiss: (id) => api.post(`/unmatched-emails/${id}/dismiss`),
+};
+
+export const importAPI = {
+  importEmails: (files, dryRun) => {
+    const form = new FormData();
+    files.forEach((f) => form.append("files", f));
+    form.append("dry_run", dryRun ? "true" : "false");
+    return api.post("/import-emails", form);
+  },
 };
 
 export const teachersAPI = {
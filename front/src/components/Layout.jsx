@@ -50,6 +50,13 @@ function Layout() {
                     >
                         <i className="fas fa-users mr-2"></i> 教师信息库
                     </button>
+                    <button
+                        onClick={() => navigate('/unmatched')}
+                        className={`w-full text-left block px-4 py-2 rounded hover:bg-gray-100 transition ${currentPath.startsWith('/unmatched') ? 'bg-blue-50 text-blue-600' : ''
+                            }`}
+                    >
+                        <i className="fas fa-inbox mr-2"></i> 待分拣邮件
+                    </button>
                     <button
                         onClick={() => navigate('/settings')}
                         className={`w-full text-left block px-4 py-2 rounded hover:bg-gray-100 transition ${currentPath.startsWith('/settings') ? 'bg-blue-50 text-blue-600' : ''
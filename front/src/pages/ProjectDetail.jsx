@@ -1,6 +1,68 @@
-import { useState, useEffect } from 'react'
+import { useState, useEffect, useRef } from 'react'
 import { useParams, useNavigate } from 'react-router-dom'
-import { projectsAPI, teachersAPI } from '../api'
+import { projectsAPI, teachersAPI, jobsAPI } from '../api'
+
+// Files unpacked from an archive are listed after it with their path inside
+const attachmentLabel = (a) => {
+    let label = a.parent_id ? `↳ ${a.original_filename}` : a.original_filename
+    if (a.status === 'rejected') label += '（已拒收：超出大小限制）'
+    if (a.extract_error) label += `（未完整解压：${a.extract_error}）`
+    if (a.validation_status === 'invalid') label += '（未通过校验）'
+    if (a.parse_status === 'failed') label += `（无法读取：${a.parse_error}）`
+    return label
+}
+
+const provenanceOptions = [
+    ['teacher_name', '教师姓名'],
+    ['teacher_email', '教师邮箱'],
+    ['department', '所在系'],
+    ['reply_time', '回复时间'],
+    ['source_file', '来源文件'],
+]
+
+const emptyColumnRule = { header: '', type: 'text', required: false, min: '', max: '', values: [] }
+
+// Column aliases are edited as one "模板表头 = 别名1, 别名2" line per header
+const aliasesToText = (aliases) =>
+    Object.entries(aliases || {})
+        .map(([header, list]) => `${header} = ${list.join(', ')}`)
+        .join('\n')
+
+const textToAliases = (text) => {
+    const aliases = {}
+    text.split('\n').forEach((line) => {
+        const [header, list] = line.split('=')
+        if (!header?.trim() || list === undefined) return
+        aliases[header.trim()] = list.split(/[,，]/).map((a) => a.trim()).filter(Boolean)
+    })
+    return aliases
+}
+
+// Summary sheets are edited as one "表名 | 分组列1, 分组列2 | sum:工作量, count" line per sheet
+const summariesToText = (summaries) =>
+    (summaries || [])
+        .map((spec) => {
+            const measures = spec.measures.map((m) => (m.column ? `${m.func}:${m.column}` : m.func))
+            return `${spec.name} | ${spec.group_by.join(', ')} | ${measures.join(', ')}`
+        })
+        .join('\n')
+
+const textToSummaries = (text) =>
+    text
+        .split('\n')
+        .filter((line) => line.trim())
+        .map((line) => {
+            const [name, groupBy = '', measures = ''] = line.split('|')
+            const split = (list) => list.split(/[,，]/).map((a) => a.trim()).filter(Boolean)
+            return {
+                name: name.trim(),
+                group_by: split(groupBy),
+                measures: split(measures).map((m) => {
+                    const [func, ...column] = m.split(/[:：]/)
+                    return { func: func.trim().toLowerCase(), column: column.join(':').trim() }
+                }),
+            }
+        })
 
 function ProjectDetail() {
     const { id } = useParams()
@@ -12,12 +74,61 @@ function ProjectDetail() {
     const [addMemberForm, setAddMemberForm] = useState({
         teacher_ids: [],
     })
+    const [activeJob, setActiveJob] = useState(null)
+    const [viewingReplies, setViewingReplies] = useState(null)
+    const [aggregation, setAggregation] = useState(null)
+    const [settingsForm, setSettingsForm] = useState(null)
+    const [rulesForm, setRulesForm] = useState(null)
+    const [dataView, setDataView] = useState(null)
+    const stopJobStream = useRef(null)
 
     useEffect(() => {
         loadProject()
         loadTeachers()
+        loadRunningJob()
+        return () => stopJobStream.current?.()
+    }, [id])
+
+    // Replies are picked up in the background (IMAP IDLE), so keep the
+    // tracking table current without a manual refresh
+    useEffect(() => {
+        const timer = setInterval(loadTracking, 15000)
+        return () => clearInterval(timer)
     }, [id])
 
+    const loadTracking = async () => {
+        try {
+            const res = await projectsAPI.getTracking(id)
+            setActiveProjectRecords(res.data?.data?.details || [])
+        } catch (err) {
+            console.error('刷新状态失败：', err)
+        }
+    }
+
+    const watchJob = (jobId) => {
+        stopJobStream.current?.()
+        stopJobStream.current = jobsAPI.stream(jobId, (event, job) => {
+            setActiveJob(job)
+            if (event === 'done') {
+                stopJobStream.current = null
+                loadProject()
+            }
+        })
+    }
+
+    const loadRunningJob = async () => {
+        try {
+            const res = await projectsAPI.getJobs(id)
+            const latest = (res.data?.data || [])[0]
+            if (latest && !latest.finished_at) {
+                setActiveJob(latest)
+                watchJob(latest.id)
+            }
+        } catch (err) {
+            console.error('加载任务失败：', err)
+        }
+    }
+
     const loadProject = async () => {
         try {
             const res = await projectsAPI.getById(id)
@@ -29,6 +140,37 @@ function ProjectDetail() {
         }
     }
 
+    const viewReplies = async (record) => {
+        try {
+            const [res, subs] = await Promise.all([
+                projectsAPI.getReplies(id, { teacher_id: record.teacher_id }),
+                projectsAPI.getSubmissions(id, { teacher_id: record.teacher_id }),
+            ])
+            setViewingReplies({
+                teacherId: record.teacher_id,
+                name: record.name,
+                replies: res.data?.data || [],
+                submissions: subs.data?.data || [],
+            })
+        } catch (err) {
+            alert('加载回复失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
+    const togglePin = async (submission) => {
+        try {
+            if (submission.pinned) {
+                await projectsAPI.unpinSubmission(id, submission.id)
+            } else {
+                await projectsAPI.pinSubmission(id, submission.id)
+            }
+            const res = await projectsAPI.getSubmissions(id, { teacher_id: viewingReplies.teacherId })
+            setViewingReplies({ ...viewingReplies, submissions: res.data?.data || [] })
+        } catch (err) {
+            alert('操作失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
     const loadTeachers = async () => {
         try {
             const res = await teachersAPI.getAll()
@@ -41,8 +183,12 @@ function ProjectDetail() {
     const dispatchEmails = async () => {
         if (!activeProject) return
         try {
-            await projectsAPI.dispatch(activeProject.id)
-            alert('邮件发送任务已启动！')
+            const res = await projectsAPI.dispatch(activeProject.id)
+            if (res.data?.job_id) {
+                watchJob(res.data.job_id)
+            } else {
+                alert(res.data?.message || '没有待发送的邮件')
+            }
             loadProject()
         } catch (err) {
             alert('发送失败：' + (err.response?.data?.error || err.message))
@@ -64,8 +210,12 @@ function ProjectDetail() {
     const remindAll = async () => {
         if (!activeProject) return
         try {
-            await projectsAPI.remind(activeProject.id, {})
-            alert('催办邮件已发送！')
+            const res = await projectsAPI.remind(activeProject.id, {})
+            if (res.data?.job_id) {
+                watchJob(res.data.job_id)
+            } else {
+                alert(res.data?.message || '没有需要催办的教师')
+            }
         } catch (err) {
             alert('催办失败：' + (err.response?.data?.error || err.message))
         }
@@ -74,7 +224,8 @@ function ProjectDetail() {
     const remindOne = async (record) => {
         if (!activeProject) return
         try {
-            await projectsAPI.remind(activeProject.id, { target_ids: [record.teacher_id] })
+            const res = await projectsAPI.remind(activeProject.id, { target_ids: [record.teacher_id] })
+            if (res.data?.job_id) watchJob(res.data.job_id)
             alert(`已向 ${record.name} 发送催办邮件！`)
         } catch (err) {
             alert('催办失败：' + (err.response?.data?.error || err.message))
@@ -84,7 +235,8 @@ function ProjectDetail() {
     const aggregateData = async () => {
         if (!activeProject) return
         try {
-            await projectsAPI.aggregate(activeProject.id)
+            const result = await projectsAPI.aggregate(activeProject.id)
+            setAggregation(result.data)
             alert('数据汇总中，请稍后下载...')
             setTimeout(async () => {
                 const res = await projectsAPI.download(activeProject.id)
@@ -101,6 +253,82 @@ function ProjectDetail() {
         }
     }
 
+    const loadData = async (query) => {
+        const params = { page: query.page, page_size: 50, q: query.q || undefined }
+        if (query.sort) {
+            params.sort = query.sort
+            params.order = query.order
+        }
+        if (query.groupBy) params.group_by = query.groupBy
+        try {
+            const res = await projectsAPI.getData(id, params)
+            setDataView({ query, result: res.data?.data })
+        } catch (err) {
+            alert('加载数据失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
+    const sortData = (column) => {
+        const { query } = dataView
+        const order = query.sort === column && query.order === 'asc' ? 'desc' : 'asc'
+        loadData({ ...query, sort: column, order, page: 1 })
+    }
+
+    const openSettings = async () => {
+        try {
+            const res = await projectsAPI.getAggregationSettings(id)
+            const settings = res.data?.data || {}
+            setSettingsForm({
+                ...settings,
+                aliasesText: aliasesToText(settings.column_aliases),
+                summariesText: summariesToText(settings.summaries),
+            })
+        } catch (err) {
+            alert('加载汇总设置失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
+    const saveSettings = async () => {
+        const { aliasesText, summariesText, ...settings } = settingsForm
+        try {
+            await projectsAPI.updateAggregationSettings(id, {
+                ...settings,
+                column_aliases: textToAliases(aliasesText),
+                summaries: textToSummaries(summariesText),
+            })
+            setSettingsForm(null)
+        } catch (err) {
+            alert('保存失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
+    const openRules = async () => {
+        try {
+            const res = await projectsAPI.getValidationRules(id)
+            setRulesForm(res.data?.data || { columns: [], min_rows: 0, max_rows: 0, send_feedback: false })
+        } catch (err) {
+            alert('加载校验规则失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
+    const updateColumnRule = (index, changes) => {
+        const columns = rulesForm.columns.map((rule, i) => (i === index ? { ...rule, ...changes } : rule))
+        setRulesForm({ ...rulesForm, columns })
+    }
+
+    const saveRules = async () => {
+        try {
+            await projectsAPI.updateValidationRules(id, {
+                ...rulesForm,
+                min_rows: parseInt(rulesForm.min_rows) || 0,
+                max_rows: parseInt(rulesForm.max_rows) || 0,
+            })
+            setRulesForm(null)
+        } catch (err) {
+            alert('保存失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
     const addMembers = async () => {
         if (!activeProject) return
         try {
@@ -139,6 +367,24 @@ function ProjectDetail() {
                     >
                         <i className="fas fa-paper-plane mr-1"></i> 发送邮件
                     </button>
+                    <button
+                        onClick={openRules}
+                        className="bg-gray-100 text-gray-700 px-4 py-2 rounded hover:bg-gray-200 text-sm"
+                    >
+                        <i className="fas fa-check-square mr-1"></i> 校验规则
+                    </button>
+                    <button
+                        onClick={() => loadData({ page: 1, q: '', sort: '', order: 'asc', groupBy: '' })}
+                        className="bg-gray-100 text-gray-700 px-4 py-2 rounded hover:bg-gray-200 text-sm"
+                    >
+                        <i className="fas fa-table mr-1"></i> 浏览数据
+                    </button>
+                    <button
+                        onClick={openSettings}
+                        className="bg-gray-100 text-gray-700 px-4 py-2 rounded hover:bg-gray-200 text-sm"
+                    >
+                        <i className="fas fa-cog mr-1"></i> 汇总设置
+                    </button>
                     <button
                         onClick={aggregateData}
                         className="bg-green-600 text-white px-4 py-2 rounded hover:bg-green-700 text-sm"
@@ -148,6 +394,79 @@ function ProjectDetail() {
                 </div>
             </div>
 
+            {activeJob && (
+                <div className="mb-6 p-4 rounded border border-indigo-100 bg-indigo-50">
+                    <div className="flex justify-between text-sm mb-2">
+                        <span className="font-medium text-indigo-800">
+                            {{ reminder: '催办任务', feedback: '修改意见' }[activeJob.kind] || '发送任务'} #{activeJob.id}
+                            {activeJob.finished_at ? ' 已完成' : ' 进行中...'}
+                        </span>
+                        <span className="text-gray-600">
+                            成功 {activeJob.sent_count} / 失败 {activeJob.failed_count} / 共 {activeJob.total_count}
+                        </span>
+                    </div>
+                    <div className="w-full bg-white rounded-full h-3 overflow-hidden flex">
+                        <div
+                            className="bg-green-500 h-3"
+                            style={{ width: `${(activeJob.sent_count / Math.max(activeJob.total_count, 1)) * 100}%` }}
+                        ></div>
+                        <div
+                            className="bg-red-500 h-3"
+                            style={{ width: `${(activeJob.failed_count / Math.max(activeJob.total_count, 1)) * 100}%` }}
+                        ></div>
+                    </div>
+                    {activeJob.finished_at && (activeJob.recipients || [])
+                        .filter((r) => r.status === 'failed' || r.status === 'unknown')
+                        .map((r) => (
+                            <div key={r.teacher_id} className="text-xs text-red-700 mt-2">
+                                {r.teacher_name} ({r.email})：{r.last_error}
+                            </div>
+                        ))}
+                    {activeJob.finished_at && (
+                        <button
+                            onClick={() => setActiveJob(null)}
+                            className="text-xs text-gray-500 hover:text-gray-700 mt-2"
+                        >
+                            关闭
+                        </button>
+                    )}
+                </div>
+            )}
+
+            {aggregation && (
+                <div className="mb-6 p-4 rounded border border-green-100 bg-green-50 text-sm">
+                    <div className="flex justify-between mb-2">
+                        <span className="font-medium text-green-800">
+                            已汇总 {aggregation.attachments} 个附件、{aggregation.rows} 行数据
+                            {aggregation.template ? '（按项目模板表头对齐）' : '（项目无 Excel 模板，按各附件表头合并）'}
+                        </span>
+                        <button onClick={() => setAggregation(null)} className="text-xs text-gray-500 hover:text-gray-700">
+                            关闭
+                        </button>
+                    </div>
+                    {(aggregation.report || [])
+                        .filter((r) => r.error || r.unmapped_columns.length > 0 || r.missing_columns.length > 0)
+                        .map((r) => (
+                            <div key={r.attachment_id} className="text-xs text-gray-700 mt-1">
+                                <span className="font-medium">{r.teacher_name || '未知教师'} · {r.filename}</span>
+                                {r.error && <span className="text-red-700">：未汇总（{r.error}）</span>}
+                                {r.unmapped_columns.length > 0 && (
+                                    <span className="text-orange-700">；无法对应的列：{r.unmapped_columns.join('、')}</span>
+                                )}
+                                {r.missing_columns.length > 0 && (
+                                    <span className="text-red-700">；缺少的列：{r.missing_columns.join('、')}</span>
+                                )}
+                            </div>
+                        ))}
+                    {aggregation.summaries?.length > 0 && (
+                        <div className="text-xs text-gray-700 mt-1">汇总表：{aggregation.summaries.join('、')}</div>
+                    )}
+                    {(aggregation.summary_errors || []).map((e) => (
+                        <div key={e} className="text-xs text-red-700 mt-1">汇总表未生成：{e}</div>
+                    ))}
+                </div>
+            )}
+
             <div className="grid grid-cols-3 gap-6 mb-8">
                 <div className="bg-blue-50 p-4 rounded border border-blue-100">
                     <div className="text-gray-500 text-sm">总发送</div>
@@ -213,17 +532,25 @@ function ProjectDetail() {
                                     <span
                                         className={`px-2 inline-flex text-xs leading-5 font-semibold rounded-full ${record.status === 'replied'
                                             ? 'bg-green-100 text-green-800'
-                                            : 'bg-red-100 text-red-800'
+                                            : record.status === 'auto_replied'
+                                                ? 'bg-yellow-100 text-yellow-800'
+                                                : record.status === 'needs_revision'
+                                                    ? 'bg-purple-100 text-purple-800'
+                                                    : record.status === 'bounced'
+                                                        ? 'bg-gray-200 text-gray-800'
+                                                        : 'bg-red-100 text-red-800'
                                             }`}
                                     >
-                                        {record.status === 'replied' ? '已回复' : '未回复'}
+                                        {{ replied: '已回复', auto_replied: '自动回复', needs_revision: '需修改', bounced: '退信' }[record.status] || '未回复'}
                                     </span>
                                 </td>
                                 <td className="px-6 py-4 whitespace-nowrap text-sm text-gray-500">
                                     {record.reply_time || '-'}
                                 </td>
                                 <td className="px-6 py-4 whitespace-nowrap text-sm font-medium">
-                                    {record.status !== 'replied' ? (
+                                    {record.status === 'bounced' ? (
+                                        <span className="text-gray-400" title="请在教师信息库中修正邮箱地址">邮箱无效</span>
+                                    ) : record.status !== 'replied' && record.status !== 'needs_revision' ? (
                                         <button
                                             onClick={() => remindOne(record)}
                                             className="text-orange-600 hover:text-orange-900"
@@ -231,7 +558,12 @@ function ProjectDetail() {
                                             催办
                                         </button>
                                     ) : (
-                                        <span className="text-gray-400">已完成</span>
+                                        <button
+                                            onClick={() => viewReplies(record)}
+                                            className="text-blue-600 hover:text-blue-900"
+                                        >
+                                            查看回复
+                                        </button>
                                     )}
                                 </td>
                             </tr>
@@ -240,6 +572,404 @@ function ProjectDetail() {
                 </table>
             </div>
 
+            {/* Replies Modal */}
+            {viewingReplies && (
+                <div className="fixed inset-0 bg-gray-600 bg-opacity-50 overflow-y-auto h-full w-full flex items-center justify-center z-50">
+                    <div className="bg-white p-8 rounded-lg shadow-xl w-1/2 max-h-[90vh] overflow-y-auto">
+                        <h3 className="text-xl font-bold mb-4">{viewingReplies.name} 的回复</h3>
+                        {viewingReplies.submissions.length > 0 && (
+                            <div className="mb-4">
+                                <div className="font-medium mb-2">提交版本</div>
+                                <div className="space-y-1">
+                                    {viewingReplies.submissions.map((sub) => (
+                                        <div key={sub.id} className="flex items-center text-sm border rounded px-3 py-2">
+                                            <span className="font-medium mr-2">第 {sub.version} 版</span>
+                                            <span className="text-gray-500 mr-2">{new Date(sub.received_at).toLocaleString()}</span>
+                                            <span className="text-gray-600 flex-1 truncate">{sub.attachments.join('，')}</span>
+                                            {sub.validation_status === 'invalid' && (
+                                                <span className="ml-2 px-2 text-xs rounded-full bg-purple-100 text-purple-800">未通过校验</span>
+                                            )}
+                                            {sub.selected && (
+                                                <span className="ml-2 px-2 text-xs rounded-full bg-green-100 text-green-800">
+                                                    {sub.pinned ? '已固定用于汇总' : '用于汇总'}
+                                                </span>
+                                            )}
+                                            <button
+                                                onClick={() => togglePin(sub)}
+                                                className="ml-2 text-blue-600 hover:text-blue-900"
+                                            >
+                                                {sub.pinned ? '取消固定' : '固定此版本'}
+                                            </button>
+                                        </div>
+                                    ))}
+                                </div>
+                            </div>
+                        )}
+                        {viewingReplies.replies.length === 0 && <div className="text-gray-500">暂无回复内容</div>}
+                        <div className="space-y-4">
+                            {viewingReplies.replies.map((reply) => (
+                                <div key={reply.id} className="border rounded p-4">
+                                    <div className="font-bold">
+                                        {reply.subject || '(无主题)'}
+                                        {reply.is_auto_reply && (
+                                            <span className="ml-2 px-2 text-xs rounded-full bg-yellow-100 text-yellow-800">自动回复</span>
+                                        )}
+                                    </div>
+                                    <div className="text-sm text-gray-500 mb-2">
+                                        {reply.from_email} · {new Date(reply.received_at).toLocaleString()}
+                                    </div>
+                                    <pre className="text-sm text-gray-700 whitespace-pre-wrap bg-gray-50 p-2 rounded">
+                                        {reply.body_text || '(无正文)'}
+                                    </pre>
+                                    {reply.attachments.length > 0 && (
+                                        <div className="text-sm text-gray-600 mt-2">
+                                            <i className="fas fa-paperclip mr-1"></i>
+                                            {reply.attachments.map(attachmentLabel).join('，')}
+                                        </div>
+                                    )}
+                                    {reply.attachments
+                                        .filter((a) => a.validation_status === 'invalid')
+                                        .map((a) => (
+                                            <div key={a.id} className="text-xs text-purple-800 bg-purple-50 rounded p-2 mt-2">
+                                                <div className="font-medium mb-1">{a.original_filename} 未通过校验：</div>
+                                                {(a.validation_issues || []).map((issue, i) => (
+                                                    <div key={i}>
+                                                        {issue.cell && `${issue.cell} `}
+                                                        {issue.column && `[${issue.column}] `}
+                                                        {issue.message}
+                                                        {issue.value && `（当前值：${issue.value}）`}
+                                                    </div>
+                                                ))}
+                                            </div>
+                                        ))}
+                                </div>
+                            ))}
+                        </div>
+                        <div className="flex justify-end mt-6">
+                            <button
+                                onClick={() => setViewingReplies(null)}
+                                className="px-4 py-2 border rounded text-gray-600 hover:bg-gray-100"
+                            >
+                                关闭
+                            </button>
+                        </div>
+                    </div>
+                </div>
+            )}
+
+            {/* Data Modal */}
+            {dataView && (
+                <div className="fixed inset-0 bg-gray-600 bg-opacity-50 overflow-y-auto h-full w-full flex items-center justify-center z-50">
+                    <div className="bg-white p-8 rounded-lg shadow-xl w-11/12 max-h-[90vh] overflow-y-auto">
+                        <h3 className="text-xl font-bold mb-4">汇总数据</h3>
+                        <div className="flex space-x-2 mb-4">
+                            <input
+                                type="text"
+                                placeholder="搜索所有列"
+                                className="border rounded px-3 py-1 text-sm flex-1"
+                                value={dataView.query.q}
+                                onChange={(e) => setDataView({ ...dataView, query: { ...dataView.query, q: e.target.value } })}
+                                onKeyDown={(e) => e.key === 'Enter' && loadData({ ...dataView.query, page: 1 })}
+                            />
+                            <select
+                                className="border rounded px-2 py-1 text-sm"
+                                value={dataView.query.groupBy}
+                                onChange={(e) => loadData({ ...dataView.query, groupBy: e.target.value, page: 1 })}
+                            >
+                                <option value="">不分组</option>
+                                <option value="department">按系分组</option>
+                                <option value="teacher">按教师分组</option>
+                            </select>
+                            <button
+                                onClick={() => loadData({ ...dataView.query, page: 1 })}
+                                className="px-3 py-1 bg-blue-600 text-white rounded text-sm hover:bg-blue-700"
+                            >
+                                搜索
+                            </button>
+                        </div>
+                        {dataView.result.pending?.length > 0 && (
+                            <div className="text-xs text-orange-600 mb-2">
+                                {dataView.result.pending.length} 个附件正在解析，暂未计入：
+                                {dataView.result.pending.map((p) => `${p.teacher_name || '未知'} - ${p.filename}`).join('；')}
+                                （稍后刷新即可）
+                            </div>
+                        )}
+                        {dataView.result.groups && (
+                            <div className="text-xs text-gray-600 mb-2">
+                                {dataView.result.groups.map((g) => `${g.key || '未知'}：${g.count} 行`).join('；')}
+                            </div>
+                        )}
+                        <div className="overflow-x-auto">
+                            <table className="min-w-full text-sm border">
+                                <thead className="bg-gray-50">
+                                    <tr>
+                                        {['teacher_name', 'department'].map((key) => (
+                                            <th
+                                                key={key}
+                                                onClick={() => sortData(key)}
+                                                className="px-2 py-1 text-left whitespace-nowrap cursor-pointer"
+                                            >
+                                                {key === 'teacher_name' ? '教师姓名' : '所在系'}
+                                                {dataView.query.sort === key && (dataView.query.order === 'asc' ? ' ↑' : ' ↓')}
+                                            </th>
+                                        ))}
+                                        {dataView.result.headers.map((h) => (
+                                            <th
+                                                key={h}
+                                                onClick={() => sortData(h)}
+                                                className="px-2 py-1 text-left whitespace-nowrap cursor-pointer"
+                                            >
+                                                {h}
+                                                {dataView.query.sort === h && (dataView.query.order === 'asc' ? ' ↑' : ' ↓')}
+                                            </th>
+                                        ))}
+                                    </tr>
+                                </thead>
+                                <tbody>
+                                    {dataView.result.rows.map((row, i) => (
+                                        <tr key={i} className="border-t">
+                                            <td className="px-2 py-1 whitespace-nowrap">{row.teacher_name}</td>
+                                            <td className="px-2 py-1 whitespace-nowrap">{row.department}</td>
+                                            {dataView.result.headers.map((h) => (
+                                                <td key={h} className="px-2 py-1">{row.values[h] || ''}</td>
+                                            ))}
+                                        </tr>
+                                    ))}
+                                </tbody>
+                            </table>
+                        </div>
+                        {dataView.result.rows.length === 0 && <div className="text-gray-500 mt-2">暂无数据</div>}
+                        <div className="flex justify-between items-center mt-4 text-sm">
+                            <span className="text-gray-600">
+                                共 {dataView.result.total} 行，第 {dataView.result.page} /{' '}
+                                {Math.max(1, Math.ceil(dataView.result.total / dataView.result.page_size))} 页
+                            </span>
+                            <div className="space-x-2">
+                                <button
+                                    disabled={dataView.query.page <= 1}
+                                    onClick={() => loadData({ ...dataView.query, page: dataView.query.page - 1 })}
+                                    className="px-3 py-1 border rounded disabled:opacity-50"
+                                >
+                                    上一页
+                                </button>
+                                <button
+                                    disabled={dataView.query.page * dataView.result.page_size >= dataView.result.total}
+                                    onClick={() => loadData({ ...dataView.query, page: dataView.query.page + 1 })}
+                                    className="px-3 py-1 border rounded disabled:opacity-50"
+                                >
+                                    下一页
+                                </button>
+                                <button
+                                    onClick={() => setDataView(null)}
+                                    className="px-4 py-1 border rounded text-gray-600 hover:bg-gray-100"
+                                >
+                                    关闭
+                                </button>
+                            </div>
+                        </div>
+                    </div>
+                </div>
+            )}
+
+            {/* Validation Rules Modal */}
+            {rulesForm && (
+                <div className="fixed inset-0 bg-gray-600 bg-opacity-50 overflow-y-auto h-full w-full flex items-center justify-center z-50">
+                    <div className="bg-white p-8 rounded-lg shadow-xl w-2/3 max-h-[90vh] overflow-y-auto">
+                        <h3 className="text-xl font-bold mb-2">校验规则</h3>
+                        <p className="text-xs text-gray-500 mb-4">
+                            收到回复时逐个检查其中的 Excel 附件（表头按模板及列名别名对应）。未通过的教师状态为"需修改"，直到收到通过校验的新提交。
+                        </p>
+                        <table className="min-w-full text-sm mb-4">
+                            <thead>
+                                <tr className="text-left text-gray-500">
+                                    <th className="py-1">表头</th>
+                                    <th className="py-1">类型</th>
+                                    <th className="py-1">必填</th>
+                                    <th className="py-1">最小值 / 最早日期</th>
+                                    <th className="py-1">最大值 / 最晚日期</th>
+                                    <th className="py-1">可选值 (逗号分隔)</th>
+                                    <th></th>
+                                </tr>
+                            </thead>
+                            <tbody>
+                                {rulesForm.columns.map((rule, i) => (
+                                    <tr key={i}>
+                                        <td className="pr-2 py-1">
+                                            <input className="border rounded w-full p-1" value={rule.header}
+                                                onChange={(e) => updateColumnRule(i, { header: e.target.value })} />
+                                        </td>
+                                        <td className="pr-2 py-1">
+                                            <select className="border rounded p-1" value={rule.type || 'text'}
+                                                onChange={(e) => updateColumnRule(i, { type: e.target.value })}>
+                                                <option value="text">文本</option>
+                                                <option value="number">数字</option>
+                                                <option value="date">日期</option>
+                                                <option value="enum">枚举</option>
+                                            </select>
+                                        </td>
+                                        <td className="pr-2 py-1 text-center">
+                                            <input type="checkbox" checked={rule.required}
+                                                onChange={(e) => updateColumnRule(i, { required: e.target.checked })} />
+                                        </td>
+                                        <td className="pr-2 py-1">
+                                            <input className="border rounded w-full p-1" value={rule.min || ''}
+                                                disabled={rule.type !== 'number' && rule.type !== 'date'}
+                                                onChange={(e) => updateColumnRule(i, { min: e.target.value })} />
+                                        </td>
+                                        <td className="pr-2 py-1">
+                                            <input className="border rounded w-full p-1" value={rule.max || ''}
+                                                disabled={rule.type !== 'number' && rule.type !== 'date'}
+                                                onChange={(e) => updateColumnRule(i, { max: e.target.value })} />
+                                        </td>
+                                        <td className="pr-2 py-1">
+                                            <input className="border rounded w-full p-1" value={(rule.values || []).join(', ')}
+                                                disabled={rule.type !== 'enum'}
+                                                onChange={(e) => updateColumnRule(i, { values: e.target.value.split(/[,，]/).map((v) => v.trim()) })} />
+                                        </td>
+                                        <td className="py-1">
+                                            <button className="text-red-600 hover:text-red-800"
+                                                onClick={() => setRulesForm({ ...rulesForm, columns: rulesForm.columns.filter((_, j) => j !== i) })}>
+                                                删除
+                                            </button>
+                                        </td>
+                                    </tr>
+                                ))}
+                            </tbody>
+                        </table>
+                        <button
+                            onClick={() => setRulesForm({ ...rulesForm, columns: [...rulesForm.columns, { ...emptyColumnRule }] })}
+                            className="text-blue-600 hover:text-blue-800 text-sm mb-4"
+                        >
+                            <i className="fas fa-plus mr-1"></i> 添加列规则
+                        </button>
+                        <div className="flex space-x-4 items-center text-sm">
+                            <label>
+                                最少行数
+                                <input type="number" min="0" className="border rounded w-20 p-1 ml-2" value={rulesForm.min_rows}
+                                    onChange={(e) => setRulesForm({ ...rulesForm, min_rows: e.target.value })} />
+                            </label>
+                            <label>
+                                最多行数
+                                <input type="number" min="0" className="border rounded w-20 p-1 ml-2" value={rulesForm.max_rows}
+                                    onChange={(e) => setRulesForm({ ...rulesForm, max_rows: e.target.value })} />
+                            </label>
+                            <label className="inline-flex items-center">
+                                <input type="checkbox" className="mr-2" checked={rulesForm.send_feedback}
+                                    onChange={(e) => setRulesForm({ ...rulesForm, send_feedback: e.target.checked })} />
+                                自动邮件告知教师未通过的单元格
+                            </label>
+                        </div>
+                        <div className="mt-6 flex justify-end space-x-3">
+                            <button
+                                onClick={() => setRulesForm(null)}
+                                className="bg-gray-200 text-gray-700 px-4 py-2 rounded hover:bg-gray-300"
+                            >
+                                取消
+                            </button>
+                            <button
+                                onClick={saveRules}
+                                className="bg-blue-600 text-white px-4 py-2 rounded hover:bg-blue-700"
+                            >
+                                保存
+                            </button>
+                        </div>
+                    </div>
+                </div>
+            )}
+
+            {/* Aggregation Settings Modal */}
+            {settingsForm && (
+                <div className="fixed inset-0 bg-gray-600 bg-opacity-50 overflow-y-auto h-full w-full flex items-center justify-center z-50">
+                    <div className="bg-white p-8 rounded-lg shadow-xl w-1/2 max-h-[90vh] overflow-y-auto">
+                        <h3 className="text-xl font-bold mb-4">汇总设置</h3>
+                        <div className="space-y-4">
+                            <div>
+                                <label className="block text-sm font-medium text-gray-700">列名别名</label>
+                                <p className="text-xs text-gray-500 mb-1">
+                                    每行一个模板表头，格式为"模板表头 = 别名1, 别名2"。附件中的列按表头名称对应到模板列，忽略大小写、空格与全角/半角差异。
+                                </p>
+                                <textarea
+                                    className="mt-1 block w-full border border-gray-300 rounded-md shadow-sm p-2 h-40 font-mono text-sm"
+                                    value={settingsForm.aliasesText}
+                                    onChange={(e) => setSettingsForm({ ...settingsForm, aliasesText: e.target.value })}
+                                    placeholder="工作量 = 课时, 学时"
+                                />
+                            </div>
+                            <div>
+                                <label className="block text-sm font-medium text-gray-700">来源列 (写在数据列之前)</label>
+                                <div className="flex flex-wrap gap-4 mt-1 text-sm">
+                                    {provenanceOptions.map(([key, label]) => (
+                                        <label key={key} className="inline-flex items-center">
+                                            <input
+                                                type="checkbox"
+                                                className="mr-1"
+                                                checked={(settingsForm.provenance_columns || []).includes(key)}
+                                                onChange={(e) => {
+                                                    const selected = (settingsForm.provenance_columns || []).filter((c) => c !== key)
+                                                    if (e.target.checked) selected.push(key)
+                                                    // Keep the columns in the order they are offered
+                                                    const ordered = provenanceOptions.map(([k]) => k).filter((k) => selected.includes(k))
+                                                    setSettingsForm({ ...settingsForm, provenance_columns: ordered })
+                                                }}
+                                            />
+                                            {label}
+                                        </label>
+                                    ))}
+                                </div>
+                            </div>
+                            <div>
+                                <label className="block text-sm font-medium text-gray-700">行顺序</label>
+                                <select
+                                    className="mt-1 border border-gray-300 rounded-md p-2 text-sm"
+                                    value={settingsForm.order_by || ''}
+                                    onChange={(e) => setSettingsForm({ ...settingsForm, order_by: e.target.value })}
+                                >
+                                    <option value="">按收到附件的先后</option>
+                                    <option value="department">按所在系、教师姓名</option>
+                                </select>
+                            </div>
+                            <div>
+                                <label className="block text-sm font-medium text-gray-700">公式</label>
+                                <select
+                                    className="mt-1 border border-gray-300 rounded-md p-2 text-sm"
+                                    value={settingsForm.formulas || ''}
+                                    onChange={(e) => setSettingsForm({ ...settingsForm, formulas: e.target.value })}
+                                >
+                                    <option value="">写入计算结果</option>
+                                    <option value="preserve">保留公式（仅引用本行单元格的公式）</option>
+                                </select>
+                            </div>
+                            <div>
+                                <label className="block text-sm font-medium text-gray-700">汇总表 (写在汇总数据之后的工作表)</label>
+                                <p className="text-xs text-gray-500 mb-1">
+                                    每行一个工作表，格式为"表名 | 分组列 | 统计"。分组列可用模板表头或 department、teacher_name、teacher_email；统计为 sum、count、avg、min、max 加冒号和数值列，单独的 count 统计行数。
+                                </p>
+                                <textarea
+                                    className="mt-1 block w-full border border-gray-300 rounded-md shadow-sm p-2 h-28 font-mono text-sm"
+                                    value={settingsForm.summariesText}
+                                    onChange={(e) => setSettingsForm({ ...settingsForm, summariesText: e.target.value })}
+                                    placeholder={'By Department | department | sum:工作量, count\nBy Teacher | department, teacher_name | sum:工作量'}
+                                />
+                            </div>
+                        </div>
+                        <div className="mt-6 flex justify-end space-x-3">
+                            <button
+                                onClick={() => setSettingsForm(null)}
+                                className="bg-gray-200 text-gray-700 px-4 py-2 rounded hover:bg-gray-300"
+                            >
+                                取消
+                            </button>
+                            <button
+                                onClick={saveSettings}
+                                className="bg-blue-600 text-white px-4 py-2 rounded hover:bg-blue-700"
+                            >
+                                保存
+                            </button>
+                        </div>
+                    </div>
+                </div>
+            )}
+
             {/* Add Member Modal */}
             {showAddMemberModal && (
                 <div className="fixed inset-0 bg-gray-600 bg-opacity-50 overflow-y-auto h-full w-full flex items-center justify-center z-50">
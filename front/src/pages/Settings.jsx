@@ -8,11 +8,18 @@ const Settings = () => {
         smtp_port: '',
         smtp_username: '',
         smtp_password: '',
+        smtp_security: 'tls',
+        smtp_skip_verify: false,
+        mail_protocol: 'imap',
         imap_host: '',
         imap_port: '',
         imap_username: '',
         imap_password: '',
-        email_address: ''
+        email_address: '',
+        plus_addressing: false,
+        mailbox_action: 'none',
+        processed_folder: '',
+        unmatched_folder: ''
     });
     const [loading, setLoading] = useState(true);
     const [message, setMessage] = useState('');
@@ -39,9 +46,11 @@ const Settings = () => {
         }
     };
 
+    const protocolLabel = config.mail_protocol === 'pop3' ? 'POP3' : 'IMAP';
+
     const handleChange = (e) => {
-        const { name, value } = e.target;
-        setConfig(prev => ({ ...prev, [name]: value }));
+        const { name, value, type, checked } = e.target;
+        setConfig(prev => ({ ...prev, [name]: type === 'checkbox' ? checked : value }));
     };
 
     const handleSubmit = async (e) => {
@@ -67,6 +76,13 @@ const Settings = () => {
                     <input className="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
                         name="email_address" value={config.email_address} onChange={handleChange} required />
                 </div>
+                <div className="mb-4">
+                    <label className="inline-flex items-center text-gray-700 text-sm">
+                        <input type="checkbox" className="mr-2" name="plus_addressing"
+                            checked={config.plus_addressing} onChange={handleChange} />
+                        回复地址附带项目代码 (如 office+DB2024@example.com，需邮箱服务商支持 + 地址；仅限由字母、数字、_ 或 - 组成的项目代码)
+                    </label>
+                </div>
 
                 <h2 className="text-xl font-bold mb-2 mt-4">SMTP 设置 (发送)</h2>
                 <div className="grid grid-cols-2 gap-4">
@@ -90,30 +106,88 @@ const Settings = () => {
                         <input type="password" className="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
                             name="smtp_password" value={config.smtp_password} onChange={handleChange} placeholder="留空以保持不变" />
                     </div>
+                    <div className="mb-4">
+                        <label className="block text-gray-700 text-sm font-bold mb-2">SMTP 加密方式</label>
+                        <select className="shadow border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
+                            name="smtp_security" value={config.smtp_security} onChange={handleChange}>
+                            <option value="tls">SSL/TLS (通常为 465 端口)</option>
+                            <option value="starttls">STARTTLS (通常为 587 端口)</option>
+                            <option value="none">不加密 (通常为 25 端口)</option>
+                        </select>
+                    </div>
+                    <div className="mb-4 flex items-end">
+                        <label className="inline-flex items-center text-gray-700 text-sm">
+                            <input type="checkbox" className="mr-2" name="smtp_skip_verify"
+                                checked={config.smtp_skip_verify} onChange={handleChange} />
+                            跳过服务器证书校验 (仅用于自签名证书)
+                        </label>
+                    </div>
                 </div>
 
-                <h2 className="text-xl font-bold mb-2 mt-4">IMAP 设置 (接收)</h2>
+                <h2 className="text-xl font-bold mb-2 mt-4">{protocolLabel} 设置 (接收)</h2>
                 <div className="grid grid-cols-2 gap-4">
                     <div className="mb-4">
-                        <label className="block text-gray-700 text-sm font-bold mb-2">IMAP 服务器</label>
+                        <label className="block text-gray-700 text-sm font-bold mb-2">收信协议</label>
+                        <select className="shadow border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
+                            name="mail_protocol" value={config.mail_protocol} onChange={handleChange}>
+                            <option value="imap">IMAP (SSL/TLS，通常为 993 端口)</option>
+                            <option value="pop3">POP3 (SSL/TLS 通常为 995 端口，110 端口使用 STLS)</option>
+                        </select>
+                    </div>
+                    <div className="mb-4"></div>
+                    <div className="mb-4">
+                        <label className="block text-gray-700 text-sm font-bold mb-2">{protocolLabel} 服务器</label>
                         <input className="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
                             name="imap_host" value={config.imap_host} onChange={handleChange} required />
                     </div>
                     <div className="mb-4">
-                        <label className="block text-gray-700 text-sm font-bold mb-2">IMAP 端口</label>
+                        <label className="block text-gray-700 text-sm font-bold mb-2">{protocolLabel} 端口</label>
                         <input className="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
                             name="imap_port" value={config.imap_port} onChange={handleChange} required />
                     </div>
                     <div className="mb-4">
-                        <label className="block text-gray-700 text-sm font-bold mb-2">IMAP 用户名</label>
+                        <label className="block text-gray-700 text-sm font-bold mb-2">{protocolLabel} 用户名</label>
                         <input className="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
                             name="imap_username" value={config.imap_username} onChange={handleChange} required />
                     </div>
                     <div className="mb-4">
-                        <label className="block text-gray-700 text-sm font-bold mb-2">IMAP 密码</label>
+                        <label className="block text-gray-700 text-sm font-bold mb-2">{protocolLabel} 密码</label>
                         <input type="password" className="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
                             name="imap_password" value={config.imap_password} onChange={handleChange} placeholder="留空以保持不变" />
                     </div>
+                    {config.mail_protocol !== 'pop3' && (
+                        <>
+                        <div className="mb-4">
+                            <label className="block text-gray-700 text-sm font-bold mb-2">已处理邮件</label>
+                            <select className="shadow border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
+                                name="mailbox_action" value={config.mailbox_action} onChange={handleChange}>
+                                <option value="none">保留在收件箱</option>
+                                <option value="move">按项目代码移入文件夹</option>
+                                <option value="flag">加星标</option>
+                            </select>
+                        </div>
+                        <div className="mb-4"></div>
+                        {config.mailbox_action === 'move' && (
+                            <>
+                                <div className="mb-4">
+                                    <label className="block text-gray-700 text-sm font-bold mb-2">回复文件夹 (其下按项目代码分子文件夹)</label>
+                                    <input className="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
+                                        name="processed_folder" value={config.processed_folder} onChange={handleChange} placeholder="DB_Intro" />
+                                </div>
+                                <div className="mb-4">
+                                    <label className="block text-gray-700 text-sm font-bold mb-2">未识别邮件文件夹</label>
+                                    <input className="shadow appearance-none border rounded w-full py-2 px-3 text-gray-700 leading-tight focus:outline-none focus:shadow-outline"
+                                        name="unmatched_folder" value={config.unmatched_folder} onChange={handleChange} placeholder="DB_Intro/Unmatched" />
+                                </div>
+                            </>
+                        )}
+                        </>
+                    )}
+                    {config.mail_protocol === 'pop3' && (
+                        <p className="col-span-2 mb-4 text-sm text-gray-500">
+                            POP3 不支持文件夹，邮件会保留在服务器上，已处理的邮件按 UIDL 记录，不会重复下载。
+                        </p>
+                    )}
                 </div>
 
                 <div className="flex items-center justify-between mt-6">
@@ -144,7 +144,17 @@ function Teachers() {
                                 <td className="px-6 py-4 whitespace-nowrap text-gray-500">
                                     {teacher.department_name || '-'}
                                 </td>
-                                <td className="px-6 py-4 whitespace-nowrap text-gray-500">{teacher.email}</td>
+                                <td className="px-6 py-4 whitespace-nowrap text-gray-500">
+                                    {teacher.email}
+                                    {teacher.email_status === 'bounced' && (
+                                        <span
+                                            className="ml-2 px-2 inline-flex text-xs leading-5 font-semibold rounded-full bg-red-100 text-red-800"
+                                            title={`退信${teacher.email_bounced_at ? '于 ' + new Date(teacher.email_bounced_at).toLocaleString() : ''}：${teacher.email_bounce_reason || ''}`}
+                                        >
+                                            <i className="fas fa-exclamation-triangle mr-1 mt-1"></i> 邮箱可疑
+                                        </span>
+                                    )}
+                                </td>
                                 <td className="px-6 py-4 whitespace-nowrap text-gray-500">{teacher.phone || '-'}</td>
                                 <td className="px-6 py-4 whitespace-nowrap text-right text-sm font-medium">
                                     <button
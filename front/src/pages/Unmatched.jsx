@@ -0,0 +1,227 @@
+import { useState, useEffect } from 'react'
+import { unmatchedAPI, projectsAPI, importAPI } from '../api'
+
+function Unmatched() {
+    const [emails, setEmails] = useState([])
+    const [projects, setProjects] = useState([])
+    const [status, setStatus] = useState('pending')
+    const [selection, setSelection] = useState({})
+    const [importFiles, setImportFiles] = useState([])
+    const [importReport, setImportReport] = useState(null)
+
+    useEffect(() => {
+        loadProjects()
+    }, [])
+
+    useEffect(() => {
+        loadEmails()
+    }, [status])
+
+    const loadEmails = async () => {
+        try {
+            const res = await unmatchedAPI.getAll({ status })
+            setEmails(res.data?.data || [])
+        } catch (err) {
+            console.error('加载待分拣邮件失败：', err)
+        }
+    }
+
+    const loadProjects = async () => {
+        try {
+            const res = await projectsAPI.getAll()
+            setProjects(res.data?.data || [])
+        } catch (err) {
+            console.error('加载项目失败：', err)
+        }
+    }
+
+    const assignEmail = async (email) => {
+        const projectId = selection[email.id] || email.candidate_projects?.[0]?.id
+        if (!projectId) {
+            alert('请先选择项目')
+            return
+        }
+        try {
+            await unmatchedAPI.assign(email.id, { project_id: parseInt(projectId, 10) })
+            loadEmails()
+        } catch (err) {
+            alert('指派失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
+    const dismissEmail = async (email) => {
+        if (!window.confirm('确定忽略这封邮件吗？其附件将被删除。')) return
+        try {
+            await unmatchedAPI.dismiss(email.id)
+            loadEmails()
+        } catch (err) {
+            alert('操作失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
+    const runImport = async (dryRun) => {
+        if (importFiles.length === 0) {
+            alert('请先选择 .eml 或 mbox 文件')
+            return
+        }
+        try {
+            const res = await importAPI.importEmails(importFiles, dryRun)
+            setImportReport(res.data?.data)
+            if (!dryRun) loadEmails()
+        } catch (err) {
+            alert('导入失败：' + (err.response?.data?.error || err.message))
+        }
+    }
+
+    const outcomeLabels = { reply: '归入项目', unmatched: '待分拣', bounce: '退信', duplicate: '已存在', failed: '失败' }
+
+    const statusLabels = { pending: '待分拣', assigned: '已指派', dismissed: '已忽略' }
+
+    return (
+        <div>
+            <div className="flex justify-between items-center mb-6">
+                <h2 className="text-2xl font-bold">待分拣邮件</h2>
+                <select
+                    value={status}
+                    onChange={(e) => setStatus(e.target.value)}
+                    className="border border-gray-300 rounded-md p-2 text-sm"
+                >
+                    <option value="pending">待分拣</option>
+                    <option value="assigned">已指派</option>
+                    <option value="dismissed">已忽略</option>
+                    <option value="all">全部</option>
+                </select>
+            </div>
+            <p className="text-sm text-gray-500 mb-4">
+                以下邮件无法自动识别所属项目（例如发件教师同时参与多个项目），请手动指派到项目或忽略。
+            </p>
+
+            <div className="bg-white p-4 rounded-lg shadow border border-gray-100 mb-6">
+                <h3 className="font-bold mb-2">导入邮件</h3>
+                <p className="text-sm text-gray-500 mb-2">
+                    上传 .eml 文件或 mbox 归档（如转交的回复、导出的邮箱），按与收信相同的规则识别项目并保存附件。可先试运行查看匹配结果。
+                </p>
+                <div className="flex items-center space-x-2">
+                    <input type="file" multiple accept=".eml,.mbox,.mbx,message/rfc822"
+                        onChange={(e) => { setImportFiles(Array.from(e.target.files)); setImportReport(null) }}
+                        className="text-sm" />
+                    <button onClick={() => runImport(true)}
+                        className="border border-gray-300 px-3 py-2 rounded hover:bg-gray-50 text-sm">
+                        试运行
+                    </button>
+                    <button onClick={() => runImport(false)}
+                        className="bg-blue-600 text-white px-3 py-2 rounded hover:bg-blue-700 text-sm">
+                        导入
+                    </button>
+                </div>
+                {importReport && (
+                    <div className="mt-4">
+                        <p className="text-sm mb-2">
+                            {importReport.dry_run ? '试运行（未保存）：' : '导入完成：'}
+                            {Object.entries(importReport.counts).map(([k, v]) => `${outcomeLabels[k] || k} ${v}`).join('，')}
+                        </p>
+                        <table className="min-w-full text-sm">
+                            <thead>
+                                <tr className="text-left text-gray-500">
+                                    <th className="py-1 pr-4">来源</th>
+                                    <th className="py-1 pr-4">发件人</th>
+                                    <th className="py-1 pr-4">主题</th>
+                                    <th className="py-1 pr-4">结果</th>
+                                    <th className="py-1">项目 / 教师</th>
+                                </tr>
+                            </thead>
+                            <tbody>
+                                {importReport.messages.map((m, i) => (
+                                    <tr key={i} className="border-t border-gray-100">
+                                        <td className="py-1 pr-4">{m.source}</td>
+                                        <td className="py-1 pr-4">{m.from}</td>
+                                        <td className="py-1 pr-4">{m.subject}</td>
+                                        <td className="py-1 pr-4">{outcomeLabels[m.outcome] || m.outcome}{m.error && `（${m.error}）`}</td>
+                                        <td className="py-1">
+                                            {m.project ? `${m.project.name}${m.teacher_name ? ' / ' + m.teacher_name : ''}` : m.candidate_projects.map((p) => p.name).join(' / ') || '-'}
+                                        </td>
+                                    </tr>
+                                ))}
+                            </tbody>
+                        </table>
+                    </div>
+                )}
+            </div>
+
+            {emails.length === 0 && <div className="text-gray-500">暂无邮件</div>}
+
+            <div className="space-y-4">
+                {emails.map((email) => (
+                    <div key={email.id} className="bg-white p-6 rounded-lg shadow border border-gray-100">
+                        <div className="flex justify-between items-start mb-2">
+                            <div>
+                                <h3 className="font-bold">{email.subject || '(无主题)'}</h3>
+                                <p className="text-sm text-gray-500">
+                                    {email.teacher_name ? `${email.teacher_name} <${email.from_email}>` : email.from_email}
+                                    {' · '}
+                                    {new Date(email.received_at).toLocaleString()}
+                                </p>
+                            </div>
+                            <span className="px-2 py-1 rounded text-xs bg-gray-100 text-gray-800">
+                                {statusLabels[email.status] || email.status}
+                            </span>
+                        </div>
+                        {email.ingest_error && (
+                            <p className="text-sm text-red-600 mb-2">
+                                邮件未能处理：{email.ingest_error}（以下仅为原文开头或邮件头）
+                            </p>
+                        )}
+                        {email.body && (
+                            <pre className="text-sm text-gray-700 whitespace-pre-wrap bg-gray-50 p-2 rounded max-h-40 overflow-y-auto mb-2">
+                                {email.body}
+                            </pre>
+                        )}
+                        {email.attachments.length > 0 && (
+                            <div className="text-sm text-gray-600 mb-2">
+                                <i className="fas fa-paperclip mr-1"></i>
+                                {email.attachments.map((a) => a.status === 'rejected' ? `${a.original_filename}（已拒收：超出大小限制）` : a.original_filename).join('，')}
+                            </div>
+                        )}
+                        {email.status === 'pending' && (
+                            <div className="flex items-center space-x-2 mt-3">
+                                <select
+                                    value={selection[email.id] || email.candidate_projects?.[0]?.id || ''}
+                                    onChange={(e) => setSelection({ ...selection, [email.id]: e.target.value })}
+                                    className="border border-gray-300 rounded-md p-2 text-sm"
+                                >
+                                    <option value="">选择项目...</option>
+                                    {email.candidate_projects.length > 0 && (
+                                        <optgroup label="发件教师参与的项目">
+                                            {email.candidate_projects.map((p) => (
+                                                <option key={p.id} value={p.id}>{p.name}</option>
+                                            ))}
+                                        </optgroup>
+                                    )}
+                                    <optgroup label="全部项目">
+                                        {projects.map((p) => (
+                                            <option key={p.id} value={p.id}>{p.name}</option>
+                                        ))}
+                                    </optgroup>
+                                </select>
+                                <button
+                                    onClick={() => assignEmail(email)}
+                                    className="bg-blue-600 text-white px-3 py-2 rounded hover:bg-blue-700 text-sm"
+                                >
+                                    指派
+                                </button>
+                                <button
+                                    onClick={() => dismissEmail(email)}
+                                    className="text-red-600 border border-red-200 px-3 py-2 rounded hover:bg-red-50 text-sm"
+                                >
+                                    忽略
+                                </button>
+                            </div>
+                        )}
+                    </div>
+                ))}
+            </div>
+        </div>
+    )
+}
+
+export default Unmatched